@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// OIDCProviderConfig describes one identity provider. Issuer is the discovery base,
+// /.well-known/openid-configuration is fetched from it on first use.
+type OIDCProviderConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientID"`
+	ClientSecret string   `json:"clientSecret"` // empty for public clients, PKCE protects the code either way
+	RedirectURL  string   `json:"redirectURL"`  // the server's /api/auth/oidc/<name>/callback
+	Scopes       []string `json:"scopes"`       // "openid" is always requested
+	// LinkByEmail signs a first time user into the existing account with the same email,
+	// if the provider says the address is verified. Only enable it for providers whose
+	// users also own the mailboxes registered here.
+	LinkByEmail bool `json:"linkByEmail"`
+}
+
+// OIDCIdentity is what a provider asserted about the user in a verified ID token
+type OIDCIdentity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against one provider
+type OIDCProvider struct {
+	name string
+	cfg  OIDCProviderConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider // discovered lazily so an unreachable provider doesn't block startup
+}
+
+func NewOIDCProvider(name string, cfg OIDCProviderConfig) *OIDCProvider {
+	return &OIDCProvider{name: name, cfg: cfg}
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.name
+}
+
+func (p *OIDCProvider) LinkByEmail() bool {
+	return p.cfg.LinkByEmail
+}
+
+// RedirectURL is the server's callback the provider sends the browser back to
+func (p *OIDCProvider) RedirectURL() string {
+	return p.cfg.RedirectURL
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider == nil {
+		provider, err := oidc.NewProvider(ctx, p.cfg.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("oidc discovery for %s: %w", p.name, err)
+		}
+		p.provider = provider
+	}
+	return p.provider, nil
+}
+
+func (p *OIDCProvider) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range p.cfg.Scopes {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+	return &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  p.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+}
+
+// AuthCodeURL is where the browser is sent to sign in
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, attempt OIDCAttempt, state string) (string, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return p.oauth2Config(provider).AuthCodeURL(state,
+		oidc.Nonce(attempt.Nonce),
+		oauth2.S256ChallengeOption(attempt.Verifier),
+	), nil
+}
+
+// Exchange redeems the code from the callback and verifies the ID token it returns
+func (p *OIDCProvider) Exchange(ctx context.Context, attempt OIDCAttempt, code string) (OIDCIdentity, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return OIDCIdentity{}, err
+	}
+
+	token, err := p.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(attempt.Verifier))
+	if err != nil {
+		return OIDCIdentity{}, fmt.Errorf("exchanging code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return OIDCIdentity{}, errors.New("token response has no id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.cfg.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return OIDCIdentity{}, fmt.Errorf("verifying id_token: %w", err)
+	}
+	if idToken.Nonce != attempt.Nonce {
+		return OIDCIdentity{}, errors.New("id_token nonce does not match")
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     any    `json:"email_verified"` // some providers send "true" as a string
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return OIDCIdentity{}, fmt.Errorf("reading id_token claims: %w", err)
+	}
+
+	return OIDCIdentity{
+		Subject:           idToken.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified == true || claims.EmailVerified == "true",
+		PreferredUsername: claims.PreferredUsername,
+		Name:              claims.Name,
+	}, nil
+}
+
+// OIDCAttempt is kept server side between the redirect to the provider and the callback
+type OIDCAttempt struct {
+	Provider   string `json:"provider"`
+	Verifier   string `json:"verifier"` // PKCE code verifier
+	Nonce      string `json:"nonce"`
+	LinkUserID string `json:"linkUserID,omitempty"` // set when a signed in user links the identity
+	// ReauthUserID is set when a signed in user without a password confirms who they are
+	ReauthUserID string `json:"reauthUserID,omitempty"`
+	// Binding is the hash of a cookie of the browser that started the attempt
+	Binding string `json:"binding"`
+}
+
+// NewOIDCAttempt creates the PKCE verifier and nonce for one sign in. It also returns the
+// binding for a cookie of the browser starting it, the callback only finishes the attempt in
+// that browser, so nobody can get another user to complete a sign in or link they started.
+func NewOIDCAttempt(provider, linkUserID string) (OIDCAttempt, string, error) {
+	nonce, _, err := newToken()
+	if err != nil {
+		return OIDCAttempt{}, "", err
+	}
+	binding, bindingID, err := newToken()
+	if err != nil {
+		return OIDCAttempt{}, "", err
+	}
+	return OIDCAttempt{
+		Provider:   provider,
+		Verifier:   oauth2.GenerateVerifier(),
+		Nonce:      nonce,
+		LinkUserID: linkUserID,
+		Binding:    bindingID,
+	}, binding, nil
+}
+
+// BoundTo reports whether binding is the cookie NewOIDCAttempt returned for the attempt
+func (a OIDCAttempt) BoundTo(binding string) bool {
+	return binding != "" && subtle.ConstantTimeCompare([]byte(tokenID(binding)), []byte(a.Binding)) == 1
+}
+
+// OIDCStates stores attempts as oidc_state:<id> keyed by the hash of the state parameter
+type OIDCStates struct {
+	rdb redis.Cmdable
+	ttl time.Duration
+}
+
+func NewOIDCStates(rdb redis.Cmdable, ttl time.Duration) *OIDCStates {
+	return &OIDCStates{rdb: rdb, ttl: ttl}
+}
+
+// Begin stores the attempt and returns the state parameter for the provider
+func (s *OIDCStates) Begin(ctx context.Context, attempt OIDCAttempt) (string, error) {
+	state, id, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(attempt)
+	if err != nil {
+		return "", err
+	}
+	if err := s.rdb.Set(ctx, "oidc_state:"+id, data, s.ttl).Err(); err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// Finish returns and forgets the attempt, so a callback URL can't be replayed
+func (s *OIDCStates) Finish(ctx context.Context, state string) (OIDCAttempt, error) {
+	if state == "" {
+		return OIDCAttempt{}, ErrInvalidToken
+	}
+	data, err := s.rdb.GetDel(ctx, "oidc_state:"+tokenID(state)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return OIDCAttempt{}, ErrInvalidToken
+	}
+	if err != nil {
+		return OIDCAttempt{}, err
+	}
+
+	var attempt OIDCAttempt
+	if err := json.Unmarshal(data, &attempt); err != nil {
+		return OIDCAttempt{}, err
+	}
+	return attempt, nil
+}
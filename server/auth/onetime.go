@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// OneTimeTokens are single use tokens that stand for a user, stored as <prefix><id> -> userID.
+// Password reset links, pending two-factor logins and finished OIDC logins and re-authentications use them.
+type OneTimeTokens struct {
+	rdb    redis.Cmdable
+	prefix string
+	ttl    time.Duration
+}
+
+func NewOneTimeTokens(rdb redis.Cmdable, prefix string, ttl time.Duration) *OneTimeTokens {
+	return &OneTimeTokens{rdb: rdb, prefix: prefix, ttl: ttl}
+}
+
+// NewResetTokens stores password reset tokens under password_reset:
+func NewResetTokens(rdb redis.Cmdable, ttl time.Duration) *OneTimeTokens {
+	return NewOneTimeTokens(rdb, "password_reset:", ttl)
+}
+
+// NewLoginChallenges stores logins waiting for their second factor under login_challenge:
+func NewLoginChallenges(rdb redis.Cmdable, ttl time.Duration) *OneTimeTokens {
+	return NewOneTimeTokens(rdb, "login_challenge:", ttl)
+}
+
+// NewOIDCLogins stores finished OIDC sign ins under oidc_login: until the client trades
+// the code for a session, so the session token never appears in a redirect URL
+func NewOIDCLogins(rdb redis.Cmdable, ttl time.Duration) *OneTimeTokens {
+	return NewOneTimeTokens(rdb, "oidc_login:", ttl)
+}
+
+// NewOIDCReauths stores fresh OIDC logins of signed in users under oidc_reauth:, accounts
+// without a password present them instead of the password to confirm sensitive changes
+func NewOIDCReauths(rdb redis.Cmdable, ttl time.Duration) *OneTimeTokens {
+	return NewOneTimeTokens(rdb, "oidc_reauth:", ttl)
+}
+
+func (r *OneTimeTokens) TTL() time.Duration {
+	return r.ttl
+}
+
+// Issue creates a token that lets its holder act once on behalf of userID
+func (r *OneTimeTokens) Issue(ctx context.Context, userID string) (string, error) {
+	token, id, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if err := r.rdb.Set(ctx, r.prefix+id, userID, r.ttl).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Lookup returns the user the token was issued for without spending it
+func (r *OneTimeTokens) Lookup(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrInvalidToken
+	}
+	userID, err := r.rdb.Get(ctx, r.prefix+tokenID(token)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrInvalidToken
+	}
+	return userID, err
+}
+
+// Consume returns the user the token was issued for and invalidates it.
+// GETDEL makes two concurrent resets with the same token impossible.
+func (r *OneTimeTokens) Consume(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrInvalidToken
+	}
+	userID, err := r.rdb.GetDel(ctx, r.prefix+tokenID(token)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrInvalidToken
+	}
+	return userID, err
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestOneTimeTokens(t *testing.T) {
+	kinds := []struct {
+		name string
+		new  func(rdb redis.Cmdable, ttl time.Duration) *OneTimeTokens
+	}{
+		{name: "password reset", new: NewResetTokens},
+		{name: "login challenge", new: NewLoginChallenges},
+		{name: "oidc login", new: NewOIDCLogins},
+		{name: "oidc reauth", new: NewOIDCReauths},
+	}
+	for _, kind := range kinds {
+		t.Run(kind.name, func(t *testing.T) {
+			ctx := t.Context()
+			mr, rdb := newTestRedis(t)
+			tokens := kind.new(rdb, time.Minute)
+
+			token, err := tokens.Issue(ctx, "ada")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userID, err := tokens.Lookup(ctx, token); err != nil || userID != "ada" {
+				t.Fatalf("Lookup = %q, %v", userID, err)
+			}
+			if userID, err := tokens.Consume(ctx, token); err != nil || userID != "ada" {
+				t.Fatalf("Consume after Lookup = %q, %v", userID, err)
+			}
+
+			for _, other := range kinds {
+				if other.name == kind.name {
+					continue
+				}
+				foreign, _ := other.new(rdb, time.Minute).Issue(ctx, "ada")
+				if _, err := tokens.Consume(ctx, foreign); !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("a %s token was accepted: %v", other.name, err)
+				}
+			}
+
+			expiring, _ := tokens.Issue(ctx, "ada")
+			mr.FastForward(time.Minute)
+
+			spent := []struct {
+				name  string
+				token string
+			}{
+				{name: "consumed", token: token},
+				{name: "expired", token: expiring},
+				{name: "empty", token: ""},
+				{name: "unknown", token: "not-a-token"},
+			}
+			for _, tt := range spent {
+				if _, err := tokens.Lookup(ctx, tt.token); !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("Lookup of %s token: %v, want ErrInvalidToken", tt.name, err)
+				}
+				if _, err := tokens.Consume(ctx, tt.token); !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("Consume of %s token: %v, want ErrInvalidToken", tt.name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// bcrypt ignores everything after 72 bytes, longer passwords would silently be truncated
+const maxPasswordBytes = 72
+
+// PasswordPolicy is the strength every new password has to meet
+type PasswordPolicy struct {
+	MinLength     int  `json:"minLength"`
+	RequireMixed  bool `json:"requireMixedCase"`
+	RequireDigit  bool `json:"requireDigit"`
+	RequireSymbol bool `json:"requireSymbol"`
+}
+
+// A few of the most common leaked passwords, rejected regardless of the policy
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "12345678": true, "123456789": true,
+	"1234567890": true, "qwerty123": true, "qwertyuiop": true, "iloveyou": true, "letmein123": true,
+	"admin123": true, "welcome1": true, "sunshine1": true, "football1": true, "abc12345": true,
+}
+
+// Check reports every rule the password breaks, in a form that can be shown to the user
+func (p PasswordPolicy) Check(password, username string) error {
+	var problems []string
+
+	if len([]rune(password)) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("at least %d characters", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("at most %d bytes", maxPasswordBytes))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireMixed && !(upper && lower) {
+		problems = append(problems, "upper and lower case letters")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "a symbol")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Password must contain " + strings.Join(problems, ", ") + ".")
+	}
+
+	lowered := strings.ToLower(password)
+	if commonPasswords[lowered] {
+		return errors.New("Password is too common.")
+	}
+	if username != "" && strings.Contains(lowered, strings.ToLower(username)) {
+		return errors.New("Password must not contain the username.")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Session is one logged in device
+type Session struct {
+	ID        string // hash of the bearer token, safe to log and compare
+	UserID    string
+	CreatedAt time.Time
+}
+
+// Sessions stores sessions as session:<id> hashes, with a user_sessions:<userID> set
+// so every session of a user can be revoked at once
+type Sessions struct {
+	rdb redis.Cmdable
+	ttl time.Duration
+}
+
+func NewSessions(rdb redis.Cmdable, ttl time.Duration) *Sessions {
+	return &Sessions{rdb: rdb, ttl: ttl}
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+func userSessionsKey(userID string) string {
+	return "user_sessions:" + userID
+}
+
+// Create starts a session for userID and returns its bearer token
+func (s *Sessions) Create(ctx context.Context, userID string) (string, error) {
+	token, id, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, sessionKey(id), "userID", userID, "createdAt", time.Now().Unix())
+	pipe.Expire(ctx, sessionKey(id), s.ttl)
+	pipe.SAdd(ctx, userSessionsKey(userID), id)
+	pipe.Expire(ctx, userSessionsKey(userID), s.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Get resolves a bearer token, ErrInvalidToken if it expired or was revoked
+func (s *Sessions) Get(ctx context.Context, token string) (Session, error) {
+	if token == "" {
+		return Session{}, ErrInvalidToken
+	}
+
+	id := tokenID(token)
+	fields, err := s.rdb.HGetAll(ctx, sessionKey(id)).Result()
+	if err != nil {
+		return Session{}, err
+	}
+	if fields["userID"] == "" {
+		return Session{}, ErrInvalidToken
+	}
+
+	session := Session{ID: id, UserID: fields["userID"]}
+	if unix, err := strconv.ParseInt(fields["createdAt"], 10, 64); err == nil {
+		session.CreatedAt = time.Unix(unix, 0)
+	}
+	return session, nil
+}
+
+// Revoke ends one session
+func (s *Sessions) Revoke(ctx context.Context, session Session) error {
+	pipe := s.rdb.TxPipeline()
+	pipe.Del(ctx, sessionKey(session.ID))
+	pipe.SRem(ctx, userSessionsKey(session.UserID), session.ID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RevokeAll ends every session of userID except keepID, pass "" to end them all
+func (s *Sessions) RevokeAll(ctx context.Context, userID, keepID string) (int, error) {
+	ids, err := s.rdb.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+
+	revoked := 0
+	pipe := s.rdb.TxPipeline()
+	for _, id := range ids {
+		if id == keepID {
+			continue
+		}
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, userSessionsKey(userID), id)
+		revoked++
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis starts an in-process Redis for one test
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+func TestSessions(t *testing.T) {
+	ctx := t.Context()
+	mr, rdb := newTestRedis(t)
+	sessions := NewSessions(rdb, time.Hour)
+
+	phone, err := sessions.Create(ctx, "ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _ := sessions.Create(ctx, "ada")
+	tablet, _ := sessions.Create(ctx, "ada")
+	other, _ := sessions.Create(ctx, "grace")
+
+	if mr.Exists(sessionKey(phone)) {
+		t.Fatal("session stored under the raw token instead of its hash")
+	}
+
+	laptopSession, _ := sessions.Get(ctx, laptop)
+	if err := sessions.Revoke(ctx, laptopSession); err != nil {
+		t.Fatal(err)
+	}
+	phoneSession, _ := sessions.Get(ctx, phone)
+	if revoked, err := sessions.RevokeAll(ctx, "ada", phoneSession.ID); err != nil || revoked != 1 {
+		t.Fatalf("RevokeAll revoked %d (%v), want the tablet only", revoked, err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantUser string
+	}{
+		{name: "kept by RevokeAll", token: phone, wantUser: "ada"},
+		{name: "revoked", token: laptop},
+		{name: "revoked by RevokeAll", token: tablet},
+		{name: "another user", token: other, wantUser: "grace"},
+		{name: "empty", token: ""},
+		{name: "unknown", token: "not-a-session"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := sessions.Get(ctx, tt.token)
+			if tt.wantUser == "" {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("got %+v (%v), want ErrInvalidToken", session, err)
+				}
+				return
+			}
+			if err != nil || session.UserID != tt.wantUser || session.ID != tokenID(tt.token) {
+				t.Fatalf("got %+v (%v), want a session of %s", session, err, tt.wantUser)
+			}
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		mr.FastForward(time.Hour)
+		if _, err := sessions.Get(ctx, other); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("session outlived its TTL: %v", err)
+		}
+	})
+}
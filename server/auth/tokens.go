@@ -0,0 +1,29 @@
+// Package auth keeps login sessions and password reset tokens in Redis and checks password strength.
+// Clients only ever see the random tokens, Redis stores their SHA-256 so a leaked dump can't be replayed.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+)
+
+// ErrInvalidToken is returned for unknown, expired or revoked tokens
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// newToken returns a random URL-safe token and the ID it is stored under
+func newToken() (token, id string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, tokenID(token), nil
+}
+
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
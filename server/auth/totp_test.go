@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		at       int64
+		wantStep int64
+		wantOK   bool
+	}{
+		// The RFC lists eight digits, six digit codes are their last six
+		{name: "rfc 59", secret: rfc6238Secret, code: "287082", at: 59, wantStep: 1, wantOK: true},
+		{name: "rfc 1111111109", secret: rfc6238Secret, code: "081804", at: 1111111109, wantStep: 37037036, wantOK: true},
+		{name: "rfc 1234567890", secret: rfc6238Secret, code: "005924", at: 1234567890, wantStep: 41152263, wantOK: true},
+		{name: "rfc 2000000000", secret: rfc6238Secret, code: "279037", at: 2000000000, wantStep: 66666666, wantOK: true},
+		{name: "previous step", secret: rfc6238Secret, code: "081804", at: 1111111109 + 30, wantStep: 37037036, wantOK: true},
+		{name: "next step", secret: rfc6238Secret, code: "081804", at: 1111111109 - 30, wantStep: 37037036, wantOK: true},
+		{name: "two steps late", secret: rfc6238Secret, code: "081804", at: 1111111109 + 60},
+		{name: "lowercase secret", secret: strings.ToLower(rfc6238Secret), code: "287082", at: 59, wantStep: 1, wantOK: true},
+		{name: "wrong code", secret: rfc6238Secret, code: "287083", at: 59},
+		{name: "short code", secret: rfc6238Secret, code: "28708", at: 59},
+		{name: "invalid secret", secret: "not base32!", code: "287082", at: 59},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(tt.secret, tt.code, time.Unix(tt.at, 0))
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Fatalf("ValidateTOTP = %d, %v, want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestIsTOTPCode(t *testing.T) {
+	tests := map[string]bool{
+		"123456":      true,
+		"12345":       false,
+		"1234567":     false,
+		"12345a":      false,
+		"abcde-fghjk": false,
+	}
+	for code, want := range tests {
+		if got := IsTOTPCode(code); got != want {
+			t.Errorf("IsTOTPCode(%q) = %v, want %v", code, got, want)
+		}
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	if recoveryByteLimit%len(recoveryAlphabet) != 0 {
+		t.Fatalf("recoveryByteLimit %d isn't a multiple of the alphabet size, codes would be biased", recoveryByteLimit)
+	}
+
+	codes, err := GenerateRecoveryCodes(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := regexp.MustCompile(`^[` + recoveryAlphabet + `]{5}-[` + recoveryAlphabet + `]{5}$`)
+	seen := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q isn't xxxxx-xxxxx from the recovery alphabet", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q generated twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := map[string]string{
+		"abcde-fghjk":  "abcdefghjk",
+		"ABCDE-FGHJK":  "abcdefghjk",
+		"abcde fghjk":  "abcdefghjk",
+		" abcdefghjk ": "abcdefghjk",
+	}
+	for code, want := range tests {
+		if got := NormalizeRecoveryCode(code); got != want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
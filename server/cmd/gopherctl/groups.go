@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"chat-app/config"
+	"chat-app/store"
+)
+
+func runGroups(ctx context.Context, cfg *config.Config, args []string) error {
+	action, args, err := subcommand(args, "groups")
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("groups "+action, flag.ContinueOnError)
+	limit := fs.Int64("limit", 50, "maximum number of groups to show, 0 for all")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var run func(*store.Stores) error
+	switch {
+	case action == "list" && len(positional) == 0:
+		run = func(s *store.Stores) error { return listGroups(ctx, s, *limit) }
+	case action == "transfer" && len(positional) == 2:
+		run = func(s *store.Stores) error { return transferGroup(ctx, s, positional[0], positional[1]) }
+	default:
+		return usageError(fmt.Sprintf("groups %s: wrong subcommand or arguments", action))
+	}
+
+	stores, disconnect := connectMongo(cfg)
+	defer disconnect()
+	return run(stores)
+}
+
+func listGroups(ctx context.Context, stores *store.Stores, limit int64) error {
+	groups, err := stores.Groups.List(ctx, limit)
+	if err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "ID\tNAME\tOWNER\tMEMBERS\tCREATED AT")
+	for _, g := range groups {
+		owner := g.CreatorID
+		if user, err := stores.Users.GetByID(ctx, g.CreatorID); err == nil {
+			owner = user.Username
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", g.ID, g.Name, owner, len(g.Members), formatTime(g.CreatedAt))
+	}
+	return w.Flush()
+}
+
+func transferGroup(ctx context.Context, stores *store.Stores, groupID, newOwnerID string) error {
+	err := stores.Groups.TransferOwnership(ctx, groupID, newOwnerID)
+	switch {
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, store.ErrInvalidID):
+		return fmt.Errorf("no group with ID %q", groupID)
+	case errors.Is(err, store.ErrNotMember):
+		return fmt.Errorf("user %q is not a member of group %q", newOwnerID, groupID)
+	case err != nil:
+		return err
+	}
+
+	fmt.Printf("group %s now belongs to %s\n", groupID, newOwnerID)
+	return nil
+}
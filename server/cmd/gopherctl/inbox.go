@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"chat-app/config"
+	"chat-app/handlers"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func runInbox(ctx context.Context, cfg *config.Config, args []string) error {
+	action, args, err := subcommand(args, "inbox")
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("inbox "+action, flag.ContinueOnError)
+	count := fs.Int64("n", 20, "number of messages to print, oldest first")
+	all := fs.Bool("all", false, "purge every user's inbox")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var run func(*redis.Client) error
+	switch {
+	case action == "list" && len(positional) == 0:
+		run = func(rdb *redis.Client) error { return listInboxes(ctx, rdb) }
+	case action == "show" && len(positional) == 1:
+		run = func(rdb *redis.Client) error { return showInbox(ctx, rdb, positional[0], *count) }
+	case action == "purge" && *all && len(positional) == 0:
+		run = func(rdb *redis.Client) error { return purgeInboxes(ctx, rdb) }
+	case action == "purge" && !*all && len(positional) == 1:
+		run = func(rdb *redis.Client) error { return purgeInbox(ctx, rdb, positional[0]) }
+	default:
+		return usageError(fmt.Sprintf("inbox %s: wrong subcommand or arguments", action))
+	}
+
+	rdb := config.ConnectRedis(cfg.Redis)
+	defer config.DisconnectRedis(rdb)
+	return run(rdb)
+}
+
+// inboxKeys walks the keyspace with SCAN so a large deployment isn't blocked like with KEYS
+func inboxKeys(ctx context.Context, rdb *redis.Client) ([]string, error) {
+	var keys []string
+	iter := rdb.Scan(ctx, 0, handlers.OfflineInboxPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+func listInboxes(ctx context.Context, rdb *redis.Client) error {
+	keys, err := inboxKeys(ctx, rdb)
+	if err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "USER ID\tQUEUED")
+	for _, key := range keys {
+		length, err := rdb.LLen(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\n", strings.TrimPrefix(key, handlers.OfflineInboxPrefix), length)
+	}
+	return w.Flush()
+}
+
+func showInbox(ctx context.Context, rdb *redis.Client, userID string, count int64) error {
+	// Messages are RPUSHed, so index 0 is the oldest
+	messages, err := rdb.LRange(ctx, handlers.OfflineInboxPrefix+userID, 0, count-1).Result()
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		fmt.Println(msg)
+	}
+	return nil
+}
+
+func purgeInbox(ctx context.Context, rdb *redis.Client, userID string) error {
+	removed, err := rdb.Del(ctx, handlers.OfflineInboxPrefix+userID).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		fmt.Printf("inbox of %s was already empty\n", userID)
+	} else {
+		fmt.Printf("purged inbox of %s\n", userID)
+	}
+	return nil
+}
+
+func purgeInboxes(ctx context.Context, rdb *redis.Client) error {
+	keys, err := inboxKeys(ctx, rdb)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := rdb.Del(ctx, key).Err(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("purged %d inboxes\n", len(keys))
+	return nil
+}
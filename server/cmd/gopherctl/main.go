@@ -0,0 +1,126 @@
+// Command gopherctl is the operator CLI for a GopherChat deployment.
+// It talks to Mongo and Redis directly, so it works while the servers are down,
+// and reads the same configuration (file, environment, flags) as the chat server.
+//
+//	gopherctl [config flags] <command> [args]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"chat-app/config"
+	"chat-app/store"
+
+	"github.com/joho/godotenv"
+)
+
+const usage = `usage: gopherctl [config flags] <command> [args]
+
+commands:
+  users list [-limit n]                     list accounts
+  users search <query> [-limit n]           find accounts by username
+  users disable <username> [-enable]        block (or unblock) logins
+  users reset-password <username> [-password p]
+                                            set a new password, a random one is printed if omitted
+  users reset-2fa <username>                turn off two-factor authentication for a lost device
+  inbox list                                show queued offline messages per user
+  inbox show <userID> [-n count]            print a user's queued messages
+  inbox purge <userID> | -all               drop queued messages
+  groups list [-limit n]                    list groups
+  groups transfer <groupID> <newOwnerID>    hand a group to another member
+  rooms list                                show active video rooms
+  rooms delete <roomID>                     end a video room
+  migrate [status]                          apply or list database migrations
+
+Config flags are the chat server's, run "gopherctl -h" to list them.
+`
+
+type command func(ctx context.Context, cfg *config.Config, args []string) error
+
+var commands = map[string]command{
+	"users":   runUsers,
+	"inbox":   runInbox,
+	"groups":  runGroups,
+	"rooms":   runRooms,
+	"migrate": runMigrate,
+}
+
+func main() {
+	_ = godotenv.Load()
+
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Stdout is reserved for command output, connection chatter stays quiet on stderr
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	if len(cfg.Args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	run, ok := commands[cfg.Args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cfg.Args[0], usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, cfg, cfg.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "gopherctl:", err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+// usageError is returned for malformed invocations
+type usageError string
+
+func (e usageError) Error() string { return string(e) + "\n\n" + usage }
+
+// subcommand splits args into the action name and the rest
+func subcommand(args []string, name string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, usageError(name + ": missing subcommand")
+	}
+	return args[0], args[1:], nil
+}
+
+// parseFlags parses flags that may appear before or after positional arguments
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, usageError(fs.Name() + ": " + err.Error())
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func connectMongo(cfg *config.Config) (*store.Stores, func()) {
+	// The commands only use the Mongo stores, those needing Redis connect it themselves
+	db := config.ConnectDatabase(cfg.Mongo)
+	return store.NewMongoStores(db, nil), func() { config.DisConnectDB(db) }
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"chat-app/config"
+	"chat-app/migrations"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const migrationTimeout = 10 * time.Minute
+
+func runMigrate(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "status") {
+		return usageError("migrate: expected no arguments or \"status\"")
+	}
+
+	db := config.ConnectDatabase(cfg.Mongo)
+	defer config.DisConnectDB(db)
+
+	switch {
+	case len(args) == 0:
+		ctx, cancel := context.WithTimeout(ctx, migrationTimeout)
+		defer cancel()
+		if err := migrations.Up(ctx, db); err != nil {
+			return err
+		}
+		fmt.Println("database is up to date")
+		return nil
+	default:
+		return migrationStatus(ctx, db)
+	}
+}
+
+func migrationStatus(ctx context.Context, db *mongo.Database) error {
+	statuses, err := migrations.List(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return w.Flush()
+}
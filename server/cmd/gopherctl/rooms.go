@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"chat-app/auth"
+	"chat-app/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Key layout owned by the video service, see video-service/redis/rooms.go
+const (
+	roomKeyPrefix = "video:room:"
+	roomUsersKey  = ":users"
+	roomMetaKey   = ":meta"
+)
+
+// errServiceUnreachable marks failures to talk to the video service at all, as opposed
+// to the service answering with an error
+var errServiceUnreachable = errors.New("video service unreachable")
+
+func runRooms(ctx context.Context, cfg *config.Config, args []string) error {
+	action, args, err := subcommand(args, "rooms")
+	if err != nil {
+		return err
+	}
+
+	// The video service keeps rooms in its own database on the shared Redis server
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Video.RedisDB,
+	})
+	defer rdb.Close()
+
+	switch {
+	case action == "list" && len(args) == 0:
+		return listRooms(ctx, rdb)
+	case action == "delete" && len(args) == 1:
+		return deleteRoom(ctx, cfg.Video, rdb, args[0])
+	default:
+		return usageError(fmt.Sprintf("rooms %s: wrong subcommand or arguments", action))
+	}
+}
+
+// activeRooms mirrors GetAllActiveRooms in the video service
+func activeRooms(ctx context.Context, rdb *redis.Client) ([]string, error) {
+	var rooms []string
+	iter := rdb.Scan(ctx, 0, roomKeyPrefix+"*"+roomUsersKey, 100).Iterator()
+	for iter.Next(ctx) {
+		parts := strings.Split(iter.Val(), ":")
+		if len(parts) >= 3 {
+			rooms = append(rooms, parts[2])
+		}
+	}
+	return rooms, iter.Err()
+}
+
+func listRooms(ctx context.Context, rdb *redis.Client) error {
+	rooms, err := activeRooms(ctx, rdb)
+	if err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "ROOM ID\tTYPE\tCREATOR\tPARTICIPANTS\tCREATED AT")
+	for _, roomID := range rooms {
+		participants, err := rdb.SCard(ctx, roomKeyPrefix+roomID+roomUsersKey).Result()
+		if err != nil {
+			return err
+		}
+		meta, err := rdb.HGetAll(ctx, roomKeyPrefix+roomID+roomMetaKey).Result()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", roomID, orDash(meta["type"]), orDash(meta["creator"]), participants, orDash(meta["createdAt"]))
+	}
+	return w.Flush()
+}
+
+// deleteRoom asks the video service first so connected peers are hung up,
+// and falls back to dropping the Redis keys only when the service can't be reached.
+// Errors the service answers with (unauthorized, no such room) are returned as they are.
+func deleteRoom(ctx context.Context, video config.VideoConfig, rdb *redis.Client, roomID string) error {
+	err := deleteRoomViaService(ctx, video, roomID)
+	if err == nil {
+		fmt.Printf("deleted room %s\n", roomID)
+		return nil
+	}
+	if !errors.Is(err, errServiceUnreachable) {
+		return err
+	}
+
+	fmt.Printf("%v, removing room state from Redis only\n", err)
+	removed, err := rdb.Del(ctx, roomKeyPrefix+roomID+roomUsersKey, roomKeyPrefix+roomID+roomMetaKey).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("no room with ID %q", roomID)
+	}
+	fmt.Printf("deleted room %s\n", roomID)
+	return nil
+}
+
+// deleteRoomViaService ends the call with a moderator join token, the video service
+// only lets hosts and moderators delete a room
+func deleteRoomViaService(ctx context.Context, video config.VideoConfig, roomID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	token, _, err := auth.NewVideoJoinTokens(video.JoinSecret, video.JoinTokenTTL.Std()).
+		Issue(roomID, "gopherctl", "", auth.VideoRoleModerator)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, video.ServiceURL+"/api/rooms/"+url.PathEscape(roomID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errServiceUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("video service refused to delete room %s: %s", roomID, resp.Status)
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
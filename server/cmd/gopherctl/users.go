@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"chat-app/auth"
+	"chat-app/config"
+	"chat-app/models"
+	"chat-app/store"
+	"chat-app/utils"
+)
+
+func runUsers(ctx context.Context, cfg *config.Config, args []string) error {
+	action, args, err := subcommand(args, "users")
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("users "+action, flag.ContinueOnError)
+	limit := fs.Int64("limit", 50, "maximum number of accounts to show, 0 for all")
+	enable := fs.Bool("enable", false, "re-enable instead of disabling")
+	password := fs.String("password", "", "new password, generated when empty")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var run func(*store.Stores) error
+	switch {
+	case action == "list" && len(positional) == 0:
+		run = func(s *store.Stores) error { return listUsers(ctx, s.Users, "", *limit) }
+	case action == "search" && len(positional) == 1:
+		run = func(s *store.Stores) error { return listUsers(ctx, s.Users, positional[0], *limit) }
+	case action == "disable" && len(positional) == 1:
+		run = func(s *store.Stores) error {
+			return disableUser(ctx, s.Users, connectSessions(cfg), positional[0], !*enable)
+		}
+	case action == "reset-password" && len(positional) == 1:
+		run = func(s *store.Stores) error {
+			return resetPassword(ctx, s.Users, connectSessions(cfg), positional[0], *password)
+		}
+	case action == "reset-2fa" && len(positional) == 1:
+		run = func(s *store.Stores) error {
+			return resetTwoFactor(ctx, s.Users, connectSessions(cfg), positional[0])
+		}
+	default:
+		return usageError(fmt.Sprintf("users %s: wrong subcommand or arguments", action))
+	}
+
+	stores, disconnect := connectMongo(cfg)
+	defer disconnect()
+	return run(stores)
+}
+
+func listUsers(ctx context.Context, users store.UserStore, query string, limit int64) error {
+	found, err := users.Search(ctx, query, limit)
+	if err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "ID\tUSERNAME\tONLINE\tDISABLED\tCREATED AT")
+	for _, u := range found {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", u.ID, u.Username, u.Online, u.Disabled, formatTime(u.CreatedAt))
+	}
+	return w.Flush()
+}
+
+func disableUser(ctx context.Context, users store.UserStore, sessions *auth.Sessions, username string, disabled bool) error {
+	user, err := lookupUser(ctx, users, username)
+	if err != nil {
+		return err
+	}
+	if err := users.SetDisabled(ctx, user.ID, disabled); err != nil {
+		return err
+	}
+
+	if disabled {
+		// Open sockets keep working until they reconnect, logins are refused from now on
+		revoked, err := sessions.RevokeAll(ctx, user.ID, "")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("disabled %s (%s), signed out %d sessions\n", user.Username, user.ID, revoked)
+	} else {
+		fmt.Printf("enabled %s (%s)\n", user.Username, user.ID)
+	}
+	return nil
+}
+
+func resetPassword(ctx context.Context, users store.UserStore, sessions *auth.Sessions, username, password string) error {
+	user, err := lookupUser(ctx, users, username)
+	if err != nil {
+		return err
+	}
+
+	generated := password == ""
+	if generated {
+		if password, err = randomPassword(); err != nil {
+			return err
+		}
+	}
+
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := users.SetPassword(ctx, user.ID, hash); err != nil {
+		return err
+	}
+
+	revoked, err := sessions.RevokeAll(ctx, user.ID, "")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("password reset for %s (%s), signed out %d sessions\n", user.Username, user.ID, revoked)
+	if generated {
+		fmt.Printf("temporary password: %s\n", password)
+	}
+	return nil
+}
+
+// resetTwoFactor is for users who lost both their device and their recovery codes.
+// The password still protects the account, sessions are revoked so everyone logs in again.
+func resetTwoFactor(ctx context.Context, users store.UserStore, sessions *auth.Sessions, username string) error {
+	user, err := lookupUser(ctx, users, username)
+	if err != nil {
+		return err
+	}
+	if user.TwoFactor == nil {
+		return fmt.Errorf("%s has no two-factor authentication set up", user.Username)
+	}
+	if err := users.SetTwoFactor(ctx, user.ID, nil); err != nil {
+		return err
+	}
+
+	revoked, err := sessions.RevokeAll(ctx, user.ID, "")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("two-factor authentication reset for %s (%s), signed out %d sessions\n", user.Username, user.ID, revoked)
+	return nil
+}
+
+func lookupUser(ctx context.Context, users store.UserStore, username string) (models.UserDetails, error) {
+	user, err := users.GetByUsername(ctx, username)
+	if errors.Is(err, store.ErrNotFound) {
+		return user, fmt.Errorf("no user named %q", username)
+	}
+	return user, err
+}
+
+func randomPassword() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// connectSessions opens the chat server's Redis, closed when the process exits
+func connectSessions(cfg *config.Config) *auth.Sessions {
+	return auth.NewSessions(config.ConnectRedis(cfg.Redis), cfg.Auth.SessionTTL.Std())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"chat-app/config"
+	"chat-app/migrations"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const migrationTimeout = 10 * time.Minute
+
+// runCommand executes a one-off subcommand and returns the process exit code.
+//
+//	server migrate          apply pending migrations
+//	server migrate status   list migrations and whether they ran
+func runCommand(cfg *config.Config, args []string) int {
+	switch args[0] {
+	case "migrate":
+		db := config.ConnectDatabase(cfg.Mongo)
+		defer config.DisConnectDB(db)
+
+		if len(args) > 1 && args[1] == "status" {
+			return printMigrationStatus(db)
+		}
+		if err := runMigrations(db); err != nil {
+			slog.Error("Database migrations failed", "error", err)
+			return 1
+		}
+		slog.Info("Database is up to date")
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, expected: migrate [status]\n", args[0])
+		return 2
+	}
+}
+
+// runMigrations applies pending migrations, Ctrl+C aborts between steps
+func runMigrations(db *mongo.Database) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, migrationTimeout)
+	defer cancel()
+
+	return migrations.Up(ctx, db)
+}
+
+func printMigrationStatus(db *mongo.Database) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	statuses, err := migrations.List(ctx, db)
+	if err != nil {
+		slog.Error("Listing migrations failed", "error", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	w.Flush()
+	return 0
+}
@@ -2,50 +2,79 @@ package config
 
 import (
 	"context"
+	"log/slog"
 	"os"
 	"time"
-	"log"
 
+	"chat-app/metrics"
+
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
-var Client *mongo.Client
-
-func ConnectDatabase(){
-	log.Println("Connecting to database...")
+// ConnectDatabase connects to Mongo and returns the application database selected by
+// MongoConfig.Database, it exits when Mongo can't be reached
+func ConnectDatabase(cfg MongoConfig) *mongo.Database {
+	slog.Info("Connecting to database...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	dbURI := os.Getenv("DB_URL")
-	if dbURI == ""{
-		dbURI = "mongodb://localhost:27017"
-	}
-	options := options.Client().ApplyURI(dbURI)
+	options := options.Client().ApplyURI(cfg.URI).SetMonitor(combineMonitors(metrics.MongoMonitor(), otelmongo.NewMonitor()))
 
 	client, err := mongo.Connect(ctx, options)
-	if err != nil{
-		log.Fatal("Error connecting to mongodb", err)
+	if err != nil {
+		slog.Error("Error connecting to mongodb", "error", err)
+		os.Exit(1)
 	}
 
-	if err = client.Ping(ctx, nil); err != nil{
-		log.Fatal("Can't ping the client", err)
+	if err = client.Ping(ctx, nil); err != nil {
+		slog.Error("Can't ping the client", "error", err)
+		os.Exit(1)
 	}
 
-	Client = client
-	log.Println("Connected to database")
+	slog.Info("Connected to database", "database", cfg.Database)
+	return client.Database(cfg.Database)
 }
 
-func DisConnectDB(){
-	if Client != nil{
+func DisConnectDB(db *mongo.Database) {
+	if db != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		if err := Client.Disconnect(ctx); err != nil{
-			log.Println("Error disconnecting MongoDB:", err)
-		}else {
-			log.Println("Database disconnected successfully.")
+		if err := db.Client().Disconnect(ctx); err != nil {
+			slog.Error("Error disconnecting MongoDB", "error", err)
+		} else {
+			slog.Info("Database disconnected successfully.")
 		}
 	}
-}
\ No newline at end of file
+}
+
+// combineMonitors fans driver command events out to several monitors (metrics and tracing)
+func combineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
@@ -2,30 +2,43 @@ package config
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
 
+	"chat-app/metrics"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 )
 
-var RedisClient *redis.Client
-
-func ConnectRedis() {
-	redisAddr := os.Getenv("REDIS_URL")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
-	}
-
-	RedisClient = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "", // no password set
-		DB:       0,  // use default DB
+// ConnectRedis connects to Redis, it exits when Redis can't be reached
+func ConnectRedis(cfg RedisConfig) *redis.Client {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
+	rdb.AddHook(metrics.RedisHook())
+	if err := redisotel.InstrumentTracing(rdb); err != nil {
+		slog.Warn("Could not instrument Redis tracing", "error", err)
+	}
 
-	_, err := RedisClient.Ping(context.Background()).Result()
+	_, err := rdb.Ping(context.Background()).Result()
 	if err != nil {
-		log.Fatalf("Could not connect to Redis: %v", err)
+		slog.Error("Could not connect to Redis", "error", err)
+		os.Exit(1)
 	}
 
-	log.Println("Connected to Redis Pub/Sub")
-}
\ No newline at end of file
+	slog.Info("Connected to Redis Pub/Sub")
+	return rdb
+}
+
+func DisconnectRedis(rdb *redis.Client) {
+	if rdb != nil {
+		if err := rdb.Close(); err != nil {
+			slog.Error("Error closing Redis connection", "error", err)
+		} else {
+			slog.Info("Redis connection closed.")
+		}
+	}
+}
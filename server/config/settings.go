@@ -0,0 +1,638 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-app/auth"
+	"chat-app/origins"
+	"chat-app/ratelimit"
+)
+
+// Config is the complete runtime configuration of the chat server.
+// Values are layered: defaults, then the JSON config file, then environment variables, then flags.
+type Config struct {
+	Server    ServerConfig    `json:"server"`
+	Mongo     MongoConfig     `json:"mongo"`
+	Redis     RedisConfig     `json:"redis"`
+	Socket    SocketConfig    `json:"socket"`
+	Video     VideoConfig     `json:"video"`
+	CORS      CORSConfig      `json:"cors"`
+	RateLimit RateLimitConfig `json:"rateLimit"`
+	Auth      AuthConfig      `json:"auth"`
+	Mail      MailConfig      `json:"mail"`
+	Privacy   PrivacyConfig   `json:"privacy"`
+	Log       LogConfig       `json:"log"`
+	Tracing   TracingConfig   `json:"tracing"`
+
+	// Args holds the positional arguments left after the flags, e.g. a subcommand
+	Args []string `json:"-"`
+}
+
+type ServerConfig struct {
+	Host            string   `json:"host"`
+	Port            int      `json:"port"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// TrustedProxies are the IPs or CIDRs allowed to set X-Forwarded-For. Empty trusts nobody,
+	// so rate limits and login lockouts key on the peer address of the connection.
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+type MongoConfig struct {
+	URI              string `json:"uri"`
+	Database         string `json:"database"`
+	MigrateOnStartup bool   `json:"migrateOnStartup"`
+}
+
+type RedisConfig struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+}
+
+type SocketConfig struct {
+	SendBufferSize int `json:"sendBufferSize"`
+}
+
+type VideoConfig struct {
+	ServiceURL string `json:"serviceURL"`
+	// RedisDB is the database the video service keeps its rooms in, on the same Redis server
+	RedisDB int `json:"redisDB"`
+	// JoinSecret signs the tokens the video service checks before a user joins a room,
+	// both services need the same value. Without it group video calls are switched off.
+	JoinSecret   string   `json:"joinSecret"`
+	JoinTokenTTL Duration `json:"joinTokenTTL"` // time between fetching a token and opening the socket
+}
+
+// RateLimitConfig sets the token buckets shared by all instances through Redis.
+// Maps from the config file are merged into the defaults, a zero rule switches one limit off.
+type RateLimitConfig struct {
+	Enabled bool                        `json:"enabled"`
+	Routes  map[string]ratelimit.Rule   `json:"routes"` // by route name, per client IP
+	Events  map[string]EventLimitConfig `json:"events"` // by socket event type, per user, unlisted events are not limited
+	Login   LoginLockoutConfig          `json:"login"`
+}
+
+type EventLimitConfig struct {
+	ratelimit.Rule
+	Penalty ratelimit.Penalty `json:"penalty"` // throttle, mute, disconnect
+	MuteFor Duration          `json:"muteFor"` // only used by the mute penalty
+}
+
+// LoginLockoutConfig locks a username and a client IP separately after repeated failed logins
+type LoginLockoutConfig struct {
+	MaxFailures int      `json:"maxFailures"` // 0 disables the lockout
+	Window      Duration `json:"window"`      // failures older than this are forgotten
+	Lockout     Duration `json:"lockout"`
+}
+
+// CORSConfig lists the browser origins allowed to call the API and open sockets, exact
+// like https://chat.example.com or any subdomain like https://*.example.com
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+type AuthConfig struct {
+	SessionTTL        Duration            `json:"sessionTTL"`
+	ResetTokenTTL     Duration            `json:"resetTokenTTL"`
+	ResetURL          string              `json:"resetURL"` // page of the client that accepts ?token=
+	Password          auth.PasswordPolicy `json:"password"`
+	TOTPIssuer        string              `json:"totpIssuer"`        // name shown in authenticator apps
+	LoginChallengeTTL Duration            `json:"loginChallengeTTL"` // time to enter the second factor after the password
+	OIDC              OIDCConfig          `json:"oidc"`
+}
+
+// OIDCConfig enables sign in with external identity providers. Providers are keyed by the
+// name used in their URLs, /api/auth/oidc/<name>/login and /api/auth/oidc/<name>/callback.
+type OIDCConfig struct {
+	Providers map[string]auth.OIDCProviderConfig `json:"providers"`
+	ClientURL string                             `json:"clientURL"` // client page that receives ?code=, ?challenge= or ?error=
+	StateTTL  Duration                           `json:"stateTTL"`  // time allowed on the provider's login page
+}
+
+type MailConfig struct {
+	Driver string     `json:"driver"` // log, file, smtp
+	From   string     `json:"from"`
+	Dir    string     `json:"dir"` // where the file driver writes .eml files
+	SMTP   SMTPConfig `json:"smtp"`
+}
+
+type PrivacyConfig struct {
+	// DeletedMessages decides what happens to the messages of a deleted account:
+	// "anonymize" keeps the text but detaches it from the user, "delete" removes it
+	DeletedMessages string `json:"deletedMessages"`
+}
+
+type SMTPConfig struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level"`  // debug, info, warn, error
+	Format string `json:"format"` // json, text
+}
+
+type TracingConfig struct {
+	Exporter string `json:"exporter"` // otlp, stdout, none
+}
+
+// Duration lets the config file use strings like "30s"
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Default returns the configuration used for local development
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Host:            "localhost",
+			Port:            8080,
+			ShutdownTimeout: Duration(30 * time.Second),
+		},
+		Mongo: MongoConfig{
+			URI:              "mongodb://localhost:27017",
+			Database:         "gopherchat",
+			MigrateOnStartup: true,
+		},
+		Redis: RedisConfig{
+			Addr: "localhost:6379",
+		},
+		Socket: SocketConfig{
+			SendBufferSize: 256,
+		},
+		Video: VideoConfig{
+			ServiceURL:   "http://localhost:4000",
+			RedisDB:      1,
+			JoinTokenTTL: Duration(2 * time.Minute),
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"http://localhost:3000", "http://localhost:5173"},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled: true,
+			Routes: map[string]ratelimit.Rule{
+				"login":          {Rate: 0.2, Burst: 10},
+				"register":       {Rate: 0.05, Burst: 3},
+				"check-username": {Rate: 2, Burst: 20},
+				"friend-request": {Rate: 0.2, Burst: 5},
+				"password":       {Rate: 0.05, Burst: 5},
+			},
+			Events: map[string]EventLimitConfig{
+				"message":    {Rule: ratelimit.Rule{Rate: 5, Burst: 15}, Penalty: ratelimit.Mute, MuteFor: Duration(30 * time.Second)},
+				"typing":     {Rule: ratelimit.Rule{Rate: 2, Burst: 5}, Penalty: ratelimit.Throttle},
+				"join":       {Rule: ratelimit.Rule{Rate: 0.5, Burst: 5}, Penalty: ratelimit.Disconnect},
+				"disconnect": {Rule: ratelimit.Rule{Rate: 0.5, Burst: 5}, Penalty: ratelimit.Disconnect},
+			},
+			Login: LoginLockoutConfig{
+				MaxFailures: 5,
+				Window:      Duration(15 * time.Minute),
+				Lockout:     Duration(15 * time.Minute),
+			},
+		},
+		Auth: AuthConfig{
+			SessionTTL:    Duration(30 * 24 * time.Hour),
+			ResetTokenTTL: Duration(30 * time.Minute),
+			ResetURL:      "http://localhost:3000/reset-password",
+			Password: auth.PasswordPolicy{
+				MinLength:    8,
+				RequireMixed: true,
+				RequireDigit: true,
+			},
+			TOTPIssuer:        "GopherChat",
+			LoginChallengeTTL: Duration(5 * time.Minute),
+			OIDC: OIDCConfig{
+				Providers: map[string]auth.OIDCProviderConfig{},
+				ClientURL: "http://localhost:3000/oidc/callback",
+				StateTTL:  Duration(10 * time.Minute),
+			},
+		},
+		Mail: MailConfig{
+			Driver: "log",
+			From:   "GopherChat <no-reply@localhost>",
+			Dir:    "mail",
+		},
+		Privacy: PrivacyConfig{
+			DeletedMessages: "anonymize",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			Exporter: "none",
+		},
+	}
+}
+
+// Load builds the configuration from the config file, the environment and the command line
+// arguments (without the program name), then validates it.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("chat-server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+	host := fs.String("host", "", "public host name")
+	port := fs.Int("port", 0, "HTTP listen port")
+	mongoURI := fs.String("mongo-uri", "", "MongoDB connection string")
+	mongoDatabase := fs.String("mongo-database", "", "MongoDB database name")
+	redisAddr := fs.String("redis-addr", "", "Redis address (host:port)")
+	videoURL := fs.String("video-service-url", "", "base URL of the video service")
+	allowedOrigins := fs.String("allowed-origins", "", "comma separated list of allowed CORS origins")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	envErr := cfg.loadEnv()
+
+	// Only flags that were actually passed override the lower layers
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			cfg.Server.Host = *host
+		case "port":
+			cfg.Server.Port = *port
+		case "mongo-uri":
+			cfg.Mongo.URI = *mongoURI
+		case "mongo-database":
+			cfg.Mongo.Database = *mongoDatabase
+		case "redis-addr":
+			cfg.Redis.Addr = *redisAddr
+		case "video-service-url":
+			cfg.Video.ServiceURL = *videoURL
+		case "allowed-origins":
+			cfg.CORS.AllowedOrigins = splitList(*allowedOrigins)
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		}
+	})
+
+	cfg.Args = fs.Args()
+
+	if err := errors.Join(envErr, cfg.Validate()); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	var errs []error
+
+	setString(&cfg.Server.Host, "HOST")
+	errs = append(errs, setInt(&cfg.Server.Port, "PORT"))
+	errs = append(errs, setDuration(&cfg.Server.ShutdownTimeout, "SHUTDOWN_TIMEOUT"))
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		cfg.Server.TrustedProxies = splitList(value)
+	}
+
+	// DB_URL is the historical name, docker-compose uses MONGODB_URI
+	setString(&cfg.Mongo.URI, "DB_URL")
+	setString(&cfg.Mongo.URI, "MONGODB_URI")
+	setString(&cfg.Mongo.Database, "MONGODB_DATABASE")
+	errs = append(errs, setBool(&cfg.Mongo.MigrateOnStartup, "MIGRATE_ON_STARTUP"))
+
+	setString(&cfg.Redis.Addr, "REDIS_URL")
+	setString(&cfg.Redis.Password, "REDIS_PASSWORD")
+	errs = append(errs, setInt(&cfg.Redis.DB, "REDIS_DB"))
+
+	errs = append(errs, setInt(&cfg.Socket.SendBufferSize, "SEND_BUFFER_SIZE"))
+	setString(&cfg.Video.ServiceURL, "VIDEO_SERVICE_URL")
+	errs = append(errs, setInt(&cfg.Video.RedisDB, "VIDEO_REDIS_DB"))
+	setString(&cfg.Video.JoinSecret, "VIDEO_JOIN_SECRET")
+	errs = append(errs, setDuration(&cfg.Video.JoinTokenTTL, "VIDEO_JOIN_TOKEN_TTL"))
+
+	if value := os.Getenv("ALLOWED_ORIGINS"); value != "" {
+		cfg.CORS.AllowedOrigins = splitList(value)
+	}
+
+	errs = append(errs, setBool(&cfg.RateLimit.Enabled, "RATE_LIMIT_ENABLED"))
+	errs = append(errs, setInt(&cfg.RateLimit.Login.MaxFailures, "LOGIN_MAX_FAILURES"))
+	errs = append(errs, setDuration(&cfg.RateLimit.Login.Lockout, "LOGIN_LOCKOUT"))
+
+	errs = append(errs, setDuration(&cfg.Auth.SessionTTL, "SESSION_TTL"))
+	errs = append(errs, setDuration(&cfg.Auth.ResetTokenTTL, "PASSWORD_RESET_TTL"))
+	setString(&cfg.Auth.ResetURL, "PASSWORD_RESET_URL")
+	errs = append(errs, setInt(&cfg.Auth.Password.MinLength, "PASSWORD_MIN_LENGTH"))
+	setString(&cfg.Auth.TOTPIssuer, "TOTP_ISSUER")
+	errs = append(errs, setDuration(&cfg.Auth.LoginChallengeTTL, "LOGIN_CHALLENGE_TTL"))
+	setString(&cfg.Auth.OIDC.ClientURL, "OIDC_CLIENT_URL")
+	errs = append(errs, cfg.loadOIDCProviderEnv())
+
+	setString(&cfg.Mail.Driver, "MAIL_DRIVER")
+	setString(&cfg.Mail.From, "MAIL_FROM")
+	setString(&cfg.Mail.Dir, "MAIL_DIR")
+	setString(&cfg.Mail.SMTP.Addr, "SMTP_ADDR")
+	setString(&cfg.Mail.SMTP.Username, "SMTP_USERNAME")
+	setString(&cfg.Mail.SMTP.Password, "SMTP_PASSWORD")
+
+	setString(&cfg.Privacy.DeletedMessages, "DELETED_MESSAGES_POLICY")
+
+	setString(&cfg.Log.Level, "LOG_LEVEL")
+	setString(&cfg.Log.Format, "LOG_FORMAT")
+	setString(&cfg.Tracing.Exporter, "OTEL_TRACES_EXPORTER")
+
+	return errors.Join(errs...)
+}
+
+// loadOIDCProviderEnv configures one provider from OIDC_* variables, more need the config file
+func (cfg *Config) loadOIDCProviderEnv() error {
+	issuer, ok := os.LookupEnv("OIDC_ISSUER")
+	if !ok || issuer == "" {
+		return nil
+	}
+
+	name := "sso"
+	setString(&name, "OIDC_PROVIDER")
+	provider := cfg.Auth.OIDC.Providers[name]
+	provider.Issuer = issuer
+	setString(&provider.ClientID, "OIDC_CLIENT_ID")
+	setString(&provider.ClientSecret, "OIDC_CLIENT_SECRET")
+	setString(&provider.RedirectURL, "OIDC_REDIRECT_URL")
+	err := setBool(&provider.LinkByEmail, "OIDC_LINK_BY_EMAIL")
+	if scopes, ok := os.LookupEnv("OIDC_SCOPES"); ok {
+		provider.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+	}
+
+	if cfg.Auth.OIDC.Providers == nil {
+		cfg.Auth.OIDC.Providers = map[string]auth.OIDCProviderConfig{}
+	}
+	cfg.Auth.OIDC.Providers[name] = provider
+	return err
+}
+
+// Validate reports every invalid setting at once so operators can fix them in one go
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.Server.Port < 1 || cfg.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port: %d is not a valid TCP port", cfg.Server.Port))
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdownTimeout: must be positive"))
+	}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if !isIPOrCIDR(proxy) {
+			errs = append(errs, fmt.Errorf("server.trustedProxies: %q must be an IP address or CIDR (TRUSTED_PROXIES)", proxy))
+		}
+	}
+
+	if !strings.HasPrefix(cfg.Mongo.URI, "mongodb://") && !strings.HasPrefix(cfg.Mongo.URI, "mongodb+srv://") {
+		errs = append(errs, errors.New("mongo.uri: must start with mongodb:// or mongodb+srv://"))
+	}
+	if cfg.Mongo.Database == "" {
+		errs = append(errs, errors.New("mongo.database: must not be empty (MONGODB_DATABASE)"))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Redis.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("redis.addr: %q must be host:port", cfg.Redis.Addr))
+	}
+	if cfg.Redis.DB < 0 {
+		errs = append(errs, errors.New("redis.db: must not be negative"))
+	}
+
+	if cfg.Socket.SendBufferSize < 1 {
+		errs = append(errs, errors.New("socket.sendBufferSize: must be at least 1"))
+	}
+
+	if u, err := url.Parse(cfg.Video.ServiceURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("video.serviceURL: %q must be an absolute http(s) URL", cfg.Video.ServiceURL))
+	}
+	if cfg.Video.RedisDB < 0 {
+		errs = append(errs, errors.New("video.redisDB: must not be negative"))
+	}
+	if cfg.Video.JoinSecret != "" && len(cfg.Video.JoinSecret) < minJoinSecretLength {
+		errs = append(errs, fmt.Errorf("video.joinSecret: must be at least %d characters (VIDEO_JOIN_SECRET)", minJoinSecretLength))
+	}
+	if cfg.Video.JoinTokenTTL <= 0 {
+		errs = append(errs, errors.New("video.joinTokenTTL: must be positive"))
+	}
+
+	if len(cfg.CORS.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("cors.allowedOrigins: at least one origin is required (ALLOWED_ORIGINS)"))
+	}
+	if _, err := origins.Parse(cfg.CORS.AllowedOrigins); err != nil {
+		errs = append(errs, fmt.Errorf("cors.allowedOrigins: %w", err))
+	}
+
+	for name, rule := range cfg.RateLimit.Routes {
+		if rule.Rate < 0 || rule.Burst < 0 {
+			errs = append(errs, fmt.Errorf("rateLimit.routes.%s: rate and burst must not be negative", name))
+		}
+	}
+	for name, event := range cfg.RateLimit.Events {
+		if event.Rate < 0 || event.Burst < 0 {
+			errs = append(errs, fmt.Errorf("rateLimit.events.%s: rate and burst must not be negative", name))
+		}
+		if !event.Penalty.Valid() {
+			errs = append(errs, fmt.Errorf("rateLimit.events.%s: penalty %q must be throttle, mute or disconnect", name, event.Penalty))
+		}
+		if event.Penalty == ratelimit.Mute && event.MuteFor <= 0 {
+			errs = append(errs, fmt.Errorf("rateLimit.events.%s: muteFor must be positive for the mute penalty", name))
+		}
+	}
+	if login := cfg.RateLimit.Login; login.MaxFailures < 0 {
+		errs = append(errs, errors.New("rateLimit.login.maxFailures: must not be negative"))
+	} else if login.MaxFailures > 0 && (login.Window <= 0 || login.Lockout <= 0) {
+		errs = append(errs, errors.New("rateLimit.login: window and lockout must be positive"))
+	}
+
+	if cfg.Auth.SessionTTL <= 0 || cfg.Auth.ResetTokenTTL <= 0 {
+		errs = append(errs, errors.New("auth.sessionTTL and auth.resetTokenTTL: must be positive"))
+	}
+	if !isAbsoluteURL(cfg.Auth.ResetURL) {
+		errs = append(errs, fmt.Errorf("auth.resetURL: %q must be an absolute http(s) URL", cfg.Auth.ResetURL))
+	}
+	if cfg.Auth.Password.MinLength < 1 {
+		errs = append(errs, errors.New("auth.password.minLength: must be at least 1"))
+	}
+	if cfg.Auth.TOTPIssuer == "" || strings.Contains(cfg.Auth.TOTPIssuer, ":") {
+		errs = append(errs, errors.New("auth.totpIssuer: must be set and must not contain ':'"))
+	}
+	if cfg.Auth.LoginChallengeTTL <= 0 {
+		errs = append(errs, errors.New("auth.loginChallengeTTL: must be positive"))
+	}
+	if len(cfg.Auth.OIDC.Providers) > 0 {
+		if !isAbsoluteURL(cfg.Auth.OIDC.ClientURL) {
+			errs = append(errs, fmt.Errorf("auth.oidc.clientURL: %q must be an absolute http(s) URL", cfg.Auth.OIDC.ClientURL))
+		}
+		if cfg.Auth.OIDC.StateTTL <= 0 {
+			errs = append(errs, errors.New("auth.oidc.stateTTL: must be positive"))
+		}
+	}
+	for name, provider := range cfg.Auth.OIDC.Providers {
+		if !providerName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("auth.oidc.providers: name %q must be lowercase letters, digits and dashes", name))
+		}
+		if !isAbsoluteURL(provider.Issuer) {
+			errs = append(errs, fmt.Errorf("auth.oidc.providers.%s.issuer: %q must be an absolute http(s) URL", name, provider.Issuer))
+		}
+		if provider.ClientID == "" {
+			errs = append(errs, fmt.Errorf("auth.oidc.providers.%s.clientID: must be set", name))
+		}
+		if !isAbsoluteURL(provider.RedirectURL) {
+			errs = append(errs, fmt.Errorf("auth.oidc.providers.%s.redirectURL: %q must be an absolute http(s) URL", name, provider.RedirectURL))
+		}
+	}
+
+	switch cfg.Mail.Driver {
+	case "log":
+	case "file":
+		if cfg.Mail.Dir == "" {
+			errs = append(errs, errors.New("mail.dir: required by the file driver (MAIL_DIR)"))
+		}
+	case "smtp":
+		if _, _, err := net.SplitHostPort(cfg.Mail.SMTP.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("mail.smtp.addr: %q must be host:port", cfg.Mail.SMTP.Addr))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("mail.driver: %q must be log, file or smtp", cfg.Mail.Driver))
+	}
+
+	switch cfg.Privacy.DeletedMessages {
+	case "anonymize", "delete":
+	default:
+		errs = append(errs, fmt.Errorf("privacy.deletedMessages: %q must be anonymize or delete", cfg.Privacy.DeletedMessages))
+	}
+
+	switch strings.ToLower(cfg.Log.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level: %q must be debug, info, warn or error", cfg.Log.Level))
+	}
+	switch strings.ToLower(cfg.Log.Format) {
+	case "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("log.format: %q must be json or text", cfg.Log.Format))
+	}
+
+	switch strings.ToLower(cfg.Tracing.Exporter) {
+	case "otlp", "stdout", "none":
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter: %q must be otlp, stdout or none", cfg.Tracing.Exporter))
+	}
+
+	return errors.Join(errs...)
+}
+
+var providerName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// minJoinSecretLength is 256 bits of printable secret for the HS256 join tokens
+const minJoinSecretLength = 32
+
+func isAbsoluteURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func isIPOrCIDR(value string) bool {
+	if net.ParseIP(value) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(value)
+	return err == nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func setString(dst *string, key string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*dst = value
+	}
+}
+
+func setInt(dst *int, key string) error {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not an integer", key, value)
+	}
+	*dst = parsed
+	return nil
+}
+
+func setDuration(dst *Duration, key string) error {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a duration like 30s", key, value)
+	}
+	*dst = Duration(parsed)
+	return nil
+}
+
+func setBool(dst *bool, key string) error {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a boolean", key, value)
+	}
+	*dst = parsed
+	return nil
+}
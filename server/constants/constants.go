@@ -13,6 +13,49 @@ const(
 	YouAreNotLoggedIN              = "You are not logged in."
 	YouAreLoggedIN                 = "You are logged in."
 	UserIsNotRegisteredWithUs      = "This account does not exist in our system."
+	AccountIsDisabled              = "This account has been disabled."
+	TooManyLoginAttempts           = "Too many failed login attempts, try again later."
+	TooManyRequests                = "Too many requests, slow down."
+	InvalidEmail                   = "Email address is not valid."
+	CurrentPasswordIsIncorrect     = "Current password is incorrect."
+	PasswordChanged                = "Password changed, your other sessions were signed out."
+	PasswordResetRequested         = "If the account has an email address, a reset link is on its way."
+	PasswordResetCompleted         = "Password reset, please log in again."
+	InvalidResetToken              = "This reset link is invalid or has expired."
+	YouAreLoggedOut                = "You are logged out."
+	PasswordIsIncorrect            = "Password is incorrect."
+	AccountDeleted                 = "Your account has been deleted."
+	ExportFormatNotSupported       = "Export format must be json or zip."
+	TwoFactorRequired              = "Enter the code from your authenticator app."
+	InvalidTwoFactorCode           = "The authentication code is incorrect."
+	InvalidLoginChallenge          = "This login attempt has expired, please log in again."
+	TwoFactorAlreadyEnabled        = "Two-factor authentication is already enabled."
+	TwoFactorNotEnabled            = "Two-factor authentication is not enabled."
+	TwoFactorEnrollmentStarted     = "Scan the secret with your authenticator app and confirm a code."
+	TwoFactorEnabled               = "Two-factor authentication enabled, store your recovery codes safely."
+	TwoFactorDisabled              = "Two-factor authentication disabled."
+	RecoveryCodesRegenerated       = "New recovery codes generated, the old ones no longer work."
+	IdentityProviderNotFound       = "Unknown identity provider."
+	IdentityProviderUnavailable    = "The identity provider can't be reached, try again later."
+	InvalidOIDCState               = "This sign in attempt has expired, please try again."
+	InvalidOIDCCode                = "This sign in code is invalid or has expired."
+	OIDCLoginFailed                = "Signing in with the identity provider failed."
+	IdentityAlreadyLinked          = "This identity is already linked to an account."
+	ReauthenticationRequired       = "Confirm it's you by signing in with your identity provider again."
+	ReauthIdentityMismatch         = "Sign in with an identity that is linked to your account."
+	SignInToLinkIdentity           = "An account with this email already exists. Sign in with your password and link the provider from your settings."
+	IdentityNotLinked              = "No identity of this provider is linked to your account."
+	IdentityUnlinked               = "Identity unlinked."
+	CantUnlinkLastLogin            = "Set a password before unlinking your only way to sign in."
+	GroupNotFound                  = "Group not found."
+	YouAreNotAGroupMember          = "You are not a member of this group."
+	VideoCallsDisabled             = "Video calls are not available on this server."
+	CallerIsNotSignedInUser        = "Calls can only be started as the signed in user."
+	InvalidVideoSignature          = "The request is not signed by the video service."
+	RecordingRegistered            = "Recording registered."
+
+	// DeletedUserID replaces the sender and recipient of anonymized messages
+	DeletedUserID = "deleted-user"
 
 	// Application response messages
 	SuccessfulResponse   = "Request completed successfully"
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"chat-app/auth"
+	"chat-app/config"
+	"chat-app/constants"
+	"chat-app/logging"
+	"chat-app/mailer"
+	"chat-app/store"
+	"chat-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const sessionContextKey = "session"
+
+// Accounts bundles what the session and password endpoints need
+type Accounts struct {
+	sessions   *auth.Sessions
+	resets     *auth.OneTimeTokens
+	challenges *auth.OneTimeTokens // logins waiting for their second factor
+	policy     auth.PasswordPolicy
+	mailer     mailer.Mailer
+	resetURL   string
+	issuer     string
+	oidc       oidcLogins
+}
+
+func NewAccounts(cfg config.AuthConfig, rdb redis.Cmdable, mail mailer.Mailer) *Accounts {
+	return &Accounts{
+		sessions:   auth.NewSessions(rdb, cfg.SessionTTL.Std()),
+		resets:     auth.NewResetTokens(rdb, cfg.ResetTokenTTL.Std()),
+		challenges: auth.NewLoginChallenges(rdb, cfg.LoginChallengeTTL.Std()),
+		policy:     cfg.Password,
+		mailer:     mail,
+		resetURL:   cfg.ResetURL,
+		issuer:     cfg.TOTPIssuer,
+		oidc:       newOIDCLogins(cfg.OIDC, rdb),
+	}
+}
+
+// RequireSession rejects requests without a valid "Authorization: Bearer <token>" header
+func RequireSession(accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		session, err := accounts.sessions.Get(c.Request.Context(), token)
+		if err != nil {
+			if !errors.Is(err, auth.ErrInvalidToken) {
+				logging.FromContext(c.Request.Context()).Error("Session lookup failed", "error", err)
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, APIResponse{
+				Code:     http.StatusUnauthorized,
+				Status:   http.StatusText(http.StatusUnauthorized),
+				Message:  constants.YouAreNotLoggedIN,
+				Response: nil,
+			})
+			return
+		}
+
+		c.Set(sessionContextKey, session)
+		c.Next()
+	}
+}
+
+// currentSession returns the session stored by RequireSession
+func currentSession(c *gin.Context) auth.Session {
+	session, _ := c.MustGet(sessionContextKey).(auth.Session)
+	return session
+}
+
+func Logout(accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := accounts.sessions.Revoke(c.Request.Context(), currentSession(c)); err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.YouAreLoggedOut,
+			Response: nil,
+		})
+	}
+}
+
+// ChangePassword needs the current password and signs out every other session of the user
+func ChangePassword(stores *store.Stores, accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		session := currentSession(c)
+
+		var request ChangePasswordRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.PasswordCantBeEmpty)
+			return
+		}
+
+		user, err := stores.Users.GetByID(ctx, session.UserID)
+		if err != nil {
+			respondError(c, http.StatusNotFound, constants.UserIsNotRegisteredWithUs)
+			return
+		}
+		if err := utils.VerifyPassword(user.Password, request.CurrentPassword); err != nil {
+			respondError(c, http.StatusForbidden, constants.CurrentPasswordIsIncorrect)
+			return
+		}
+		if err := accounts.policy.Check(request.NewPassword, user.Username); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := setPassword(c, stores, accounts, user.ID, request.NewPassword, session.ID); err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.PasswordChanged,
+			Response: nil,
+		})
+	}
+}
+
+// ForgotPassword mails a reset link. The answer is the same whether or not the account
+// exists, so the endpoint can't be used to probe for usernames.
+func ForgotPassword(stores *store.Stores, accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		logger := logging.FromContext(ctx)
+
+		var request ForgotPasswordRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.UsernameCantBeEmpty)
+			return
+		}
+
+		user, err := stores.Users.GetByUsername(ctx, request.Username)
+		switch {
+		case err != nil:
+			logger.Info("Password reset requested for unknown user")
+		case user.Disabled || user.Email == "":
+			logger.Info("Password reset requested for an account that can't receive it", "user_id", user.ID)
+		default:
+			if err := sendResetMail(c, accounts, user); err != nil {
+				logger.Error("Failed to send password reset mail", "user_id", user.ID, "error", err)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, APIResponse{
+			Code:     http.StatusAccepted,
+			Status:   http.StatusText(http.StatusAccepted),
+			Message:  constants.PasswordResetRequested,
+			Response: nil,
+		})
+	}
+}
+
+func sendResetMail(c *gin.Context, accounts *Accounts, user UserDetails) error {
+	token, err := accounts.resets.Issue(c.Request.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(accounts.resetURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return accounts.mailer.Send(c.Request.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your GopherChat password",
+		Body: "Hi " + user.Username + ",\n\n" +
+			"someone asked to reset the password of your GopherChat account. Open this link to choose a new one:\n\n" +
+			link.String() + "\n\n" +
+			"The link expires in " + accounts.resets.TTL().String() + ". If it wasn't you, ignore this mail.\n",
+	})
+}
+
+// ResetPassword redeems a reset token and signs the user out everywhere
+func ResetPassword(stores *store.Stores, accounts *Accounts, limits *RateLimits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var request ResetPasswordRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.InvalidResetToken)
+			return
+		}
+
+		// Validate before spending the token, so a weak password can be retried with the same link
+		userID, err := accounts.resets.Lookup(ctx, request.Token)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, constants.InvalidResetToken)
+			return
+		}
+
+		user, err := stores.Users.GetByID(ctx, userID)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, constants.InvalidResetToken)
+			return
+		}
+		if err := accounts.policy.Check(request.NewPassword, user.Username); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if consumedBy, err := accounts.resets.Consume(ctx, request.Token); err != nil || consumedBy != user.ID {
+			respondError(c, http.StatusBadRequest, constants.InvalidResetToken)
+			return
+		}
+
+		if err := setPassword(c, stores, accounts, user.ID, request.NewPassword, ""); err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		limits.logins.Reset(ctx, "user:"+user.Username)
+
+		// The token came through the mailbox, which proves the address belongs to the user
+		if !user.EmailVerified {
+			if err := stores.Users.MarkEmailVerified(ctx, user.ID); err != nil {
+				logging.FromContext(ctx).Error("Failed to mark email verified", "user_id", user.ID, "error", err)
+			}
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.PasswordResetCompleted,
+			Response: nil,
+		})
+	}
+}
+
+// confirmIdentity checks the password again before a sensitive change. Accounts without one
+// present the code of a fresh OIDC login instead, see OIDCReauth. It responds on failure.
+func confirmIdentity(c *gin.Context, accounts *Accounts, user UserDetails, password, reauth string) bool {
+	if user.Password != "" {
+		if err := utils.VerifyPassword(user.Password, password); err != nil {
+			respondError(c, http.StatusForbidden, constants.PasswordIsIncorrect)
+			return false
+		}
+		return true
+	}
+
+	userID, err := accounts.oidc.reauths.Consume(c.Request.Context(), reauth)
+	if err != nil || userID != user.ID {
+		respondError(c, http.StatusForbidden, constants.ReauthenticationRequired)
+		return false
+	}
+	return true
+}
+
+// setPassword stores the new hash and revokes every session except keepSessionID
+func setPassword(c *gin.Context, stores *store.Stores, accounts *Accounts, userID, password, keepSessionID string) error {
+	ctx := c.Request.Context()
+	logger := logging.FromContext(ctx)
+
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := stores.Users.SetPassword(ctx, userID, hash); err != nil {
+		logger.Error("Failed to store new password", "user_id", userID, "error", err)
+		return err
+	}
+
+	revoked, err := accounts.sessions.RevokeAll(ctx, userID, keepSessionID)
+	if err != nil {
+		logger.Error("Password changed but revoking sessions failed", "user_id", userID, "error", err)
+		return err
+	}
+	logger.Info("Password changed", "user_id", userID, "revoked_sessions", revoked)
+	return nil
+}
+
+func respondError(c *gin.Context, status int, message string) {
+	c.JSON(status, APIResponse{
+		Code:     status,
+		Status:   http.StatusText(status),
+		Message:  message,
+		Response: nil,
+	})
+}
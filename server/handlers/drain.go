@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+type drainingEvent struct {
+	Reason    string `json:"reason"`
+	Reconnect bool   `json:"reconnect"` // clients should reconnect, the load balancer routes them elsewhere
+}
+
+// IsDraining reports whether the lobby has stopped accepting new sockets
+func (lobby *Lobby) IsDraining() bool {
+	return lobby.draining.Load()
+}
+
+// Drain hands every connected client over to the remaining instances.
+// It announces the shutdown with a server-draining event, lets the send queues flush,
+// closes the sockets and finally drops the Redis subscription. ctx bounds the whole process.
+func (lobby *Lobby) Drain(ctx context.Context) {
+	if !lobby.draining.CompareAndSwap(false, true) {
+		return
+	}
+
+	slog.Info("Draining socket connections", "clients", lobby.clientCount())
+
+	BroadcastToEveryone(lobby, createWSMessage("server-draining", drainingEvent{
+		Reason:    "server is shutting down",
+		Reconnect: true,
+	}, ""))
+
+	if !lobby.waitUntil(ctx, func() bool { return lobby.QueueStats().QueuedTotal == 0 }) {
+		slog.Warn("Drain deadline reached before send queues were flushed")
+	}
+
+	lobby.mu.RLock()
+	for client := range lobby.clients {
+		client.disconnect(websocket.CloseServiceRestart, "server draining, please reconnect")
+	}
+	lobby.mu.RUnlock()
+
+	// Wait for readPump to unregister the clients so their disconnect events are published
+	if !lobby.waitUntil(ctx, func() bool { return lobby.clientCount() == 0 }) {
+		slog.Warn("Drain deadline reached with clients still registered", "clients", lobby.clientCount())
+	}
+
+	lobby.unsubscribe()
+}
+
+func (lobby *Lobby) clientCount() int {
+	lobby.mu.RLock()
+	defer lobby.mu.RUnlock()
+	return len(lobby.clients)
+}
+
+// waitUntil polls done until it returns true or ctx expires
+func (lobby *Lobby) waitUntil(ctx context.Context, done func() bool) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func (lobby *Lobby) unsubscribe() {
+	lobby.mu.Lock()
+	subscription := lobby.subscription
+	lobby.subscription = nil
+	lobby.mu.Unlock()
+
+	if subscription != nil {
+		if err := subscription.Close(); err != nil {
+			slog.Error("Error closing Redis subscription", "error", err)
+		} else {
+			slog.Info("Unsubscribed from Redis channel", "channel", PubSubChannel)
+		}
+	}
+}
@@ -6,29 +6,29 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
+	"chat-app/auth"
 	"chat-app/config"
 	"chat-app/constants"
+	"chat-app/logging"
+	"chat-app/metrics"
+	"chat-app/store"
+	"chat-app/tracing"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-// CreateGroupQuery inserts a new group into MongoDB
-func CreateGroupQuery(req CreateGroupRequest) (GroupResponse, error) {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("groups")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+const groupHistoryLimit = 50
 
+// CreateGroupQuery stores a new group with the creator as admin
+func CreateGroupQuery(ctx context.Context, stores *store.Stores, req CreateGroupRequest) (GroupResponse, error) {
 	// 1. Create initial members list (Creator is admin)
 	creatorID := req.CreatorID
-	creator := GetUserByUserID(creatorID)
+	creator, _ := stores.Users.GetByID(ctx, creatorID)
 
 	members := []GroupMember{
 		{
@@ -45,8 +45,8 @@ func CreateGroupQuery(req CreateGroupRequest) (GroupResponse, error) {
 		if memberID == creatorID {
 			continue
 		}
-		user := GetUserByUserID(memberID)
-		if user.ID != "" {
+		user, err := stores.Users.GetByID(ctx, memberID)
+		if err == nil {
 			members = append(members, GroupMember{
 				UserID:   user.ID,
 				Username: user.Username,
@@ -58,7 +58,6 @@ func CreateGroupQuery(req CreateGroupRequest) (GroupResponse, error) {
 
 	// 2. Prepare Group Document
 	newGroup := GroupDetails{
-		ID:          primitive.NewObjectID().Hex(), // Generate ID manually to return it easily
 		Name:        req.Name,
 		Description: req.Description,
 		Avatar:      req.Avatar,
@@ -73,300 +72,249 @@ func CreateGroupQuery(req CreateGroupRequest) (GroupResponse, error) {
 		UpdatedAt: time.Now(),
 	}
 
-	// Overwrite the ObjectID with the generated one
-	objID, _ := primitive.ObjectIDFromHex(newGroup.ID)
-
-	insertDoc := bson.M{
-		"_id":         objID,
-		"name":        newGroup.Name,
-		"description": newGroup.Description,
-		"avatar":      newGroup.Avatar,
-		"creatorID":   newGroup.CreatorID,
-		"members":     newGroup.Members,
-		"settings":    newGroup.Settings,
-		"createdAt":   newGroup.CreatedAt,
-		"updatedAt":   newGroup.UpdatedAt,
-	}
-
-	_, err := collection.InsertOne(ctx, insertDoc)
+	groupID, err := stores.Groups.Create(ctx, newGroup)
 	if err != nil {
 		return GroupResponse{}, errors.New(constants.ServerFailedResponse)
 	}
+	newGroup.ID = groupID
+
+	return toGroupResponse(newGroup), nil
+}
 
+func toGroupResponse(group GroupDetails) GroupResponse {
 	return GroupResponse{
-		GroupID:     newGroup.ID,
-		Name:        newGroup.Name,
-		Description: newGroup.Description,
-		Avatar:      newGroup.Avatar,
-		CreatorID:   newGroup.CreatorID,
-		MemberCount: len(newGroup.Members),
-		CreatedAt:   newGroup.CreatedAt,
-	}, nil
+		GroupID:     group.ID,
+		Name:        group.Name,
+		Description: group.Description,
+		Avatar:      group.Avatar,
+		CreatorID:   group.CreatorID,
+		MemberCount: len(group.Members),
+		CreatedAt:   group.CreatedAt,
+	}
 }
 
 // GetGroupsByUserID fetches all groups a user belongs to
-func GetGroupsByUserID(userID string) ([]GroupResponse, error) {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("groups")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Find groups where 'members.userID' matches the input userID
-	filter := bson.M{"members.userID": userID}
-	cursor, err := collection.Find(ctx, filter)
+func GetGroupsByUserID(ctx context.Context, groups store.GroupStore, userID string) ([]GroupResponse, error) {
+	memberOf, err := groups.ListByMember(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
-
-	var groups []GroupResponse
-	for cursor.Next(ctx) {
-		var group GroupDetails
-		if err := cursor.Decode(&group); err == nil {
-			groups = append(groups, GroupResponse{
-				GroupID:     group.ID,
-				Name:        group.Name,
-				Description: group.Description,
-				Avatar:      group.Avatar,
-				CreatorID:   group.CreatorID,
-				MemberCount: len(group.Members),
-				CreatedAt:   group.CreatedAt,
-			})
-		}
+
+	var response []GroupResponse
+	for _, group := range memberOf {
+		response = append(response, toGroupResponse(group))
 	}
-	return groups, nil
+	return response, nil
 }
 
 // GetGroupByID fetches full details of a specific group
-func GetGroupByID(groupID string) (GroupDetails, error) {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("groups")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	objID, err := primitive.ObjectIDFromHex(groupID)
-	if err != nil {
+func GetGroupByID(ctx context.Context, groups store.GroupStore, groupID string) (GroupDetails, error) {
+	group, err := groups.GetByID(ctx, groupID)
+	switch {
+	case errors.Is(err, store.ErrInvalidID):
 		return GroupDetails{}, errors.New("invalid group ID")
+	case errors.Is(err, store.ErrNotFound):
+		return GroupDetails{}, errors.New("group not found")
 	}
-
-	var group GroupDetails
-	err = collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&group)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return GroupDetails{}, errors.New("group not found")
-		}
-		return GroupDetails{}, err
-	}
-
-	return group, nil
+	return group, err
 }
 
 // AddMemberToGroup adds a user to the group
-func AddMemberToGroup(groupID, userID, role string) error {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("groups")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	objID, err := primitive.ObjectIDFromHex(groupID)
-	if err != nil {
-		return errors.New("invalid group ID")
-	}
-
+func AddMemberToGroup(ctx context.Context, stores *store.Stores, groupID, userID, role string) error {
 	// Check if user exists
-	user := GetUserByUserID(userID)
-	if user.ID == "" {
+	user, err := stores.Users.GetByID(ctx, userID)
+	if err != nil {
 		return errors.New("user not found")
 	}
 
-	// Check if already a member
-	count, _ := collection.CountDocuments(ctx, bson.M{
-		"_id":            objID,
-		"members.userID": userID,
-	})
-	if count > 0 {
-		return errors.New("user is already a member")
-	}
-
-	newMember := GroupMember{
+	err = stores.Groups.AddMember(ctx, groupID, GroupMember{
 		UserID:   userID,
 		Username: user.Username,
 		Role:     role,
 		JoinedAt: time.Now(),
+	})
+	switch {
+	case errors.Is(err, store.ErrInvalidID):
+		return errors.New("invalid group ID")
+	case errors.Is(err, store.ErrNotFound):
+		return errors.New("group not found")
+	case errors.Is(err, store.ErrAlreadyExists):
+		return errors.New("user is already a member")
 	}
-
-	_, err = collection.UpdateOne(ctx,
-		bson.M{"_id": objID},
-		bson.M{"$push": bson.M{"members": newMember}},
-	)
-
 	return err
 }
 
 // RemoveMemberFromGroup removes a user from the group
-func RemoveMemberFromGroup(groupID, userID string) error {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("groups")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	objID, err := primitive.ObjectIDFromHex(groupID)
+func RemoveMemberFromGroup(ctx context.Context, groups store.GroupStore, groupID, userID string) error {
+	group, err := GetGroupByID(ctx, groups, groupID)
 	if err != nil {
-		return errors.New("invalid group ID")
+		return err
 	}
 
 	// Don't allow removing the creator (simple logic for now)
 	// In a real app, ownership transfer logic is needed
-	var group GroupDetails
-	collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&group)
 	if group.CreatorID == userID {
 		return errors.New("cannot remove the group creator")
 	}
 
-	_, err = collection.UpdateOne(ctx,
-		bson.M{"_id": objID},
-		bson.M{"$pull": bson.M{"members": bson.M{"userID": userID}}},
-	)
-
-	return err
+	return groups.RemoveMember(ctx, groupID, userID)
 }
 
 // UpdateGroup modifies group details
-func UpdateGroup(req UpdateGroupRequest) error {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("groups")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	objID, err := primitive.ObjectIDFromHex(req.GroupID)
-	if err != nil {
+func UpdateGroup(ctx context.Context, groups store.GroupStore, req UpdateGroupRequest) error {
+	err := groups.Update(ctx, req.GroupID, store.GroupUpdate{
+		Name:        req.Name,
+		Description: req.Description,
+		Avatar:      req.Avatar,
+	})
+	if errors.Is(err, store.ErrInvalidID) {
 		return errors.New("invalid group ID")
 	}
-
-	updateFields := bson.M{}
-	if req.Name != "" {
-		updateFields["name"] = req.Name
-	}
-	if req.Description != "" {
-		updateFields["description"] = req.Description
-	}
-	if req.Avatar != "" {
-		updateFields["avatar"] = req.Avatar
-	}
-	updateFields["updatedAt"] = time.Now()
-
-	_, err = collection.UpdateOne(ctx, bson.M{"_id": objID}, bson.M{"$set": updateFields})
 	return err
 }
 
 // DeleteGroupByID deletes the group
-func DeleteGroupByID(groupID, requesterID string) error {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("groups")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	objID, err := primitive.ObjectIDFromHex(groupID)
-	if err != nil {
-		return errors.New("invalid group ID")
-	}
-
+func DeleteGroupByID(ctx context.Context, groups store.GroupStore, groupID, requesterID string) error {
 	// Verify requester is creator
-	var group GroupDetails
-	err = collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&group)
+	group, err := GetGroupByID(ctx, groups, groupID)
 	if err != nil {
-		return errors.New("group not found")
+		return err
 	}
 
 	if group.CreatorID != requesterID {
 		return errors.New("only the creator can delete the group")
 	}
 
-	_, err = collection.DeleteOne(ctx, bson.M{"_id": objID})
-	return err
+	return groups.Delete(ctx, groupID)
 }
 
 // StoreGroupMessage saves a message to the database
-func StoreGroupMessage(req GroupMessageRequest) (string, error) {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("group_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	id := primitive.NewObjectID()
-
-	_, err := collection.InsertOne(ctx, bson.M{
-		"_id":        id,
-		"groupID":    req.GroupID,
-		"fromUserID": req.FromUserID,
-		"message":    req.Message,
-		"type":       req.Type,
-		"createdAt":  time.Now(),
+func StoreGroupMessage(ctx context.Context, groups store.GroupStore, req GroupMessageRequest) (string, error) {
+	return groups.SaveMessage(ctx, GroupMessage{
+		GroupID:    req.GroupID,
+		FromUserID: req.FromUserID,
+		Message:    req.Message,
+		Type:       req.Type,
 	})
-
-	if err != nil {
-		return "", err
-	}
-
-	return id.Hex(), nil
 }
 
-// GetGroupMessageHistory fetches messages with pagination
-func GetGroupMessageHistory(groupID string, page string) ([]GroupMessage, error) {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("group_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
+// GetGroupMessageHistory fetches the latest messages of a group
+func GetGroupMessageHistory(ctx context.Context, groups store.GroupStore, groupID string, page string) ([]GroupMessage, error) {
 	// Basic pagination (implement logic to convert page string to offset)
 	// For now, let's just return the last 50 messages
-	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetLimit(50)
+	return groups.Messages(ctx, groupID, groupHistoryLimit)
+}
 
-	cursor, err := collection.Find(ctx, bson.M{"groupID": groupID}, opts)
-	if err != nil {
-		return nil, err
+// errVideoCallsDisabled is returned when no join secret is configured
+var errVideoCallsDisabled = errors.New("video calls are disabled, video.joinSecret is not set")
+
+// VideoServiceClient talks to the video service's REST API and mints the tokens its websocket accepts
+type VideoServiceClient struct {
+	baseURL string
+	http    *http.Client
+	joins   *auth.VideoJoinTokens // nil without a join secret
+}
+
+// NewVideoServiceClient builds a client that propagates the trace context with every request
+func NewVideoServiceClient(cfg config.VideoConfig) *VideoServiceClient {
+	client := &VideoServiceClient{
+		baseURL: strings.TrimRight(cfg.ServiceURL, "/"),
+		http: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   10 * time.Second,
+		},
+	}
+	if cfg.JoinSecret != "" {
+		client.joins = auth.NewVideoJoinTokens(cfg.JoinSecret, cfg.JoinTokenTTL.Std())
 	}
-	defer cursor.Close(ctx)
+	return client
+}
 
-	var messages []GroupMessage
-	if err = cursor.All(ctx, &messages); err != nil {
-		return nil, err
+// Enabled reports whether join tokens can be minted, the video service refuses sockets without one
+func (v *VideoServiceClient) Enabled() bool {
+	return v.joins != nil
+}
+
+// JoinToken lets userID open the signaling socket of roomID as role for a short while
+func (v *VideoServiceClient) JoinToken(roomID, userID, username, role string) (string, time.Time, error) {
+	if v.joins == nil {
+		return "", time.Time{}, errVideoCallsDisabled
 	}
+	return v.joins.Issue(roomID, userID, username, role)
+}
 
-	return messages, nil
+// VerifyCallback reports whether body was signed by the video service, false while video calls are disabled
+func (v *VideoServiceClient) VerifyCallback(body []byte, signature string) bool {
+	return v.joins != nil && v.joins.VerifyCallback(body, signature)
 }
 
-// InitiateGroupVideoCall contacts the Video Service to create a room
-func InitiateGroupVideoCall(groupID, callerID string) (string, error) {
-	// 1. Define the payload expected by Video Service
-	requestBody, err := json.Marshal(map[string]string{
-		"roomId":    "room_" + groupID, // Consistent naming
-		"creatorId": callerID,
-		"groupId":   groupID,
-		"type":      "group",
+// groupRoomID is the video room every call of a group takes place in
+func groupRoomID(groupID string) string {
+	return "room_" + groupID
+}
+
+// InitiateGroupVideoCall contacts the Video Service to create a room, created is false
+// when the group's call is already running. The request ID in ctx is forwarded so both
+// services log the call under the same ID.
+func (v *VideoServiceClient) InitiateGroupVideoCall(ctx context.Context, groupID, callerID string) (roomID string, created bool, err error) {
+	logger := logging.FromContext(ctx)
+	if v.joins == nil {
+		return "", false, errVideoCallsDisabled
+	}
+
+	// 1. Define the payload expected by Video Service, signed so nobody else can create rooms
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"roomId":      groupRoomID(groupID),
+		"creatorId":   callerID,
+		"groupId":     groupID,
+		"type":        "group",
+		"requestedAt": time.Now().Unix(),
 	})
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
-	// 2. Get Video Service URL (Default to localhost:4000 if not in .env)
-	videoServiceURL := os.Getenv("VIDEO_SERVICE_URL")
-	if videoServiceURL == "" {
-		videoServiceURL = "http://localhost:4000"
+	// 2. Make the HTTP Request
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.baseURL+"/api/rooms/create", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(auth.VideoSignatureHeader, v.joins.SignRequest(requestBody))
+	if requestID := logging.RequestIDFromContext(ctx); requestID != "" {
+		req.Header.Set(logging.RequestIDHeader, requestID)
 	}
 
-	// 3. Make the HTTP Request
-	resp, err := http.Post(videoServiceURL+"/api/rooms/create", "application/json", bytes.NewBuffer(requestBody))
+	resp, err := v.http.Do(req)
 	if err != nil {
-		log.Printf("Failed to contact video service: %v", err)
-		return "", errors.New("video service unavailable")
+		logger.Error("Failed to contact video service", logging.KeyGroupID, groupID, "error", err)
+		return "", false, errors.New("video service unavailable")
 	}
 	defer resp.Body.Close()
 
-	// 4. Check for success (200 OK)
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("video service returned status: %d", resp.StatusCode)
+	// 3. Check for success (200 OK), 409 means the room exists and keeps its host
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		logger.Error("Video service rejected room creation", logging.KeyGroupID, groupID, "status", resp.StatusCode)
+		return "", false, fmt.Errorf("video service returned status: %d", resp.StatusCode)
 	}
 
-	// 5. Parse the JSON response to get the confirmed Room ID
+	// 4. Parse the JSON response to get the confirmed Room ID
 	var res map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return "", err
+		return "", false, err
+	}
+
+	roomID, _ = res["roomId"].(string)
+	if roomID == "" {
+		return "", false, errors.New("video service returned no room ID")
 	}
 
-	return res["roomId"].(string), nil
+	if resp.StatusCode == http.StatusConflict {
+		logger.Info("Video room already running", logging.KeyGroupID, groupID, logging.KeyRoomID, roomID)
+		return roomID, false, nil
+	}
+	logger.Info("Video room created", logging.KeyGroupID, groupID, logging.KeyRoomID, roomID)
+	return roomID, true, nil
 }
 
 // BroadcastQueue is a channel to send messages from HTTP handlers to the WebSocket Hub.
@@ -374,11 +322,11 @@ func InitiateGroupVideoCall(groupID, callerID string) (string, error) {
 var BroadcastQueue = make(chan WSMessage, 1000)
 
 // BroadcastGroupMessage sends a real-time message to all online members of a group
-func BroadcastGroupMessage(groupID, fromUserID, message, msgType string) {
+func BroadcastGroupMessage(ctx context.Context, groups store.GroupStore, groupID, fromUserID, message, msgType string) {
 	// 1. Get Group Details
-	group, err := GetGroupByID(groupID)
+	group, err := GetGroupByID(ctx, groups, groupID)
 	if err != nil {
-		log.Printf("Failed to broadcast: group %s not found", groupID)
+		slog.Warn("Failed to broadcast: group not found", logging.KeyGroupID, groupID)
 		return
 	}
 
@@ -393,7 +341,7 @@ func BroadcastGroupMessage(groupID, fromUserID, message, msgType string) {
 
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Failed to marshal broadcast payload: %v", err)
+		slog.Error("Failed to marshal broadcast payload", logging.KeyGroupID, groupID, "error", err)
 		return
 	}
 
@@ -404,6 +352,7 @@ func BroadcastGroupMessage(groupID, fromUserID, message, msgType string) {
 			Type:     "group-message",
 			Payload:  payloadBytes,
 			TargetID: member.UserID, // Lobby will route this to the correct connection
+			Trace:    tracing.Inject(ctx),
 		}
 
 		// Push to the lobby's broadcast channel
@@ -411,14 +360,15 @@ func BroadcastGroupMessage(groupID, fromUserID, message, msgType string) {
 		select {
 		case MainLobby.broadcast <- wsMsg:
 		default:
-			log.Printf("Warning: Lobby broadcast channel full, dropping message for %s", member.UserID)
+			slog.Warn("Lobby broadcast channel full, dropping message", logging.KeyGroupID, groupID, logging.KeyUserID, member.UserID)
+			metrics.DroppedMessages.WithLabelValues(wsMsg.Type, "lobby_busy").Inc()
 		}
 	}
 }
 
 // NotifyGroupCall alerts all group members that a video call has started
-func NotifyGroupCall(groupID, callerID, roomID string) {
-	group, err := GetGroupByID(groupID)
+func NotifyGroupCall(ctx context.Context, groups store.GroupStore, groupID, callerID, roomID string) {
+	group, err := GetGroupByID(ctx, groups, groupID)
 	if err != nil {
 		return
 	}
@@ -445,11 +395,13 @@ func NotifyGroupCall(groupID, callerID, roomID string) {
 			Type:     "group-message",
 			Payload:  payloadBytes,
 			TargetID: member.UserID,
+			Trace:    tracing.Inject(ctx),
 		}
 
 		select {
 		case MainLobby.broadcast <- wsMsg:
 		default:
+			metrics.DroppedMessages.WithLabelValues(wsMsg.Type, "lobby_busy").Inc()
 		}
 	}
 }
@@ -1,18 +1,26 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"regexp"
 	"time"
 
+	"chat-app/auth"
 	"chat-app/constants"
+	"chat-app/logging"
+	"chat-app/models"
+	"chat-app/store"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 // CreateGroup creates a new group chat
-func CreateGroup() gin.HandlerFunc {
+func CreateGroup(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req CreateGroupRequest
 
@@ -42,7 +50,7 @@ func CreateGroup() gin.HandlerFunc {
 		}
 
 		// Create group in database
-		group, err := CreateGroupQuery(req)
+		group, err := CreateGroupQuery(c.Request.Context(), stores, req)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Code:    http.StatusInternalServerError,
@@ -61,7 +69,7 @@ func CreateGroup() gin.HandlerFunc {
 }
 
 // GetUserGroups returns all groups a user is part of
-func GetUserGroups() gin.HandlerFunc {
+func GetUserGroups(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.Param("userID")
 
@@ -74,7 +82,7 @@ func GetUserGroups() gin.HandlerFunc {
 			return
 		}
 
-		groups, err := GetGroupsByUserID(userID)
+		groups, err := GetGroupsByUserID(c.Request.Context(), stores.Groups, userID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Code:    http.StatusInternalServerError,
@@ -93,11 +101,11 @@ func GetUserGroups() gin.HandlerFunc {
 }
 
 // GetGroupDetails returns detailed information about a group
-func GetGroupDetails() gin.HandlerFunc {
+func GetGroupDetails(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		groupID := c.Param("groupID")
 
-		group, err := GetGroupByID(groupID)
+		group, err := GetGroupByID(c.Request.Context(), stores.Groups, groupID)
 		if err != nil {
 			c.JSON(http.StatusNotFound, APIResponse{
 				Code:    http.StatusNotFound,
@@ -118,7 +126,7 @@ func GetGroupDetails() gin.HandlerFunc {
 }
 
 // AddGroupMember adds a new member to a group
-func AddGroupMember() gin.HandlerFunc {
+func AddGroupMember(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req AddMemberRequest
 
@@ -134,7 +142,7 @@ func AddGroupMember() gin.HandlerFunc {
 		// TODO: Check if user is already a member
 		// TODO: Send notification to added user
 
-		err := AddMemberToGroup(req.GroupID, req.UserID, "member")
+		err := AddMemberToGroup(c.Request.Context(), stores, req.GroupID, req.UserID, "member")
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Code:    http.StatusInternalServerError,
@@ -151,7 +159,7 @@ func AddGroupMember() gin.HandlerFunc {
 }
 
 // RemoveGroupMember removes a member from a group
-func RemoveGroupMember() gin.HandlerFunc {
+func RemoveGroupMember(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		groupID := c.Param("groupID")
 		userID := c.Param("userID")
@@ -160,7 +168,7 @@ func RemoveGroupMember() gin.HandlerFunc {
 		// TODO: Cannot remove group creator
 		// TODO: Notify removed user
 
-		err := RemoveMemberFromGroup(groupID, userID)
+		err := RemoveMemberFromGroup(c.Request.Context(), stores.Groups, groupID, userID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Code:    http.StatusInternalServerError,
@@ -177,7 +185,7 @@ func RemoveGroupMember() gin.HandlerFunc {
 }
 
 // UpdateGroupSettings updates group information
-func UpdateGroupSettings() gin.HandlerFunc {
+func UpdateGroupSettings(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req UpdateGroupRequest
 
@@ -191,7 +199,7 @@ func UpdateGroupSettings() gin.HandlerFunc {
 
 		// TODO: Validate permissions (only admin can update)
 
-		err := UpdateGroup(req)
+		err := UpdateGroup(c.Request.Context(), stores.Groups, req)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Code:    http.StatusInternalServerError,
@@ -208,7 +216,7 @@ func UpdateGroupSettings() gin.HandlerFunc {
 }
 
 // DeleteGroup deletes a group
-func DeleteGroup() gin.HandlerFunc {
+func DeleteGroup(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		groupID := c.Param("groupID")
 		requesterID := c.Query("requesterID")
@@ -217,7 +225,7 @@ func DeleteGroup() gin.HandlerFunc {
 		// TODO: Notify all members
 		// TODO: Archive group messages
 
-		err := DeleteGroupByID(groupID, requesterID)
+		err := DeleteGroupByID(c.Request.Context(), stores.Groups, groupID, requesterID)
 		if err != nil {
 			c.JSON(http.StatusForbidden, APIResponse{
 				Code:    http.StatusForbidden,
@@ -234,14 +242,14 @@ func DeleteGroup() gin.HandlerFunc {
 }
 
 // GetGroupMessages returns message history for a group
-func GetGroupMessages() gin.HandlerFunc {
+func GetGroupMessages(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		groupID := c.Param("groupID")
 		page := c.DefaultQuery("page", "1")
 
 		// TODO: Verify user is a member
 
-		messages, err := GetGroupMessageHistory(groupID, page)
+		messages, err := GetGroupMessageHistory(c.Request.Context(), stores.Groups, groupID, page)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Code:    http.StatusInternalServerError,
@@ -260,7 +268,7 @@ func GetGroupMessages() gin.HandlerFunc {
 }
 
 // SendGroupMessage sends a message to a group
-func SendGroupMessage() gin.HandlerFunc {
+func SendGroupMessage(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req GroupMessageRequest
 
@@ -276,7 +284,7 @@ func SendGroupMessage() gin.HandlerFunc {
 		// TODO: Store message in database
 		// TODO: Broadcast via WebSocket to all group members
 
-		msgID, err := StoreGroupMessage(req)
+		msgID, err := StoreGroupMessage(c.Request.Context(), stores.Groups, req)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Code:    http.StatusInternalServerError,
@@ -286,7 +294,7 @@ func SendGroupMessage() gin.HandlerFunc {
 		}
 
 		// Broadcast to group members via WebSocket
-		BroadcastGroupMessage(req.GroupID, req.FromUserID, req.Message, req.Type)
+		BroadcastGroupMessage(c.Request.Context(), stores.Groups, req.GroupID, req.FromUserID, req.Message, req.Type)
 
 		c.JSON(http.StatusOK, APIResponse{
 			Code:     http.StatusOK,
@@ -296,47 +304,229 @@ func SendGroupMessage() gin.HandlerFunc {
 	}
 }
 
-// StartGroupVideoCall initiates a video call for a group
-func StartGroupVideoCall() gin.HandlerFunc {
+// StartGroupVideoCall creates the group's video room, invites the other members and
+// returns a join token that makes the caller the host of the call. If the call is already
+// running the caller joins it like through GroupVideoCallToken, and nobody is invited again.
+func StartGroupVideoCall(stores *store.Stores, video *VideoServiceClient) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req StartCallRequest
+		ctx := c.Request.Context()
+		callerID := currentSession(c).UserID
 
+		var req StartCallRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, APIResponse{
-				Code:    http.StatusBadRequest,
-				Message: "Invalid request",
-			})
+			respondError(c, http.StatusBadRequest, "Invalid request")
+			return
+		}
+		if req.CallerID != "" && req.CallerID != callerID {
+			respondError(c, http.StatusForbidden, constants.CallerIsNotSignedInUser)
+			return
+		}
+		if !video.Enabled() {
+			respondError(c, http.StatusServiceUnavailable, constants.VideoCallsDisabled)
+			return
+		}
+		caller, ok := groupMemberOrRespond(c, stores, req.GroupID, callerID)
+		if !ok {
 			return
 		}
 
-		// TODO: Verify user is a member
-		// TODO: Create video room in video-service
-		// TODO: Notify all group members
+		roomID, created, err := video.InitiateGroupVideoCall(ctx, req.GroupID, callerID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, "Failed to start call")
+			return
+		}
+		role := auth.VideoRoleHost
+		if !created {
+			role = groupVideoRole(caller)
+		}
+		join, err := newVideoJoinResponse(video, req.GroupID, roomID, caller, role)
+		if err != nil {
+			logging.FromContext(ctx).Error("Failed to issue video join token", logging.KeyGroupID, req.GroupID, "error", err)
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		// Notify group members about the call
+		if created {
+			NotifyGroupCall(ctx, stores.Groups, req.GroupID, callerID, roomID)
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  "Video call started",
+			Response: join,
+		})
+	}
+}
+
+// GroupVideoCallToken lets a member join the group's running call. Group admins join as
+// moderators, everyone else as participants.
+func GroupVideoCallToken(stores *store.Stores, video *VideoServiceClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID := c.Param("groupID")
+		userID := currentSession(c).UserID
 
-		roomID, err := InitiateGroupVideoCall(req.GroupID, req.CallerID)
+		if !video.Enabled() {
+			respondError(c, http.StatusServiceUnavailable, constants.VideoCallsDisabled)
+			return
+		}
+		member, ok := groupMemberOrRespond(c, stores, groupID, userID)
+		if !ok {
+			return
+		}
+
+		join, err := newVideoJoinResponse(video, groupID, groupRoomID(groupID), member, groupVideoRole(member))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, APIResponse{
-				Code:    http.StatusInternalServerError,
-				Message: "Failed to start call",
+			logging.FromContext(c.Request.Context()).Error("Failed to issue video join token", logging.KeyGroupID, groupID, "error", err)
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: join,
+		})
+	}
+}
+
+// groupVideoRole is the role a member joins a call they didn't start with
+func groupVideoRole(member GroupMember) string {
+	if member.Role == "admin" {
+		return auth.VideoRoleModerator
+	}
+	return auth.VideoRoleParticipant
+}
+
+// groupMemberOrRespond returns the membership of userID, or answers 404/403 and returns false
+func groupMemberOrRespond(c *gin.Context, stores *store.Stores, groupID, userID string) (GroupMember, bool) {
+	group, err := GetGroupByID(c.Request.Context(), stores.Groups, groupID)
+	if err != nil {
+		respondError(c, http.StatusNotFound, constants.GroupNotFound)
+		return GroupMember{}, false
+	}
+	for _, member := range group.Members {
+		if member.UserID == userID {
+			return member, true
+		}
+	}
+	respondError(c, http.StatusForbidden, constants.YouAreNotAGroupMember)
+	return GroupMember{}, false
+}
+
+func newVideoJoinResponse(video *VideoServiceClient, groupID, roomID string, member GroupMember, role string) (VideoJoinResponse, error) {
+	token, expiresAt, err := video.JoinToken(roomID, member.UserID, member.Username, role)
+	if err != nil {
+		return VideoJoinResponse{}, err
+	}
+	return VideoJoinResponse{
+		RoomID:    roomID,
+		GroupID:   groupID,
+		Role:      role,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// maxCallbackBody bounds what the video service may post, a recording lists a few files
+const maxCallbackBody = 1 << 20
+
+// groupRecordingsLimit is how many recordings a group lists, newest first
+const groupRecordingsLimit = 50
+
+// RegisterVideoRecording stores a finished recording of a group call. Only the video service
+// calls it, it signs the body with the shared join secret. Repeated deliveries are accepted.
+func RegisterVideoRecording(stores *store.Stores, video *VideoServiceClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxCallbackBody))
+		if err != nil {
+			respondError(c, http.StatusRequestEntityTooLarge, "Invalid request")
+			return
+		}
+		if !video.VerifyCallback(body, c.GetHeader(auth.VideoSignatureHeader)) {
+			logging.FromContext(ctx).Warn("Rejected unsigned video service callback", "client_ip", c.ClientIP())
+			respondError(c, http.StatusUnauthorized, constants.InvalidVideoSignature)
+			return
+		}
+
+		var req VideoRecordingRequest
+		if err := binding.JSON.BindBody(body, &req); err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid request")
+			return
+		}
+		if _, err := GetGroupByID(ctx, stores.Groups, req.GroupID); err != nil {
+			respondError(c, http.StatusNotFound, constants.GroupNotFound)
+			return
+		}
+
+		recording := models.GroupRecording{
+			ID:        req.RecordingID,
+			GroupID:   req.GroupID,
+			RoomID:    req.RoomID,
+			StartedBy: req.StartedBy,
+			StartedAt: req.StartedAt,
+			StoppedAt: req.StoppedAt,
+			Files:     make([]models.RecordingFile, 0, len(req.Files)),
+		}
+		for _, file := range req.Files {
+			recording.Files = append(recording.Files, models.RecordingFile{
+				Name:     file.Name,
+				UserID:   file.UserID,
+				Kind:     file.Kind,
+				MimeType: file.MimeType,
+				Size:     file.Size,
 			})
+		}
+
+		err = stores.Groups.SaveRecording(ctx, recording)
+		if err != nil && !errors.Is(err, store.ErrAlreadyExists) {
+			logging.FromContext(ctx).Error("Failed to save recording", logging.KeyGroupID, req.GroupID, "recording_id", req.RecordingID, "error", err)
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
 			return
 		}
+		logging.FromContext(ctx).Info("Recording registered", logging.KeyGroupID, req.GroupID, "recording_id", req.RecordingID, "files", len(recording.Files))
 
-		// Notify group members about the call
-		NotifyGroupCall(req.GroupID, req.CallerID, roomID)
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.RecordingRegistered,
+			Response: map[string]string{"recordingId": req.RecordingID},
+		})
+	}
+}
+
+// GetGroupRecordings lists the recorded calls of a group to its members
+func GetGroupRecordings(stores *store.Stores) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID := c.Param("groupID")
+		if _, ok := groupMemberOrRespond(c, stores, groupID, currentSession(c).UserID); !ok {
+			return
+		}
+
+		recordings, err := stores.Groups.Recordings(c.Request.Context(), groupID, groupRecordingsLimit)
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Error("Failed to fetch recordings", logging.KeyGroupID, groupID, "error", err)
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		if recordings == nil {
+			recordings = []models.GroupRecording{}
+		}
 
 		c.JSON(http.StatusOK, APIResponse{
-			Code:    http.StatusOK,
-			Message: "Video call started",
-			Response: map[string]string{
-				"roomId":  roomID,
-				"groupId": req.GroupID,
-			},
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: recordings,
 		})
 	}
 }
 
-func HandleGroupMessageEvent(client *Client, msg WSMessage) {
+func HandleGroupMessageEvent(ctx context.Context, client *Client, msg WSMessage) {
 	var payloadData map[string]string
 	if err := json.Unmarshal(msg.Payload, &payloadData); err != nil {
 		return
@@ -359,14 +549,14 @@ func HandleGroupMessageEvent(client *Client, msg WSMessage) {
 	}
 
 	// FIX: Use underscore (_) to ignore unused msgID
-	_, _ = StoreGroupMessage(GroupMessageRequest{
+	_, _ = StoreGroupMessage(ctx, client.Lobby.stores.Groups, GroupMessageRequest{
 		GroupID:    groupID,
 		FromUserID: fromUserID,
 		Message:    message,
 		Type:       msgType,
 	})
 
-	group, err := GetGroupByID(groupID)
+	group, err := GetGroupByID(ctx, client.Lobby.stores.Groups, groupID)
 	if err != nil {
 		return
 	}
@@ -374,7 +564,7 @@ func HandleGroupMessageEvent(client *Client, msg WSMessage) {
 	for _, member := range group.Members {
 		// FIX: Use 'member.UserID' to target the specific user
 		responsePayload := createWSMessage("group-message-response", messagePacket, member.UserID)
-		PublishMessage(responsePayload)
+		PublishMessage(ctx, client.Lobby.stores.Redis, responsePayload)
 	}
 }
 
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"chat-app/logging"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// checkDependencies pings Mongo and Redis, the report is healthy only if both answer.
+// The probes are unauthenticated, so failures are logged and only reported as "error".
+func checkDependencies(ctx context.Context, db *mongo.Database, rdb redis.UniversalClient) healthReport {
+	report := healthReport{Status: "ok", Checks: map[string]string{}}
+	logger := logging.FromContext(ctx)
+
+	if db == nil {
+		report.Checks["mongo"] = "not connected"
+	} else if err := db.Client().Ping(ctx, nil); err != nil {
+		logger.Error("Health check failed", "dependency", "mongo", "error", err)
+		report.Checks["mongo"] = "error"
+	} else {
+		report.Checks["mongo"] = "ok"
+	}
+
+	if rdb == nil {
+		report.Checks["redis"] = "not connected"
+	} else if err := rdb.Ping(ctx).Err(); err != nil {
+		logger.Error("Health check failed", "dependency", "redis", "error", err)
+		report.Checks["redis"] = "error"
+	} else {
+		report.Checks["redis"] = "ok"
+	}
+
+	for _, result := range report.Checks {
+		if result != "ok" {
+			report.Status = "unhealthy"
+		}
+	}
+	return report
+}
+
+func writeHealthReport(c *gin.Context, report healthReport) {
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, report)
+}
+
+// HealthCheck reports whether the instance can reach its databases
+// Route: GET /healthz
+func HealthCheck(db *mongo.Database, rdb redis.UniversalClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+		defer cancel()
+
+		writeHealthReport(c, checkDependencies(ctx, db, rdb))
+	}
+}
+
+// ReadinessCheck also fails while the lobby is draining so the load balancer stops routing here
+// Route: GET /readyz
+func ReadinessCheck(db *mongo.Database, rdb redis.UniversalClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+		defer cancel()
+
+		report := checkDependencies(ctx, db, rdb)
+		if MainLobby.IsDraining() {
+			report.Status = "draining"
+			report.Checks["lobby"] = "draining"
+		} else {
+			report.Checks["lobby"] = "ok"
+		}
+		writeHealthReport(c, report)
+	}
+}
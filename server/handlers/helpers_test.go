@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"chat-app/config"
+	"chat-app/mailer"
+	"chat-app/models"
+	"chat-app/store"
+	"chat-app/utils"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testEnv wires handlers to the memory stores and an in-process Redis
+type testEnv struct {
+	redis    *miniredis.Miniredis
+	stores   *store.Stores
+	accounts *Accounts
+	limits   *RateLimits
+	mail     *testMailer
+}
+
+// newTestEnv starts from the default config, configure may adjust it first
+func newTestEnv(t *testing.T, configure func(cfg *config.Config)) *testEnv {
+	t.Helper()
+	cfg := config.Default()
+	if configure != nil {
+		configure(cfg)
+	}
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	mail := &testMailer{}
+	return &testEnv{
+		redis:    mr,
+		stores:   store.NewMemoryStores(rdb),
+		accounts: NewAccounts(cfg.Auth, rdb, mail),
+		limits:   NewRateLimits(cfg.RateLimit, rdb),
+		mail:     mail,
+	}
+}
+
+// createUser stores a user with a hashed password, empty for accounts that only sign in
+// through a provider. adjust may set further fields first.
+func (env *testEnv) createUser(t *testing.T, username, password string, adjust func(user *models.UserDetails)) string {
+	t.Helper()
+	user := models.UserDetails{Username: username, Online: "N"}
+	if password != "" {
+		hash, err := utils.HashPassword(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Password = hash
+	}
+	if adjust != nil {
+		adjust(&user)
+	}
+	userID, err := env.stores.Users.Create(t.Context(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+// testMailer keeps every mail instead of sending it
+type testMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *testMailer) Send(_ context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *testMailer) last(t *testing.T) mailer.Message {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		t.Fatal("no mail was sent")
+	}
+	return m.sent[len(m.sent)-1]
+}
+
+// serve runs one request through handler, body is encoded as JSON unless it is nil.
+// headers are name, value pairs.
+func serve(handler http.Handler, method, target string, body any, headers ...string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeResponse reads the Response field of an APIResponse into v, unless v is nil, and
+// returns its Message. A handler that wrote more than one response fails the test.
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, v any) string {
+	t.Helper()
+	var envelope struct {
+		Message  string          `json:"message"`
+		Response json.RawMessage `json:"response"`
+	}
+	decoder := json.NewDecoder(rec.Body)
+	if err := decoder.Decode(&envelope); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if decoder.More() {
+		t.Fatalf("handler wrote more than one response after %q", envelope.Message)
+	}
+	if v != nil {
+		if err := json.Unmarshal(envelope.Response, v); err != nil {
+			t.Fatalf("decoding response %s: %v", envelope.Response, err)
+		}
+	}
+	return envelope.Message
+}
+
+func bearer(token string) []string {
+	return []string{"Authorization", "Bearer " + token}
+}
@@ -1,25 +1,50 @@
 package handlers
 
+import (
+	"sync"
+	"sync/atomic"
+
+	"chat-app/metrics"
+	"chat-app/store"
+
+	"github.com/redis/go-redis/v9"
+)
+
 type Lobby struct {
-	clients    map[*Client]bool
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan WSMessage // New channel for sending messages
+	mu           sync.RWMutex // guards clients, the Redis subscriber reads it from its own goroutine
+	clients      map[*Client]bool
+	register     chan *Client
+	unregister   chan *Client
+	broadcast    chan WSMessage // New channel for sending messages
+	subscription *redis.PubSub
+	draining     atomic.Bool
+
+	sendBufferSize int           // capacity of every client's outbound queue
+	stores         *store.Stores // used by socket events to look up users and persist messages
+	limits         *RateLimits   // per user budgets for socket events
 }
 
-// Global instance
-var MainLobby = NewLobby()
+// Global instance, created in main from the socket config
+var MainLobby *Lobby
 
-func NewLobby() *Lobby {
+func NewLobby(sendBufferSize int, stores *store.Stores, limits *RateLimits) *Lobby {
 	return &Lobby{
-		clients:    make(map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan WSMessage), // Initialize the channel
+		sendBufferSize: sendBufferSize,
+		stores:         stores,
+		limits:         limits,
+		clients:        make(map[*Client]bool),
+		register:       make(chan *Client),
+		unregister:     make(chan *Client),
+		broadcast:      make(chan WSMessage), // Initialize the channel
 	}
 }
 
 func (lobby *Lobby) Run() {
+	metrics.RegisterSendQueueGauges(
+		func() float64 { return float64(lobby.QueueStats().QueuedTotal) },
+		func() float64 { return float64(lobby.QueueStats().MaxDepth) },
+	)
+
 	// Start the Redis Subscriber in the background
 	go SubscribeToRedis(lobby)
 
@@ -33,17 +58,7 @@ func (lobby *Lobby) Run() {
 
 		case msg := <-lobby.broadcast:
 			// Handle internal broadcasts (from HTTP handlers)
-			// Iterate through clients to find the target UserID
-			for client := range lobby.clients {
-				if client.UserID == msg.TargetID {
-					select {
-					case client.Send <- msg:
-					default:
-						close(client.Send)
-						delete(lobby.clients, client)
-					}
-				}
-			}
+			EmitToClient(lobby, msg, msg.TargetID)
 		}
 	}
 }
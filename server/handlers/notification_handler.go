@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 type NotificationPayload struct {
@@ -14,7 +17,7 @@ type NotificationPayload struct {
 }
 
 // SendNotification creates a notification event and pushes it via Redis
-func SendNotification(toUserID, fromUsername, messageType, alertText string) {
+func SendNotification(ctx context.Context, rdb redis.UniversalClient, toUserID, fromUsername, messageType, alertText string) {
 	
 	notif := NotificationPayload{
 		ID:        time.Now().String(), // In prod use UUID
@@ -38,5 +41,5 @@ func SendNotification(toUserID, fromUsername, messageType, alertText string) {
 	// OR (Better) we add a TargetID to WSMessage.
 	
 	// We'll update WSMessage struct below to support routing.
-	PublishMessage(wsMsg)
+	PublishMessage(ctx, rdb, wsMsg)
 }
\ No newline at end of file
@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"chat-app/auth"
+	"chat-app/config"
+	"chat-app/constants"
+	"chat-app/logging"
+	"chat-app/models"
+	"chat-app/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// errLinkNeedsSignIn means the email of a new identity belongs to an account whose owner never
+// proved it, linking would hand the account to whoever registered the provider identity first
+var errLinkNeedsSignIn = errors.New("matching account has an unverified email")
+
+const (
+	// oidcLoginTTL is how long the client has to trade the code from the callback for a session
+	oidcLoginTTL = time.Minute
+	// oidcReauthTTL is how long a re-authentication code confirms a sensitive change
+	oidcReauthTTL = 5 * time.Minute
+	// oidcBindingCookie ties a sign in to the browser that started it, see auth.NewOIDCAttempt
+	oidcBindingCookie = "oidc_binding"
+)
+
+// oidcLogins holds the configured identity providers and the sign ins in progress
+type oidcLogins struct {
+	providers map[string]*auth.OIDCProvider
+	states    *auth.OIDCStates
+	logins    *auth.OneTimeTokens
+	reauths   *auth.OneTimeTokens
+	clientURL string
+	stateTTL  time.Duration
+}
+
+func newOIDCLogins(cfg config.OIDCConfig, rdb redis.Cmdable) oidcLogins {
+	providers := make(map[string]*auth.OIDCProvider, len(cfg.Providers))
+	for name, provider := range cfg.Providers {
+		providers[name] = auth.NewOIDCProvider(name, provider)
+	}
+	return oidcLogins{
+		providers: providers,
+		states:    auth.NewOIDCStates(rdb, cfg.StateTTL.Std()),
+		logins:    auth.NewOIDCLogins(rdb, oidcLoginTTL),
+		reauths:   auth.NewOIDCReauths(rdb, oidcReauthTTL),
+		clientURL: cfg.ClientURL,
+		stateTTL:  cfg.StateTTL.Std(),
+	}
+}
+
+// OIDCProviders lists the provider names the client can offer as sign in buttons
+func OIDCProviders(accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		names := make([]string, 0, len(accounts.oidc.providers))
+		for name := range accounts.oidc.providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: names,
+		})
+	}
+}
+
+// OIDCLogin sends the browser to the provider's login page
+func OIDCLogin(accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link, ok := beginOIDC(c, accounts, "", "")
+		if !ok {
+			return
+		}
+		c.Redirect(http.StatusFound, link)
+	}
+}
+
+// OIDCLink starts linking a provider to the signed in account. The session lives in a header
+// the browser won't send on a redirect, so the client navigates to the returned URL itself.
+// The request has to be made with credentials so the browser keeps the binding cookie.
+func OIDCLink(accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link, ok := beginOIDC(c, accounts, currentSession(c).UserID, "")
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: gin.H{"url": link},
+		})
+	}
+}
+
+// OIDCReauth starts a fresh login for a signed in user, the callback ends with ?reauth=<code>.
+// Accounts without a password send that code where others confirm with their password.
+func OIDCReauth(accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link, ok := beginOIDC(c, accounts, "", currentSession(c).UserID)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: gin.H{"url": link},
+		})
+	}
+}
+
+func beginOIDC(c *gin.Context, accounts *Accounts, linkUserID, reauthUserID string) (string, bool) {
+	ctx := c.Request.Context()
+
+	provider, ok := accounts.oidc.providers[c.Param("provider")]
+	if !ok {
+		respondError(c, http.StatusNotFound, constants.IdentityProviderNotFound)
+		return "", false
+	}
+
+	attempt, binding, err := auth.NewOIDCAttempt(provider.Name(), linkUserID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+		return "", false
+	}
+	attempt.ReauthUserID = reauthUserID
+	state, err := accounts.oidc.states.Begin(ctx, attempt)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+		return "", false
+	}
+
+	link, err := provider.AuthCodeURL(ctx, attempt, state)
+	if err != nil {
+		logging.FromContext(ctx).Error("Identity provider unavailable", "provider", provider.Name(), "error", err)
+		respondError(c, http.StatusBadGateway, constants.IdentityProviderUnavailable)
+		return "", false
+	}
+	setOIDCBinding(c, accounts, provider, binding)
+	return link, true
+}
+
+// setOIDCBinding hands the browser the cookie the callback checks, scoped to the callback
+// and sent on the provider's top level redirect back. An empty binding removes it.
+func setOIDCBinding(c *gin.Context, accounts *Accounts, provider *auth.OIDCProvider, binding string) {
+	path := "/"
+	if callback, err := url.Parse(provider.RedirectURL()); err == nil && callback.Path != "" {
+		path = callback.Path
+	}
+	maxAge := int(accounts.oidc.stateTTL.Seconds())
+	if binding == "" {
+		maxAge = -1
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcBindingCookie, binding, maxAge, path, "", strings.HasPrefix(provider.RedirectURL(), "https://"), true)
+}
+
+// OIDCCallback is where the provider sends the browser back. It ends on the client page with
+// ?code= to trade for a session, ?challenge= when a second factor is needed, ?linked= after
+// linking, ?reauth= after re-authenticating, or ?error= with a message to show.
+func OIDCCallback(stores *store.Stores, accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		logger := logging.FromContext(ctx)
+
+		provider, ok := accounts.oidc.providers[c.Param("provider")]
+		if !ok {
+			respondError(c, http.StatusNotFound, constants.IdentityProviderNotFound)
+			return
+		}
+
+		// The state is spent even if the user cancelled at the provider
+		attempt, err := accounts.oidc.states.Finish(ctx, c.Query("state"))
+		binding, _ := c.Cookie(oidcBindingCookie)
+		setOIDCBinding(c, accounts, provider, "")
+		if err != nil || attempt.Provider != provider.Name() {
+			redirectToClient(c, accounts, "error", constants.InvalidOIDCState)
+			return
+		}
+		if !attempt.BoundTo(binding) {
+			logger.Warn("OIDC callback in another browser than the one that started it", "provider", provider.Name())
+			redirectToClient(c, accounts, "error", constants.InvalidOIDCState)
+			return
+		}
+		if providerErr := c.Query("error"); providerErr != "" {
+			logger.Info("Identity provider returned an error", "provider", provider.Name(), "error", providerErr)
+			redirectToClient(c, accounts, "error", constants.OIDCLoginFailed)
+			return
+		}
+
+		identity, err := provider.Exchange(ctx, attempt, c.Query("code"))
+		if err != nil {
+			logger.Warn("OIDC sign in failed", "provider", provider.Name(), "error", err)
+			redirectToClient(c, accounts, "error", constants.OIDCLoginFailed)
+			return
+		}
+
+		if attempt.LinkUserID != "" {
+			err := stores.Users.AddIdentity(ctx, attempt.LinkUserID, newIdentity(provider, identity))
+			switch {
+			case errors.Is(err, store.ErrAlreadyExists):
+				redirectToClient(c, accounts, "error", constants.IdentityAlreadyLinked)
+			case err != nil:
+				logger.Error("Failed to link identity", "user_id", attempt.LinkUserID, "provider", provider.Name(), "error", err)
+				redirectToClient(c, accounts, "error", constants.OIDCLoginFailed)
+			default:
+				logger.Info("Identity linked", "user_id", attempt.LinkUserID, "provider", provider.Name())
+				redirectToClient(c, accounts, "linked", provider.Name())
+			}
+			return
+		}
+
+		if attempt.ReauthUserID != "" {
+			// Only an identity already linked to the signed in account confirms it
+			user, err := stores.Users.GetByIdentity(ctx, provider.Name(), identity.Subject)
+			if err != nil || user.ID != attempt.ReauthUserID {
+				logger.Warn("Re-authentication with an identity of another account", "user_id", attempt.ReauthUserID, "provider", provider.Name())
+				redirectToClient(c, accounts, "error", constants.ReauthIdentityMismatch)
+				return
+			}
+			code, err := accounts.oidc.reauths.Issue(ctx, user.ID)
+			if err != nil {
+				redirectToClient(c, accounts, "error", constants.ServerFailedResponse)
+				return
+			}
+			redirectToClient(c, accounts, "reauth", code)
+			return
+		}
+
+		user, err := oidcUser(ctx, stores.Users, provider, identity)
+		if errors.Is(err, errLinkNeedsSignIn) {
+			redirectToClient(c, accounts, "error", constants.SignInToLinkIdentity)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to resolve OIDC user", "provider", provider.Name(), "error", err)
+			redirectToClient(c, accounts, "error", constants.OIDCLoginFailed)
+			return
+		}
+		if user.Disabled {
+			redirectToClient(c, accounts, "error", constants.AccountIsDisabled)
+			return
+		}
+
+		// Accounts with two-factor authentication finish through LoginTwoFactor like a password login
+		if twoFactorEnabled(user) {
+			challenge, err := accounts.challenges.Issue(ctx, user.ID)
+			if err != nil {
+				redirectToClient(c, accounts, "error", constants.ServerFailedResponse)
+				return
+			}
+			redirectToClient(c, accounts, "challenge", challenge)
+			return
+		}
+
+		code, err := accounts.oidc.logins.Issue(ctx, user.ID)
+		if err != nil {
+			redirectToClient(c, accounts, "error", constants.ServerFailedResponse)
+			return
+		}
+		redirectToClient(c, accounts, "code", code)
+	}
+}
+
+// OIDCSession trades the code from the callback redirect for a session token
+func OIDCSession(stores *store.Stores, accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var request OIDCSessionRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.InvalidOIDCCode)
+			return
+		}
+
+		userID, err := accounts.oidc.logins.Consume(ctx, request.Code)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, constants.InvalidOIDCCode)
+			return
+		}
+		user, err := stores.Users.GetByID(ctx, userID)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, constants.InvalidOIDCCode)
+			return
+		}
+
+		if err := stores.Users.SetOnline(ctx, user.ID, "Y"); err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		token, err := accounts.sessions.Create(ctx, user.ID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:    http.StatusOK,
+			Status:  http.StatusText(http.StatusOK),
+			Message: constants.UserLoginCompleted,
+			Response: UserResponse{
+				Username: user.Username,
+				UserID:   user.ID,
+				Token:    token,
+			},
+		})
+	}
+}
+
+// OIDCUnlink removes a linked provider, unless it is the only way left to sign in
+func OIDCUnlink(stores *store.Stores) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		provider := c.Param("provider")
+
+		user, err := stores.Users.GetByID(ctx, currentSession(c).UserID)
+		if err != nil {
+			respondError(c, http.StatusNotFound, constants.UserIsNotRegisteredWithUs)
+			return
+		}
+		if user.Password == "" && len(user.Identities) == 1 && user.Identities[0].Provider == provider {
+			respondError(c, http.StatusConflict, constants.CantUnlinkLastLogin)
+			return
+		}
+
+		err = stores.Users.RemoveIdentity(ctx, user.ID, provider)
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(c, http.StatusNotFound, constants.IdentityNotLinked)
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		logging.FromContext(ctx).Info("Identity unlinked", "user_id", user.ID, "provider", provider)
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.IdentityUnlinked,
+			Response: nil,
+		})
+	}
+}
+
+// oidcUser finds the account of a provider identity. Unknown identities are linked to the
+// account with the same email when the provider allows it and both sides verified the address,
+// otherwise they get a new account without a password. An unverified local match has to be
+// linked by its owner after signing in, see errLinkNeedsSignIn.
+func oidcUser(ctx context.Context, users store.UserStore, provider *auth.OIDCProvider, identity auth.OIDCIdentity) (UserDetails, error) {
+	logger := logging.FromContext(ctx)
+
+	user, err := users.GetByIdentity(ctx, provider.Name(), identity.Subject)
+	if !errors.Is(err, store.ErrNotFound) {
+		return user, err
+	}
+	link := newIdentity(provider, identity)
+
+	if provider.LinkByEmail() && identity.EmailVerified && identity.Email != "" {
+		matches, err := users.FindByEmail(ctx, identity.Email)
+		if err != nil {
+			return UserDetails{}, err
+		}
+		switch len(matches) {
+		case 0:
+		case 1:
+			if !matches[0].EmailVerified {
+				logger.Info("Email matches an account with an unverified email, not linking", "user_id", matches[0].ID, "provider", provider.Name())
+				return UserDetails{}, errLinkNeedsSignIn
+			}
+			err := users.AddIdentity(ctx, matches[0].ID, link)
+			if err == nil {
+				logger.Info("Identity linked by email", "user_id", matches[0].ID, "provider", provider.Name())
+				return users.GetByID(ctx, matches[0].ID)
+			}
+			if !errors.Is(err, store.ErrAlreadyExists) {
+				return UserDetails{}, err
+			}
+			// The account is linked to another subject of this provider, don't take it over
+			logger.Warn("Email matches an account linked to another identity", "user_id", matches[0].ID, "provider", provider.Name())
+		default:
+			logger.Warn("Email matches several accounts, not linking", "provider", provider.Name(), "matches", len(matches))
+		}
+	}
+
+	account := UserDetails{Online: "N", Identities: []models.Identity{link}}
+	if identity.EmailVerified {
+		account.Email = identity.Email
+		account.EmailVerified = identity.Email != ""
+	}
+	base := oidcUsername(identity)
+	for attempt := 1; attempt <= 10; attempt++ {
+		account.Username = base
+		if attempt > 1 {
+			account.Username = fmt.Sprintf("%s%d", base, attempt)
+		}
+
+		userID, err := users.Create(ctx, account)
+		if errors.Is(err, store.ErrAlreadyExists) {
+			// A parallel callback may have created the account for this identity already
+			if existing, getErr := users.GetByIdentity(ctx, provider.Name(), identity.Subject); getErr == nil {
+				return existing, nil
+			}
+			continue
+		}
+		if err != nil {
+			return UserDetails{}, err
+		}
+		logger.Info("Account created from identity provider", "user_id", userID, "provider", provider.Name())
+		return users.GetByID(ctx, userID)
+	}
+	return UserDetails{}, fmt.Errorf("no free username based on %q", base)
+}
+
+func newIdentity(provider *auth.OIDCProvider, identity auth.OIDCIdentity) models.Identity {
+	return models.Identity{
+		Provider: provider.Name(),
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		LinkedAt: time.Now().UTC(),
+	}
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// oidcUsername picks a username from the claims, numbers are appended if it is taken
+func oidcUsername(identity auth.OIDCIdentity) string {
+	candidates := []string{identity.PreferredUsername}
+	if at := strings.LastIndex(identity.Email, "@"); at > 0 {
+		candidates = append(candidates, identity.Email[:at])
+	}
+	candidates = append(candidates, identity.Name)
+	for _, candidate := range candidates {
+		name := usernameUnsafe.ReplaceAllString(candidate, "")
+		if len(name) > 24 {
+			name = name[:24]
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return "user"
+}
+
+func redirectToClient(c *gin.Context, accounts *Accounts, key, value string) {
+	target, err := url.Parse(accounts.oidc.clientURL)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+		return
+	}
+	query := target.Query()
+	query.Set(key, value)
+	target.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, target.String())
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-app/auth"
+	"chat-app/config"
+	"chat-app/constants"
+	"chat-app/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testRedirectURL = "http://chat.test/api/auth/oidc/test/callback"
+
+// fakeProvider is an OIDC provider that approves every sign in with the claims the test picks
+type fakeProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]fakeGrant // by authorization code
+}
+
+type fakeGrant struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{key: key, grants: map[string]fakeGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// authorize plays the user signing in at link, it returns the callback URL the browser is sent to
+func (p *fakeProvider) authorize(t *testing.T, link string, claims map[string]any) string {
+	t.Helper()
+	target, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := target.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization request without PKCE: %s", link)
+	}
+
+	claims["nonce"] = query.Get("nonce")
+	claims["aud"] = query.Get("client_id")
+	code := rand.Text()
+	p.mu.Lock()
+	p.grants[code] = fakeGrant{challenge: query.Get("code_challenge"), claims: claims}
+	p.mu.Unlock()
+
+	callback, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	return callback.RequestURI()
+}
+
+func (p *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	grant, ok := p.grants[r.FormValue("code")]
+	delete(p.grants, r.FormValue("code"))
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	grant.claims["iss"] = p.server.URL
+	grant.claims["iat"] = now.Unix()
+	grant.claims["exp"] = now.Add(time.Minute).Unix()
+	idToken, err := p.sign(grant.claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": rand.Text(),
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func (p *fakeProvider) sign(claims map[string]any) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// newOIDCTestEnv configures the fake provider as "test" and mounts the OIDC routes like server.go
+func newOIDCTestEnv(t *testing.T, linkByEmail bool) (*testEnv, *fakeProvider, *gin.Engine) {
+	t.Helper()
+	provider := newFakeProvider(t)
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Auth.OIDC.Providers = map[string]auth.OIDCProviderConfig{"test": {
+			Issuer:      provider.server.URL,
+			ClientID:    "chat",
+			RedirectURL: testRedirectURL,
+			Scopes:      []string{"email", "profile"},
+			LinkByEmail: linkByEmail,
+		}}
+	})
+
+	router := gin.New()
+	oidc := router.Group("/api/auth/oidc")
+	oidc.POST("/session", OIDCSession(env.stores, env.accounts))
+	oidc.GET("/:provider/login", OIDCLogin(env.accounts))
+	oidc.GET("/:provider/callback", OIDCCallback(env.stores, env.accounts))
+	oidc.POST("/:provider/link", RequireSession(env.accounts), OIDCLink(env.accounts))
+	return env, provider, router
+}
+
+// bindingCookie returns the cookie beginOIDC handed the browser
+func bindingCookie(t *testing.T, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == oidcBindingCookie && cookie.Value != "" {
+			if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/api/auth/oidc/test/callback" {
+				t.Fatalf("binding cookie %+v is not HttpOnly, SameSite=Lax and scoped to the callback", cookie)
+			}
+			return cookie
+		}
+	}
+	t.Fatalf("no %s cookie in %v", oidcBindingCookie, rec.Header().Values("Set-Cookie"))
+	return nil
+}
+
+// clientRedirect returns the query the callback sent the browser back to the client with
+func clientRedirect(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+	t.Helper()
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback answered %d: %s", rec.Code, rec.Body.String())
+	}
+	target, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target.Query()
+}
+
+// signIn runs /login, the provider and the callback, then trades the code for a session
+func signIn(t *testing.T, provider *fakeProvider, router *gin.Engine, claims map[string]any) UserResponse {
+	t.Helper()
+	login := serve(router, http.MethodGet, "/api/auth/oidc/test/login", nil)
+	if login.Code != http.StatusFound {
+		t.Fatalf("login answered %d: %s", login.Code, login.Body.String())
+	}
+	cookie := bindingCookie(t, login)
+
+	callback := provider.authorize(t, login.Header().Get("Location"), claims)
+	redirect := clientRedirect(t, serve(router, http.MethodGet, callback, nil, "Cookie", cookie.String()))
+	if redirect.Get("code") == "" {
+		t.Fatalf("callback redirected without a code: %v", redirect)
+	}
+
+	session := serve(router, http.MethodPost, "/api/auth/oidc/session", OIDCSessionRequest{Code: redirect.Get("code")})
+	if session.Code != http.StatusOK {
+		t.Fatalf("session answered %d: %s", session.Code, session.Body.String())
+	}
+	var user UserResponse
+	decodeResponse(t, session, &user)
+	if user.Token == "" {
+		t.Fatal("session response has no token")
+	}
+	return user
+}
+
+func TestOIDCLinkByEmail(t *testing.T) {
+	env, provider, router := newOIDCTestEnv(t, true)
+	ctx := t.Context()
+
+	userID, err := env.stores.Users.Create(ctx, models.UserDetails{
+		Username:      "ada",
+		Password:      "hash",
+		Online:        "N",
+		Email:         "ada@example.com",
+		EmailVerified: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := signIn(t, provider, router, map[string]any{
+		"sub":            "ada-at-provider",
+		"email":          "ada@example.com",
+		"email_verified": true,
+	})
+	if user.UserID != userID {
+		t.Fatalf("signed in as %q, want the account with the same email %q", user.UserID, userID)
+	}
+	linked, err := env.stores.Users.GetByIdentity(ctx, "test", "ada-at-provider")
+	if err != nil || linked.ID != userID {
+		t.Fatalf("identity linked to %q (%v), want %q", linked.ID, err, userID)
+	}
+}
+
+func TestOIDCExplicitLink(t *testing.T) {
+	env, provider, router := newOIDCTestEnv(t, false)
+	ctx := t.Context()
+
+	userID, err := env.stores.Users.Create(ctx, models.UserDetails{Username: "grace", Password: "hash", Online: "N"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := env.accounts.sessions.Create(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	begin := serve(router, http.MethodPost, "/api/auth/oidc/test/link", nil, bearer(token)...)
+	if begin.Code != http.StatusOK {
+		t.Fatalf("link answered %d: %s", begin.Code, begin.Body.String())
+	}
+	var link struct {
+		URL string `json:"url"`
+	}
+	decodeResponse(t, begin, &link)
+	cookie := bindingCookie(t, begin)
+
+	claims := map[string]any{"sub": "grace-at-provider", "email": "grace@example.com", "email_verified": true}
+	callback := provider.authorize(t, link.URL, claims)
+	redirect := clientRedirect(t, serve(router, http.MethodGet, callback, nil, "Cookie", cookie.String()))
+	if redirect.Get("linked") != "test" {
+		t.Fatalf("callback redirected with %v, want linked=test", redirect)
+	}
+
+	// The linked identity now signs into the same account
+	user := signIn(t, provider, router, map[string]any{"sub": "grace-at-provider"})
+	if user.UserID != userID {
+		t.Fatalf("signed in as %q, want the linked account %q", user.UserID, userID)
+	}
+}
+
+func TestOIDCCallbackNeedsBindingCookie(t *testing.T) {
+	_, provider, router := newOIDCTestEnv(t, false)
+
+	other := serve(router, http.MethodGet, "/api/auth/oidc/test/login", nil)
+	otherCookie := bindingCookie(t, other)
+
+	tests := []struct {
+		name    string
+		headers []string
+	}{
+		{name: "no cookie"},
+		{name: "cookie of another attempt", headers: []string{"Cookie", otherCookie.String()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login := serve(router, http.MethodGet, "/api/auth/oidc/test/login", nil)
+			callback := provider.authorize(t, login.Header().Get("Location"), map[string]any{"sub": "mallory"})
+
+			redirect := clientRedirect(t, serve(router, http.MethodGet, callback, nil, tt.headers...))
+			if redirect.Get("error") != constants.InvalidOIDCState {
+				t.Fatalf("callback redirected with %v, want error=%q", redirect, constants.InvalidOIDCState)
+			}
+		})
+	}
+}
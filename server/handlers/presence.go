@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// presenceTTL bounds how long the sockets of a crashed instance keep their users online
+const presenceTTL = 24 * time.Hour
+
+// presenceKey holds the IDs of the sockets a user has open, on every instance
+func presenceKey(userID string) string {
+	return "presence:" + userID
+}
+
+// addPresence records an open socket of the user
+func addPresence(ctx context.Context, rdb redis.UniversalClient, userID, connID string) error {
+	pipe := rdb.TxPipeline()
+	pipe.SAdd(ctx, presenceKey(userID), connID)
+	pipe.Expire(ctx, presenceKey(userID), presenceTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// removePresence forgets a closed socket and returns how many the user still has open
+func removePresence(ctx context.Context, rdb redis.UniversalClient, userID, connID string) (int64, error) {
+	pipe := rdb.TxPipeline()
+	pipe.SRem(ctx, presenceKey(userID), connID)
+	open := pipe.SCard(ctx, presenceKey(userID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return open.Val(), nil
+}
+
+// openSockets returns how many sockets the user has open
+func openSockets(ctx context.Context, rdb redis.UniversalClient, userID string) (int64, error) {
+	return rdb.SCard(ctx, presenceKey(userID)).Result()
+}
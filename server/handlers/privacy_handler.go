@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"chat-app/config"
+	"chat-app/constants"
+	"chat-app/logging"
+	"chat-app/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// ---------------- EXPORT ----------------
+
+type ExportProfile struct {
+	UserID    string    `json:"userID"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ExportFriend struct {
+	UserID    string    `json:"userID"`
+	Username  string    `json:"username,omitempty"`
+	Status    string    `json:"status"`    // "pending", "accepted"
+	Direction string    `json:"direction"` // "outgoing" if the user sent the request
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ExportGroup struct {
+	GroupID  string    `json:"groupID"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	Owner    bool      `json:"owner"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// AccountExport is everything stored about one user
+type AccountExport struct {
+	ExportedAt     time.Time      `json:"exportedAt"`
+	Profile        ExportProfile  `json:"profile"`
+	Friends        []ExportFriend `json:"friends"`
+	Groups         []ExportGroup  `json:"groups"`
+	DirectMessages []Message      `json:"directMessages"`
+	GroupMessages  []GroupMessage `json:"groupMessages"`
+}
+
+// ExportAccount returns the data of the signed in user, ?format=zip for an archive with one file per section
+func ExportAccount(stores *store.Stores) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && format != "zip" {
+			respondError(c, http.StatusBadRequest, constants.ExportFormatNotSupported)
+			return
+		}
+
+		export, err := buildAccountExport(c.Request.Context(), stores, currentSession(c).UserID)
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Error("Account export failed", "error", err)
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		filename := fmt.Sprintf("gopherchat-%s-%s", export.Profile.Username, export.ExportedAt.Format("20060102"))
+		if format == "json" {
+			c.Header("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+			c.JSON(http.StatusOK, export)
+			return
+		}
+
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+		c.Header("Content-Type", "application/zip")
+		c.Status(http.StatusOK)
+		if err := writeExportZip(c.Writer, export); err != nil {
+			// Headers are gone already, all we can do is log and cut the archive short
+			logging.FromContext(c.Request.Context()).Error("Writing export archive failed", "error", err)
+		}
+	}
+}
+
+func buildAccountExport(ctx context.Context, stores *store.Stores, userID string) (AccountExport, error) {
+	user, err := stores.Users.GetByID(ctx, userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+
+	export := AccountExport{
+		ExportedAt: time.Now().UTC(),
+		Profile: ExportProfile{
+			UserID:    user.ID,
+			Username:  user.Username,
+			Email:     user.Email,
+			CreatedAt: user.CreatedAt,
+		},
+		Friends:        []ExportFriend{},
+		Groups:         []ExportGroup{},
+		DirectMessages: []Message{},
+		GroupMessages:  []GroupMessage{},
+	}
+
+	friendships, err := stores.Friendships.ForUser(ctx, userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	for _, f := range friendships {
+		friend := ExportFriend{Status: f.Status, Direction: "outgoing", UserID: f.AddresseeID, CreatedAt: f.CreatedAt}
+		if f.AddresseeID == userID {
+			friend.Direction = "incoming"
+			friend.UserID = f.RequesterID
+		}
+		if details, err := stores.Users.GetByID(ctx, friend.UserID); err == nil {
+			friend.Username = details.Username
+		}
+		export.Friends = append(export.Friends, friend)
+	}
+
+	groups, err := stores.Groups.ListByMember(ctx, userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	for _, g := range groups {
+		for _, m := range g.Members {
+			if m.UserID == userID {
+				export.Groups = append(export.Groups, ExportGroup{
+					GroupID:  g.ID,
+					Name:     g.Name,
+					Role:     m.Role,
+					Owner:    g.CreatorID == userID,
+					JoinedAt: m.JoinedAt,
+				})
+			}
+		}
+	}
+
+	if export.DirectMessages, err = stores.Messages.ForUser(ctx, userID); err != nil {
+		return AccountExport{}, err
+	}
+	if export.GroupMessages, err = stores.Groups.MessagesByUser(ctx, userID); err != nil {
+		return AccountExport{}, err
+	}
+	return export, nil
+}
+
+func writeExportZip(w http.ResponseWriter, export AccountExport) error {
+	archive := zip.NewWriter(w)
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"friends.json", export.Friends},
+		{"groups.json", export.Groups},
+		{"direct_messages.json", export.DirectMessages},
+		{"group_messages.json", export.GroupMessages},
+	}
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// ---------------- DELETION ----------------
+
+// DeleteAccount removes the signed in user after checking their password, or a fresh OIDC login, again.
+// Messages are anonymized or deleted according to the privacy config.
+func DeleteAccount(stores *store.Stores, accounts *Accounts, privacy config.PrivacyConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		logger := logging.FromContext(ctx)
+		session := currentSession(c)
+
+		var request DeleteAccountRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.PasswordCantBeEmpty)
+			return
+		}
+
+		user, err := stores.Users.GetByID(ctx, session.UserID)
+		if err != nil {
+			respondError(c, http.StatusNotFound, constants.UserIsNotRegisteredWithUs)
+			return
+		}
+		if !confirmIdentity(c, accounts, user, request.Password, request.Reauth) {
+			return
+		}
+
+		// Each step is idempotent, a failed deletion can simply be retried
+		if err := deleteAccountData(ctx, stores, user.ID, privacy.DeletedMessages); err != nil {
+			logger.Error("Account deletion failed", "user_id", user.ID, "error", err)
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		purgeAccountRedis(ctx, stores.Redis, accounts, user.ID)
+
+		if err := stores.Users.Delete(ctx, user.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			logger.Error("Deleting user document failed", "user_id", user.ID, "error", err)
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		// Let the user's other tabs log out and everyone else drop them from their lists
+		PublishMessage(ctx, stores.Redis, createWSMessage("account-deleted", nil, user.ID))
+		PublishMessage(ctx, stores.Redis, createWSMessage("user_status", gin.H{"userID": user.ID, "username": user.Username, "status": "N"}, ""))
+
+		logger.Info("Account deleted", "user_id", user.ID, "messages", privacy.DeletedMessages)
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.AccountDeleted,
+			Response: nil,
+		})
+	}
+}
+
+// deleteAccountData hands over or leaves the user's groups, then removes friendships and messages
+func deleteAccountData(ctx context.Context, stores *store.Stores, userID, messagePolicy string) error {
+	groups, err := stores.Groups.ListByMember(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if err := leaveGroup(ctx, stores.Groups, group, userID); err != nil {
+			return fmt.Errorf("leaving group %s: %w", group.ID, err)
+		}
+	}
+
+	if _, err := stores.Friendships.DeleteForUser(ctx, userID); err != nil {
+		return err
+	}
+
+	if messagePolicy == "delete" {
+		if _, err := stores.Messages.DeleteForUser(ctx, userID); err != nil {
+			return err
+		}
+		_, err = stores.Groups.DeleteMessagesByUser(ctx, userID)
+		return err
+	}
+
+	if _, err := stores.Messages.AnonymizeUser(ctx, userID, constants.DeletedUserID); err != nil {
+		return err
+	}
+	_, err = stores.Groups.AnonymizeMessagesByUser(ctx, userID, constants.DeletedUserID)
+	return err
+}
+
+// leaveGroup removes the user from a group. Owners hand the group to the longest serving admin,
+// or the longest serving member, and a group left without members is deleted.
+func leaveGroup(ctx context.Context, groups store.GroupStore, group GroupDetails, userID string) error {
+	if group.CreatorID == userID {
+		successor := groupSuccessor(group, userID)
+		if successor == "" {
+			err := groups.Delete(ctx, group.ID)
+			if errors.Is(err, store.ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		if err := groups.TransferOwnership(ctx, group.ID, successor); err != nil {
+			return err
+		}
+	}
+
+	err := groups.RemoveMember(ctx, group.ID, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func groupSuccessor(group GroupDetails, leavingID string) string {
+	var candidates []GroupMember
+	for _, m := range group.Members {
+		if m.UserID != leavingID {
+			candidates = append(candidates, m)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if (candidates[i].Role == "admin") != (candidates[j].Role == "admin") {
+			return candidates[i].Role == "admin"
+		}
+		return candidates[i].JoinedAt.Before(candidates[j].JoinedAt)
+	})
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0].UserID
+}
+
+// purgeAccountRedis drops sessions, the offline inbox, socket presence and the user's global chat lines.
+// Rate limit buckets are keyed by user ID too but expire within minutes on their own.
+func purgeAccountRedis(ctx context.Context, rdb redis.UniversalClient, accounts *Accounts, userID string) {
+	logger := logging.FromContext(ctx)
+
+	if _, err := accounts.sessions.RevokeAll(ctx, userID, ""); err != nil {
+		logger.Error("Revoking sessions of deleted account failed", "user_id", userID, "error", err)
+	}
+	if err := rdb.Del(ctx, offlineInboxKey(userID), presenceKey(userID)).Err(); err != nil {
+		logger.Error("Purging offline inbox failed", "user_id", userID, "error", err)
+	}
+
+	history, err := rdb.LRange(ctx, "global_chat_history", 0, -1).Result()
+	if err != nil {
+		logger.Error("Reading global chat history failed", "error", err)
+		return
+	}
+	for _, raw := range history {
+		var msg MessagePayload
+		if json.Unmarshal([]byte(raw), &msg) == nil && msg.FromUserID == userID {
+			rdb.LRem(ctx, "global_chat_history", 0, raw)
+		}
+	}
+}
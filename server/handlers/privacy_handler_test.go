@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-app/config"
+	"chat-app/constants"
+	"chat-app/models"
+	"chat-app/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newPrivacyRouter mounts export and deletion like server.go
+func newPrivacyRouter(env *testEnv, privacy config.PrivacyConfig) *gin.Engine {
+	router := gin.New()
+	router.POST("/api/auth/login", Login(env.stores, env.accounts, env.limits))
+	user := router.Group("/api/user")
+	user.DELETE("", RequireSession(env.accounts), DeleteAccount(env.stores, env.accounts, privacy))
+	user.GET("/export", RequireSession(env.accounts), ExportAccount(env.stores))
+	return router
+}
+
+// accountFixture is a user with a friend, direct and group messages, an owned group and a joined one
+type accountFixture struct {
+	adaID, graceID, bobID string
+	ownedGroup            string // ada created it, grace is an admin and bob a member
+	soloGroup             string // only ada is in it
+	joinedGroup           string // grace created it, ada joined
+}
+
+func seedAccount(t *testing.T, env *testEnv) accountFixture {
+	t.Helper()
+	ctx := t.Context()
+	f := accountFixture{
+		adaID:   env.createUser(t, "ada", "correct horse", func(user *models.UserDetails) { user.Email = "ada@example.com" }),
+		graceID: env.createUser(t, "grace", "correct horse", nil),
+		bobID:   env.createUser(t, "bob", "correct horse", nil),
+	}
+
+	if err := env.stores.Friendships.Request(ctx, f.adaID, f.graceID); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.stores.Friendships.Accept(ctx, f.adaID, f.graceID); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.stores.Friendships.Request(ctx, f.bobID, f.adaID); err != nil {
+		t.Fatal(err)
+	}
+
+	joined := time.Now().Add(-time.Hour)
+	groups := []struct {
+		id      *string
+		creator string
+		members []models.GroupMember
+	}{
+		{id: &f.ownedGroup, creator: f.adaID, members: []models.GroupMember{
+			{UserID: f.adaID, Role: "admin", JoinedAt: joined},
+			{UserID: f.bobID, Role: "member", JoinedAt: joined.Add(time.Minute)},
+			{UserID: f.graceID, Role: "admin", JoinedAt: joined.Add(2 * time.Minute)},
+		}},
+		{id: &f.soloGroup, creator: f.adaID, members: []models.GroupMember{
+			{UserID: f.adaID, Role: "admin", JoinedAt: joined},
+		}},
+		{id: &f.joinedGroup, creator: f.graceID, members: []models.GroupMember{
+			{UserID: f.graceID, Role: "admin", JoinedAt: joined},
+			{UserID: f.adaID, Role: "member", JoinedAt: joined.Add(time.Minute)},
+		}},
+	}
+	for _, g := range groups {
+		id, err := env.stores.Groups.Create(ctx, models.GroupDetails{Name: "group", CreatorID: g.creator, Members: g.members})
+		if err != nil {
+			t.Fatal(err)
+		}
+		*g.id = id
+	}
+
+	for _, msg := range []models.Message{
+		{FromUserID: f.adaID, ToUserID: f.graceID, Message: "hi grace"},
+		{FromUserID: f.graceID, ToUserID: f.adaID, Message: "hi ada"},
+		{FromUserID: f.graceID, ToUserID: f.bobID, Message: "ada is not in this one"},
+	} {
+		if _, err := env.stores.Messages.Save(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range []models.GroupMessage{
+		{GroupID: f.ownedGroup, FromUserID: f.adaID, Message: "welcome"},
+		{GroupID: f.joinedGroup, FromUserID: f.adaID, Message: "thanks"},
+		{GroupID: f.joinedGroup, FromUserID: f.graceID, Message: "you're welcome"},
+	} {
+		if _, err := env.stores.Groups.SaveMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+func TestExportAccount(t *testing.T) {
+	env := newTestEnv(t, nil)
+	router := newPrivacyRouter(env, config.PrivacyConfig{})
+	f := seedAccount(t, env)
+	token := mustLogin(t, router, "ada", "correct horse")
+
+	rec := serve(router, http.MethodGet, "/api/user/export", nil, bearer(token)...)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Content-Disposition"), ".json") {
+		t.Fatalf("json export answered %d with %q", rec.Code, rec.Header().Get("Content-Disposition"))
+	}
+	var export AccountExport
+	if err := json.Unmarshal(rec.Body.Bytes(), &export); err != nil {
+		t.Fatal(err)
+	}
+
+	if export.Profile.UserID != f.adaID || export.Profile.Email != "ada@example.com" {
+		t.Errorf("profile %+v", export.Profile)
+	}
+	friends := make(map[string]string)
+	for _, friend := range export.Friends {
+		friends[friend.Username] = friend.Status + " " + friend.Direction
+	}
+	if friends["grace"] != "accepted outgoing" || friends["bob"] != "pending incoming" || len(friends) != 2 {
+		t.Errorf("friends %v", friends)
+	}
+	owned := make(map[string]bool)
+	for _, group := range export.Groups {
+		owned[group.GroupID] = group.Owner
+	}
+	if !owned[f.ownedGroup] || !owned[f.soloGroup] || owned[f.joinedGroup] || len(owned) != 3 {
+		t.Errorf("groups %+v", export.Groups)
+	}
+	if len(export.DirectMessages) != 2 || len(export.GroupMessages) != 2 {
+		t.Errorf("exported %d direct and %d group messages, want 2 and 2", len(export.DirectMessages), len(export.GroupMessages))
+	}
+
+	rec = serve(router, http.MethodGet, "/api/user/export?format=zip", nil, bearer(token)...)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("zip export answered %d with %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "direct_messages.json friends.json group_messages.json groups.json profile.json" {
+		t.Errorf("archive holds %s", got)
+	}
+
+	rec = serve(router, http.MethodGet, "/api/user/export?format=csv", nil, bearer(token)...)
+	if message := decodeResponse(t, rec, nil); rec.Code != http.StatusBadRequest || message != constants.ExportFormatNotSupported {
+		t.Fatalf("csv export answered %d %q", rec.Code, message)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		password    string
+		wantStatus  int
+		wantMessage string
+	}{
+		{name: "anonymize", policy: "anonymize", password: "correct horse", wantStatus: http.StatusOK, wantMessage: constants.AccountDeleted},
+		{name: "delete", policy: "delete", password: "correct horse", wantStatus: http.StatusOK, wantMessage: constants.AccountDeleted},
+		{name: "wrong password", policy: "delete", password: "battery staple", wantStatus: http.StatusForbidden, wantMessage: constants.PasswordIsIncorrect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, nil)
+			router := newPrivacyRouter(env, config.PrivacyConfig{DeletedMessages: tt.policy})
+			ctx := t.Context()
+			f := seedAccount(t, env)
+			token := mustLogin(t, router, "ada", "correct horse")
+			otherDevice := mustLogin(t, router, "ada", "correct horse")
+			env.stores.Redis.RPush(ctx, offlineInboxKey(f.adaID), "parked")
+
+			rec := serve(router, http.MethodDelete, "/api/user", DeleteAccountRequest{Password: tt.password}, bearer(token)...)
+			if message := decodeResponse(t, rec, nil); rec.Code != tt.wantStatus || message != tt.wantMessage {
+				t.Fatalf("answered %d %q, want %d %q", rec.Code, message, tt.wantStatus, tt.wantMessage)
+			}
+
+			_, err := env.stores.Users.GetByID(ctx, f.adaID)
+			if deleted := errors.Is(err, store.ErrNotFound); deleted != (tt.wantStatus == http.StatusOK) {
+				t.Fatalf("user deleted: %v, lookup error %v", deleted, err)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if _, err := env.accounts.sessions.Get(ctx, otherDevice); err != nil {
+					t.Fatalf("a refused deletion revoked sessions: %v", err)
+				}
+				return
+			}
+
+			if _, err := env.accounts.sessions.Get(ctx, otherDevice); err == nil {
+				t.Error("sessions survived the deletion")
+			}
+			if env.redis.Exists(offlineInboxKey(f.adaID)) {
+				t.Error("offline inbox survived the deletion")
+			}
+			if friendships, _ := env.stores.Friendships.ForUser(ctx, f.graceID); len(friendships) != 0 {
+				t.Errorf("grace still has friendships %+v", friendships)
+			}
+
+			// Grace is the only admin left, so she takes over from ada
+			owned, err := env.stores.Groups.GetByID(ctx, f.ownedGroup)
+			if err != nil || owned.CreatorID != f.graceID || len(owned.Members) != 2 {
+				t.Errorf("owned group after deletion %+v (%v), want grace owning it with bob", owned, err)
+			}
+			if _, err := env.stores.Groups.GetByID(ctx, f.soloGroup); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("group without members left survived: %v", err)
+			}
+			if joined, _ := env.stores.Groups.GetByID(ctx, f.joinedGroup); len(joined.Members) != 1 {
+				t.Errorf("ada still in joined group %+v", joined.Members)
+			}
+
+			wantLeft := 0
+			if tt.policy == "anonymize" {
+				wantLeft = 2
+			}
+			if direct, _ := env.stores.Messages.ForUser(ctx, constants.DeletedUserID); len(direct) != wantLeft {
+				t.Errorf("%d direct messages of the deleted user kept, want %d", len(direct), wantLeft)
+			}
+			if group, _ := env.stores.Groups.MessagesByUser(ctx, constants.DeletedUserID); len(group) != wantLeft {
+				t.Errorf("%d group messages of the deleted user kept, want %d", len(group), wantLeft)
+			}
+			direct, _ := env.stores.Messages.ForUser(ctx, f.adaID)
+			group, _ := env.stores.Groups.MessagesByUser(ctx, f.adaID)
+			if len(direct) != 0 || len(group) != 0 {
+				t.Errorf("messages still carry ada's ID: %+v %+v", direct, group)
+			}
+			if others, _ := env.stores.Messages.ForUser(ctx, f.bobID); len(others) != 1 {
+				t.Errorf("messages between other users were touched: %+v", others)
+			}
+		})
+	}
+}
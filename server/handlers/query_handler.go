@@ -3,82 +3,29 @@ package handlers
 import (
 	"context"
 	"errors"
-	"os"
-	"time"
+	"net/mail"
 
-	"chat-app/config"
+	"chat-app/auth"
 	"chat-app/constants"
+	"chat-app/store"
 	"chat-app/utils"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func UpdateUserOnlineStatusByUserID(userId, status string) error {
-	docID, err := primitive.ObjectIDFromHex(userId)
-	if err != nil {
-		return errors.New("unable to extract Id from Hex Id")
-	}
-
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, err = collection.UpdateOne(ctx,
-		bson.M{"_id": docID},
-		bson.M{"$set": bson.M{"online": status}},
-	)
-
-	if err != nil {
-		return errors.New(constants.ServerFailedResponse)
-	}
-	return nil
-}
-
-func GetUserByUsername(username string) UserDetails {
-	var userDetails UserDetails
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_ = collection.FindOne(ctx, bson.M{"username": username}).Decode(&userDetails)
-
-	return userDetails
-}
-
-func GetUserByUserID(userID string) UserDetails {
-	var userDetails UserDetails
-
-	docID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		return UserDetails{}
-	}
-
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	_ = collection.FindOne(ctx, bson.M{
-		"_id": docID,
-	}).Decode(&userDetails)
-
-	cancel()
-	return userDetails
-}
+const conversationPageSize = 20
 
-func IsUsernameAvailableQueryHandler(username string) bool {
-	userDetails := GetUserByUsername(username)
-	return userDetails == (UserDetails{})
+func IsUsernameAvailableQueryHandler(ctx context.Context, users store.UserStore, username string) bool {
+	_, err := users.GetByUsername(ctx, username)
+	return errors.Is(err, store.ErrNotFound)
 }
 
-func LoginQueryHandler(userDetailsRequest LoginRequest) (UserResponse, error) {
+func LoginQueryHandler(ctx context.Context, users store.UserStore, userDetailsRequest LoginRequest) (UserResponse, error) {
 	if userDetailsRequest.Username == "" {
 		return UserResponse{}, errors.New(constants.UsernameCantBeEmpty)
 	} else if userDetailsRequest.Password == "" {
 		return UserResponse{}, errors.New(constants.PasswordCantBeEmpty)
 	} else {
-		userDetails := GetUserByUsername(userDetailsRequest.Username)
-		if userDetails == (UserDetails{}) {
+		userDetails, err := users.GetByUsername(ctx, userDetailsRequest.Username)
+		if err != nil {
 			return UserResponse{}, errors.New(constants.UserIsNotRegisteredWithUs)
 		}
 
@@ -86,7 +33,20 @@ func LoginQueryHandler(userDetailsRequest LoginRequest) (UserResponse, error) {
 			return UserResponse{}, errors.New(constants.LoginPasswordIsInCorrect)
 		}
 
-		if onlineStatusErr := UpdateUserOnlineStatusByUserID(userDetails.ID, "Y"); onlineStatusErr != nil {
+		if userDetails.Disabled {
+			return UserResponse{}, errors.New(constants.AccountIsDisabled)
+		}
+
+		// The user stays offline until the second factor is verified
+		if twoFactorEnabled(userDetails) {
+			return UserResponse{
+				Username:          userDetails.Username,
+				UserID:            userDetails.ID,
+				TwoFactorRequired: true,
+			}, nil
+		}
+
+		if onlineStatusErr := users.SetOnline(ctx, userDetails.ID, "Y"); onlineStatusErr != nil {
 			return UserResponse{}, errors.New(constants.LoginPasswordIsInCorrect)
 		}
 
@@ -97,287 +57,132 @@ func LoginQueryHandler(userDetailsRequest LoginRequest) (UserResponse, error) {
 	}
 }
 
-func RegisterQueryHandler(userDetails RegistrationRequest) (string, error) {
+func RegisterQueryHandler(ctx context.Context, users store.UserStore, policy auth.PasswordPolicy, userDetails RegistrationRequest) (string, error) {
 	if userDetails.Username == "" {
 		return "", errors.New(constants.UsernameCantBeEmpty)
 	} else if userDetails.Password == "" {
 		return "", errors.New(constants.PasswordCantBeEmpty)
+	} else if policyErr := policy.Check(userDetails.Password, userDetails.Username); policyErr != nil {
+		return "", policyErr
+	} else if _, emailErr := mail.ParseAddress(userDetails.Email); userDetails.Email != "" && emailErr != nil {
+		return "", errors.New(constants.InvalidEmail)
 	} else {
 		newPasswordHash, PassErr := utils.HashPassword(userDetails.Password)
 		if PassErr != nil {
 			return "", errors.New(constants.ServerFailedResponse)
 		}
 
-		collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		id := primitive.NewObjectID()
-		uid := id.Hex()
-
-		_, registrationErr := collection.InsertOne(ctx, bson.M{
-			"_id":       id,
-			"username":  userDetails.Username,
-			"password":  newPasswordHash,
-			"online":    "N",
-			"createdAt": time.Now(),
+		uid, registrationErr := users.Create(ctx, UserDetails{
+			Username: userDetails.Username,
+			Password: newPasswordHash,
+			Email:    userDetails.Email,
+			Online:   "N",
 		})
-
+		if errors.Is(registrationErr, store.ErrAlreadyExists) {
+			// The unique username index catches registrations racing for the same name
+			return "", errors.New(constants.UsernameIsNotAvailable)
+		}
 		if registrationErr != nil {
 			return "", errors.New(constants.ServerFailedResponse)
 		}
 
-		if onlineStatusError := UpdateUserOnlineStatusByUserID(uid, "Y"); onlineStatusError != nil {
+		if onlineStatusError := users.SetOnline(ctx, uid, "Y"); onlineStatusError != nil {
 			return "", errors.New(constants.ServerFailedResponse)
 		}
 		return uid, nil
 	}
 }
 
-func GetAllOnlineUsers(userID string) []UserResponse {
+func GetAllOnlineUsers(ctx context.Context, users store.UserStore, userID string) []UserResponse {
 	var onlineUsers []UserResponse
 
-	docID, err := primitive.ObjectIDFromHex(userID)
+	online, err := users.ListOnline(ctx, userID)
 	if err != nil {
 		return onlineUsers
 	}
 
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	cursor, queryError := collection.Find(ctx, bson.M{
-		"online": "Y",
-		"_id": bson.M{
-			"$ne": docID, // excludes the user itself
-		},
-	})
-	if queryError != nil {
-		return onlineUsers
-	}
-	defer cursor.Close(ctx)
-
-	if queryError != nil {
-		return onlineUsers
-	}
-
-	for cursor.Next(context.TODO()) {
-		var user UserDetails
-		err := cursor.Decode(&user)
-
-		if err == nil {
-			onlineUsers = append(onlineUsers, UserResponse{
-				UserID:   user.ID,
-				Username: user.Username,
-				Online:   user.Online,
-			})
-		}
+	for _, user := range online {
+		onlineUsers = append(onlineUsers, UserResponse{
+			UserID:   user.ID,
+			Username: user.Username,
+			Online:   user.Online,
+		})
 	}
-
 	return onlineUsers
 }
 
-func StoreNewMessages(message MessagePayload) bool {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("messages")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, registrationError := collection.InsertOne(ctx, bson.M{
-		"fromUserID": message.FromUserID,
-		"message":    message.Message,
-		"toUserID":   message.ToUserID,
-		"createdAt":  time.Now(),
+func StoreNewMessages(ctx context.Context, messages store.MessageStore, message MessagePayload) bool {
+	_, err := messages.Save(ctx, Message{
+		FromUserID: message.FromUserID,
+		Message:    message.Message,
+		ToUserID:   message.ToUserID,
+		Type:       message.Type,
 	})
-
-	return registrationError == nil
+	return err == nil
 }
 
-func GetConversationBetweenTwoUsers(toUser, fromUser string, page int64) []Message {
-	var conversation []Message
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("messages")
-	var limit int64 = 20
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	queryHandler := bson.M{
-		"$or": []bson.M{
-			{
-				"toUserID":   toUser,
-				"fromUserID": fromUser,
-			},
-			{
-				"fromUserID": toUser,
-				"toUserID":   fromUser,
-			},
-		},
-	}
-
-	// FIX START: Initialize and chain methods on the SAME variable
-	findOptions := options.Find()
-	findOptions.SetSort(bson.D{{Key: "createdAt", Value: -1}}) // Sort by newest first
-	findOptions.SetLimit(limit)                                // Apply limit (20)
-	findOptions.SetSkip((page - 1) * limit)                    // Apply pagination skip
-	// FIX END
-
-	cursor, err := collection.Find(ctx, queryHandler, findOptions)
+func GetConversationBetweenTwoUsers(ctx context.Context, messages store.MessageStore, toUser, fromUser string, page int64) []Message {
+	conversation, err := messages.Conversation(ctx, toUser, fromUser, page, conversationPageSize)
 	if err != nil {
-		return conversation
+		return nil
 	}
-	defer cursor.Close(ctx)
-
-	for cursor.Next(ctx) {
-		var message Message
-		if err := cursor.Decode(&message); err == nil {
-			conversation = append(conversation, message)
-		}
-	}
-
-	// Reverse the order so the frontend receives them chronologically (oldest -> newest)
-	for i, j := 0, len(conversation)-1; i < j; i, j = i+1, j-1 {
-		conversation[i], conversation[j] = conversation[j], conversation[i]
-	}
-
 	return conversation
 }
 
 // ---------------- NEW SOCIAL GRAPH FUNCTIONS ----------------
 
-func CreateFriendRequest(requesterID, addresseeID string) error {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("friendships")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Check if friendship already exists (in either direction)
-	count, _ := collection.CountDocuments(ctx, bson.M{
-		"$or": []bson.M{
-			{"requesterID": requesterID, "addresseeID": addresseeID},
-			{"requesterID": addresseeID, "addresseeID": requesterID},
-		},
-	})
-
-	if count > 0 {
+func CreateFriendRequest(ctx context.Context, friendships store.FriendshipStore, requesterID, addresseeID string) error {
+	err := friendships.Request(ctx, requesterID, addresseeID)
+	if errors.Is(err, store.ErrAlreadyExists) {
 		return errors.New("friendship request already exists or you are already friends")
 	}
-
-	_, err := collection.InsertOne(ctx, bson.M{
-		"requesterID": requesterID,
-		"addresseeID": addresseeID,
-		"status":      "pending",
-		"createdAt":   time.Now(),
-	})
-
-	return err
-}
-
-func AcceptFriendRequest(requesterID, addresseeID string) error {
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("friendships")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, err := collection.UpdateOne(ctx,
-		bson.M{
-			"requesterID": requesterID,
-			"addresseeID": addresseeID,
-			"status":      "pending",
-		},
-		bson.M{"$set": bson.M{"status": "accepted"}},
-	)
 	return err
 }
 
-func GetPendingRequests(userID string) ([]FriendRequestResponse, error) {
+func GetPendingRequests(ctx context.Context, stores *store.Stores, userID string) ([]FriendRequestResponse, error) {
 	var requests []FriendRequestResponse
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("friendships")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
 
-	// Find requests where I am the addressee and status is pending
-	cursor, err := collection.Find(ctx, bson.M{
-		"addresseeID": userID,
-		"status":      "pending",
-	})
+	// Requests where I am the addressee and status is pending
+	pending, err := stores.Friendships.Pending(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
 
-	for cursor.Next(ctx) {
-		var friendship Friendship
-		if err := cursor.Decode(&friendship); err == nil {
-			requester := GetUserByUserID(friendship.RequesterID)
-			requests = append(requests, FriendRequestResponse{
-				ID:       friendship.RequesterID,
-				Username: requester.Username,
-				Status:   "pending",
-			})
-		}
+	for _, friendship := range pending {
+		requester, _ := stores.Users.GetByID(ctx, friendship.RequesterID)
+		requests = append(requests, FriendRequestResponse{
+			ID:       friendship.RequesterID,
+			Username: requester.Username,
+			Status:   "pending",
+		})
 	}
 	return requests, nil
 }
 
-func GetFriendList(userID string) ([]UserResponse, error) {
+func GetFriendList(ctx context.Context, stores *store.Stores, userID string) ([]UserResponse, error) {
 	var friends []UserResponse
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("friendships")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
 
-	// Find accepted friendships where I am either requester or addressee
-	cursor, err := collection.Find(ctx, bson.M{
-		"status": "accepted",
-		"$or": []bson.M{
-			{"requesterID": userID},
-			{"addresseeID": userID},
-		},
-	})
+	// Accepted friendships where I am either requester or addressee
+	accepted, err := stores.Friendships.Accepted(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
 
-	for cursor.Next(ctx) {
-		var friendship Friendship
-		if err := cursor.Decode(&friendship); err == nil {
-			// Determine which ID is the friend's ID
-			var friendID string
-			if friendship.RequesterID == userID {
-				friendID = friendship.AddresseeID
-			} else {
-				friendID = friendship.RequesterID
-			}
-
-			friendDetails := GetUserByUserID(friendID)
-			friends = append(friends, UserResponse{
-				UserID:   friendDetails.ID,
-				Username: friendDetails.Username,
-				Online:   friendDetails.Online,
-			})
+	for _, friendship := range accepted {
+		// Determine which ID is the friend's ID
+		var friendID string
+		if friendship.RequesterID == userID {
+			friendID = friendship.AddresseeID
+		} else {
+			friendID = friendship.RequesterID
 		}
-	}
-	return friends, nil
-}
 
-func DeleteMessages(messageIDs []string, userID string) error {
-	// Convert string IDs to ObjectIDs
-	var objectIDs []primitive.ObjectID
-	for _, id := range messageIDs {
-		oid, _ := primitive.ObjectIDFromHex(id)
-		objectIDs = append(objectIDs, oid)
+		friendDetails, _ := stores.Users.GetByID(ctx, friendID)
+		friends = append(friends, UserResponse{
+			UserID:   friendDetails.ID,
+			Username: friendDetails.Username,
+			Online:   friendDetails.Online,
+		})
 	}
-
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Delete messages where ID matches AND (fromUserID == userID OR toUserID == userID)
-	// This allows deleting messages you sent OR received (WhatsApp style "Delete for me" logic is complex, this is "Delete" logic)
-	_, err := collection.DeleteMany(ctx, bson.M{
-		"_id": bson.M{"$in": objectIDs},
-		"$or": []bson.M{
-			{"fromUserID": userID},
-			// {"toUserID": userID}, // Uncomment to allow deleting received messages too
-		},
-	})
-	return err
+	return friends, nil
 }
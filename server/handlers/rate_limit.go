@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chat-app/config"
+	"chat-app/constants"
+	"chat-app/logging"
+	"chat-app/ratelimit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimits holds the shared limiter and the budgets configured for routes and socket events
+type RateLimits struct {
+	limiter *ratelimit.Limiter
+	routes  map[string]ratelimit.Rule
+	events  map[string]config.EventLimitConfig
+	logins  *ratelimit.Lockout
+}
+
+// NewRateLimits builds the limits from config, when disabled every check passes
+func NewRateLimits(cfg config.RateLimitConfig, rdb redis.Cmdable) *RateLimits {
+	if !cfg.Enabled {
+		return &RateLimits{}
+	}
+	return &RateLimits{
+		limiter: ratelimit.New(rdb),
+		routes:  cfg.Routes,
+		events:  cfg.Events,
+		logins: ratelimit.NewLockout(rdb, "login", ratelimit.LockoutPolicy{
+			MaxFailures: cfg.Login.MaxFailures,
+			Window:      cfg.Login.Window.Std(),
+			Duration:    cfg.Login.Lockout.Std(),
+		}),
+	}
+}
+
+// Route limits a route per client IP with the budget configured under name
+func (rl *RateLimits) Route(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		decision := rl.limiter.Allow(c.Request.Context(), "route:"+name, c.ClientIP(), rl.routes[name])
+		if !decision.Allowed {
+			logging.FromContext(c.Request.Context()).Warn("Route rate limited", "route", name)
+			abortTooManyRequests(c, constants.TooManyRequests, decision.RetryAfter)
+			return
+		}
+		c.Next()
+	}
+}
+
+func abortTooManyRequests(c *gin.Context, message string, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, APIResponse{
+		Code:     http.StatusTooManyRequests,
+		Status:   http.StatusText(http.StatusTooManyRequests),
+		Message:  message,
+		Response: nil,
+	})
+}
+
+// loginKeys locks usernames and client IPs separately, so guessing one account
+// from many IPs and many accounts from one IP are both caught
+func loginKeys(c *gin.Context, username string) []string {
+	return []string{"user:" + username, "ip:" + c.ClientIP()}
+}
+
+type rateLimitNotice struct {
+	Event        string            `json:"event"`
+	Penalty      ratelimit.Penalty `json:"penalty"`
+	RetryAfterMs int64             `json:"retryAfterMs"`
+}
+
+// allowEvent takes a token for a socket event and applies the configured penalty when the
+// user is out of budget. It returns false when the event must be dropped.
+func (rl *RateLimits) allowEvent(c *Client, msgType string) bool {
+	limit, ok := rl.events[msgType]
+	if !ok || rl.limiter == nil {
+		return true
+	}
+
+	ctx := context.Background()
+	scope := "event:" + msgType
+
+	if muted := rl.limiter.MutedFor(ctx, scope, c.UserID); muted > 0 {
+		c.notifyRateLimited(msgType, ratelimit.Mute, muted)
+		return false
+	}
+
+	decision := rl.limiter.Allow(ctx, scope, c.UserID, limit.Rule)
+	if decision.Allowed {
+		return true
+	}
+
+	c.log.Warn("Socket event rate limited", "type", msgType, "penalty", limit.Penalty)
+	switch limit.Penalty {
+	case ratelimit.Mute:
+		rl.limiter.Mute(ctx, scope, c.UserID, limit.MuteFor.Std())
+		c.notifyRateLimited(msgType, ratelimit.Mute, limit.MuteFor.Std())
+	case ratelimit.Disconnect:
+		c.disconnect(websocket.ClosePolicyViolation, "rate limit exceeded")
+	default:
+		c.notifyRateLimited(msgType, ratelimit.Throttle, decision.RetryAfter)
+	}
+	return false
+}
+
+func (c *Client) notifyRateLimited(msgType string, penalty ratelimit.Penalty, retryAfter time.Duration) {
+	c.deliver(createWSMessage("rate-limited", rateLimitNotice{
+		Event:        msgType,
+		Penalty:      penalty,
+		RetryAfterMs: retryAfter.Milliseconds(),
+	}, c.UserID))
+}
@@ -1,49 +1,88 @@
 package handlers
 
 import (
-	"chat-app/config"
+	"chat-app/tracing"
 	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	PubSubChannel = "chat_global_channel"
 )
 
-// PublishMessage sends a message to the Redis channel
-func PublishMessage(msg WSMessage) {
-	ctx := context.Background()
+// PublishMessage sends a message to the Redis channel.
+// The span context of ctx travels inside the message so the receiving instance continues the trace.
+func PublishMessage(ctx context.Context, rdb redis.UniversalClient, msg WSMessage) {
+	ctx, span := tracing.Tracer().Start(ctx, "pubsub publish "+msg.Type,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "redis"),
+			attribute.String("messaging.destination.name", PubSubChannel),
+		),
+	)
+	defer span.End()
+
+	msg.Trace = tracing.Inject(ctx)
 	payload, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Error marshaling message for Redis: %v", err)
+		slog.Error("Error marshaling message for Redis", "type", msg.Type, "error", err)
+		span.RecordError(err)
 		return
 	}
 
-	err = config.RedisClient.Publish(ctx, PubSubChannel, payload).Err()
+	err = rdb.Publish(ctx, PubSubChannel, payload).Err()
 	if err != nil {
-		log.Printf("Error publishing to Redis: %v", err)
+		slog.Error("Error publishing to Redis", "type", msg.Type, "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "publish failed")
 	}
 }
 
 // SubscribeToRedis listens for messages from other servers and forwards them to the local lobby
 func SubscribeToRedis(lobby *Lobby) {
 	ctx := context.Background()
-	subscriber := config.RedisClient.Subscribe(ctx, PubSubChannel)
+	subscriber := lobby.stores.Redis.Subscribe(ctx, PubSubChannel)
+
+	// Keep a handle so Drain can unsubscribe during shutdown
+	lobby.mu.Lock()
+	lobby.subscription = subscriber
+	lobby.mu.Unlock()
 
-	log.Println("Subscribed to Redis channel:", PubSubChannel)
+	slog.Info("Subscribed to Redis channel", "channel", PubSubChannel)
 
 	ch := subscriber.Channel()
 
 	for msg := range ch {
 		var wsMsg WSMessage
 		if err := json.Unmarshal([]byte(msg.Payload), &wsMsg); err != nil {
-			log.Printf("Error unmarshaling Redis message: %v", err)
+			slog.Error("Error unmarshaling Redis message", "error", err)
 			continue
 		}
 
 		// When we receive a message from Redis, we treat it as a local event
 		// and send it to the appropriate users connected to THIS server.
-		BroadcastLocal(lobby, wsMsg)
+		deliverFromRedis(lobby, wsMsg)
 	}
-}
\ No newline at end of file
+}
+
+// deliverFromRedis continues the publisher's trace and hands the message to writePump
+func deliverFromRedis(lobby *Lobby, wsMsg WSMessage) {
+	ctx := tracing.Extract(context.Background(), wsMsg.Trace)
+	ctx, span := tracing.Tracer().Start(ctx, "pubsub receive "+wsMsg.Type,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "redis"),
+			attribute.String("messaging.destination.name", PubSubChannel),
+		),
+	)
+	defer span.End()
+
+	wsMsg.Trace = tracing.Inject(ctx)
+	BroadcastLocal(lobby, wsMsg)
+}
@@ -10,8 +10,8 @@ import (
 	"sync"
 	"time"
 
-	"chat-app/config"
 	"chat-app/constants"
+	"chat-app/store"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,7 +27,7 @@ func RenderHome() gin.HandlerFunc {
 	}
 }
 
-func IsUsernameAvailable() gin.HandlerFunc {
+func IsUsernameAvailable(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		type usernameAvailable struct {
 			IsUsernameAvailable bool `json:"isUsernameAvailable"`
@@ -46,7 +46,7 @@ func IsUsernameAvailable() gin.HandlerFunc {
 			return
 		}
 
-		isUsernameAvailable := IsUsernameAvailableQueryHandler(username)
+		isUsernameAvailable := IsUsernameAvailableQueryHandler(c.Request.Context(), stores.Users, username)
 		if isUsernameAvailable {
 			c.JSON(http.StatusOK, APIResponse{
 				Code:    http.StatusOK,
@@ -69,7 +69,7 @@ func IsUsernameAvailable() gin.HandlerFunc {
 	}
 }
 
-func Login() gin.HandlerFunc {
+func Login(stores *store.Stores, accounts *Accounts, limits *RateLimits) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var userDetails LoginRequest
 
@@ -90,6 +90,7 @@ func Login() gin.HandlerFunc {
 				Message:  constants.UsernameCantBeEmpty,
 				Response: nil,
 			})
+			return
 		}
 
 		if userDetails.Password == "" {
@@ -99,22 +100,64 @@ func Login() gin.HandlerFunc {
 				Message:  constants.PasswordCantBeEmpty,
 				Response: nil,
 			})
+			return
+		}
 
+		ctx := c.Request.Context()
+		lockKeys := loginKeys(c, userDetails.Username)
+		if lockedFor := limits.logins.LockedFor(ctx, lockKeys...); lockedFor > 0 {
+			abortTooManyRequests(c, constants.TooManyLoginAttempts, lockedFor)
+			return
 		}
 
-		userDetailsResponse, loginErrorMessage := LoginQueryHandler(userDetails)
+		userDetailsResponse, loginErrorMessage := LoginQueryHandler(ctx, stores.Users, userDetails)
 
 		if loginErrorMessage != nil {
-			c.JSON(http.StatusNotFound, APIResponse{
-				Code:     http.StatusNotFound,
-				Status:   http.StatusText(http.StatusNotFound),
+			switch loginErrorMessage.Error() {
+			case constants.UserIsNotRegisteredWithUs, constants.LoginPasswordIsInCorrect:
+				limits.logins.Fail(ctx, lockKeys...)
+			}
+
+			status := http.StatusNotFound
+			if loginErrorMessage.Error() == constants.AccountIsDisabled {
+				status = http.StatusForbidden
+			}
+			c.JSON(status, APIResponse{
+				Code:     status,
+				Status:   http.StatusText(status),
 				Message:  loginErrorMessage.Error(),
 				Response: nil,
 			})
 			return
 		}
 
-		// succesfil login
+		// Password was right, the session waits for LoginTwoFactor. Failures are kept
+		// until then so the password can't be used to reset the lockout for code guessing.
+		if userDetailsResponse.TwoFactorRequired {
+			challenge, challengeErr := accounts.challenges.Issue(ctx, userDetailsResponse.UserID)
+			if challengeErr != nil {
+				respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+				return
+			}
+			userDetailsResponse.Challenge = challenge
+			c.JSON(http.StatusOK, APIResponse{
+				Code:     http.StatusOK,
+				Status:   http.StatusText(http.StatusOK),
+				Message:  constants.TwoFactorRequired,
+				Response: userDetailsResponse,
+			})
+			return
+		}
+
+		// succesfil login, the IP keeps its failures so one valid account can't reset them
+		limits.logins.Reset(ctx, lockKeys[0])
+
+		token, sessionErr := accounts.sessions.Create(ctx, userDetailsResponse.UserID)
+		if sessionErr != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		userDetailsResponse.Token = token
 		c.JSON(http.StatusOK, APIResponse{
 			Code:     http.StatusOK,
 			Status:   http.StatusText(http.StatusOK),
@@ -124,7 +167,7 @@ func Login() gin.HandlerFunc {
 	}
 }
 
-func Registration() gin.HandlerFunc {
+func Registration(stores *store.Stores, accounts *Accounts) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var requestPayload RegistrationRequest
 
@@ -158,14 +201,23 @@ func Registration() gin.HandlerFunc {
 			return
 		}
 
-		userObjectID, registrationErr := RegisterQueryHandler(requestPayload)
+		userObjectID, registrationErr := RegisterQueryHandler(c.Request.Context(), stores.Users, accounts.policy, requestPayload)
 		if registrationErr != nil {
-			c.JSON(http.StatusInternalServerError, APIResponse{
-				Code:     http.StatusInternalServerError,
-				Status:   http.StatusText(http.StatusInternalServerError),
-				Message:  constants.ServerFailedResponse,
-				Response: nil,
-			})
+			switch registrationErr.Error() {
+			case constants.UsernameIsNotAvailable:
+				respondError(c, http.StatusConflict, constants.UsernameIsNotAvailable)
+			case constants.ServerFailedResponse:
+				respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			default:
+				// Password policy and email validation failures
+				respondError(c, http.StatusBadRequest, registrationErr.Error())
+			}
+			return
+		}
+
+		token, sessionErr := accounts.sessions.Create(c.Request.Context(), userObjectID)
+		if sessionErr != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
 			return
 		}
 
@@ -176,12 +228,13 @@ func Registration() gin.HandlerFunc {
 			Response: UserResponse{
 				Username: requestPayload.Username,
 				UserID:   userObjectID,
+				Token:    token,
 			},
 		})
 	}
 }
 
-func UserSessionCheck() gin.HandlerFunc {
+func UserSessionCheck(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var IsAlphaNumeric = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_-]*[A-Za-z0-9])?$`).MatchString
 		uid := c.Param("userID")
@@ -196,8 +249,7 @@ func UserSessionCheck() gin.HandlerFunc {
 			return
 		}
 
-		userDetails := GetUserByUserID(uid)
-		if userDetails == (UserDetails{}) {
+		if _, err := stores.Users.GetByID(c.Request.Context(), uid); err != nil {
 			c.JSON(http.StatusOK, APIResponse{
 				Code:     http.StatusOK,
 				Status:   http.StatusText(http.StatusOK),
@@ -218,7 +270,7 @@ func UserSessionCheck() gin.HandlerFunc {
 	}
 }
 
-func GetMessagesHandler() gin.HandlerFunc {
+func GetMessagesHandler(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		toUserID := c.Param("toUserID")
 		fromUserID := c.Param("fromUserID")
@@ -240,7 +292,7 @@ func GetMessagesHandler() gin.HandlerFunc {
 			page = 1
 		}
 
-		conversations := GetConversationBetweenTwoUsers(toUserID, fromUserID, int64(page))
+		conversations := GetConversationBetweenTwoUsers(c.Request.Context(), stores.Messages, toUserID, fromUserID, int64(page))
 
 		c.JSON(http.StatusOK, APIResponse{
 			Code:     http.StatusOK,
@@ -251,13 +303,13 @@ func GetMessagesHandler() gin.HandlerFunc {
 	}
 }
 
-func GetGlobalChatHistory() gin.HandlerFunc {
+func GetGlobalChatHistory(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 
 		// Fetch last 50 messages
 		// LRange 0 -1 gets everything, but we trimmed it to 50
-		messagesJSON, err := config.RedisClient.LRange(ctx, "global_chat_history", 0, -1).Result()
+		messagesJSON, err := stores.Redis.LRange(ctx, "global_chat_history", 0, -1).Result()
 		if err != nil {
 			c.JSON(500, APIResponse{Message: "Error fetching global chat"})
 			return
@@ -335,7 +387,7 @@ func JoinRandomChatHandler() gin.HandlerFunc {
 
 // NEW SOCIAL GRAPH HANDLERS
 
-func SendFriendRequestHandler() gin.HandlerFunc {
+func SendFriendRequestHandler(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req FriendRequestPayload
 		fromUserID := c.Param("fromUserID")
@@ -347,15 +399,15 @@ func SendFriendRequestHandler() gin.HandlerFunc {
 			return
 		}
 
-		targetUser := GetUserByUsername(req.TargetUsername)
-		if targetUser == (UserDetails{}) {
+		targetUser, err := stores.Users.GetByUsername(c.Request.Context(), req.TargetUsername)
+		if err != nil {
 			c.JSON(http.StatusNotFound, APIResponse{
 				Code: http.StatusNotFound, Message: "User not found",
 			})
 			return
 		}
 
-		if err := CreateFriendRequest(fromUserID, targetUser.ID); err != nil {
+		if err := CreateFriendRequest(c.Request.Context(), stores.Friendships, fromUserID, targetUser.ID); err != nil {
 			c.JSON(http.StatusBadRequest, APIResponse{
 				Code: http.StatusBadRequest, Message: err.Error(),
 			})
@@ -363,8 +415,8 @@ func SendFriendRequestHandler() gin.HandlerFunc {
 		}
 
 		// Trigger Notification via Redis
-		sender := GetUserByUserID(fromUserID)
-		SendNotification(targetUser.ID, sender.Username, "friend_request", sender.Username+" sent you a friend request")
+		sender, _ := stores.Users.GetByID(c.Request.Context(), fromUserID)
+		SendNotification(c.Request.Context(), stores.Redis, targetUser.ID, sender.Username, "friend_request", sender.Username+" sent you a friend request")
 
 		c.JSON(http.StatusOK, APIResponse{
 			Code: http.StatusOK, Message: "Friend Request Sent",
@@ -372,14 +424,14 @@ func SendFriendRequestHandler() gin.HandlerFunc {
 	}
 }
 
-func AcceptFriendRequestHandler() gin.HandlerFunc {
+func AcceptFriendRequestHandler(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Requester ID (The person who sent the original request)
 		requesterID := c.Param("requesterID")
 		// Addressee ID (The person accepting it - ME)
 		myUserID := c.Param("myUserID")
 
-		if err := AcceptFriendRequest(requesterID, myUserID); err != nil {
+		if err := stores.Friendships.Accept(c.Request.Context(), requesterID, myUserID); err != nil {
 			c.JSON(http.StatusBadRequest, APIResponse{
 				Code: http.StatusBadRequest, Message: "Could not accept request",
 			})
@@ -387,8 +439,8 @@ func AcceptFriendRequestHandler() gin.HandlerFunc {
 		}
 
 		// Notify the requester that I accepted
-		me := GetUserByUserID(myUserID)
-		SendNotification(requesterID, me.Username, "friend_accept", me.Username+" accepted your friend request")
+		me, _ := stores.Users.GetByID(c.Request.Context(), myUserID)
+		SendNotification(c.Request.Context(), stores.Redis, requesterID, me.Username, "friend_accept", me.Username+" accepted your friend request")
 
 		c.JSON(http.StatusOK, APIResponse{
 			Code: http.StatusOK, Message: "Friend Request Accepted",
@@ -396,10 +448,10 @@ func AcceptFriendRequestHandler() gin.HandlerFunc {
 	}
 }
 
-func GetPendingRequestsHandler() gin.HandlerFunc {
+func GetPendingRequestsHandler(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.Param("userID")
-		requests, err := GetPendingRequests(userID)
+		requests, err := GetPendingRequests(c.Request.Context(), stores, userID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{Code: 500, Message: "Error fetching requests"})
 			return
@@ -410,10 +462,10 @@ func GetPendingRequestsHandler() gin.HandlerFunc {
 	}
 }
 
-func GetFriendListHandler() gin.HandlerFunc {
+func GetFriendListHandler(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.Param("userID")
-		friends, err := GetFriendList(userID)
+		friends, err := GetFriendList(c.Request.Context(), stores, userID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, APIResponse{Code: 500, Message: "Error fetching friends"})
 			return
@@ -424,7 +476,7 @@ func GetFriendListHandler() gin.HandlerFunc {
 	}
 }
 
-func DeleteMessagesHandler() gin.HandlerFunc {
+func DeleteMessagesHandler(stores *store.Stores) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			MessageIDs []string `json:"messageIDs"`
@@ -436,7 +488,7 @@ func DeleteMessagesHandler() gin.HandlerFunc {
 
 		userID := c.Param("userID") // From middleware or param
 
-		if err := DeleteMessages(req.MessageIDs, userID); err != nil {
+		if err := stores.Messages.Delete(c.Request.Context(), req.MessageIDs, userID); err != nil {
 			c.JSON(500, APIResponse{Message: "Failed to delete"})
 			return
 		}
@@ -452,34 +504,36 @@ func isRandomChat(userID string) bool {
 	return userID == "random"
 }
 
-func RegisterGroupRoutes(router *gin.Engine) {
+func RegisterGroupRoutes(router *gin.Engine, stores *store.Stores, accounts *Accounts, video *VideoServiceClient) {
 	// Group Management
 	groupRoutes := router.Group("/api/groups")
 	{
 		// Create a new group
-		groupRoutes.POST("/create", CreateGroup())
+		groupRoutes.POST("/create", CreateGroup(stores))
 
 		// Get all groups for a user
-		groupRoutes.GET("/user/:userID", GetUserGroups())
+		groupRoutes.GET("/user/:userID", GetUserGroups(stores))
 
 		// Get group details
-		groupRoutes.GET("/:groupID", GetGroupDetails())
+		groupRoutes.GET("/:groupID", GetGroupDetails(stores))
 
 		// Member management
-		groupRoutes.POST("/members/add", AddGroupMember())
-		groupRoutes.DELETE("/:groupID/members/:userID", RemoveGroupMember())
+		groupRoutes.POST("/members/add", AddGroupMember(stores))
+		groupRoutes.DELETE("/:groupID/members/:userID", RemoveGroupMember(stores))
 
 		// Update group settings
-		groupRoutes.PUT("/update", UpdateGroupSettings())
+		groupRoutes.PUT("/update", UpdateGroupSettings(stores))
 
 		// Delete group
-		groupRoutes.DELETE("/:groupID", DeleteGroup())
+		groupRoutes.DELETE("/:groupID", DeleteGroup(stores))
 
 		// Group messages
-		groupRoutes.GET("/:groupID/messages", GetGroupMessages())
-		groupRoutes.POST("/messages/send", SendGroupMessage())
+		groupRoutes.GET("/:groupID/messages", GetGroupMessages(stores))
+		groupRoutes.POST("/messages/send", SendGroupMessage(stores))
 
 		// Video calling
-		groupRoutes.POST("/video-call/start", StartGroupVideoCall())
+		groupRoutes.POST("/video-call/start", RequireSession(accounts), StartGroupVideoCall(stores, video))
+		groupRoutes.POST("/:groupID/video-call/token", RequireSession(accounts), GroupVideoCallToken(stores, video))
+		groupRoutes.GET("/:groupID/recordings", RequireSession(accounts), GetGroupRecordings(stores))
 	}
 }
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"chat-app/constants"
+	"chat-app/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAuthRouter mounts the login and two-factor routes like server.go, without route limits
+func newAuthRouter(env *testEnv) *gin.Engine {
+	router := gin.New()
+	auth := router.Group("/api/auth")
+	auth.POST("/login", Login(env.stores, env.accounts, env.limits))
+	auth.POST("/login/2fa", LoginTwoFactor(env.stores, env.accounts, env.limits))
+
+	twoFactor := auth.Group("/2fa", RequireSession(env.accounts))
+	twoFactor.POST("/enroll", EnrollTwoFactor(env.stores, env.accounts))
+	twoFactor.POST("/verify", VerifyTwoFactor(env.stores, env.accounts))
+	twoFactor.POST("/disable", DisableTwoFactor(env.stores, env.accounts))
+	twoFactor.POST("/recovery-codes", RegenerateRecoveryCodes(env.stores))
+	return router
+}
+
+func TestLogin(t *testing.T) {
+	env := newTestEnv(t, nil)
+	router := newAuthRouter(env)
+
+	adaID := env.createUser(t, "ada", "correct horse", nil)
+	env.createUser(t, "mallory", "correct horse", func(user *models.UserDetails) { user.Disabled = true })
+	env.createUser(t, "grace", "correct horse", func(user *models.UserDetails) {
+		user.TwoFactor = &models.TwoFactor{Enabled: true, Secret: "JBSWY3DPEHPK3PXP"}
+	})
+
+	tests := []struct {
+		name        string
+		request     LoginRequest
+		wantStatus  int
+		wantMessage string
+		wantToken   bool
+	}{
+		{name: "valid", request: LoginRequest{Username: "ada", Password: "correct horse"}, wantStatus: http.StatusOK, wantMessage: constants.UserLoginCompleted, wantToken: true},
+		{name: "empty username", request: LoginRequest{Password: "correct horse"}, wantStatus: http.StatusBadRequest, wantMessage: constants.UsernameAndPasswordCantBeEmpty},
+		{name: "empty password", request: LoginRequest{Username: "ada"}, wantStatus: http.StatusBadRequest, wantMessage: constants.UsernameAndPasswordCantBeEmpty},
+		{name: "wrong password", request: LoginRequest{Username: "ada", Password: "battery staple"}, wantStatus: http.StatusNotFound, wantMessage: constants.LoginPasswordIsInCorrect},
+		{name: "unknown user", request: LoginRequest{Username: "nobody", Password: "correct horse"}, wantStatus: http.StatusNotFound, wantMessage: constants.UserIsNotRegisteredWithUs},
+		{name: "disabled", request: LoginRequest{Username: "mallory", Password: "correct horse"}, wantStatus: http.StatusForbidden, wantMessage: constants.AccountIsDisabled},
+		{name: "two-factor", request: LoginRequest{Username: "grace", Password: "correct horse"}, wantStatus: http.StatusOK, wantMessage: constants.TwoFactorRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(router, http.MethodPost, "/api/auth/login", tt.request)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			var user UserResponse
+			if message := decodeResponse(t, rec, &user); message != tt.wantMessage {
+				t.Fatalf("message %q, want %q", message, tt.wantMessage)
+			}
+			if (user.Token != "") != tt.wantToken {
+				t.Fatalf("token %q, want one: %v", user.Token, tt.wantToken)
+			}
+			if tt.wantStatus == http.StatusOK && !tt.wantToken && (!user.TwoFactorRequired || user.Challenge == "") {
+				t.Fatalf("two-factor login without a challenge: %+v", user)
+			}
+		})
+	}
+
+	session, err := env.accounts.sessions.Get(t.Context(), mustLogin(t, router, "ada", "correct horse"))
+	if err != nil || session.UserID != adaID {
+		t.Fatalf("login token belongs to %q (%v), want %q", session.UserID, err, adaID)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		wait       time.Duration
+		username   string // logs in after the failures against "ada", with the right password
+		wantStatus int
+	}{
+		{name: "below the limit", failures: 4, username: "ada", wantStatus: http.StatusOK},
+		{name: "locked", failures: 5, username: "ada", wantStatus: http.StatusTooManyRequests},
+		{name: "locked from the same IP", failures: 5, username: "grace", wantStatus: http.StatusTooManyRequests},
+		{name: "lock expired", failures: 5, wait: 15 * time.Minute, username: "ada", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, nil)
+			router := newAuthRouter(env)
+			env.createUser(t, "ada", "correct horse", nil)
+			env.createUser(t, "grace", "correct horse", nil)
+
+			for range tt.failures {
+				rec := serve(router, http.MethodPost, "/api/auth/login", LoginRequest{Username: "ada", Password: "wrong"})
+				if rec.Code != http.StatusNotFound {
+					t.Fatalf("failed login answered %d: %s", rec.Code, rec.Body.String())
+				}
+			}
+			env.redis.FastForward(tt.wait)
+
+			rec := serve(router, http.MethodPost, "/api/auth/login", LoginRequest{Username: tt.username, Password: "correct horse"})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+				t.Fatal("lockout without Retry-After")
+			}
+		})
+	}
+}
+
+// mustLogin signs in with a password and returns the session token
+func mustLogin(t *testing.T, router http.Handler, username, password string) string {
+	t.Helper()
+	rec := serve(router, http.MethodPost, "/api/auth/login", LoginRequest{Username: username, Password: password})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login as %s answered %d: %s", username, rec.Code, rec.Body.String())
+	}
+	var user UserResponse
+	decodeResponse(t, rec, &user)
+	return user.Token
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"chat-app/metrics"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// OverflowPolicy decides what happens to an event when a client's send buffer is full
+type OverflowPolicy int
+
+const (
+	// PolicyDisconnect closes the connection of a client that can't keep up
+	PolicyDisconnect OverflowPolicy = iota
+	// PolicyDrop discards the event, for ephemeral events like typing and presence
+	PolicyDrop
+	// PolicyInbox parks a direct message to the user in their offline inbox until the buffer
+	// drains, any other event of the type is dropped
+	PolicyInbox
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case PolicyDrop:
+		return "drop"
+	case PolicyInbox:
+		return "inbox"
+	default:
+		return "disconnect"
+	}
+}
+
+const slowConsumerReason = "slow consumer: send buffer full"
+
+// OverflowPolicies maps an event type to the policy applied when the client's queue is full.
+// Anything not listed here is treated as PolicyDisconnect.
+var OverflowPolicies = map[string]OverflowPolicy{
+	"typing-response":  PolicyDrop,
+	"user_status":      PolicyDrop,
+	"notification":     PolicyDrop,
+	"rate-limited":     PolicyDrop,
+	"message-response": PolicyInbox,
+}
+
+func overflowPolicyFor(msgType string) OverflowPolicy {
+	if policy, ok := OverflowPolicies[msgType]; ok {
+		return policy
+	}
+	return PolicyDisconnect
+}
+
+// OfflineInboxPrefix prefixes the Redis list holding a user's undelivered messages
+const OfflineInboxPrefix = "offline_msgs:"
+
+func offlineInboxKey(userID string) string {
+	return OfflineInboxPrefix + userID
+}
+
+// deliver queues a payload on the client's send buffer without blocking.
+// When the buffer is full the overflow policy for the event type kicks in.
+func (c *Client) deliver(payload WSMessage) {
+	c.sendMu.Lock()
+	if c.sendClosed {
+		c.sendMu.Unlock()
+		return
+	}
+	select {
+	case c.Send <- payload:
+		c.sendMu.Unlock()
+		return
+	default:
+	}
+	c.sendMu.Unlock()
+
+	policy := overflowPolicyFor(payload.Type)
+	metrics.SendQueueOverflows.WithLabelValues(payload.Type, policy.String()).Inc()
+
+	switch policy {
+	case PolicyDrop:
+		// Ephemeral event, the next one supersedes it anyway
+		metrics.DroppedMessages.WithLabelValues(payload.Type, "buffer_full").Inc()
+	case PolicyInbox:
+		// Broadcasts and acks of what the user sent have nowhere to be redelivered from
+		if !isDirectMessageTo(payload, c.UserID) {
+			metrics.DroppedMessages.WithLabelValues(payload.Type, "buffer_full").Inc()
+			return
+		}
+		if err := pushToOfflineInbox(c.Lobby.stores.Redis, c.UserID, payload); err != nil {
+			c.log.Error("Failed to park message in offline inbox", "type", payload.Type, "error", err)
+			metrics.DroppedMessages.WithLabelValues(payload.Type, "inbox_failed").Inc()
+			c.disconnect(websocket.CloseTryAgainLater, slowConsumerReason)
+			return
+		}
+		c.inboxPending.Store(true)
+	default:
+		metrics.DroppedMessages.WithLabelValues(payload.Type, "slow_consumer").Inc()
+		c.disconnect(websocket.CloseTryAgainLater, slowConsumerReason)
+	}
+}
+
+// closeSend closes the send channel exactly once, writePump then sends the close frame
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.Send)
+	}
+}
+
+// disconnect tells the client why it is being dropped and closes the socket.
+// readPump notices the closed connection and unregisters the client from the lobby.
+// The close handshake runs in the background so callers holding the lobby lock never wait on I/O.
+func (c *Client) disconnect(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.log.Warn("Disconnecting client", "reason", reason)
+		go func() {
+			deadline := time.Now().Add(writeWait)
+			_ = c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+			c.Conn.Close()
+		}()
+	})
+}
+
+// isDirectMessageTo reports whether payload is a direct message addressed to userID
+func isDirectMessageTo(payload WSMessage, userID string) bool {
+	var msg MessagePayload
+	if err := json.Unmarshal(payload.Payload, &msg); err != nil {
+		return false
+	}
+	return msg.ToUserID == userID
+}
+
+func pushToOfflineInbox(rdb redis.UniversalClient, userID string, payload WSMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Inbox entries are stored as the bare MessagePayload, the same shape used for offline users
+	return rdb.RPush(ctx, offlineInboxKey(userID), []byte(payload.Payload)).Err()
+}
+
+// flushOfflineInbox redelivers parked messages while there is room in the send buffer.
+// Whatever doesn't fit stays in Redis and is retried once the buffer drains again.
+func flushOfflineInbox(c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := offlineInboxKey(c.UserID)
+	for len(c.Send) < cap(c.Send) {
+		msgStr, err := c.Lobby.stores.Redis.LPop(ctx, key).Result()
+		if err != nil {
+			// redis.Nil means the inbox is empty
+			return
+		}
+
+		var savedMsg MessagePayload
+		if err := json.Unmarshal([]byte(msgStr), &savedMsg); err != nil {
+			c.log.Warn("Skipping malformed offline message", "error", err)
+			continue
+		}
+		c.deliver(createWSMessage("message-response", savedMsg, c.UserID))
+	}
+	c.inboxPending.Store(true)
+}
+
+// SendQueueStats is a point-in-time view of the outbound queues on this instance
+type SendQueueStats struct {
+	Clients     int
+	Capacity    int
+	QueuedTotal int
+	MaxDepth    int
+}
+
+// QueueStats reports the current depth of every client queue
+func (lobby *Lobby) QueueStats() SendQueueStats {
+	stats := SendQueueStats{Capacity: lobby.sendBufferSize}
+
+	lobby.mu.RLock()
+	for client := range lobby.clients {
+		depth := len(client.Send)
+		stats.Clients++
+		stats.QueuedTotal += depth
+		if depth > stats.MaxDepth {
+			stats.MaxDepth = depth
+		}
+	}
+	lobby.mu.RUnlock()
+
+	return stats
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newQueueClient connects a client with a send buffer of size through a real socket and
+// returns the browser's end of it
+func newQueueClient(t *testing.T, env *testEnv, userID string, size int) (*Client, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	browser, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { browser.Close() })
+
+	return &Client{
+		Lobby:  NewLobby(size, env.stores, env.limits),
+		Conn:   <-conns,
+		Send:   make(chan WSMessage, size),
+		UserID: userID,
+		log:    slog.Default(),
+	}, browser
+}
+
+// closeReason ends the connection and returns the text of the first close frame it carried
+func closeReason(t *testing.T, c *Client, browser *websocket.Conn) string {
+	t.Helper()
+	c.disconnect(websocket.CloseNormalClosure, "test done")
+	browser.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := browser.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("reading close frame: %v", err)
+	}
+	return closeErr.Text
+}
+
+func TestDeliverOverflow(t *testing.T) {
+	toAda := MessagePayload{FromUserID: "grace", ToUserID: "ada", Message: "hi"}
+	fromAda := MessagePayload{FromUserID: "ada", ToUserID: "grace", Message: "hi"}
+
+	tests := []struct {
+		name        string
+		payload     WSMessage
+		wantParked  bool
+		wantClosing bool
+	}{
+		{name: "typing", payload: createWSMessage("typing-response", map[string]string{"userID": "grace"}, "ada")},
+		{name: "presence", payload: createWSMessage("user_status", map[string]string{"userID": "grace", "status": "Y"}, "")},
+		{name: "notification", payload: createWSMessage("notification", map[string]string{"type": "friend-request"}, "ada")},
+		{name: "rate limited", payload: createWSMessage("rate-limited", map[string]string{"event": "message"}, "ada")},
+		{name: "direct message", payload: createWSMessage("message-response", toAda, "ada"), wantParked: true},
+		{name: "ack of own message", payload: createWSMessage("message-response", fromAda, "ada")},
+		{name: "global message", payload: createWSMessage("message-response", MessagePayload{FromUserID: "grace", Message: "hi all"}, "")},
+		{name: "unlisted event", payload: createWSMessage("group-message-response", map[string]string{"groupID": "g"}, "ada"), wantClosing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, nil)
+			c, browser := newQueueClient(t, env, "ada", 1)
+			queued := createWSMessage("message-response", toAda, "ada")
+			c.deliver(queued)
+
+			c.deliver(tt.payload)
+
+			if len(c.Send) != 1 || string((<-c.Send).Payload) != string(queued.Payload) {
+				t.Fatal("overflow replaced what was already queued")
+			}
+			parked, _ := env.redis.List(offlineInboxKey("ada"))
+			if tt.wantParked != (len(parked) == 1) || c.inboxPending.Load() != tt.wantParked {
+				t.Fatalf("parked %v with pending %v, want parked: %v", parked, c.inboxPending.Load(), tt.wantParked)
+			}
+			if tt.wantParked && parked[0] != string(tt.payload.Payload) {
+				t.Fatalf("parked %s, want the bare payload %s", parked[0], tt.payload.Payload)
+			}
+
+			reason := closeReason(t, c, browser)
+			if (reason == slowConsumerReason) != tt.wantClosing {
+				t.Fatalf("closed with %q, want the slow consumer reason: %v", reason, tt.wantClosing)
+			}
+		})
+	}
+}
+
+func TestFlushOfflineInbox(t *testing.T) {
+	env := newTestEnv(t, nil)
+	c, _ := newQueueClient(t, env, "ada", 2)
+	key := offlineInboxKey("ada")
+	for _, msg := range []string{"first", "second", "third"} {
+		data, _ := json.Marshal(MessagePayload{FromUserID: "grace", ToUserID: "ada", Message: msg})
+		env.redis.RPush(key, string(data))
+	}
+	env.redis.Lpush(key, "not json")
+
+	flushOfflineInbox(c)
+
+	for _, want := range []string{"first", "second"} {
+		payload := <-c.Send
+		var msg MessagePayload
+		if err := json.Unmarshal(payload.Payload, &msg); err != nil || payload.Type != "message-response" || msg.Message != want {
+			t.Fatalf("redelivered %s %s, want message-response %q", payload.Type, payload.Payload, want)
+		}
+	}
+	if left, _ := env.redis.List(key); len(left) != 1 || !c.inboxPending.Load() {
+		t.Fatalf("inbox holds %v with pending %v, want the third message waiting for room", left, c.inboxPending.Load())
+	}
+
+	c.inboxPending.Store(false)
+	flushOfflineInbox(c)
+	if len(c.Send) != 1 || env.redis.Exists(key) || c.inboxPending.Load() {
+		t.Fatalf("second flush left %d queued, inbox %v, pending %v", len(c.Send), env.redis.Exists(key), c.inboxPending.Load())
+	}
+}
@@ -2,14 +2,20 @@ package handlers
 
 import (
 	"bytes"
-	"chat-app/config"
+	"chat-app/logging"
+	"chat-app/metrics"
+	"chat-app/origins"
+	"chat-app/tracing"
 	"context"
 	"encoding/json"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // pingPeriod < pongWait, 6-second buffer in case a pong is a bit delayed.
@@ -20,15 +26,21 @@ const (
 	maxMessageSize = 512 * 1024          // Increased to 512KB to support base64 images (Goal 1)
 )
 
-// Upgrader specifies parameters for upgrading an HTTP connection to a WebSocket connection
-var Upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// This CheckOrigin function allows connections from any origin
-	// In production, you might want to be more restrictive
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// NewUpgrader specifies parameters for upgrading an HTTP connection to a WebSocket connection.
+// Browsers don't apply CORS to websockets, so the origin allowlist is checked here as well.
+func NewUpgrader(allowed *origins.Allowlist) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if allowed.Allows(origin, r.Host) {
+				return true
+			}
+			logging.FromContext(r.Context()).Warn("Rejected websocket from disallowed origin", "origin", origin)
+			return false
+		},
+	}
 }
 
 // Helper function to easily create WSMessage with correct JSON payload
@@ -42,7 +54,29 @@ func createWSMessage(msgType string, data interface{}, targetID string) WSMessag
 	}
 }
 
-func HandleSocketPayloadEvents(client *Client, msg WSMessage) {
+// socketEventLabel keeps client supplied event types from exploding metric cardinality
+func socketEventLabel(msgType string) string {
+	switch msgType {
+	case "message", "typing", "join", "disconnect":
+		return msgType
+	default:
+		return "other"
+	}
+}
+
+// startEventSpan opens the span covering one socket event, from decoding to the last publish
+func startEventSpan(c *Client, msgType string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(context.Background(), "socket "+socketEventLabel(msgType),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("chat.event", msgType),
+			attribute.String("chat.user_id", c.UserID),
+			attribute.String("chat.conn_id", c.ConnID),
+		),
+	)
+}
+
+func HandleSocketPayloadEvents(ctx context.Context, client *Client, msg WSMessage) {
     type chatListResponse struct {
         Type     string      `json:"type"`
         Chatlist interface{} `json:"chatlist"`
@@ -55,64 +89,82 @@ func HandleSocketPayloadEvents(client *Client, msg WSMessage) {
         Status   string `json:"status"` // "Y" or "N"
     }
 
+    rdb := client.Lobby.stores.Redis
+
     switch msg.Type {
     case "join":
-        var userID string
-        if err := json.Unmarshal(msg.Payload, &userID); err != nil {
-            log.Printf("Error unmarshaling join payload: %v", err)
-            return
-        }
-
-        userDetails := GetUserByUserID(userID)
+        // Presence always follows the authenticated socket, never the userID a client claims
+        users := client.Lobby.stores.Users
+        userDetails, _ := users.GetByID(ctx, client.UserID)
 
         if userDetails.ID != "" {
-            if userDetails.Online != "N" {
-                // 1. Broadcast "user_status" (Online) to EVERYONE
-                statusPayload := createWSMessage("user_status", userStatusEvent{
-                    UserID:   userDetails.ID,
-                    Username: userDetails.Username,
-                    Status:   "Y",
-                }, "") 
-                PublishMessage(statusPayload)
-
-                // 2. Send "my-chatlist" ONLY to the joining client (so they know who is online)
-                allOnlineUsersPayload := createWSMessage("chatlist-response", chatListResponse{
-                    Type:     "my-chatlist",
-                    Chatlist: GetAllOnlineUsers(userDetails.ID),
-                }, userDetails.ID)
-                EmitToClient(client.Lobby, allOnlineUsersPayload, userDetails.ID)
-
-                // 3. Flush Offline Messages
-                ctx := context.Background()
-                offlineKey := "offline_msgs:" + userID
-                messages, err := config.RedisClient.LRange(ctx, offlineKey, 0, -1).Result()
-                if err == nil && len(messages) > 0 {
-                    for _, msgStr := range messages {
-                        var savedMsg MessagePayload
-                        json.Unmarshal([]byte(msgStr), &savedMsg)
-                        payload := createWSMessage("message-response", savedMsg, userID)
-                        EmitToClient(client.Lobby, payload, userID)
-                    }
-                    config.RedisClient.Del(ctx, offlineKey)
-                }
+            // The user stays online until their last socket, on any instance, closes
+            if err := addPresence(ctx, rdb, client.UserID, client.ConnID); err != nil {
+                client.log.Error("Error recording socket presence", "error", err)
+            }
+            if err := users.SetOnline(ctx, client.UserID, "Y"); err != nil {
+                client.log.Error("Error marking user online", "error", err)
             }
+
+            // 1. Broadcast "user_status" (Online) to EVERYONE
+            statusPayload := createWSMessage("user_status", userStatusEvent{
+                UserID:   userDetails.ID,
+                Username: userDetails.Username,
+                Status:   "Y",
+            }, "")
+            PublishMessage(ctx, rdb, statusPayload)
+
+            // 2. Send "my-chatlist" ONLY to the joining client (so they know who is online)
+            allOnlineUsersPayload := createWSMessage("chatlist-response", chatListResponse{
+                Type:     "my-chatlist",
+                Chatlist: GetAllOnlineUsers(ctx, users, userDetails.ID),
+            }, userDetails.ID)
+            EmitToClient(client.Lobby, allOnlineUsersPayload, userDetails.ID)
+
+            // 3. Flush Offline Messages (whatever doesn't fit is picked up by writePump later)
+            flushOfflineInbox(client)
         }
 
     case "disconnect":
-        if len(msg.Payload) > 0 {
-            var userID string
-            if err := json.Unmarshal(msg.Payload, &userID); err == nil {
-                userDetails := GetUserByUserID(userID)
-                UpdateUserOnlineStatusByUserID(userID, "N")
-
-                // Broadcast "user_status" (Offline) to EVERYONE
-                disconnectMsg := createWSMessage("user_status", userStatusEvent{
-                    UserID:   userDetails.ID,
-                    Username: userDetails.Username,
-                    Status:   "N",
-                }, "")
-                PublishMessage(disconnectMsg)
+        // A socket the user reconnected elsewhere, e.g. from a draining instance, keeps them online
+        open, err := removePresence(ctx, rdb, client.UserID, client.ConnID)
+        if err != nil {
+            client.log.Error("Error removing socket presence", "error", err)
+            return
+        }
+        if open > 0 {
+            return
+        }
+
+        users := client.Lobby.stores.Users
+        userDetails, _ := users.GetByID(ctx, client.UserID)
+        if userDetails.ID == "" {
+            return
+        }
+        if err := users.SetOnline(ctx, client.UserID, "N"); err != nil {
+            client.log.Error("Error marking user offline", "error", err)
+            return
+        }
+
+        // Broadcast "user_status" (Offline) to EVERYONE
+        disconnectMsg := createWSMessage("user_status", userStatusEvent{
+            UserID:   userDetails.ID,
+            Username: userDetails.Username,
+            Status:   "N",
+        }, "")
+        PublishMessage(ctx, rdb, disconnectMsg)
+
+        // A socket opened in between may have marked the user online before this marked them offline
+        if open, err := openSockets(ctx, rdb, client.UserID); err == nil && open > 0 {
+            if err := users.SetOnline(ctx, client.UserID, "Y"); err != nil {
+                client.log.Error("Error marking user online", "error", err)
+                return
             }
+            PublishMessage(ctx, rdb, createWSMessage("user_status", userStatusEvent{
+                UserID:   userDetails.ID,
+                Username: userDetails.Username,
+                Status:   "Y",
+            }, ""))
         }
 
     case "message":
@@ -128,8 +180,8 @@ func HandleSocketPayloadEvents(client *Client, msg WSMessage) {
         msgType := payloadData["type"]
         if msgType == "" { msgType = "text" }
 
-        fromUser := GetUserByUserID(fromUserID)
-        toUser := GetUserByUserID(toUserID)
+        fromUser, _ := client.Lobby.stores.Users.GetByID(ctx, fromUserID)
+        toUser, _ := client.Lobby.stores.Users.GetByID(ctx, toUserID)
 
         if message != "" && fromUserID != "" && toUserID != "" {
             messagePacket := MessagePayload{
@@ -143,33 +195,33 @@ func HandleSocketPayloadEvents(client *Client, msg WSMessage) {
 
             if toUserID == "global" {
                 globalPayload := createWSMessage("message-response", messagePacket, "") 
-                PublishMessage(globalPayload)
+                PublishMessage(ctx, rdb, globalPayload)
                 
                 ctx := context.Background()
                 jsonMsg, _ := json.Marshal(messagePacket)
-                config.RedisClient.LPush(ctx, "global_chat_history", jsonMsg)
-                config.RedisClient.LTrim(ctx, "global_chat_history", 0, 49)
+                rdb.LPush(ctx, "global_chat_history", jsonMsg)
+                rdb.LTrim(ctx, "global_chat_history", 0, 49)
                 
             } else if toUserID == "random" || isRandomChat(toUserID) { 
                 responsePayload := createWSMessage("message-response", messagePacket, toUserID)
-                PublishMessage(responsePayload)
+                PublishMessage(ctx, rdb, responsePayload)
             } else {
-                StoreNewMessages(messagePacket)
+                StoreNewMessages(ctx, client.Lobby.stores.Messages, messagePacket)
 
                 responsePayload := createWSMessage("message-response", messagePacket, toUserID)
-                PublishMessage(responsePayload)
+                PublishMessage(ctx, rdb, responsePayload)
 
                 if toUser.Online != "Y" {
                     ctx := context.Background()
                     jsonMsg, _ := json.Marshal(messagePacket)
-                    config.RedisClient.RPush(ctx, "offline_msgs:"+toUserID, jsonMsg)
+                    rdb.RPush(ctx, offlineInboxKey(toUserID), jsonMsg)
                 }
 
                 if fromUserID != toUserID {
                     ackPayload := createWSMessage("message-response", messagePacket, fromUserID)
-                    PublishMessage(ackPayload)
+                    PublishMessage(ctx, rdb, ackPayload)
                 }
-                SendNotification(toUserID, fromUser.Username, "new_message", "New message from "+fromUser.Username)
+                SendNotification(ctx, rdb, toUserID, fromUser.Username, "new_message", "New message from "+fromUser.Username)
             }
         }
 
@@ -180,7 +232,7 @@ func HandleSocketPayloadEvents(client *Client, msg WSMessage) {
         }
         toUserID := payloadData["toUserID"].(string)
         // Broadcast typing to the target user
-        PublishMessage(createWSMessage("typing-response", payloadData, toUserID))
+        PublishMessage(ctx, rdb, createWSMessage("typing-response", payloadData, toUserID))
     }
 }
 
@@ -211,7 +263,7 @@ func (c *Client) readPump() {
 
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error ===: %v", err)
+				c.log.Warn("Socket closed unexpectedly", "error", err)
 			}
 			break
 		}
@@ -220,11 +272,37 @@ func (c *Client) readPump() {
 		decoderErr := decoder.Decode(&msg)
 
 		if decoderErr != nil {
-			log.Printf("error: %v", decoderErr)
+			c.log.Warn("Dropping connection after malformed payload", "error", decoderErr)
 			break
 		}
 
-		HandleSocketPayloadEvents(c, msg)
+		metrics.MessagesTotal.WithLabelValues(socketEventLabel(msg.Type)).Inc()
+		c.log.Debug("Socket event received", "type", msg.Type)
+
+		if !c.Lobby.limits.allowEvent(c, msg.Type) {
+			continue
+		}
+
+		ctx, span := startEventSpan(c, msg.Type)
+		HandleSocketPayloadEvents(ctx, c, msg)
+		span.End()
+	}
+}
+
+// writePayload encodes one message into the current frame. The span continues the trace
+// carried by the message, so the time spent waiting in the send buffer shows up as a gap.
+func (c *Client) writePayload(w io.Writer, payload WSMessage) {
+	ctx := tracing.Extract(context.Background(), payload.Trace)
+	_, span := tracing.Tracer().Start(ctx, "socket write "+payload.Type,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("chat.conn_id", c.ConnID)),
+	)
+	defer span.End()
+
+	// Trace context is only for server hops, clients never see it
+	payload.Trace = nil
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		span.RecordError(err)
 	}
 }
 
@@ -253,18 +331,23 @@ func (c *Client) writePump() {
 			}
 
 			// Encode the WSMessage struct to JSON
-			json.NewEncoder(w).Encode(payload)
+			c.writePayload(w, payload)
 
 			// Add queued messages to the current websocket frame
 			n := len(c.Send)
 			for i := 0; i < n; i++ {
-				json.NewEncoder(w).Encode(<-c.Send)
+				c.writePayload(w, <-c.Send)
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
 
+			// Once the queue has drained, retry anything that overflowed into the offline inbox
+			if len(c.Send) == 0 && c.inboxPending.CompareAndSwap(true, false) {
+				flushOfflineInbox(c)
+			}
+
 		// This sends a ping message every pingPeriod to check if the client is still connected.
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -275,13 +358,19 @@ func (c *Client) writePump() {
 	}
 }
 
-func CreateClient(lobby *Lobby, connection *websocket.Conn, userID string) {
+// CreateClient registers a freshly upgraded socket. logger is the request logger of the
+// upgrade request, so socket log lines share its request ID.
+func CreateClient(lobby *Lobby, connection *websocket.Conn, userID string, logger *slog.Logger) {
+	connID := logging.NewID()
 	client := &Client{
 		Lobby:  lobby,
 		Conn:   connection,
-		Send:   make(chan WSMessage),
+		Send:   make(chan WSMessage, lobby.sendBufferSize),
 		UserID: userID,
+		ConnID: connID,
+		log:    logger.With(slog.String(logging.KeyUserID, userID), slog.String(logging.KeyConnID, connID)),
 	}
+	client.log.Info("Socket connected")
 
 	go client.writePump() // uses ping, mssg: server
 	go client.readPump()  // uses pong
@@ -291,12 +380,18 @@ func CreateClient(lobby *Lobby, connection *websocket.Conn, userID string) {
 
 // Join for new Socket Users
 func HandleUserRegisterEvent(lobby *Lobby, client *Client) {
+	lobby.mu.Lock()
 	lobby.clients[client] = true
+	lobby.mu.Unlock()
+	metrics.ConnectedSockets.Inc()
 
 	// Create payload manually for the internal event
 	payloadBytes, _ := json.Marshal(client.UserID)
 
-	HandleSocketPayloadEvents(client, WSMessage{
+	ctx, span := startEventSpan(client, "join")
+	defer span.End()
+
+	HandleSocketPayloadEvents(ctx, client, WSMessage{
 		Type:    "join",
 		Payload: payloadBytes,
 	})
@@ -304,17 +399,27 @@ func HandleUserRegisterEvent(lobby *Lobby, client *Client) {
 
 // Disconnect for Socket Users
 func HandleUserDisconnectEvent(lobby *Lobby, client *Client) {
+	lobby.mu.Lock()
 	_, ok := lobby.clients[client]
 	if ok {
 		// remove client from lobby and close the communication channel
 		delete(lobby.clients, client)
-		close(client.Send)
+		client.closeSend()
+	}
+	lobby.mu.Unlock()
+
+	if ok {
+		metrics.ConnectedSockets.Dec()
+		client.log.Info("Socket disconnected")
 
 		// Create payload manually
 		payloadBytes, _ := json.Marshal(client.UserID)
 
+		ctx, span := startEventSpan(client, "disconnect")
+		defer span.End()
+
 		// close the websocket connection
-		HandleSocketPayloadEvents(client, WSMessage{
+		HandleSocketPayloadEvents(ctx, client, WSMessage{
 			Type:    "disconnect",
 			Payload: payloadBytes,
 		})
@@ -322,39 +427,34 @@ func HandleUserDisconnectEvent(lobby *Lobby, client *Client) {
 }
 
 // Helper functions (Preserved for Redis Adapter usage)
+// Full send buffers are handled by Client.deliver according to the event's OverflowPolicy
 func EmitToClient(lobby *Lobby, payload WSMessage, userID string) {
+	lobby.mu.RLock()
+	defer lobby.mu.RUnlock()
+
 	for client := range lobby.clients {
 		if client.UserID == userID {
-			select {
-			case client.Send <- payload:
-			default:
-				close(client.Send)
-				delete(lobby.clients, client)
-			}
+			client.deliver(payload)
 		}
 	}
 }
 
 func BroadcastToEveryone(lobby *Lobby, payload WSMessage) {
+	lobby.mu.RLock()
+	defer lobby.mu.RUnlock()
+
 	for client := range lobby.clients {
-		select {
-		case client.Send <- payload:
-		default:
-			close(client.Send)
-			delete(lobby.clients, client)
-		}
+		client.deliver(payload)
 	}
 }
 
 func BroadcastToEveryoneExceptme(lobby *Lobby, payload WSMessage, myUserID string) {
+	lobby.mu.RLock()
+	defer lobby.mu.RUnlock()
+
 	for client := range lobby.clients {
 		if client.UserID != myUserID {
-			select {
-			case client.Send <- payload:
-			default:
-				close(client.Send)
-				delete(lobby.clients, client)
-			}
+			client.deliver(payload)
 		}
 	}
 }
@@ -368,4 +468,4 @@ func BroadcastLocal(lobby *Lobby, payload WSMessage) {
 
 	// Otherwise broadcast to everyone on this server
 	BroadcastToEveryone(lobby, payload)
-}
\ No newline at end of file
+}
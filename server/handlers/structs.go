@@ -2,28 +2,26 @@ package handlers
 
 import (
 	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"chat-app/models"
+
 	"github.com/gorilla/websocket"
 )
 
-type UserDetails struct {
-	ID        string    `bson:"_id,omitempty"`
-	Username  string    `json:"username" binding:"required" bson:"username"`
-	Password  string    `json:"-" bson:"password"`
-	Online    string    `json:"online" bson:"online"`
-	SocketID  string    `json:"socketId,omitempty" bson:"socketId,omitempty"`
-	CreatedAt time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
-}
-
-type Message struct {
-	ID         string    `json:"id" bson:"_id,omitempty"`
-	Message    string    `json:"message" binding:"required" bson:"message"`
-	ToUserID   string    `json:"toUserID" binding:"required" bson:"toUserID"`
-	FromUserID string    `json:"fromUserID" binding:"required" bson:"fromUserID"`
-	Type       string    `json:"type" bson:"type"` // "text", "image", "file"
-	CreatedAt  time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
-}
+// Persisted documents live in the models package so the stores can share them
+type (
+	UserDetails   = models.UserDetails
+	Message       = models.Message
+	Friendship    = models.Friendship
+	GroupMember   = models.GroupMember
+	GroupSettings = models.GroupSettings
+	GroupDetails  = models.GroupDetails
+	GroupMessage  = models.GroupMessage
+)
 
 // GroupMessagePayload is used for broadcasting group messages via WebSocket/Redis
 type GroupMessagePayload struct {
@@ -34,15 +32,6 @@ type GroupMessagePayload struct {
 	CreatedAt  time.Time `json:"createdAt"`
 }
 
-// NEW: Friend System Structs
-type Friendship struct {
-	ID          string    `json:"id" bson:"_id,omitempty"`
-	RequesterID string    `json:"requesterID" bson:"requesterID"`
-	AddresseeID string    `json:"addresseeID" bson:"addresseeID"`
-	Status      string    `json:"status" bson:"status"` // "pending", "accepted"
-	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
-}
-
 type FriendRequestPayload struct {
 	TargetUsername string `json:"targetUsername" binding:"required"`
 }
@@ -61,18 +50,73 @@ type LoginRequest struct {
 type RegistrationRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	Email    string `json:"email"` // optional, needed to recover the account
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required"`
+}
+
+// Accounts without a password send Reauth, the code of a fresh OIDC login, instead of Password
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+	Reauth   string `json:"reauth"`
+}
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"` // TOTP code or recovery code
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Reauth   string `json:"reauth"` // instead of Password for accounts without one
+	Code     string `json:"code" binding:"required"`
+}
+
+type OIDCSessionRequest struct {
+	Code string `json:"code" binding:"required"` // from the ?code= of the callback redirect
+}
+
+type TwoFactorEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// URI for a QR code
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
 }
 
 type UserResponse struct {
 	Username string `json:"username"`
 	UserID   string `json:"userID"`
 	Online   string `json:"online"`
+	Token    string `json:"token,omitempty"` // session token, only returned by login and registration
+
+	// Set instead of Token when the password was right but a second factor is needed
+	TwoFactorRequired bool   `json:"twoFactorRequired,omitempty"`
+	Challenge         string `json:"challenge,omitempty"`
 }
 
 type WSMessage struct {
-	Type     string          `json:"type"`
-	Payload  json.RawMessage `json:"payload"`
-	TargetID string          `json:"targetID,omitempty"`
+	Type     string            `json:"type"`
+	Payload  json.RawMessage   `json:"payload"`
+	TargetID string            `json:"targetID,omitempty"`
+	Trace    map[string]string `json:"trace,omitempty"` // W3C trace context for the Redis pub/sub hop
 }
 
 type Client struct {
@@ -80,6 +124,14 @@ type Client struct {
 	Conn   *websocket.Conn
 	Send   chan WSMessage
 	UserID string
+	ConnID string
+
+	log *slog.Logger // carries user_id and conn_id on every line
+
+	sendMu       sync.Mutex
+	sendClosed   bool
+	closeOnce    sync.Once
+	inboxPending atomic.Bool // messages were parked in the offline inbox while the buffer was full
 }
 
 type MessagePayload struct {
@@ -98,31 +150,6 @@ type APIResponse struct {
 	Response interface{} `json:"response"`
 }
 
-type GroupMember struct {
-	UserID   string    `json:"userID" bson:"userID"`
-	Username string    `json:"username,omitempty" bson:"username,omitempty"`
-	Role     string    `json:"role" bson:"role"` // "admin", "member"
-	JoinedAt time.Time `json:"joinedAt" bson:"joinedAt"`
-}
-
-type GroupSettings struct {
-	IsPublic          bool `json:"isPublic" bson:"isPublic"`
-	AllowInvites      bool `json:"allowInvites" bson:"allowInvites"`
-	MessagesCanDelete bool `json:"messagesCanDelete" bson:"messagesCanDelete"`
-}
-
-type GroupDetails struct {
-	ID          string        `json:"id" bson:"_id,omitempty"`
-	Name        string        `json:"name" bson:"name"`
-	Description string        `json:"description" bson:"description"`
-	Avatar      string        `json:"avatar" bson:"avatar"`
-	CreatorID   string        `json:"creatorID" bson:"creatorID"`
-	Members     []GroupMember `json:"members" bson:"members"`
-	Settings    GroupSettings `json:"settings" bson:"settings"`
-	CreatedAt   time.Time     `json:"createdAt" bson:"createdAt"`
-	UpdatedAt   time.Time     `json:"updatedAt" bson:"updatedAt"`
-}
-
 type GroupResponse struct {
 	GroupID     string    `json:"groupID"`
 	Name        string    `json:"name"`
@@ -153,15 +180,6 @@ type UpdateGroupRequest struct {
 	Avatar      string `json:"avatar"`
 }
 
-type GroupMessage struct {
-	ID         string    `json:"id" bson:"_id,omitempty"`
-	GroupID    string    `json:"groupID" bson:"groupID"`
-	FromUserID string    `json:"fromUserID" bson:"fromUserID"`
-	Message    string    `json:"message" bson:"message"`
-	Type       string    `json:"type" bson:"type"` // "text", "image", "file"
-	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
-}
-
 type GroupMessageRequest struct {
 	GroupID    string `json:"groupID" binding:"required"`
 	FromUserID string `json:"fromUserID" binding:"required"`
@@ -171,7 +189,35 @@ type GroupMessageRequest struct {
 
 type StartCallRequest struct {
 	GroupID  string `json:"groupID" binding:"required"`
-	CallerID string `json:"callerID" binding:"required"`
+	CallerID string `json:"callerID"` // optional, the caller is the signed in user
+}
+
+// VideoJoinResponse is handed to the client to open /ws/:roomId?token=... on the video service
+type VideoJoinResponse struct {
+	RoomID    string    `json:"roomId"`
+	GroupID   string    `json:"groupId"`
+	Role      string    `json:"role"` // host, moderator or participant
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// VideoRecordingRequest is sent by the video service once a recording of a group call ended
+type VideoRecordingRequest struct {
+	RecordingID string               `json:"recordingId" binding:"required"`
+	RoomID      string               `json:"roomId" binding:"required"`
+	GroupID     string               `json:"groupId" binding:"required"`
+	StartedBy   string               `json:"startedBy"`
+	StartedAt   time.Time            `json:"startedAt"`
+	StoppedAt   time.Time            `json:"stoppedAt"`
+	Files       []VideoRecordingFile `json:"files"`
+}
+
+type VideoRecordingFile struct {
+	Name     string `json:"name"`
+	UserID   string `json:"userId"`
+	Kind     string `json:"kind"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
 }
 
 // Video call related structs (for integration)
@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"chat-app/auth"
+	"chat-app/constants"
+	"chat-app/logging"
+	"chat-app/models"
+	"chat-app/store"
+	"chat-app/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const recoveryCodeCount = 10
+
+// LoginTwoFactor is the second login step. The challenge comes from Login after the
+// password was verified, the code is either a TOTP code or an unused recovery code.
+func LoginTwoFactor(stores *store.Stores, accounts *Accounts, limits *RateLimits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		logger := logging.FromContext(ctx)
+
+		var request TwoFactorLoginRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.InvalidTwoFactorCode)
+			return
+		}
+
+		userID, err := accounts.challenges.Lookup(ctx, request.Challenge)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, constants.InvalidLoginChallenge)
+			return
+		}
+		user, err := stores.Users.GetByID(ctx, userID)
+		if err != nil || !twoFactorEnabled(user) {
+			respondError(c, http.StatusUnauthorized, constants.InvalidLoginChallenge)
+			return
+		}
+		if user.Disabled {
+			respondError(c, http.StatusForbidden, constants.AccountIsDisabled)
+			return
+		}
+
+		// Wrong codes count towards the same lockout as wrong passwords
+		lockKeys := loginKeys(c, user.Username)
+		if lockedFor := limits.logins.LockedFor(ctx, lockKeys...); lockedFor > 0 {
+			abortTooManyRequests(c, constants.TooManyLoginAttempts, lockedFor)
+			return
+		}
+
+		ok, err := verifySecondFactor(ctx, stores.Users, user, request.Code)
+		if err != nil {
+			logger.Error("Failed to verify second factor", "user_id", user.ID, "error", err)
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		if !ok {
+			limits.logins.Fail(ctx, lockKeys...)
+			respondError(c, http.StatusUnauthorized, constants.InvalidTwoFactorCode)
+			return
+		}
+
+		if consumedBy, err := accounts.challenges.Consume(ctx, request.Challenge); err != nil || consumedBy != user.ID {
+			respondError(c, http.StatusUnauthorized, constants.InvalidLoginChallenge)
+			return
+		}
+		limits.logins.Reset(ctx, lockKeys[0])
+
+		if err := stores.Users.SetOnline(ctx, user.ID, "Y"); err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		token, err := accounts.sessions.Create(ctx, user.ID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:    http.StatusOK,
+			Status:  http.StatusText(http.StatusOK),
+			Message: constants.UserLoginCompleted,
+			Response: UserResponse{
+				Username: user.Username,
+				UserID:   user.ID,
+				Token:    token,
+			},
+		})
+	}
+}
+
+// EnrollTwoFactor starts enrollment with a fresh secret. It only becomes active after
+// VerifyTwoFactor, so a user who never scans the QR code isn't locked out.
+func EnrollTwoFactor(stores *store.Stores, accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		user, err := stores.Users.GetByID(ctx, currentSession(c).UserID)
+		if err != nil {
+			respondError(c, http.StatusNotFound, constants.UserIsNotRegisteredWithUs)
+			return
+		}
+		if twoFactorEnabled(user) {
+			respondError(c, http.StatusConflict, constants.TwoFactorAlreadyEnabled)
+			return
+		}
+
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		if err := stores.Users.SetTwoFactor(ctx, user.ID, &models.TwoFactor{PendingSecret: secret}); err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:    http.StatusOK,
+			Status:  http.StatusText(http.StatusOK),
+			Message: constants.TwoFactorEnrollmentStarted,
+			Response: TwoFactorEnrollmentResponse{
+				Secret: secret,
+				URI:    auth.TOTPProvisioningURI(accounts.issuer, user.Username, secret),
+			},
+		})
+	}
+}
+
+// VerifyTwoFactor confirms enrollment with a code from the app, turns two-factor
+// authentication on and returns the recovery codes. They are never shown again.
+func VerifyTwoFactor(stores *store.Stores, accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		logger := logging.FromContext(ctx)
+		session := currentSession(c)
+
+		var request TwoFactorCodeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.InvalidTwoFactorCode)
+			return
+		}
+
+		user, err := stores.Users.GetByID(ctx, session.UserID)
+		if err != nil {
+			respondError(c, http.StatusNotFound, constants.UserIsNotRegisteredWithUs)
+			return
+		}
+		if twoFactorEnabled(user) {
+			respondError(c, http.StatusConflict, constants.TwoFactorAlreadyEnabled)
+			return
+		}
+		if user.TwoFactor == nil || user.TwoFactor.PendingSecret == "" {
+			respondError(c, http.StatusBadRequest, constants.TwoFactorNotEnabled)
+			return
+		}
+
+		step, ok := auth.ValidateTOTP(user.TwoFactor.PendingSecret, request.Code, time.Now())
+		if !ok {
+			respondError(c, http.StatusBadRequest, constants.InvalidTwoFactorCode)
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		err = stores.Users.SetTwoFactor(ctx, user.ID, &models.TwoFactor{
+			Enabled:       true,
+			Secret:        user.TwoFactor.PendingSecret,
+			RecoveryCodes: hashes,
+			LastUsedStep:  step,
+			EnabledAt:     time.Now().UTC(),
+		})
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		// Sessions opened with only the password shouldn't outlive the switch
+		revoked, err := accounts.sessions.RevokeAll(ctx, user.ID, session.ID)
+		if err != nil {
+			logger.Error("Two-factor enabled but revoking sessions failed", "user_id", user.ID, "error", err)
+		}
+		logger.Info("Two-factor authentication enabled", "user_id", user.ID, "revoked_sessions", revoked)
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.TwoFactorEnabled,
+			Response: RecoveryCodesResponse{RecoveryCodes: codes},
+		})
+	}
+}
+
+// DisableTwoFactor needs both the password (or a fresh OIDC login) and a current code
+func DisableTwoFactor(stores *store.Stores, accounts *Accounts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var request DisableTwoFactorRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.PasswordCantBeEmpty)
+			return
+		}
+
+		user, err := stores.Users.GetByID(ctx, currentSession(c).UserID)
+		if err != nil {
+			respondError(c, http.StatusNotFound, constants.UserIsNotRegisteredWithUs)
+			return
+		}
+		if !twoFactorEnabled(user) {
+			respondError(c, http.StatusBadRequest, constants.TwoFactorNotEnabled)
+			return
+		}
+		if !confirmIdentity(c, accounts, user, request.Password, request.Reauth) {
+			return
+		}
+		if !verifyCodeOrRespond(c, stores.Users, user, request.Code) {
+			return
+		}
+
+		if err := stores.Users.SetTwoFactor(ctx, user.ID, nil); err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		logging.FromContext(ctx).Info("Two-factor authentication disabled", "user_id", user.ID)
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.TwoFactorDisabled,
+			Response: nil,
+		})
+	}
+}
+
+// RegenerateRecoveryCodes replaces every recovery code, used or not
+func RegenerateRecoveryCodes(stores *store.Stores) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var request TwoFactorCodeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, constants.InvalidTwoFactorCode)
+			return
+		}
+
+		userID := currentSession(c).UserID
+		user, err := stores.Users.GetByID(ctx, userID)
+		if err != nil {
+			respondError(c, http.StatusNotFound, constants.UserIsNotRegisteredWithUs)
+			return
+		}
+		if !twoFactorEnabled(user) {
+			respondError(c, http.StatusBadRequest, constants.TwoFactorNotEnabled)
+			return
+		}
+		if !verifyCodeOrRespond(c, stores.Users, user, request.Code) {
+			return
+		}
+
+		// Reload so the step recorded by the verification isn't overwritten
+		user, err = stores.Users.GetByID(ctx, userID)
+		if err != nil || !twoFactorEnabled(user) {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+		updated := *user.TwoFactor
+		updated.RecoveryCodes = hashes
+		if err := stores.Users.SetTwoFactor(ctx, user.ID, &updated); err != nil {
+			respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.RecoveryCodesRegenerated,
+			Response: RecoveryCodesResponse{RecoveryCodes: codes},
+		})
+	}
+}
+
+func twoFactorEnabled(user UserDetails) bool {
+	return user.TwoFactor != nil && user.TwoFactor.Enabled
+}
+
+// verifyCodeOrRespond checks the code for a signed in user and answers the request when it fails
+func verifyCodeOrRespond(c *gin.Context, users store.UserStore, user UserDetails, code string) bool {
+	ok, err := verifySecondFactor(c.Request.Context(), users, user, code)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("Failed to verify second factor", "user_id", user.ID, "error", err)
+		respondError(c, http.StatusInternalServerError, constants.ServerFailedResponse)
+		return false
+	}
+	if !ok {
+		respondError(c, http.StatusForbidden, constants.InvalidTwoFactorCode)
+		return false
+	}
+	return true
+}
+
+// verifySecondFactor accepts a TOTP code that wasn't used before or an unused recovery code.
+// Both are spent with a conditional update, so concurrent requests can't use a code twice.
+func verifySecondFactor(ctx context.Context, users store.UserStore, user UserDetails, code string) (bool, error) {
+	twoFactor := user.TwoFactor
+
+	if auth.IsTOTPCode(code) {
+		step, ok := auth.ValidateTOTP(twoFactor.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		err := users.UseTOTPStep(ctx, user.ID, step)
+		if errors.Is(err, store.ErrAlreadyExists) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	normalized := auth.NormalizeRecoveryCode(code)
+	for _, hash := range twoFactor.RecoveryCodes {
+		if utils.VerifyPassword(hash, normalized) != nil {
+			continue
+		}
+		err := users.UseRecoveryCode(ctx, user.ID, hash)
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		if err == nil {
+			logging.FromContext(ctx).Info("Recovery code used", "user_id", user.ID, "remaining", len(twoFactor.RecoveryCodes)-1)
+		}
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// newRecoveryCodes returns the codes to show once and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		if hashes[i], err = utils.HashPassword(auth.NormalizeRecoveryCode(code)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return codes, hashes, nil
+}
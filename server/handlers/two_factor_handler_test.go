@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-app/auth"
+	"chat-app/constants"
+	"chat-app/models"
+)
+
+// totpAt computes the code an authenticator app shows for secret at the given time
+func totpAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff%1_000_000)
+}
+
+// loginChallenge runs the password step of a two-factor login and returns the challenge
+func loginChallenge(t *testing.T, env *testEnv, username, password string) string {
+	t.Helper()
+	rec := serve(newAuthRouter(env), http.MethodPost, "/api/auth/login", LoginRequest{Username: username, Password: password})
+	var user UserResponse
+	decodeResponse(t, rec, &user)
+	if rec.Code != http.StatusOK || user.Challenge == "" {
+		t.Fatalf("password step answered %d without a challenge: %+v", rec.Code, user)
+	}
+	return user.Challenge
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	env := newTestEnv(t, nil)
+	router := newAuthRouter(env)
+	ctx := t.Context()
+
+	userID := env.createUser(t, "ada", "correct horse", nil)
+	otherDevice, _ := env.accounts.sessions.Create(ctx, userID)
+	token := mustLogin(t, router, "ada", "correct horse")
+
+	rec := serve(router, http.MethodPost, "/api/auth/2fa/enroll", nil, bearer(token)...)
+	var enrollment TwoFactorEnrollmentResponse
+	decodeResponse(t, rec, &enrollment)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(enrollment.URI, "otpauth://totp/") {
+		t.Fatalf("enroll answered %d: %+v", rec.Code, enrollment)
+	}
+
+	// Until it's verified the password alone still signs in
+	mustLogin(t, router, "ada", "correct horse")
+
+	now := time.Now()
+	verifications := []struct {
+		name       string
+		code       string
+		wantStatus int
+	}{
+		{name: "wrong code", code: "abcdef", wantStatus: http.StatusBadRequest},
+		{name: "code from the app", code: totpAt(t, enrollment.Secret, now), wantStatus: http.StatusOK},
+		{name: "already enabled", code: totpAt(t, enrollment.Secret, now), wantStatus: http.StatusConflict},
+	}
+	var recovery RecoveryCodesResponse
+	for _, tt := range verifications {
+		rec := serve(router, http.MethodPost, "/api/auth/2fa/verify", TwoFactorCodeRequest{Code: tt.code}, bearer(token)...)
+		if rec.Code != tt.wantStatus {
+			t.Fatalf("%s: verify answered %d, want %d: %s", tt.name, rec.Code, tt.wantStatus, rec.Body.String())
+		}
+		if rec.Code == http.StatusOK {
+			decodeResponse(t, rec, &recovery)
+		}
+	}
+	if len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recovery.RecoveryCodes), recoveryCodeCount)
+	}
+
+	if _, err := env.accounts.sessions.Get(ctx, otherDevice); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Fatalf("session opened with the password alone survived enabling two-factor: %v", err)
+	}
+	if _, err := env.accounts.sessions.Get(ctx, token); err != nil {
+		t.Fatalf("the session that enabled two-factor was revoked: %v", err)
+	}
+	loginChallenge(t, env, "ada", "correct horse")
+
+	// Disabling needs the password and a code, the step verify used is spent
+	disable := DisableTwoFactorRequest{Password: "correct horse", Code: totpAt(t, enrollment.Secret, now)}
+	if rec := serve(router, http.MethodPost, "/api/auth/2fa/disable", disable, bearer(token)...); rec.Code != http.StatusForbidden {
+		t.Fatalf("disable with a spent code answered %d", rec.Code)
+	}
+	disable.Code = recovery.RecoveryCodes[0]
+	if rec := serve(router, http.MethodPost, "/api/auth/2fa/disable", disable, bearer(token)...); rec.Code != http.StatusOK {
+		t.Fatalf("disable answered %d: %s", rec.Code, rec.Body.String())
+	}
+	mustLogin(t, router, "ada", "correct horse")
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	env := newTestEnv(t, nil)
+	router := newAuthRouter(env)
+	ctx := t.Context()
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := env.createUser(t, "ada", "correct horse", func(user *models.UserDetails) {
+		user.TwoFactor = &models.TwoFactor{Enabled: true, Secret: secret, RecoveryCodes: hashes}
+	})
+	totp := totpAt(t, secret, time.Now())
+
+	// The cases run in order, later ones retry what earlier ones spent
+	tests := []struct {
+		name        string
+		code        string
+		challenge   string // a fresh one from the password step if empty
+		wantStatus  int
+		wantMessage string
+	}{
+		{name: "totp", code: totp, wantStatus: http.StatusOK, wantMessage: constants.UserLoginCompleted},
+		{name: "replayed totp", code: totp, wantStatus: http.StatusUnauthorized, wantMessage: constants.InvalidTwoFactorCode},
+		{name: "recovery code as typed", code: strings.ToUpper(strings.Replace(codes[0], "-", " ", 1)), wantStatus: http.StatusOK, wantMessage: constants.UserLoginCompleted},
+		{name: "spent recovery code", code: codes[0], wantStatus: http.StatusUnauthorized, wantMessage: constants.InvalidTwoFactorCode},
+		{name: "unknown recovery code", code: "aaaaa-aaaaa", wantStatus: http.StatusUnauthorized, wantMessage: constants.InvalidTwoFactorCode},
+		{name: "unknown challenge", code: codes[1], challenge: "not-a-challenge", wantStatus: http.StatusUnauthorized, wantMessage: constants.InvalidLoginChallenge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge := tt.challenge
+			if challenge == "" {
+				challenge = loginChallenge(t, env, "ada", "correct horse")
+			}
+			rec := serve(router, http.MethodPost, "/api/auth/login/2fa", TwoFactorLoginRequest{Challenge: challenge, Code: tt.code})
+			var user UserResponse
+			message := decodeResponse(t, rec, &user)
+			if rec.Code != tt.wantStatus || message != tt.wantMessage {
+				t.Fatalf("answered %d %q, want %d %q", rec.Code, message, tt.wantStatus, tt.wantMessage)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			if session, err := env.accounts.sessions.Get(ctx, user.Token); err != nil || session.UserID != userID {
+				t.Fatalf("token belongs to %q (%v), want %q", session.UserID, err, userID)
+			}
+			// The challenge is spent with the login
+			rec = serve(router, http.MethodPost, "/api/auth/login/2fa", TwoFactorLoginRequest{Challenge: challenge, Code: codes[2]})
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("reusing the challenge answered %d", rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Namespace is shared with the video service so both export the same metric names
+const Namespace = "gopherchat"
+
+var (
+	ConnectedSockets = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "connected_sockets",
+		Help:      "Number of WebSocket connections currently open on this instance.",
+	})
+
+	// MessagesTotal counts inbound socket events, rate() gives messages per second by type
+	MessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "messages_total",
+		Help:      "Socket messages received, by message type.",
+	}, []string{"type"})
+
+	DroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "dropped_messages_total",
+		Help:      "Outbound messages that were never delivered, by message type and reason.",
+	}, []string{"type", "reason"})
+
+	// SendQueueOverflows counts events that found a client's send buffer full, by the policy applied
+	SendQueueOverflows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "send_queue_overflows_total",
+		Help:      "Outbound messages that found a client's send buffer full, by message type and overflow policy.",
+	}, []string{"type", "policy"})
+
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests and socket events rejected by the rate limiter, by route or event.",
+	}, []string{"scope"})
+
+	RedisCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Latency of Redis commands (including PUBLISH), by command.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"command"})
+
+	MongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "mongo_command_duration_seconds",
+		Help:      "Latency of MongoDB commands, by command and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"command", "status"})
+)
+
+// redisHook times every command that goes through a go-redis client
+type redisHook struct{}
+
+// RedisHook returns a go-redis hook that feeds RedisCommandDuration
+func RedisHook() redis.Hook {
+	return redisHook{}
+}
+
+func (redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		RedisCommandDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		RedisCommandDuration.WithLabelValues("pipeline").Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// MongoMonitor returns a command monitor that feeds MongoCommandDuration.
+// The driver reports the duration on the succeeded/failed events, so no bookkeeping of start times is needed.
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			MongoCommandDuration.WithLabelValues(e.CommandName, "ok").Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			MongoCommandDuration.WithLabelValues(e.CommandName, "error").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+var registerOnce sync.Once
+
+// RegisterSendQueueGauges exposes the outbound queue depth of the lobby.
+// The values are computed at scrape time from the supplied functions.
+func RegisterSendQueueGauges(queued, maxDepth func() float64) {
+	registerOnce.Do(func() {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "send_queue_depth",
+			Help:      "Messages waiting in all client send buffers on this instance.",
+		}, queued)
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "send_queue_max_depth",
+			Help:      "Deepest single client send buffer on this instance.",
+		}, maxDepth)
+	})
+}
@@ -0,0 +1,221 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is one versioned change to the database. Up must be safe to re-run
+// if it failed halfway, only completed migrations are recorded.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+// Status reports whether a migration has been applied
+type Status struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"appliedAt,omitempty"`
+}
+
+const (
+	collectionName = "schema_migrations"
+	lockID         = "lock"
+	lockTTL        = 5 * time.Minute
+	lockRenew      = lockTTL / 3
+	lockRetry      = 2 * time.Second
+)
+
+type appliedRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// ordered returns the registry sorted by version, rejecting duplicate versions
+func ordered() ([]Migration, error) {
+	sorted := append([]Migration(nil), registry...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Version == sorted[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", sorted[i].Version)
+		}
+	}
+	return sorted, nil
+}
+
+// Up applies every pending migration in version order. Instances starting at the same time
+// take turns through a lock document, the loser waits and then finds nothing left to do.
+func Up(ctx context.Context, db *mongo.Database) error {
+	pending, err := ordered()
+	if err != nil {
+		return err
+	}
+	collection := db.Collection(collectionName)
+
+	release, err := acquireLock(ctx, collection)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	applied, err := appliedVersions(ctx, collection)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		logger := slog.With("version", m.Version, "migration", m.Name)
+		logger.Info("Applying migration")
+		start := time.Now()
+
+		if err := m.Up(ctx, db); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		_, err := collection.InsertOne(ctx, appliedRecord{Version: m.Version, Name: m.Name, AppliedAt: time.Now()})
+		if err != nil {
+			return fmt.Errorf("recording migration %d: %w", m.Version, err)
+		}
+		logger.Info("Migration applied", "duration", time.Since(start))
+	}
+	return nil
+}
+
+// List reports every known migration and whether it has been applied
+func List(ctx context.Context, db *mongo.Database) ([]Status, error) {
+	known, err := ordered()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(ctx, db.Collection(collectionName))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(known))
+	for _, m := range known {
+		record, ok := applied[m.Version]
+		statuses = append(statuses, Status{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   ok,
+			AppliedAt: record.AppliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+func appliedVersions(ctx context.Context, collection *mongo.Collection) (map[int]appliedRecord, error) {
+	// The lock document has a string _id, applied migrations have numeric ones
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var records []appliedRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]appliedRecord, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// acquireLock takes the migration lock, waiting for another instance to finish if needed.
+// A crashed holder can't block forever, the lock is taken over once lockedUntil has passed.
+// The holder keeps pushing lockedUntil forward until it releases the lock, so migrations
+// may run longer than lockTTL.
+func acquireLock(ctx context.Context, collection *mongo.Collection) (func(), error) {
+	owner, _ := os.Hostname()
+	owner = fmt.Sprintf("%s/%d", owner, os.Getpid())
+
+	for {
+		now := time.Now()
+		_, err := collection.UpdateOne(ctx,
+			bson.M{"_id": lockID, "lockedUntil": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": owner, "lockedUntil": now.Add(lockTTL)}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				renewLock(collection, owner, stop)
+			}()
+
+			release := func() {
+				close(stop)
+				<-done
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if _, err := collection.DeleteOne(ctx, bson.M{"_id": lockID, "owner": owner}); err != nil {
+					slog.Warn("Could not release migration lock", "error", err)
+				}
+			}
+			return release, nil
+		}
+
+		// The upsert collides with a live lock held by someone else
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("acquiring migration lock: %w", err)
+		}
+
+		slog.Info("Waiting for another instance to finish migrations")
+		select {
+		case <-ctx.Done():
+			return nil, errors.Join(errors.New("timed out waiting for the migration lock"), ctx.Err())
+		case <-time.After(lockRetry):
+		}
+	}
+}
+
+// renewLock extends lockedUntil every lockRenew until stop is closed
+func renewLock(collection *mongo.Collection, owner string, stop <-chan struct{}) {
+	ticker := time.NewTicker(lockRenew)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": lockID, "owner": owner},
+			bson.M{"$set": bson.M{"lockedUntil": time.Now().Add(lockTTL)}},
+		)
+		cancel()
+
+		switch {
+		case err != nil:
+			slog.Warn("Could not renew migration lock", "error", err)
+		case result.MatchedCount == 0:
+			slog.Error("Migration lock was taken over by another instance", "owner", owner)
+		}
+	}
+}
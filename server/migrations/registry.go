@@ -0,0 +1,219 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// registry lists every migration. Append new ones with the next version, never renumber
+// or edit a migration that has shipped.
+var registry = []Migration{
+	{Version: 1, Name: "schema_migrations lock expiry", Up: lockExpiryIndex},
+	{Version: 2, Name: "normalize users.online", Up: normalizeOnlineStatus},
+	{Version: 3, Name: "users indexes", Up: userIndexes},
+	{Version: 4, Name: "messages indexes", Up: messageIndexes},
+	{Version: 5, Name: "friendships indexes", Up: friendshipIndexes},
+	{Version: 6, Name: "groups and group_messages indexes", Up: groupIndexes},
+	{Version: 7, Name: "per user message indexes", Up: perUserMessageIndexes},
+	{Version: 8, Name: "users identity and email indexes", Up: identityIndexes},
+	{Version: 9, Name: "group_recordings indexes", Up: groupRecordingIndexes},
+	{Version: 10, Name: "friendships pending expiry", Up: pendingFriendshipExpiry},
+}
+
+func createIndexes(ctx context.Context, collection *mongo.Collection, models ...mongo.IndexModel) error {
+	// Creating an index that already exists with the same spec is a no-op, so reruns are safe
+	names, err := collection.Indexes().CreateMany(ctx, models)
+	if err != nil {
+		return fmt.Errorf("creating indexes on %s: %w", collection.Name(), err)
+	}
+	slog.Info("Indexes ready", "collection", collection.Name(), "indexes", names)
+	return nil
+}
+
+// pendingFriendRequestTTL is how long a friend request stays pending before Mongo drops it
+const pendingFriendRequestTTL = 30 * 24 * time.Hour
+
+// lockExpiryIndex lets Mongo clean up a migration lock left behind by a crashed instance
+func lockExpiryIndex(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection(collectionName), mongo.IndexModel{
+		Keys:    bson.D{{Key: "lockedUntil", Value: 1}},
+		Options: options.Index().SetName("lock_ttl").SetExpireAfterSeconds(0),
+	})
+}
+
+// normalizeOnlineStatus rewrites legacy presence values (booleans, lowercase, missing) to "Y"/"N"
+func normalizeOnlineStatus(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection("users")
+
+	online, err := users.UpdateMany(ctx,
+		bson.M{"online": bson.M{"$in": bson.A{true, 1, "y", "yes", "true", "online"}}},
+		bson.M{"$set": bson.M{"online": "Y"}},
+	)
+	if err != nil {
+		return err
+	}
+
+	offline, err := users.UpdateMany(ctx,
+		bson.M{"online": bson.M{"$nin": bson.A{"Y", "N"}}},
+		bson.M{"$set": bson.M{"online": "N"}},
+	)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Normalized online status", "online", online.ModifiedCount, "offline", offline.ModifiedCount)
+	return nil
+}
+
+// userIndexes makes usernames unique, which fails loudly if duplicates already exist
+func userIndexes(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection("users")
+
+	duplicates, err := duplicateUsernames(ctx, users)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("cannot create unique username index, resolve duplicate usernames first: %v", duplicates)
+	}
+
+	return createIndexes(ctx, users,
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetName("username_unique").SetUnique(true),
+		},
+		mongo.IndexModel{
+			// Chat list lookups only care about online users
+			Keys:    bson.D{{Key: "online", Value: 1}},
+			Options: options.Index().SetName("online"),
+		},
+	)
+}
+
+func duplicateUsernames(ctx context.Context, users *mongo.Collection) ([]string, error) {
+	cursor, err := users.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$username", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: 20}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Username string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(results))
+	for _, r := range results {
+		names = append(names, r.Username)
+	}
+	return names, nil
+}
+
+// messageIndexes serves both branches of the conversation $or and its createdAt sort
+func messageIndexes(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection("messages"), mongo.IndexModel{
+		Keys:    bson.D{{Key: "fromUserID", Value: 1}, {Key: "toUserID", Value: 1}, {Key: "createdAt", Value: -1}},
+		Options: options.Index().SetName("conversation"),
+	})
+}
+
+// friendshipIndexes stops concurrent requests from creating the same pair twice
+func friendshipIndexes(ctx context.Context, db *mongo.Database) error {
+	friendships := db.Collection("friendships")
+
+	err := createIndexes(ctx, friendships,
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "requesterID", Value: 1}, {Key: "addresseeID", Value: 1}},
+			Options: options.Index().SetName("pair_unique").SetUnique(true),
+		},
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "addresseeID", Value: 1}, {Key: "status", Value: 1}},
+			Options: options.Index().SetName("addressee_status"),
+		},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("duplicate friend requests exist, remove them before rerunning: %w", err)
+	}
+	return err
+}
+
+func groupIndexes(ctx context.Context, db *mongo.Database) error {
+	err := createIndexes(ctx, db.Collection("groups"), mongo.IndexModel{
+		Keys:    bson.D{{Key: "members.userID", Value: 1}},
+		Options: options.Index().SetName("member"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return createIndexes(ctx, db.Collection("group_messages"), mongo.IndexModel{
+		Keys:    bson.D{{Key: "groupID", Value: 1}, {Key: "createdAt", Value: -1}},
+		Options: options.Index().SetName("group_history"),
+	})
+}
+
+// perUserMessageIndexes serve account export and deletion, which look messages up by one side only.
+// Sent direct messages already use the fromUserID prefix of "conversation".
+func perUserMessageIndexes(ctx context.Context, db *mongo.Database) error {
+	err := createIndexes(ctx, db.Collection("messages"), mongo.IndexModel{
+		Keys:    bson.D{{Key: "toUserID", Value: 1}, {Key: "createdAt", Value: 1}},
+		Options: options.Index().SetName("recipient"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return createIndexes(ctx, db.Collection("group_messages"), mongo.IndexModel{
+		Keys:    bson.D{{Key: "fromUserID", Value: 1}, {Key: "createdAt", Value: 1}},
+		Options: options.Index().SetName("sender"),
+	})
+}
+
+// identityIndexes back OIDC sign in. A subject can only be linked to one account, the email
+// index uses the case-insensitive collation of store.FindByEmail.
+func identityIndexes(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection("users"),
+		mongo.IndexModel{
+			Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetName("identity_unique").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities": bson.M{"$exists": true}}),
+		},
+		mongo.IndexModel{
+			Keys: bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetName("email").
+				SetCollation(&options.Collation{Locale: "en", Strength: 2}).
+				SetPartialFilterExpression(bson.M{"email": bson.M{"$exists": true}}),
+		},
+	)
+}
+
+// groupRecordingIndexes serve the recording list of a group, newest first
+func groupRecordingIndexes(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection("group_recordings"), mongo.IndexModel{
+		Keys:    bson.D{{Key: "groupID", Value: 1}, {Key: "startedAt", Value: -1}},
+		Options: options.Index().SetName("group_recordings"),
+	})
+}
+
+// pendingFriendshipExpiry removes friend requests nobody answered. Accepted friendships
+// fall outside the partial filter and are kept.
+func pendingFriendshipExpiry(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection("friendships"), mongo.IndexModel{
+		Keys: bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetName("pending_ttl").
+			SetExpireAfterSeconds(int32(pendingFriendRequestTTL.Seconds())).
+			SetPartialFilterExpression(bson.M{"status": "pending"}),
+	})
+}
@@ -0,0 +1,112 @@
+package models
+
+import "time"
+
+// Documents persisted by the stores. The handlers package re-exports them under the same names.
+
+type UserDetails struct {
+	ID         string     `bson:"_id,omitempty"`
+	Username   string     `json:"username" binding:"required" bson:"username"`
+	Password   string     `json:"-" bson:"password"`
+	Online     string     `json:"online" bson:"online"`
+	Email      string     `json:"email,omitempty" bson:"email,omitempty"` // optional, only used for account recovery
+	SocketID   string     `json:"socketId,omitempty" bson:"socketId,omitempty"`
+	Disabled   bool       `json:"disabled,omitempty" bson:"disabled,omitempty"` // set by operators, blocks login
+	TwoFactor  *TwoFactor `json:"-" bson:"twoFactor,omitempty"`
+	Identities []Identity `json:"-" bson:"identities,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+
+	// EmailVerified is set once the owner of Email proved it, through a reset mail or a provider
+	EmailVerified bool `json:"-" bson:"emailVerified,omitempty"`
+}
+
+// Identity links an account to a user of an external OIDC provider. Provider and
+// Subject together are unique across all users.
+type Identity struct {
+	Provider string    `bson:"provider"`
+	Subject  string    `bson:"subject"`
+	Email    string    `bson:"email,omitempty"` // as asserted by the provider when linked
+	LinkedAt time.Time `bson:"linkedAt"`
+}
+
+// TwoFactor is the TOTP state of a user. PendingSecret is set during enrollment
+// and replaces Secret once the user proved their app produces valid codes.
+type TwoFactor struct {
+	Enabled       bool      `bson:"enabled"`
+	Secret        string    `bson:"secret,omitempty"`
+	PendingSecret string    `bson:"pendingSecret,omitempty"`
+	RecoveryCodes []string  `bson:"recoveryCodes,omitempty"` // bcrypt hashes, removed once used
+	LastUsedStep  int64     `bson:"lastUsedStep"`            // TOTP codes from this step or earlier are replays
+	EnabledAt     time.Time `bson:"enabledAt,omitempty"`
+}
+
+type Message struct {
+	ID         string    `json:"id" bson:"_id,omitempty"`
+	Message    string    `json:"message" binding:"required" bson:"message"`
+	ToUserID   string    `json:"toUserID" binding:"required" bson:"toUserID"`
+	FromUserID string    `json:"fromUserID" binding:"required" bson:"fromUserID"`
+	Type       string    `json:"type" bson:"type"` // "text", "image", "file"
+	CreatedAt  time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+}
+
+type Friendship struct {
+	ID          string    `json:"id" bson:"_id,omitempty"`
+	RequesterID string    `json:"requesterID" bson:"requesterID"`
+	AddresseeID string    `json:"addresseeID" bson:"addresseeID"`
+	Status      string    `json:"status" bson:"status"` // "pending", "accepted"
+	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+type GroupMember struct {
+	UserID   string    `json:"userID" bson:"userID"`
+	Username string    `json:"username,omitempty" bson:"username,omitempty"`
+	Role     string    `json:"role" bson:"role"` // "admin", "member"
+	JoinedAt time.Time `json:"joinedAt" bson:"joinedAt"`
+}
+
+type GroupSettings struct {
+	IsPublic          bool `json:"isPublic" bson:"isPublic"`
+	AllowInvites      bool `json:"allowInvites" bson:"allowInvites"`
+	MessagesCanDelete bool `json:"messagesCanDelete" bson:"messagesCanDelete"`
+}
+
+type GroupDetails struct {
+	ID          string        `json:"id" bson:"_id,omitempty"`
+	Name        string        `json:"name" bson:"name"`
+	Description string        `json:"description" bson:"description"`
+	Avatar      string        `json:"avatar" bson:"avatar"`
+	CreatorID   string        `json:"creatorID" bson:"creatorID"`
+	Members     []GroupMember `json:"members" bson:"members"`
+	Settings    GroupSettings `json:"settings" bson:"settings"`
+	CreatedAt   time.Time     `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time     `json:"updatedAt" bson:"updatedAt"`
+}
+
+type GroupMessage struct {
+	ID         string    `json:"id" bson:"_id,omitempty"`
+	GroupID    string    `json:"groupID" bson:"groupID"`
+	FromUserID string    `json:"fromUserID" bson:"fromUserID"`
+	Message    string    `json:"message" bson:"message"`
+	Type       string    `json:"type" bson:"type"` // "text", "image", "file"
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// GroupRecording is a recorded call of a group, registered by the video service once it ended
+type GroupRecording struct {
+	ID        string          `json:"id" bson:"_id"` // recording ID from the video service
+	GroupID   string          `json:"groupID" bson:"groupID"`
+	RoomID    string          `json:"roomID" bson:"roomID"`
+	StartedBy string          `json:"startedBy" bson:"startedBy"` // user ID
+	StartedAt time.Time       `json:"startedAt" bson:"startedAt"`
+	StoppedAt time.Time       `json:"stoppedAt" bson:"stoppedAt"`
+	Files     []RecordingFile `json:"files" bson:"files"`
+}
+
+// RecordingFile is one recorded track, Name is its path in the video service's storage
+type RecordingFile struct {
+	Name     string `json:"name" bson:"name"`
+	UserID   string `json:"userID" bson:"userID"`
+	Kind     string `json:"kind" bson:"kind"` // "audio" or "video"
+	MimeType string `json:"mimeType" bson:"mimeType"`
+	Size     int64  `json:"size" bson:"size"`
+}
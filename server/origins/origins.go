@@ -0,0 +1,97 @@
+// Package origins decides which browser origins may call the API or open a websocket.
+// server/origins is the source, video-service/origins a copy for the other module.
+// Edit the server's files and run make sync-origins, make check-origins finds drift.
+package origins
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Allowlist holds exact origins like https://chat.example.com and wildcard origins like
+// https://*.example.com. A wildcard matches any subdomain but not example.com itself.
+type Allowlist struct {
+	exact     map[string]bool
+	wildcards []wildcard
+}
+
+type wildcard struct {
+	scheme string
+	suffix string // ".example.com"
+	port   string
+}
+
+// Parse validates the patterns, so a typo fails at startup instead of blocking the client
+func Parse(patterns []string) (*Allowlist, error) {
+	allowlist := &Allowlist{exact: make(map[string]bool)}
+
+	for _, pattern := range patterns {
+		u, err := url.Parse(strings.ToLower(strings.TrimSpace(pattern)))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("origin %q must look like https://host[:port] or https://*.host[:port]", pattern)
+		}
+
+		scheme, host, port := split(u)
+		if suffix, ok := strings.CutPrefix(host, "*."); ok {
+			if suffix == "" || strings.Contains(suffix, "*") {
+				return nil, fmt.Errorf("origin %q: only the leftmost label can be a wildcard", pattern)
+			}
+			allowlist.wildcards = append(allowlist.wildcards, wildcard{scheme: scheme, suffix: "." + suffix, port: port})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("origin %q: only the leftmost label can be a wildcard", pattern)
+		}
+		allowlist.exact[join(scheme, host, port)] = true
+	}
+	return allowlist, nil
+}
+
+// Allowed reports whether a browser on origin may make credentialed requests
+func (a *Allowlist) Allowed(origin string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false // includes "null" from sandboxed frames and file:// pages
+	}
+
+	scheme, host, port := split(u)
+	if a.exact[join(scheme, host, port)] {
+		return true
+	}
+	for _, w := range a.wildcards {
+		if scheme == w.scheme && port == w.port && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows is Allowed for an incoming request. Requests without an Origin header don't come
+// from a browser page and same-origin requests can't be cross-site, both are let through.
+func (a *Allowlist) Allows(origin, requestHost string) bool {
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host != "" && strings.EqualFold(u.Host, requestHost) {
+		return true
+	}
+	return a.Allowed(origin)
+}
+
+// split drops default ports so https://host and https://host:443 compare equal
+func split(u *url.URL) (scheme, host, port string) {
+	scheme, host, port = u.Scheme, u.Hostname(), u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	return scheme, host, port
+}
+
+func join(scheme, host, port string) string {
+	if port == "" {
+		return scheme + "://" + host
+	}
+	return scheme + "://" + host + ":" + port
+}
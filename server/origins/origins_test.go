@@ -0,0 +1,95 @@
+package origins
+
+import "testing"
+
+func TestParseRejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{
+		"chat.example.com",
+		"ftp://chat.example.com",
+		"https://",
+		"https://user@chat.example.com",
+		"https://chat.example.com/app",
+		"https://chat.example.com?x=1",
+		"https://*.",
+		"https://*.*.example.com",
+		"https://chat.*.example.com",
+	} {
+		if _, err := Parse([]string{pattern}); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	allowlist, err := Parse([]string{
+		"https://chat.example.com",
+		"http://localhost:3000",
+		"https://*.preview.example.com",
+		"https://*.staging.example.com:8443",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{"exact", "https://chat.example.com", true},
+		{"exact with trailing slash", "https://chat.example.com/", true},
+		{"exact is case-insensitive", "HTTPS://Chat.Example.COM", true},
+		{"exact with explicit default port", "https://chat.example.com:443", true},
+		{"exact with other port", "https://chat.example.com:8443", false},
+		{"exact with other scheme", "http://chat.example.com", false},
+		{"exact with non-default port", "http://localhost:3000", true},
+		{"non-default port left out", "http://localhost", false},
+		{"subdomain of exact", "https://evil.chat.example.com", false},
+		{"wildcard subdomain", "https://pr-42.preview.example.com", true},
+		{"wildcard nested subdomain", "https://a.b.preview.example.com", true},
+		{"wildcard with explicit default port", "https://pr-42.preview.example.com:443", true},
+		{"wildcard with other scheme", "http://pr-42.preview.example.com", false},
+		{"wildcard bare domain", "https://preview.example.com", false},
+		{"wildcard suffix without dot", "https://evilpreview.example.com", false},
+		{"wildcard with port", "https://pr-42.staging.example.com:8443", true},
+		{"wildcard with port left out", "https://pr-42.staging.example.com", false},
+		{"null", "null", false},
+		{"file page", "file:///home/user/index.html", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowlist.Allowed(tt.origin); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllows(t *testing.T) {
+	allowlist, err := Parse([]string{"https://chat.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		origin      string
+		requestHost string
+		want        bool
+	}{
+		{"no origin header", "", "api.example.com", true},
+		{"same origin", "https://api.example.com", "api.example.com", true},
+		{"same origin with port", "http://localhost:8080", "localhost:8080", true},
+		{"allowed cross origin", "https://chat.example.com", "api.example.com", true},
+		{"other cross origin", "https://evil.example.com", "api.example.com", false},
+		{"null", "null", "api.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowlist.Allows(tt.origin, tt.requestHost); got != tt.want {
+				t.Errorf("Allows(%q, %q) = %v, want %v", tt.origin, tt.requestHost, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,76 +1,183 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"chat-app/config"
 	"chat-app/handlers"
+	"chat-app/logging"
+	"chat-app/mailer"
+	"chat-app/origins"
+	"chat-app/store"
+	"chat-app/tracing"
 	"chat-app/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 func main() {
 	err := godotenv.Load()
+
+	cfg, cfgErr := config.Load(os.Args[1:])
+	if cfgErr != nil {
+		fmt.Fprintln(os.Stderr, cfgErr)
+		os.Exit(2)
+	}
+
+	logging.Setup(cfg.Log.Level, cfg.Log.Format)
 	if err != nil {
-		log.Println("Note: .env file not found, using system environment variables")
+		slog.Info("Note: .env file not found, using system environment variables")
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Positional arguments select a one-off command instead of serving
+	if len(cfg.Args) > 0 {
+		os.Exit(runCommand(cfg, cfg.Args))
 	}
 
-	host := os.Getenv("HOST")
-	if host == "" {
-		host = "localhost"
+	shutdownTracing, err := tracing.Setup(context.Background(), "chat-server", cfg.Tracing.Exporter)
+	if err != nil {
+		slog.Error("Invalid tracing configuration", "error", err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("Server starting at http://%s:%s\n", host, port)
+	slog.Info("Server starting", "url", fmt.Sprintf("http://%s:%d", cfg.Server.Host, cfg.Server.Port))
 
-	config.ConnectDatabase()
+	db := config.ConnectDatabase(cfg.Mongo)
 
-	// Connect to Redis (New Feature)
-	config.ConnectRedis()
+	if cfg.Mongo.MigrateOnStartup {
+		if err := runMigrations(db); err != nil {
+			slog.Error("Database migrations failed", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	// Ensure we disconnect on shutdown
-	defer config.DisConnectDB()
+	// Connect to Redis (New Feature)
+	rdb := config.ConnectRedis(cfg.Redis)
 
 	router := gin.New()
-	router.Use(gin.Logger())
+	// c.ClientIP() only honours X-Forwarded-For from these, the rate limits depend on it
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		slog.Error("Invalid trusted proxies", "error", err)
+		os.Exit(1)
+	}
+	router.Use(otelgin.Middleware("chat-server"))
+	router.Use(utils.RequestLogger())
 	router.Use(gin.Recovery()) // Added recovery middleware to prevent crashes
-	router.Use(utils.CORSMiddleware())
+	allowedOrigins, err := origins.Parse(cfg.CORS.AllowedOrigins)
+	if err != nil {
+		slog.Error("Invalid allowed origins", "error", err)
+		os.Exit(1)
+	}
+	router.Use(utils.CORSMiddleware(allowedOrigins))
+
+	stores := store.NewMongoStores(db, rdb)
 
 	// Start the Lobby
+	mail, err := mailer.New(cfg.Mail)
+	if err != nil {
+		slog.Error("Invalid mail configuration", "error", err)
+		os.Exit(1)
+	}
+
+	limits := handlers.NewRateLimits(cfg.RateLimit, rdb)
+	accounts := handlers.NewAccounts(cfg.Auth, rdb, mail)
+	handlers.MainLobby = handlers.NewLobby(cfg.Socket.SendBufferSize, stores, limits)
 	go handlers.MainLobby.Run()
 
-	setupRoutes(router)
+	if cfg.Video.JoinSecret == "" {
+		slog.Warn("VIDEO_JOIN_SECRET is not set, group video calls are disabled")
+	}
+
+	setupRoutes(router, db, stores, accounts, limits, cfg.Privacy, handlers.NewVideoServiceClient(cfg.Video), handlers.NewUpgrader(allowedOrigins))
 
-	router.Run(":" + port)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler: router,
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Wait for SIGINT/SIGTERM, then drain within the shutdown deadline
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	slog.Info("Shutdown signal received, draining", "deadline", cfg.Server.ShutdownTimeout.Std())
+	shutdown(srv, db, rdb, cfg.Server.ShutdownTimeout.Std(), shutdownTracing)
+}
+
+// shutdown stops accepting sockets, hands connected clients over to other instances,
+// then closes the HTTP server and the Mongo/Redis connections.
+func shutdown(srv *http.Server, db *mongo.Database, rdb *redis.Client, timeout time.Duration, shutdownTracing func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Hijacked websocket connections are not tracked by srv.Shutdown, the lobby drains them
+	handlers.MainLobby.Drain(ctx)
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shutdown", "error", err)
+	}
+
+	config.DisConnectDB(db)
+	config.DisconnectRedis(rdb)
+
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Flushing traces", "error", err)
+	}
+	slog.Info("Server stopped")
 }
 
-func setupRoutes(router *gin.Engine) {
+func setupRoutes(router *gin.Engine, db *mongo.Database, stores *store.Stores, accounts *handlers.Accounts, limits *handlers.RateLimits, privacy config.PrivacyConfig, video *handlers.VideoServiceClient, upgrader *websocket.Upgrader) {
 	// Root route
 	router.GET("/", handlers.RenderHome())
 
+	// Probes and Prometheus scrape endpoint
+	router.GET("/healthz", handlers.HealthCheck(db, stores.Redis))
+	router.GET("/readyz", handlers.ReadinessCheck(db, stores.Redis))
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	// WebSocket Route
 	router.GET("/ws/:userID", func(c *gin.Context) {
+		if handlers.MainLobby.IsDraining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is draining, reconnect to another instance"})
+			return
+		}
+
 		userID := c.Param("userID")
 		if userID == "" {
 			c.JSON(400, gin.H{"error": "User ID required"})
 			return
 		}
 
-		conn, err := handlers.Upgrader.Upgrade(c.Writer, c.Request, nil)
+		logger := logging.FromContext(c.Request.Context())
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
-			log.Println("Failed to upgrade connection: ", err)
+			logger.Warn("Failed to upgrade connection", "error", err)
 			return
 		}
 
-		handlers.CreateClient(handlers.MainLobby, conn, userID)
+		handlers.CreateClient(handlers.MainLobby, conn, userID, logger)
 	})
 
 	// API Routes Group
@@ -79,46 +186,79 @@ func setupRoutes(router *gin.Engine) {
 		// Auth Routes
 		auth := api.Group("/auth")
 		{
-			auth.POST("/login", handlers.Login())
-			auth.POST("/register", handlers.Registration())
-			auth.GET("/check-username/:username", handlers.IsUsernameAvailable())
+			auth.POST("/login", limits.Route("login"), handlers.Login(stores, accounts, limits))
+			auth.POST("/register", limits.Route("register"), handlers.Registration(stores, accounts))
+			auth.GET("/check-username/:username", limits.Route("check-username"), handlers.IsUsernameAvailable(stores))
+			auth.POST("/login/2fa", limits.Route("login"), handlers.LoginTwoFactor(stores, accounts, limits))
+			auth.POST("/logout", handlers.RequireSession(accounts), handlers.Logout(accounts))
+
+			// Password management, change needs a session, forgot/reset work with a mailed token
+			auth.POST("/password/change", limits.Route("password"), handlers.RequireSession(accounts), handlers.ChangePassword(stores, accounts))
+			auth.POST("/password/forgot", limits.Route("password"), handlers.ForgotPassword(stores, accounts))
+			auth.POST("/password/reset", limits.Route("password"), handlers.ResetPassword(stores, accounts, limits))
+
+			// Sign in with the OIDC providers from auth.oidc, and linking them to an existing account
+			oidc := auth.Group("/oidc")
+			oidc.GET("/providers", handlers.OIDCProviders(accounts))
+			oidc.POST("/session", limits.Route("login"), handlers.OIDCSession(stores, accounts))
+			oidc.GET("/:provider/login", limits.Route("login"), handlers.OIDCLogin(accounts))
+			oidc.GET("/:provider/callback", limits.Route("login"), handlers.OIDCCallback(stores, accounts))
+			oidc.POST("/:provider/link", handlers.RequireSession(accounts), handlers.OIDCLink(accounts))
+			oidc.DELETE("/:provider/link", handlers.RequireSession(accounts), handlers.OIDCUnlink(stores))
+			oidc.POST("/:provider/reauth", handlers.RequireSession(accounts), handlers.OIDCReauth(accounts))
+
+			// TOTP two-factor authentication for the signed in user
+			twoFactor := auth.Group("/2fa", limits.Route("password"), handlers.RequireSession(accounts))
+			twoFactor.POST("/enroll", handlers.EnrollTwoFactor(stores, accounts))
+			twoFactor.POST("/verify", handlers.VerifyTwoFactor(stores, accounts))
+			twoFactor.POST("/disable", handlers.DisableTwoFactor(stores, accounts))
+			twoFactor.POST("/recovery-codes", handlers.RegenerateRecoveryCodes(stores))
 		}
 
 		// User Routes
 		user := api.Group("/user")
 		{
-			user.GET("/session/:userID", handlers.UserSessionCheck())
+			user.GET("/session/:userID", handlers.UserSessionCheck(stores))
 
 			// FIXED LINE BELOW: Changed 'api.GET' to 'user.GET'
 			user.GET("/random/join/:userID", handlers.JoinRandomChatHandler())
+
+			// Account removal and data export for the signed in user
+			user.DELETE("", handlers.RequireSession(accounts), handlers.DeleteAccount(stores, accounts, privacy))
+			user.GET("/export", handlers.RequireSession(accounts), handlers.ExportAccount(stores))
 		}
 
 		// Message Routes
 		messages := api.Group("/messages")
 		{
-			messages.GET("/conversation/:toUserID/:fromUserID", handlers.GetMessagesHandler())
+			messages.GET("/conversation/:toUserID/:fromUserID", handlers.GetMessagesHandler(stores))
 		}
 
 		friends := api.Group("/friends")
 		{
-			friends.POST("/request/:fromUserID", handlers.SendFriendRequestHandler())
-			friends.POST("/accept/:requesterID/:myUserID", handlers.AcceptFriendRequestHandler())
-			friends.GET("/requests/:userID", handlers.GetPendingRequestsHandler())
-			friends.GET("/list/:userID", handlers.GetFriendListHandler())
+			friends.POST("/request/:fromUserID", limits.Route("friend-request"), handlers.SendFriendRequestHandler(stores))
+			friends.POST("/accept/:requesterID/:myUserID", handlers.AcceptFriendRequestHandler(stores))
+			friends.GET("/requests/:userID", handlers.GetPendingRequestsHandler(stores))
+			friends.GET("/list/:userID", handlers.GetFriendListHandler(stores))
 		}
 
+		// Callbacks from the video service, signed with the shared join secret
+		api.POST("/video/recordings", handlers.RegisterVideoRecording(stores, video))
+
 		groupRoutes := api.Group("/api/groups")
 		{
-			groupRoutes.POST("/create", handlers.CreateGroup())
-			groupRoutes.GET("/user/:userID", handlers.GetUserGroups())
-			groupRoutes.GET("/:groupID", handlers.GetGroupDetails())
-			groupRoutes.POST("/members/add", handlers.AddGroupMember())
-			groupRoutes.DELETE("/:groupID/members/:userID", handlers.RemoveGroupMember())
-			groupRoutes.PUT("/update", handlers.UpdateGroupSettings())
-			groupRoutes.DELETE("/:groupID", handlers.DeleteGroup())
-			groupRoutes.GET("/:groupID/messages", handlers.GetGroupMessages())
-			groupRoutes.POST("/messages/send", handlers.SendGroupMessage())
-			groupRoutes.POST("/video-call/start", handlers.StartGroupVideoCall())
+			groupRoutes.POST("/create", handlers.CreateGroup(stores))
+			groupRoutes.GET("/user/:userID", handlers.GetUserGroups(stores))
+			groupRoutes.GET("/:groupID", handlers.GetGroupDetails(stores))
+			groupRoutes.POST("/members/add", handlers.AddGroupMember(stores))
+			groupRoutes.DELETE("/:groupID/members/:userID", handlers.RemoveGroupMember(stores))
+			groupRoutes.PUT("/update", handlers.UpdateGroupSettings(stores))
+			groupRoutes.DELETE("/:groupID", handlers.DeleteGroup(stores))
+			groupRoutes.GET("/:groupID/messages", handlers.GetGroupMessages(stores))
+			groupRoutes.POST("/messages/send", handlers.SendGroupMessage(stores))
+			groupRoutes.POST("/video-call/start", handlers.RequireSession(accounts), handlers.StartGroupVideoCall(stores, video))
+			groupRoutes.POST("/:groupID/video-call/token", handlers.RequireSession(accounts), handlers.GroupVideoCallToken(stores, video))
+			groupRoutes.GET("/:groupID/recordings", handlers.RequireSession(accounts), handlers.GetGroupRecordings(stores))
 		}
 	}
 }
@@ -0,0 +1,759 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat-app/models"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemoryStores keeps everything in process memory, for tests and local experiments.
+// IDs are ObjectID hex strings so they pass the same validation as the Mongo stores.
+// rdb is shared as Stores.Redis, tests can pass an in-process Redis.
+func NewMemoryStores(rdb redis.UniversalClient) *Stores {
+	return &Stores{
+		Users:       &MemoryUserStore{users: make(map[string]models.UserDetails)},
+		Messages:    &MemoryMessageStore{messages: make(map[string]models.Message)},
+		Friendships: &MemoryFriendshipStore{},
+		Groups:      &MemoryGroupStore{groups: make(map[string]models.GroupDetails)},
+		Redis:       rdb,
+	}
+}
+
+func newID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+func validID(id string) error {
+	_, err := objectID(id)
+	return err
+}
+
+// ---------------- USERS ----------------
+
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]models.UserDetails
+}
+
+func (s *MemoryUserStore) GetByID(_ context.Context, userID string) (models.UserDetails, error) {
+	if err := validID(userID); err != nil {
+		return models.UserDetails{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[userID]
+	if !ok {
+		return models.UserDetails{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryUserStore) GetByUsername(_ context.Context, username string) (models.UserDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return models.UserDetails{}, ErrNotFound
+}
+
+func (s *MemoryUserStore) Create(_ context.Context, user models.UserDetails) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.users {
+		if existing.Username == user.Username {
+			return "", ErrAlreadyExists
+		}
+		for _, identity := range user.Identities {
+			if hasIdentity(existing, identity.Provider, identity.Subject) {
+				return "", ErrAlreadyExists
+			}
+		}
+	}
+
+	user.ID = newID()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	s.users[user.ID] = user
+	return user.ID, nil
+}
+
+func (s *MemoryUserStore) SetOnline(_ context.Context, userID, status string) error {
+	if err := validID(userID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.users[userID]; ok {
+		user.Online = status
+		s.users[userID] = user
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) ListOnline(_ context.Context, excludeID string) ([]models.UserDetails, error) {
+	if err := validID(excludeID); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var users []models.UserDetails
+	for id, user := range s.users {
+		if id != excludeID && user.Online == "Y" {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryUserStore) Search(_ context.Context, query string, limit int64) ([]models.UserDetails, error) {
+	query = strings.ToLower(query)
+
+	s.mu.RLock()
+	var users []models.UserDetails
+	for _, user := range s.users {
+		if strings.Contains(strings.ToLower(user.Username), query) {
+			users = append(users, user)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return paginate(users, 0, limit), nil
+}
+
+func (s *MemoryUserStore) SetDisabled(_ context.Context, userID string, disabled bool) error {
+	return s.modify(userID, func(user *models.UserDetails) { user.Disabled = disabled })
+}
+
+func (s *MemoryUserStore) SetPassword(_ context.Context, userID, passwordHash string) error {
+	return s.modify(userID, func(user *models.UserDetails) { user.Password = passwordHash })
+}
+
+func (s *MemoryUserStore) MarkEmailVerified(_ context.Context, userID string) error {
+	return s.modify(userID, func(user *models.UserDetails) { user.EmailVerified = true })
+}
+
+func (s *MemoryUserStore) SetTwoFactor(_ context.Context, userID string, twoFactor *models.TwoFactor) error {
+	if twoFactor != nil {
+		copied := *twoFactor
+		copied.RecoveryCodes = append([]string(nil), twoFactor.RecoveryCodes...)
+		twoFactor = &copied
+	}
+	return s.modify(userID, func(user *models.UserDetails) { user.TwoFactor = twoFactor })
+}
+
+func (s *MemoryUserStore) UseTOTPStep(_ context.Context, userID string, step int64) error {
+	var replay bool
+	err := s.modify(userID, func(user *models.UserDetails) {
+		if user.TwoFactor == nil || user.TwoFactor.LastUsedStep >= step {
+			replay = true
+			return
+		}
+		updated := *user.TwoFactor
+		updated.LastUsedStep = step
+		user.TwoFactor = &updated
+	})
+	if err == nil && replay {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *MemoryUserStore) UseRecoveryCode(_ context.Context, userID, codeHash string) error {
+	found := false
+	err := s.modify(userID, func(user *models.UserDetails) {
+		if user.TwoFactor == nil {
+			return
+		}
+		updated := *user.TwoFactor
+		updated.RecoveryCodes = nil
+		for _, hash := range user.TwoFactor.RecoveryCodes {
+			if hash == codeHash && !found {
+				found = true
+				continue
+			}
+			updated.RecoveryCodes = append(updated.RecoveryCodes, hash)
+		}
+		user.TwoFactor = &updated
+	})
+	if err == nil && !found {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MemoryUserStore) GetByIdentity(_ context.Context, provider, subject string) (models.UserDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if hasIdentity(user, provider, subject) {
+			return user, nil
+		}
+	}
+	return models.UserDetails{}, ErrNotFound
+}
+
+func (s *MemoryUserStore) FindByEmail(_ context.Context, email string) ([]models.UserDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []models.UserDetails
+	for _, user := range s.users {
+		if user.Email != "" && strings.EqualFold(user.Email, email) {
+			found = append(found, user)
+		}
+	}
+	return found, nil
+}
+
+func (s *MemoryUserStore) AddIdentity(_ context.Context, userID string, identity models.Identity) error {
+	if err := validID(userID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, existing := range s.users {
+		if hasIdentity(existing, identity.Provider, identity.Subject) {
+			return ErrAlreadyExists
+		}
+	}
+	for _, linked := range user.Identities {
+		if linked.Provider == identity.Provider {
+			return ErrAlreadyExists
+		}
+	}
+
+	user.Identities = append(append([]models.Identity(nil), user.Identities...), identity)
+	s.users[userID] = user
+	return nil
+}
+
+func (s *MemoryUserStore) RemoveIdentity(_ context.Context, userID, provider string) error {
+	found := false
+	err := s.modify(userID, func(user *models.UserDetails) {
+		var kept []models.Identity
+		for _, identity := range user.Identities {
+			if identity.Provider == provider {
+				found = true
+				continue
+			}
+			kept = append(kept, identity)
+		}
+		user.Identities = kept
+	})
+	if err == nil && !found {
+		return ErrNotFound
+	}
+	return err
+}
+
+func hasIdentity(user models.UserDetails, provider, subject string) bool {
+	for _, identity := range user.Identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryUserStore) modify(userID string, fn func(*models.UserDetails)) error {
+	if err := validID(userID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	fn(&user)
+	s.users[userID] = user
+	return nil
+}
+
+func (s *MemoryUserStore) Delete(_ context.Context, userID string) error {
+	if err := validID(userID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.users, userID)
+	return nil
+}
+
+// ---------------- MESSAGES ----------------
+
+type MemoryMessageStore struct {
+	mu       sync.RWMutex
+	messages map[string]models.Message
+}
+
+func (s *MemoryMessageStore) Save(_ context.Context, msg models.Message) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg.ID = newID()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	s.messages[msg.ID] = msg
+	return msg.ID, nil
+}
+
+func (s *MemoryMessageStore) Conversation(_ context.Context, userA, userB string, page, limit int64) ([]models.Message, error) {
+	s.mu.RLock()
+	var conversation []models.Message
+	for _, msg := range s.messages {
+		if (msg.ToUserID == userA && msg.FromUserID == userB) || (msg.FromUserID == userA && msg.ToUserID == userB) {
+			conversation = append(conversation, msg)
+		}
+	}
+	s.mu.RUnlock()
+
+	// Same paging as the Mongo store: pages count back from the newest message
+	sort.Slice(conversation, func(i, j int) bool {
+		return conversation[i].CreatedAt.After(conversation[j].CreatedAt)
+	})
+	conversation = paginate(conversation, (page-1)*limit, limit)
+
+	for i, j := 0, len(conversation)-1; i < j; i, j = i+1, j-1 {
+		conversation[i], conversation[j] = conversation[j], conversation[i]
+	}
+	return conversation, nil
+}
+
+func (s *MemoryMessageStore) Delete(_ context.Context, messageIDs []string, fromUserID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range messageIDs {
+		if msg, ok := s.messages[id]; ok && msg.FromUserID == fromUserID {
+			delete(s.messages, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryMessageStore) ForUser(_ context.Context, userID string) ([]models.Message, error) {
+	s.mu.RLock()
+	var messages []models.Message
+	for _, msg := range s.messages {
+		if msg.FromUserID == userID || msg.ToUserID == userID {
+			messages = append(messages, msg)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].CreatedAt.Before(messages[j].CreatedAt) })
+	return messages, nil
+}
+
+func (s *MemoryMessageStore) DeleteForUser(_ context.Context, userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, msg := range s.messages {
+		if msg.FromUserID == userID || msg.ToUserID == userID {
+			delete(s.messages, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryMessageStore) AnonymizeUser(_ context.Context, userID, replacement string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var modified int64
+	for id, msg := range s.messages {
+		if msg.FromUserID == userID {
+			msg.FromUserID = replacement
+			modified++
+		}
+		if msg.ToUserID == userID {
+			msg.ToUserID = replacement
+			modified++
+		}
+		s.messages[id] = msg
+	}
+	return modified, nil
+}
+
+func paginate[T any](items []T, skip, limit int64) []T {
+	if skip < 0 {
+		skip = 0
+	}
+	if skip >= int64(len(items)) {
+		return nil
+	}
+	items = items[skip:]
+	if limit > 0 && limit < int64(len(items)) {
+		items = items[:limit]
+	}
+	return items
+}
+
+// ---------------- FRIENDSHIPS ----------------
+
+type MemoryFriendshipStore struct {
+	mu          sync.RWMutex
+	friendships []models.Friendship
+}
+
+func (s *MemoryFriendshipStore) Request(_ context.Context, requesterID, addresseeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.friendships {
+		if (f.RequesterID == requesterID && f.AddresseeID == addresseeID) ||
+			(f.RequesterID == addresseeID && f.AddresseeID == requesterID) {
+			return ErrAlreadyExists
+		}
+	}
+
+	s.friendships = append(s.friendships, models.Friendship{
+		ID:          newID(),
+		RequesterID: requesterID,
+		AddresseeID: addresseeID,
+		Status:      "pending",
+		CreatedAt:   time.Now(),
+	})
+	return nil
+}
+
+func (s *MemoryFriendshipStore) Accept(_ context.Context, requesterID, addresseeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.friendships {
+		if f.RequesterID == requesterID && f.AddresseeID == addresseeID && f.Status == "pending" {
+			s.friendships[i].Status = "accepted"
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryFriendshipStore) Pending(_ context.Context, addresseeID string) ([]models.Friendship, error) {
+	return s.filter(func(f models.Friendship) bool {
+		return f.AddresseeID == addresseeID && f.Status == "pending"
+	}), nil
+}
+
+func (s *MemoryFriendshipStore) Accepted(_ context.Context, userID string) ([]models.Friendship, error) {
+	return s.filter(func(f models.Friendship) bool {
+		return f.Status == "accepted" && (f.RequesterID == userID || f.AddresseeID == userID)
+	}), nil
+}
+
+func (s *MemoryFriendshipStore) ForUser(_ context.Context, userID string) ([]models.Friendship, error) {
+	return s.filter(func(f models.Friendship) bool {
+		return f.RequesterID == userID || f.AddresseeID == userID
+	}), nil
+}
+
+func (s *MemoryFriendshipStore) DeleteForUser(_ context.Context, userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.friendships[:0]
+	for _, f := range s.friendships {
+		if f.RequesterID != userID && f.AddresseeID != userID {
+			kept = append(kept, f)
+		}
+	}
+	deleted := int64(len(s.friendships) - len(kept))
+	s.friendships = kept
+	return deleted, nil
+}
+
+func (s *MemoryFriendshipStore) filter(match func(models.Friendship) bool) []models.Friendship {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []models.Friendship
+	for _, f := range s.friendships {
+		if match(f) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// ---------------- GROUPS ----------------
+
+type MemoryGroupStore struct {
+	mu         sync.RWMutex
+	groups     map[string]models.GroupDetails
+	messages   []models.GroupMessage
+	recordings []models.GroupRecording
+}
+
+// cloneGroup copies the members slice so callers can't mutate the stored group
+func cloneGroup(group models.GroupDetails) models.GroupDetails {
+	group.Members = append([]models.GroupMember(nil), group.Members...)
+	return group
+}
+
+func (s *MemoryGroupStore) Create(_ context.Context, group models.GroupDetails) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group.ID = newID()
+	s.groups[group.ID] = cloneGroup(group)
+	return group.ID, nil
+}
+
+func (s *MemoryGroupStore) GetByID(_ context.Context, groupID string) (models.GroupDetails, error) {
+	if err := validID(groupID); err != nil {
+		return models.GroupDetails{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	group, ok := s.groups[groupID]
+	if !ok {
+		return models.GroupDetails{}, ErrNotFound
+	}
+	return cloneGroup(group), nil
+}
+
+func (s *MemoryGroupStore) List(_ context.Context, limit int64) ([]models.GroupDetails, error) {
+	s.mu.RLock()
+	groups := make([]models.GroupDetails, 0, len(s.groups))
+	for _, group := range s.groups {
+		groups = append(groups, cloneGroup(group))
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].CreatedAt.After(groups[j].CreatedAt) })
+	return paginate(groups, 0, limit), nil
+}
+
+func (s *MemoryGroupStore) ListByMember(_ context.Context, userID string) ([]models.GroupDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var groups []models.GroupDetails
+	for _, group := range s.groups {
+		for _, member := range group.Members {
+			if member.UserID == userID {
+				groups = append(groups, cloneGroup(group))
+				break
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (s *MemoryGroupStore) AddMember(_ context.Context, groupID string, member models.GroupMember) error {
+	return s.modify(groupID, func(group *models.GroupDetails) error {
+		for _, existing := range group.Members {
+			if existing.UserID == member.UserID {
+				return ErrAlreadyExists
+			}
+		}
+		group.Members = append(group.Members, member)
+		return nil
+	})
+}
+
+func (s *MemoryGroupStore) RemoveMember(_ context.Context, groupID, userID string) error {
+	return s.modify(groupID, func(group *models.GroupDetails) error {
+		members := group.Members[:0]
+		for _, member := range group.Members {
+			if member.UserID != userID {
+				members = append(members, member)
+			}
+		}
+		group.Members = members
+		return nil
+	})
+}
+
+func (s *MemoryGroupStore) Update(_ context.Context, groupID string, update GroupUpdate) error {
+	return s.modify(groupID, func(group *models.GroupDetails) error {
+		if update.Name != "" {
+			group.Name = update.Name
+		}
+		if update.Description != "" {
+			group.Description = update.Description
+		}
+		if update.Avatar != "" {
+			group.Avatar = update.Avatar
+		}
+		group.UpdatedAt = time.Now()
+		return nil
+	})
+}
+
+func (s *MemoryGroupStore) Delete(_ context.Context, groupID string) error {
+	if err := validID(groupID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[groupID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.groups, groupID)
+	return nil
+}
+
+func (s *MemoryGroupStore) TransferOwnership(_ context.Context, groupID, newOwnerID string) error {
+	return s.modify(groupID, func(group *models.GroupDetails) error {
+		for i, member := range group.Members {
+			if member.UserID == newOwnerID {
+				group.Members[i].Role = "admin"
+				group.CreatorID = newOwnerID
+				group.UpdatedAt = time.Now()
+				return nil
+			}
+		}
+		return ErrNotMember
+	})
+}
+
+// modify applies fn to a copy of the group and stores it only if fn succeeds
+func (s *MemoryGroupStore) modify(groupID string, fn func(*models.GroupDetails) error) error {
+	if err := validID(groupID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[groupID]
+	if !ok {
+		return ErrNotFound
+	}
+	group = cloneGroup(group)
+	if err := fn(&group); err != nil {
+		return err
+	}
+	s.groups[groupID] = group
+	return nil
+}
+
+func (s *MemoryGroupStore) SaveMessage(_ context.Context, msg models.GroupMessage) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg.ID = newID()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	s.messages = append(s.messages, msg)
+	return msg.ID, nil
+}
+
+func (s *MemoryGroupStore) Messages(_ context.Context, groupID string, limit int64) ([]models.GroupMessage, error) {
+	s.mu.RLock()
+	var messages []models.GroupMessage
+	for _, msg := range s.messages {
+		if msg.GroupID == groupID {
+			messages = append(messages, msg)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+	if limit > 0 && int64(len(messages)) > limit {
+		messages = messages[int64(len(messages))-limit:]
+	}
+	return messages, nil
+}
+
+func (s *MemoryGroupStore) MessagesByUser(_ context.Context, userID string) ([]models.GroupMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []models.GroupMessage
+	for _, msg := range s.messages {
+		if msg.FromUserID == userID {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (s *MemoryGroupStore) DeleteMessagesByUser(_ context.Context, userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.messages[:0]
+	for _, msg := range s.messages {
+		if msg.FromUserID != userID {
+			kept = append(kept, msg)
+		}
+	}
+	deleted := int64(len(s.messages) - len(kept))
+	s.messages = kept
+	return deleted, nil
+}
+
+func (s *MemoryGroupStore) AnonymizeMessagesByUser(_ context.Context, userID, replacement string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var modified int64
+	for i := range s.messages {
+		if s.messages[i].FromUserID == userID {
+			s.messages[i].FromUserID = replacement
+			modified++
+		}
+	}
+	return modified, nil
+}
+
+func (s *MemoryGroupStore) SaveRecording(_ context.Context, recording models.GroupRecording) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.recordings {
+		if existing.ID == recording.ID {
+			return ErrAlreadyExists
+		}
+	}
+	recording.Files = append([]models.RecordingFile(nil), recording.Files...)
+	s.recordings = append(s.recordings, recording)
+	return nil
+}
+
+func (s *MemoryGroupStore) Recordings(_ context.Context, groupID string, limit int64) ([]models.GroupRecording, error) {
+	s.mu.RLock()
+	var recordings []models.GroupRecording
+	for _, recording := range s.recordings {
+		if recording.GroupID == groupID {
+			recordings = append(recordings, recording)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].StartedAt.After(recordings[j].StartedAt)
+	})
+	return paginate(recordings, 0, limit), nil
+}
@@ -0,0 +1,857 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"chat-app/models"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const queryTimeout = 10 * time.Second
+
+// emailCollation compares emails case-insensitively, the users "email" index is built with it
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// NewMongoStores backs every store with a collection of db, rdb is shared as Stores.Redis
+func NewMongoStores(db *mongo.Database, rdb redis.UniversalClient) *Stores {
+	return &Stores{
+		Users:       &MongoUserStore{users: db.Collection("users")},
+		Messages:    &MongoMessageStore{messages: db.Collection("messages")},
+		Friendships: &MongoFriendshipStore{friendships: db.Collection("friendships")},
+		Groups: &MongoGroupStore{
+			groups:     db.Collection("groups"),
+			messages:   db.Collection("group_messages"),
+			recordings: db.Collection("group_recordings"),
+		},
+		Redis: rdb,
+	}
+}
+
+func objectID(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, ErrInvalidID
+	}
+	return oid, nil
+}
+
+func findOne[T any](ctx context.Context, collection *mongo.Collection, filter bson.M) (T, error) {
+	var doc T
+	err := collection.FindOne(ctx, filter).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return doc, ErrNotFound
+	}
+	return doc, err
+}
+
+// ---------------- USERS ----------------
+
+type MongoUserStore struct {
+	users *mongo.Collection
+}
+
+func (s *MongoUserStore) GetByID(ctx context.Context, userID string) (models.UserDetails, error) {
+	docID, err := objectID(userID)
+	if err != nil {
+		return models.UserDetails{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	return findOne[models.UserDetails](ctx, s.users, bson.M{"_id": docID})
+}
+
+func (s *MongoUserStore) GetByUsername(ctx context.Context, username string) (models.UserDetails, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	return findOne[models.UserDetails](ctx, s.users, bson.M{"username": username})
+}
+
+func (s *MongoUserStore) Create(ctx context.Context, user models.UserDetails) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	id := primitive.NewObjectID()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+
+	doc := bson.M{
+		"_id":       id,
+		"username":  user.Username,
+		"password":  user.Password,
+		"online":    user.Online,
+		"createdAt": user.CreatedAt,
+	}
+	if user.Email != "" {
+		doc["email"] = user.Email
+	}
+	if len(user.Identities) > 0 {
+		doc["identities"] = user.Identities
+	}
+
+	_, err := s.users.InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", ErrAlreadyExists
+	}
+	if err != nil {
+		return "", err
+	}
+	return id.Hex(), nil
+}
+
+func (s *MongoUserStore) SetOnline(ctx context.Context, userID, status string) error {
+	docID, err := objectID(userID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err = s.users.UpdateOne(ctx,
+		bson.M{"_id": docID},
+		bson.M{"$set": bson.M{"online": status}},
+	)
+	return err
+}
+
+func (s *MongoUserStore) ListOnline(ctx context.Context, excludeID string) ([]models.UserDetails, error) {
+	docID, err := objectID(excludeID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	cursor, err := s.users.Find(ctx, bson.M{
+		"online": "Y",
+		"_id":    bson.M{"$ne": docID}, // excludes the user itself
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var users []models.UserDetails
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoUserStore) Search(ctx context.Context, query string, limit int64) ([]models.UserDetails, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	filter := bson.M{}
+	if query != "" {
+		filter["username"] = bson.M{"$regex": regexp.QuoteMeta(query), "$options": "i"}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "username", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := s.users.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var users []models.UserDetails
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoUserStore) SetDisabled(ctx context.Context, userID string, disabled bool) error {
+	return s.set(ctx, userID, bson.M{"disabled": disabled})
+}
+
+func (s *MongoUserStore) SetPassword(ctx context.Context, userID, passwordHash string) error {
+	return s.set(ctx, userID, bson.M{"password": passwordHash})
+}
+
+func (s *MongoUserStore) MarkEmailVerified(ctx context.Context, userID string) error {
+	return s.set(ctx, userID, bson.M{"emailVerified": true})
+}
+
+func (s *MongoUserStore) SetTwoFactor(ctx context.Context, userID string, twoFactor *models.TwoFactor) error {
+	if twoFactor == nil {
+		return s.update(ctx, userID, bson.M{}, bson.M{"$unset": bson.M{"twoFactor": ""}})
+	}
+	return s.set(ctx, userID, bson.M{"twoFactor": twoFactor})
+}
+
+func (s *MongoUserStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	err := s.update(ctx, userID,
+		bson.M{"twoFactor.lastUsedStep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"twoFactor.lastUsedStep": step}},
+	)
+	if errors.Is(err, ErrNotFound) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *MongoUserStore) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	// Filtering on the hash makes the pull atomic, two logins can't spend the same code
+	return s.update(ctx, userID,
+		bson.M{"twoFactor.recoveryCodes": codeHash},
+		bson.M{"$pull": bson.M{"twoFactor.recoveryCodes": codeHash}},
+	)
+}
+
+func (s *MongoUserStore) GetByIdentity(ctx context.Context, provider, subject string) (models.UserDetails, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	return findOne[models.UserDetails](ctx, s.users, bson.M{
+		"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}},
+	})
+}
+
+func (s *MongoUserStore) FindByEmail(ctx context.Context, email string) ([]models.UserDetails, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// Same collation as the email index, so the comparison ignores case and uses it
+	opts := options.Find().SetCollation(emailCollation).SetLimit(10)
+	cursor, err := s.users.Find(ctx, bson.M{"email": email}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []models.UserDetails
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoUserStore) AddIdentity(ctx context.Context, userID string, identity models.Identity) error {
+	err := s.update(ctx, userID,
+		bson.M{"identities.provider": bson.M{"$ne": identity.Provider}},
+		bson.M{"$push": bson.M{"identities": identity}},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	}
+	if errors.Is(err, ErrNotFound) {
+		// Either the user is gone or the filter on the provider didn't match
+		if _, getErr := s.GetByID(ctx, userID); getErr == nil {
+			return ErrAlreadyExists
+		}
+	}
+	return err
+}
+
+func (s *MongoUserStore) RemoveIdentity(ctx context.Context, userID, provider string) error {
+	return s.update(ctx, userID,
+		bson.M{"identities.provider": provider},
+		bson.M{"$pull": bson.M{"identities": bson.M{"provider": provider}}},
+	)
+}
+
+func (s *MongoUserStore) set(ctx context.Context, userID string, fields bson.M) error {
+	return s.update(ctx, userID, bson.M{}, bson.M{"$set": fields})
+}
+
+// update applies change to the user if it also matches filter, ErrNotFound otherwise
+func (s *MongoUserStore) update(ctx context.Context, userID string, filter, change bson.M) error {
+	docID, err := objectID(userID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	filter["_id"] = docID
+	result, err := s.users.UpdateOne(ctx, filter, change)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) Delete(ctx context.Context, userID string) error {
+	docID, err := objectID(userID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := s.users.DeleteOne(ctx, bson.M{"_id": docID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ---------------- MESSAGES ----------------
+
+type MongoMessageStore struct {
+	messages *mongo.Collection
+}
+
+func (s *MongoMessageStore) Save(ctx context.Context, msg models.Message) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	id := primitive.NewObjectID()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+
+	_, err := s.messages.InsertOne(ctx, bson.M{
+		"_id":        id,
+		"fromUserID": msg.FromUserID,
+		"message":    msg.Message,
+		"toUserID":   msg.ToUserID,
+		"type":       msg.Type,
+		"createdAt":  msg.CreatedAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	return id.Hex(), nil
+}
+
+func (s *MongoMessageStore) Conversation(ctx context.Context, userA, userB string, page, limit int64) ([]models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	filter := bson.M{
+		"$or": []bson.M{
+			{"toUserID": userA, "fromUserID": userB},
+			{"fromUserID": userA, "toUserID": userB},
+		},
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}). // Sort by newest first
+		SetLimit(limit).
+		SetSkip((page - 1) * limit)
+
+	cursor, err := s.messages.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var conversation []models.Message
+	if err := cursor.All(ctx, &conversation); err != nil {
+		return nil, err
+	}
+
+	// Reverse the order so the frontend receives them chronologically (oldest -> newest)
+	for i, j := 0, len(conversation)-1; i < j; i, j = i+1, j-1 {
+		conversation[i], conversation[j] = conversation[j], conversation[i]
+	}
+	return conversation, nil
+}
+
+func (s *MongoMessageStore) Delete(ctx context.Context, messageIDs []string, fromUserID string) error {
+	var objectIDs []primitive.ObjectID
+	for _, id := range messageIDs {
+		if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+			objectIDs = append(objectIDs, oid)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// Only the sender may delete a message
+	_, err := s.messages.DeleteMany(ctx, bson.M{
+		"_id":        bson.M{"$in": objectIDs},
+		"fromUserID": fromUserID,
+	})
+	return err
+}
+
+func involving(userID string) bson.M {
+	return bson.M{"$or": []bson.M{{"fromUserID": userID}, {"toUserID": userID}}}
+}
+
+func (s *MongoMessageStore) ForUser(ctx context.Context, userID string) ([]models.Message, error) {
+	return findAll[models.Message](ctx, s.messages, involving(userID))
+}
+
+func (s *MongoMessageStore) DeleteForUser(ctx context.Context, userID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := s.messages.DeleteMany(ctx, involving(userID))
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *MongoMessageStore) AnonymizeUser(ctx context.Context, userID, replacement string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var modified int64
+	for _, field := range []string{"fromUserID", "toUserID"} {
+		result, err := s.messages.UpdateMany(ctx, bson.M{field: userID}, bson.M{"$set": bson.M{field: replacement}})
+		if err != nil {
+			return modified, err
+		}
+		modified += result.ModifiedCount
+	}
+	return modified, nil
+}
+
+// findAll decodes every match, oldest first, for exports that need the complete history
+func findAll[T any](ctx context.Context, collection *mongo.Collection, filter bson.M) ([]T, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []T
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// ---------------- FRIENDSHIPS ----------------
+
+type MongoFriendshipStore struct {
+	friendships *mongo.Collection
+}
+
+func (s *MongoFriendshipStore) Request(ctx context.Context, requesterID, addresseeID string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// Check if friendship already exists (in either direction)
+	count, err := s.friendships.CountDocuments(ctx, bson.M{
+		"$or": []bson.M{
+			{"requesterID": requesterID, "addresseeID": addresseeID},
+			{"requesterID": addresseeID, "addresseeID": requesterID},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrAlreadyExists
+	}
+
+	_, err = s.friendships.InsertOne(ctx, bson.M{
+		"requesterID": requesterID,
+		"addresseeID": addresseeID,
+		"status":      "pending",
+		"createdAt":   time.Now(),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *MongoFriendshipStore) Accept(ctx context.Context, requesterID, addresseeID string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := s.friendships.UpdateOne(ctx,
+		bson.M{
+			"requesterID": requesterID,
+			"addresseeID": addresseeID,
+			"status":      "pending",
+		},
+		bson.M{"$set": bson.M{"status": "accepted"}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoFriendshipStore) Pending(ctx context.Context, addresseeID string) ([]models.Friendship, error) {
+	return s.find(ctx, bson.M{
+		"addresseeID": addresseeID,
+		"status":      "pending",
+	})
+}
+
+func (s *MongoFriendshipStore) Accepted(ctx context.Context, userID string) ([]models.Friendship, error) {
+	return s.find(ctx, bson.M{
+		"status": "accepted",
+		"$or": []bson.M{
+			{"requesterID": userID},
+			{"addresseeID": userID},
+		},
+	})
+}
+
+func (s *MongoFriendshipStore) ForUser(ctx context.Context, userID string) ([]models.Friendship, error) {
+	return s.find(ctx, bson.M{
+		"$or": []bson.M{
+			{"requesterID": userID},
+			{"addresseeID": userID},
+		},
+	})
+}
+
+func (s *MongoFriendshipStore) DeleteForUser(ctx context.Context, userID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := s.friendships.DeleteMany(ctx, bson.M{
+		"$or": []bson.M{
+			{"requesterID": userID},
+			{"addresseeID": userID},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *MongoFriendshipStore) find(ctx context.Context, filter bson.M) ([]models.Friendship, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	cursor, err := s.friendships.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var friendships []models.Friendship
+	if err := cursor.All(ctx, &friendships); err != nil {
+		return nil, err
+	}
+	return friendships, nil
+}
+
+// ---------------- GROUPS ----------------
+
+type MongoGroupStore struct {
+	groups     *mongo.Collection
+	messages   *mongo.Collection
+	recordings *mongo.Collection
+}
+
+func (s *MongoGroupStore) Create(ctx context.Context, group models.GroupDetails) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	id := primitive.NewObjectID()
+	_, err := s.groups.InsertOne(ctx, bson.M{
+		"_id":         id,
+		"name":        group.Name,
+		"description": group.Description,
+		"avatar":      group.Avatar,
+		"creatorID":   group.CreatorID,
+		"members":     group.Members,
+		"settings":    group.Settings,
+		"createdAt":   group.CreatedAt,
+		"updatedAt":   group.UpdatedAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	return id.Hex(), nil
+}
+
+func (s *MongoGroupStore) GetByID(ctx context.Context, groupID string) (models.GroupDetails, error) {
+	objID, err := objectID(groupID)
+	if err != nil {
+		return models.GroupDetails{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	return findOne[models.GroupDetails](ctx, s.groups, bson.M{"_id": objID})
+}
+
+func (s *MongoGroupStore) List(ctx context.Context, limit int64) ([]models.GroupDetails, error) {
+	return s.find(ctx, bson.M{}, limit)
+}
+
+func (s *MongoGroupStore) ListByMember(ctx context.Context, userID string) ([]models.GroupDetails, error) {
+	return s.find(ctx, bson.M{"members.userID": userID}, 0)
+}
+
+func (s *MongoGroupStore) find(ctx context.Context, filter bson.M, limit int64) ([]models.GroupDetails, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := s.groups.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []models.GroupDetails
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (s *MongoGroupStore) AddMember(ctx context.Context, groupID string, member models.GroupMember) error {
+	objID, err := objectID(groupID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// Matching on "not already a member" keeps the check and the push atomic
+	result, err := s.groups.UpdateOne(ctx,
+		bson.M{"_id": objID, "members.userID": bson.M{"$ne": member.UserID}},
+		bson.M{"$push": bson.M{"members": member}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := s.GetByID(ctx, groupID); err != nil {
+			return err
+		}
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+func (s *MongoGroupStore) RemoveMember(ctx context.Context, groupID, userID string) error {
+	objID, err := objectID(groupID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := s.groups.UpdateOne(ctx,
+		bson.M{"_id": objID},
+		bson.M{"$pull": bson.M{"members": bson.M{"userID": userID}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoGroupStore) Update(ctx context.Context, groupID string, update GroupUpdate) error {
+	objID, err := objectID(groupID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	updateFields := bson.M{"updatedAt": time.Now()}
+	if update.Name != "" {
+		updateFields["name"] = update.Name
+	}
+	if update.Description != "" {
+		updateFields["description"] = update.Description
+	}
+	if update.Avatar != "" {
+		updateFields["avatar"] = update.Avatar
+	}
+
+	result, err := s.groups.UpdateOne(ctx, bson.M{"_id": objID}, bson.M{"$set": updateFields})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoGroupStore) Delete(ctx context.Context, groupID string) error {
+	objID, err := objectID(groupID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := s.groups.DeleteOne(ctx, bson.M{"_id": objID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoGroupStore) TransferOwnership(ctx context.Context, groupID, newOwnerID string) error {
+	objID, err := objectID(groupID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// The positional $ targets the new owner's entry in members
+	result, err := s.groups.UpdateOne(ctx,
+		bson.M{"_id": objID, "members.userID": newOwnerID},
+		bson.M{"$set": bson.M{
+			"creatorID":      newOwnerID,
+			"members.$.role": "admin",
+			"updatedAt":      time.Now(),
+		}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := s.GetByID(ctx, groupID); err != nil {
+			return err
+		}
+		return ErrNotMember
+	}
+	return nil
+}
+
+func (s *MongoGroupStore) SaveMessage(ctx context.Context, msg models.GroupMessage) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	id := primitive.NewObjectID()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+
+	_, err := s.messages.InsertOne(ctx, bson.M{
+		"_id":        id,
+		"groupID":    msg.GroupID,
+		"fromUserID": msg.FromUserID,
+		"message":    msg.Message,
+		"type":       msg.Type,
+		"createdAt":  msg.CreatedAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	return id.Hex(), nil
+}
+
+func (s *MongoGroupStore) Messages(ctx context.Context, groupID string, limit int64) ([]models.GroupMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(limit)
+	cursor, err := s.messages.Find(ctx, bson.M{"groupID": groupID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []models.GroupMessage
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	// Newest were fetched first, hand them out oldest -> newest
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s *MongoGroupStore) MessagesByUser(ctx context.Context, userID string) ([]models.GroupMessage, error) {
+	return findAll[models.GroupMessage](ctx, s.messages, bson.M{"fromUserID": userID})
+}
+
+func (s *MongoGroupStore) DeleteMessagesByUser(ctx context.Context, userID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := s.messages.DeleteMany(ctx, bson.M{"fromUserID": userID})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *MongoGroupStore) AnonymizeMessagesByUser(ctx context.Context, userID, replacement string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := s.messages.UpdateMany(ctx, bson.M{"fromUserID": userID}, bson.M{"$set": bson.M{"fromUserID": replacement}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (s *MongoGroupStore) SaveRecording(ctx context.Context, recording models.GroupRecording) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := s.recordings.InsertOne(ctx, recording)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *MongoGroupStore) Recordings(ctx context.Context, groupID string, limit int64) ([]models.GroupRecording, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "startedAt", Value: -1}}).SetLimit(limit)
+	cursor, err := s.recordings.Find(ctx, bson.M{"groupID": groupID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var recordings []models.GroupRecording
+	if err := cursor.All(ctx, &recordings); err != nil {
+		return nil, err
+	}
+	return recordings, nil
+}
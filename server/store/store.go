@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"chat-app/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrNotFound is returned when the requested document doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned when a unique document would be created twice
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrInvalidID is returned for IDs that are not valid ObjectID hex strings
+	ErrInvalidID = errors.New("invalid ID")
+	// ErrNotMember is returned when a group operation targets a user outside the group
+	ErrNotMember = errors.New("not a group member")
+)
+
+// UserStore persists user accounts
+type UserStore interface {
+	GetByID(ctx context.Context, userID string) (models.UserDetails, error)
+	GetByUsername(ctx context.Context, username string) (models.UserDetails, error)
+	// Create inserts the user with a fresh ID and returns it
+	Create(ctx context.Context, user models.UserDetails) (string, error)
+	SetOnline(ctx context.Context, userID, status string) error
+	// ListOnline returns every online user except excludeID
+	ListOnline(ctx context.Context, excludeID string) ([]models.UserDetails, error)
+	// Search matches usernames containing query (case-insensitive), an empty query lists everyone
+	Search(ctx context.Context, query string, limit int64) ([]models.UserDetails, error)
+	SetDisabled(ctx context.Context, userID string, disabled bool) error
+	SetPassword(ctx context.Context, userID, passwordHash string) error
+	// MarkEmailVerified records that the user proved they own their current email
+	MarkEmailVerified(ctx context.Context, userID string) error
+	Delete(ctx context.Context, userID string) error
+
+	// SetTwoFactor replaces the TOTP state, nil turns two-factor authentication off
+	SetTwoFactor(ctx context.Context, userID string, twoFactor *models.TwoFactor) error
+	// UseTOTPStep records a verified TOTP step, ErrAlreadyExists if it or a later one was used
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	// UseRecoveryCode removes a recovery code hash, ErrNotFound if it was used already
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) error
+
+	// GetByIdentity finds the user linked to an OIDC subject
+	GetByIdentity(ctx context.Context, provider, subject string) (models.UserDetails, error)
+	// FindByEmail matches case-insensitively, emails aren't unique so there can be several
+	FindByEmail(ctx context.Context, email string) ([]models.UserDetails, error)
+	// AddIdentity links an OIDC subject, ErrAlreadyExists if the subject belongs to
+	// someone or the user already has an identity of that provider
+	AddIdentity(ctx context.Context, userID string, identity models.Identity) error
+	// RemoveIdentity unlinks the user's identity of provider, ErrNotFound if there is none
+	RemoveIdentity(ctx context.Context, userID, provider string) error
+}
+
+// MessageStore persists direct messages
+type MessageStore interface {
+	Save(ctx context.Context, msg models.Message) (string, error)
+	// Conversation returns one page of messages between two users, oldest first
+	Conversation(ctx context.Context, userA, userB string, page, limit int64) ([]models.Message, error)
+	// Delete removes the given messages if they were sent by fromUserID
+	Delete(ctx context.Context, messageIDs []string, fromUserID string) error
+
+	// ForUser returns every message userID sent or received, oldest first
+	ForUser(ctx context.Context, userID string) ([]models.Message, error)
+	// DeleteForUser removes every message userID sent or received
+	DeleteForUser(ctx context.Context, userID string) (int64, error)
+	// AnonymizeUser replaces userID as sender and recipient, the text stays for the other side
+	AnonymizeUser(ctx context.Context, userID, replacement string) (int64, error)
+}
+
+// FriendshipStore persists friend requests and accepted friendships
+type FriendshipStore interface {
+	// Request creates a pending request, ErrAlreadyExists if the pair is already linked either way
+	Request(ctx context.Context, requesterID, addresseeID string) error
+	Accept(ctx context.Context, requesterID, addresseeID string) error
+	// Pending lists requests waiting for addresseeID to answer
+	Pending(ctx context.Context, addresseeID string) ([]models.Friendship, error)
+	// Accepted lists friendships where userID is either side
+	Accepted(ctx context.Context, userID string) ([]models.Friendship, error)
+	// ForUser lists every request and friendship where userID is either side
+	ForUser(ctx context.Context, userID string) ([]models.Friendship, error)
+	DeleteForUser(ctx context.Context, userID string) (int64, error)
+}
+
+// GroupUpdate holds the editable group fields, empty fields are left untouched
+type GroupUpdate struct {
+	Name        string
+	Description string
+	Avatar      string
+}
+
+// GroupStore persists groups, their members and group messages
+type GroupStore interface {
+	// Create inserts the group with a fresh ID and returns it
+	Create(ctx context.Context, group models.GroupDetails) (string, error)
+	GetByID(ctx context.Context, groupID string) (models.GroupDetails, error)
+	List(ctx context.Context, limit int64) ([]models.GroupDetails, error)
+	ListByMember(ctx context.Context, userID string) ([]models.GroupDetails, error)
+	// AddMember returns ErrAlreadyExists if the user is already in the group
+	AddMember(ctx context.Context, groupID string, member models.GroupMember) error
+	RemoveMember(ctx context.Context, groupID, userID string) error
+	Update(ctx context.Context, groupID string, update GroupUpdate) error
+	Delete(ctx context.Context, groupID string) error
+	// TransferOwnership makes an existing member the creator and an admin, ErrNotMember otherwise
+	TransferOwnership(ctx context.Context, groupID, newOwnerID string) error
+
+	SaveMessage(ctx context.Context, msg models.GroupMessage) (string, error)
+	// Messages returns the latest limit messages of a group, oldest first
+	Messages(ctx context.Context, groupID string, limit int64) ([]models.GroupMessage, error)
+	// MessagesByUser returns every group message sent by userID, oldest first
+	MessagesByUser(ctx context.Context, userID string) ([]models.GroupMessage, error)
+	DeleteMessagesByUser(ctx context.Context, userID string) (int64, error)
+	AnonymizeMessagesByUser(ctx context.Context, userID, replacement string) (int64, error)
+
+	// SaveRecording returns ErrAlreadyExists if a recording with the same ID was saved before
+	SaveRecording(ctx context.Context, recording models.GroupRecording) error
+	// Recordings returns the latest limit recordings of a group, newest first
+	Recordings(ctx context.Context, groupID string, limit int64) ([]models.GroupRecording, error)
+}
+
+// Stores bundles every store so handlers can receive them in one argument
+type Stores struct {
+	Users       UserStore
+	Messages    MessageStore
+	Friendships FriendshipStore
+	Groups      GroupStore
+
+	// Redis holds what is shared between instances: offline inboxes, the global chat
+	// history and the pub/sub channel socket events travel on
+	Redis redis.UniversalClient
+}
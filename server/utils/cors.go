@@ -1,24 +1,42 @@
 package utils
 
 import (
+	"net/http"
+
+	"chat-app/logging"
+	"chat-app/origins"
+
 	"github.com/gin-gonic/gin"
 )
 
-// returns a gin middleware handler for CORS
-func CORSMiddleware() gin.HandlerFunc {
+// returns a gin middleware handler for CORS. Allowed origins are echoed back, since browsers
+// refuse "*" together with credentials. Requests from any other origin are rejected.
+func CORSMiddleware(allowed *origins.Allowlist) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Origin, Accept")
-		c.Writer.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
+		origin := c.GetHeader("Origin")
+		c.Writer.Header().Add("Vary", "Origin")
+
+		if !allowed.Allows(origin, c.Request.Host) {
+			logging.FromContext(c.Request.Context()).Warn("Rejected request from disallowed origin",
+				"origin", origin, "method", c.Request.Method, "path", c.Request.URL.Path)
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if origin != "" {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Origin, Accept")
+			c.Writer.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
+		}
 
 		// Handle preflight requests
 		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204) // Changed from 206 to 204
+			c.AbortWithStatus(http.StatusNoContent)
 			return
 		}
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
@@ -1,23 +1,27 @@
 package utils
 
-import(
+import (
 	"errors"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string)(string, error){
+// ErrPasswordMismatch is returned by VerifyPassword. It deliberately carries neither the
+// password nor the hash, errors end up in logs and traces.
+var ErrPasswordMismatch = errors.New("password does not match")
+
+func HashPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil{
+	if err != nil {
 		return "", errors.New("error occurred while creating a Hash")
 	}
 
 	return string(hashedPassword), nil
 }
 
-func VerifyPassword(hashPass, password string) error{
-	err := bcrypt.CompareHashAndPassword([]byte(hashPass), []byte(password))
-	if err != nil{
-		return errors.New("The " + password + " and " + hashPass + " doesn't match")
+func VerifyPassword(hashPass, password string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(hashPass), []byte(password)); err != nil {
+		return ErrPasswordMismatch
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"log/slog"
+	"time"
+
+	"chat-app/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// route params that identify the acting user, in order of preference
+var userIDParams = []string{"userID", "fromUserID", "myUserID"}
+
+// RequestLogger assigns every request a correlation ID and logs it once it completes.
+// An incoming X-Request-ID is reused so IDs survive hops between services.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader(logging.RequestIDHeader)
+		if requestID == "" {
+			requestID = logging.NewID()
+		}
+		c.Writer.Header().Set(logging.RequestIDHeader, requestID)
+
+		logger := slog.Default().With(slog.String(logging.KeyRequestID, requestID))
+		for _, param := range userIDParams {
+			if userID := c.Param(param); userID != "" {
+				logger = logger.With(slog.String(logging.KeyUserID, userID))
+				break
+			}
+		}
+		if groupID := c.Param("groupID"); groupID != "" {
+			logger = logger.With(slog.String(logging.KeyGroupID, groupID))
+		}
+
+		ctx := logging.WithRequestID(c.Request.Context(), requestID)
+		c.Request = c.Request.WithContext(logging.WithLogger(ctx, logger))
+
+		c.Next()
+
+		level := slog.LevelInfo
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+		logger.Log(c.Request.Context(), level, "http request",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.FullPath()),
+			slog.Int("status", c.Writer.Status()),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// CallbackSignatureHeader carries the signature of requests between this service and the
+// chat server, in both directions
+const CallbackSignatureHeader = "X-Video-Signature"
+
+// Prefixes keep callback, service request and join token signatures made with the same secret apart
+const (
+	callbackPrefix       = "callback."
+	serviceRequestPrefix = "request."
+)
+
+// ServiceRequestMaxAge is how far the requestedAt of a signed request from the chat server may
+// be off, older requests are refused so a captured one can't be replayed later
+const ServiceRequestMaxAge = time.Minute
+
+// SignCallback signs a request body for the chat server, which checks it with the shared
+// VIDEO_JOIN_SECRET in chat-app/auth
+func SignCallback(secret, body []byte) string {
+	return sign(secret, callbackPrefix, body)
+}
+
+// SignServiceRequest signs a request body the way the chat server does for its requests here
+func SignServiceRequest(secret, body []byte) string {
+	return sign(secret, serviceRequestPrefix, body)
+}
+
+// VerifyServiceRequest checks the signature the chat server made over body with the shared secret
+func VerifyServiceRequest(secret, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(SignServiceRequest(secret, body)))
+}
+
+func sign(secret []byte, prefix string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(prefix))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
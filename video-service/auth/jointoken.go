@@ -0,0 +1,97 @@
+// Package auth verifies the join tokens the chat server mints for video rooms.
+// The chat server signs them with the same VIDEO_JOIN_SECRET in chat-app/auth.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Roles a participant can join a room with
+const (
+	RoleHost        = "host"        // started the call
+	RoleModerator   = "moderator"   // admin of the group the call belongs to
+	RoleParticipant = "participant" // any other member
+)
+
+const (
+	audience = "video-service"
+	// clockSkew tolerates small clock differences between the chat server and this service
+	clockSkew = 30 * time.Second
+)
+
+// ErrInvalidToken is returned for malformed, forged, expired or misdirected tokens
+var ErrInvalidToken = errors.New("invalid or expired join token")
+
+// JoinClaims says who may join which room in which role until when
+type JoinClaims struct {
+	Subject  string `json:"sub"`            // user ID
+	Name     string `json:"name,omitempty"` // username, tokens of older chat servers have none
+	Room     string `json:"room"`
+	Role     string `json:"role"`
+	Audience string `json:"aud"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+// VerifyJoinToken checks the HS256 signature and the claims of a token for roomId
+func VerifyJoinToken(secret []byte, token, roomId string, now time.Time) (JoinClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return JoinClaims{}, ErrInvalidToken
+	}
+
+	// Only HS256 is ever issued, anything else ("none" included) is refused before looking further
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return JoinClaims{}, ErrInvalidToken
+	}
+	var jose struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &jose); err != nil || jose.Alg != "HS256" {
+		return JoinClaims{}, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return JoinClaims{}, ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return JoinClaims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return JoinClaims{}, ErrInvalidToken
+	}
+	var claims JoinClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return JoinClaims{}, ErrInvalidToken
+	}
+
+	switch {
+	case claims.Audience != audience,
+		claims.Subject == "",
+		claims.Room != roomId,
+		!validRole(claims.Role),
+		now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)):
+		return JoinClaims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func validRole(role string) bool {
+	switch role {
+	case RoleHost, RoleModerator, RoleParticipant:
+		return true
+	}
+	return false
+}
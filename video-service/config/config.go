@@ -0,0 +1,391 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"video-service/origins"
+)
+
+// Config is the complete runtime configuration of the video service.
+// Values are layered: defaults, then the JSON config file, then environment variables, then flags.
+type Config struct {
+	Server    ServerConfig    `json:"server"`
+	Redis     RedisConfig     `json:"redis"`
+	CORS      CORSConfig      `json:"cors"`
+	Auth      AuthConfig      `json:"auth"`
+	SFU       SFUConfig       `json:"sfu"`
+	ICE       ICEConfig       `json:"ice"`
+	Recording RecordingConfig `json:"recording"`
+	Chat      ChatConfig      `json:"chat"`
+	Log       LogConfig       `json:"log"`
+	Tracing   TracingConfig   `json:"tracing"`
+}
+
+type ServerConfig struct {
+	Port int `json:"port"`
+}
+
+type RedisConfig struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"` // DB 1 by default to avoid conflicts with the chat service
+}
+
+// CORSConfig lists the browser origins allowed to call the API and open sockets, exact
+// like https://chat.example.com or any subdomain like https://*.example.com
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+// AuthConfig controls who may open a signaling socket
+type AuthConfig struct {
+	// JoinSecret verifies the join tokens minted by the chat server, both need the same value
+	JoinSecret string `json:"joinSecret"`
+	// AllowImplicitRooms lets a valid token create its room on join. Off by default, rooms
+	// then only exist once the chat server created them through POST /api/rooms/create.
+	AllowImplicitRooms bool `json:"allowImplicitRooms"`
+}
+
+// SFUConfig controls when calls go through the server and how it is reached
+type SFUConfig struct {
+	// MeshMaxParticipants is the largest room without a type that stays a mesh, the next
+	// participant moves the call to the SFU. Rooms of type "group" always use the SFU.
+	MeshMaxParticipants int      `json:"meshMaxParticipants"`
+	ICEServers          []string `json:"iceServers"`
+	UDPPortMin          int      `json:"udpPortMin"` // 0 lets the OS pick any port
+	UDPPortMax          int      `json:"udpPortMax"`
+	PublicIPs           []string `json:"publicIPs"` // announced instead of the host address, for 1:1 NAT
+}
+
+// ICEConfig is what GET /api/ice-servers hands to clients. TURN credentials are minted per
+// user in the TURN REST API format, coturn checks them with use-auth-secret and the same secret.
+type ICEConfig struct {
+	STUNURLs []string `json:"stunURLs"`
+	TURNURLs []string `json:"turnURLs"` // turn: and turns: URLs, empty serves STUN only
+	// TURNSecret is coturn's static-auth-secret, required with TURN URLs
+	TURNSecret string `json:"turnSecret"`
+	// CredentialTTLSeconds is how long TURN credentials work, a call that outlives them keeps its allocation
+	CredentialTTLSeconds int `json:"credentialTTLSeconds"`
+	// RateLimitPerMinute and RateLimitBurst bound how often one user fetches credentials
+	RateLimitPerMinute int `json:"rateLimitPerMinute"`
+	RateLimitBurst     int `json:"rateLimitBurst"`
+}
+
+// RecordingConfig controls server side recording of SFU calls
+type RecordingConfig struct {
+	// Storage is the backend recordings are written to, "local" or "none" to turn recording off
+	Storage string `json:"storage"`
+	// Dir is where the local backend keeps recordings, one directory per room and recording
+	Dir string `json:"dir"`
+}
+
+// ChatConfig is how the video service reaches the chat server
+type ChatConfig struct {
+	// ServiceURL receives finished recordings, signed with auth.joinSecret. Empty keeps
+	// recordings out of the chat groups.
+	ServiceURL string `json:"serviceURL"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level"`  // debug, info, warn, error
+	Format string `json:"format"` // json, text
+}
+
+type TracingConfig struct {
+	Exporter string `json:"exporter"` // otlp, stdout, none
+}
+
+// Default returns the configuration used for local development
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port: 4000,
+		},
+		Redis: RedisConfig{
+			Addr: "localhost:6379",
+			DB:   1,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"http://localhost:3000", "http://localhost:5173"},
+		},
+		SFU: SFUConfig{
+			MeshMaxParticipants: 4,
+			ICEServers:          []string{"stun:stun.l.google.com:19302"},
+		},
+		ICE: ICEConfig{
+			STUNURLs:             []string{"stun:stun.l.google.com:19302"},
+			CredentialTTLSeconds: 3600,
+			RateLimitPerMinute:   10,
+			RateLimitBurst:       5,
+		},
+		Recording: RecordingConfig{
+			Storage: "local",
+			Dir:     "recordings",
+		},
+		Chat: ChatConfig{
+			ServiceURL: "http://localhost:8080",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			Exporter: "none",
+		},
+	}
+}
+
+// Load builds the configuration from the config file, the environment and the command line
+// arguments (without the program name), then validates it.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("video-service", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+	port := fs.Int("port", 0, "HTTP listen port")
+	redisAddr := fs.String("redis-addr", "", "Redis address (host:port)")
+	allowedOrigins := fs.String("allowed-origins", "", "comma separated list of allowed CORS origins")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	envErr := cfg.loadEnv()
+
+	// Only flags that were actually passed override the lower layers
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = *port
+		case "redis-addr":
+			cfg.Redis.Addr = *redisAddr
+		case "allowed-origins":
+			cfg.CORS.AllowedOrigins = splitList(*allowedOrigins)
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		}
+	})
+
+	if err := errors.Join(envErr, cfg.Validate()); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	var errs []error
+
+	// VIDEO_SERVICE_PORT is the historical name, docker-compose uses PORT
+	errs = append(errs, setInt(&cfg.Server.Port, "VIDEO_SERVICE_PORT"))
+	errs = append(errs, setInt(&cfg.Server.Port, "PORT"))
+
+	setString(&cfg.Redis.Addr, "REDIS_URL")
+	setString(&cfg.Redis.Password, "REDIS_PASSWORD")
+	errs = append(errs, setInt(&cfg.Redis.DB, "REDIS_DB"))
+
+	if value := os.Getenv("ALLOWED_ORIGINS"); value != "" {
+		cfg.CORS.AllowedOrigins = splitList(value)
+	}
+
+	setString(&cfg.Auth.JoinSecret, "VIDEO_JOIN_SECRET")
+	errs = append(errs, setBool(&cfg.Auth.AllowImplicitRooms, "ALLOW_IMPLICIT_ROOMS"))
+
+	errs = append(errs, setInt(&cfg.SFU.MeshMaxParticipants, "SFU_MESH_MAX_PARTICIPANTS"))
+	if value := os.Getenv("SFU_ICE_SERVERS"); value != "" {
+		cfg.SFU.ICEServers = splitList(value)
+	}
+	errs = append(errs, setInt(&cfg.SFU.UDPPortMin, "SFU_UDP_PORT_MIN"))
+	errs = append(errs, setInt(&cfg.SFU.UDPPortMax, "SFU_UDP_PORT_MAX"))
+	if value := os.Getenv("SFU_PUBLIC_IPS"); value != "" {
+		cfg.SFU.PublicIPs = splitList(value)
+	}
+
+	if value := os.Getenv("STUN_URLS"); value != "" {
+		cfg.ICE.STUNURLs = splitList(value)
+	}
+	if value := os.Getenv("TURN_URLS"); value != "" {
+		cfg.ICE.TURNURLs = splitList(value)
+	}
+	setString(&cfg.ICE.TURNSecret, "TURN_SECRET")
+	errs = append(errs, setInt(&cfg.ICE.CredentialTTLSeconds, "TURN_CREDENTIAL_TTL"))
+	errs = append(errs, setInt(&cfg.ICE.RateLimitPerMinute, "ICE_RATE_LIMIT_PER_MINUTE"))
+	errs = append(errs, setInt(&cfg.ICE.RateLimitBurst, "ICE_RATE_LIMIT_BURST"))
+
+	setString(&cfg.Recording.Storage, "RECORDING_STORAGE")
+	setString(&cfg.Recording.Dir, "RECORDING_DIR")
+	setString(&cfg.Chat.ServiceURL, "CHAT_SERVICE_URL")
+
+	setString(&cfg.Log.Level, "LOG_LEVEL")
+	setString(&cfg.Log.Format, "LOG_FORMAT")
+	setString(&cfg.Tracing.Exporter, "OTEL_TRACES_EXPORTER")
+
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid setting at once so operators can fix them in one go
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.Server.Port < 1 || cfg.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port: %d is not a valid TCP port", cfg.Server.Port))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Redis.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("redis.addr: %q must be host:port", cfg.Redis.Addr))
+	}
+	if cfg.Redis.DB < 0 {
+		errs = append(errs, errors.New("redis.db: must not be negative"))
+	}
+
+	if len(cfg.CORS.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("cors.allowedOrigins: at least one origin is required (ALLOWED_ORIGINS)"))
+	}
+	if _, err := origins.Parse(cfg.CORS.AllowedOrigins); err != nil {
+		errs = append(errs, fmt.Errorf("cors.allowedOrigins: %w", err))
+	}
+
+	if len(cfg.Auth.JoinSecret) < minJoinSecretLength {
+		errs = append(errs, fmt.Errorf("auth.joinSecret: must be at least %d characters, the same as the chat server's (VIDEO_JOIN_SECRET)", minJoinSecretLength))
+	}
+
+	if cfg.SFU.MeshMaxParticipants < 2 {
+		errs = append(errs, errors.New("sfu.meshMaxParticipants: must be at least 2"))
+	}
+	if sfu := cfg.SFU; sfu.UDPPortMin < 0 || sfu.UDPPortMax > 65535 || sfu.UDPPortMin > sfu.UDPPortMax ||
+		(sfu.UDPPortMin == 0) != (sfu.UDPPortMax == 0) {
+		errs = append(errs, fmt.Errorf("sfu.udpPortMin/udpPortMax: %d-%d is not a valid port range", sfu.UDPPortMin, sfu.UDPPortMax))
+	}
+	for _, ip := range cfg.SFU.PublicIPs {
+		if net.ParseIP(ip) == nil {
+			errs = append(errs, fmt.Errorf("sfu.publicIPs: %q is not an IP address", ip))
+		}
+	}
+
+	for _, u := range cfg.ICE.STUNURLs {
+		if !strings.HasPrefix(u, "stun:") && !strings.HasPrefix(u, "stuns:") {
+			errs = append(errs, fmt.Errorf("ice.stunURLs: %q must start with stun: or stuns:", u))
+		}
+	}
+	for _, u := range cfg.ICE.TURNURLs {
+		if !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+			errs = append(errs, fmt.Errorf("ice.turnURLs: %q must start with turn: or turns:", u))
+		}
+	}
+	if len(cfg.ICE.TURNURLs) > 0 && cfg.ICE.TURNSecret == "" {
+		errs = append(errs, errors.New("ice.turnSecret: required with TURN URLs, coturn's static-auth-secret (TURN_SECRET)"))
+	}
+	if cfg.ICE.CredentialTTLSeconds < 60 {
+		errs = append(errs, errors.New("ice.credentialTTLSeconds: must be at least 60"))
+	}
+	if cfg.ICE.RateLimitPerMinute < 0 || cfg.ICE.RateLimitBurst < 0 {
+		errs = append(errs, errors.New("ice.rateLimitPerMinute/rateLimitBurst: must not be negative, 0 turns limiting off"))
+	}
+
+	switch strings.ToLower(cfg.Recording.Storage) {
+	case "local":
+		if cfg.Recording.Dir == "" {
+			errs = append(errs, errors.New("recording.dir: required by the local storage (RECORDING_DIR)"))
+		}
+	case "none":
+	default:
+		errs = append(errs, fmt.Errorf("recording.storage: %q must be local or none", cfg.Recording.Storage))
+	}
+
+	if cfg.Chat.ServiceURL != "" {
+		if u, err := url.Parse(cfg.Chat.ServiceURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("chat.serviceURL: %q must be an http(s) URL", cfg.Chat.ServiceURL))
+		}
+	}
+
+	switch strings.ToLower(cfg.Log.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level: %q must be debug, info, warn or error", cfg.Log.Level))
+	}
+	switch strings.ToLower(cfg.Log.Format) {
+	case "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("log.format: %q must be json or text", cfg.Log.Format))
+	}
+
+	switch strings.ToLower(cfg.Tracing.Exporter) {
+	case "otlp", "stdout", "none":
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter: %q must be otlp, stdout or none", cfg.Tracing.Exporter))
+	}
+
+	return errors.Join(errs...)
+}
+
+// minJoinSecretLength is 256 bits of printable secret for the HS256 join tokens
+const minJoinSecretLength = 32
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func setString(dst *string, key string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*dst = value
+	}
+}
+
+func setInt(dst *int, key string) error {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not an integer", key, value)
+	}
+	*dst = parsed
+	return nil
+}
+
+func setBool(dst *bool, key string) error {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a boolean", key, value)
+	}
+	*dst = parsed
+	return nil
+}
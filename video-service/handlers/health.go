@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"context"
+	"time"
+	"video-service/redis"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// HealthCheck pings Redis, the only dependency of the video service. The probe is
+// unauthenticated, so a failure is logged and only reported as "error".
+// Route: GET /healthz (and the legacy /health)
+func HealthCheck(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	checks := fiber.Map{"redis": "ok"}
+	status := fiber.StatusOK
+	if err := redis.Ping(ctx); err != nil {
+		requestLogger(c).Error("Health check failed", "dependency", "redis", "error", err)
+		checks["redis"] = "error"
+		status = fiber.StatusServiceUnavailable
+	}
+
+	state := "healthy"
+	if status != fiber.StatusOK {
+		state = "unhealthy"
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"status":  state,
+		"service": "video-calling",
+		"checks":  checks,
+	})
+}
+
+// ReadinessCheck reports whether this instance can accept signaling connections
+// Route: GET /readyz
+func ReadinessCheck(c *fiber.Ctx) error {
+	return HealthCheck(c)
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"video-service/auth"
+	"video-service/config"
+	"video-service/logging"
+	"video-service/redis"
+	"video-service/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	iceConfig  config.ICEConfig
+	joinSecret []byte
+)
+
+// ConfigureICE sets the ICE servers served to clients, called once from main before serving
+func ConfigureICE(cfg config.ICEConfig, secret []byte) {
+	iceConfig = cfg
+	joinSecret = secret
+}
+
+// GetICEServers returns the STUN and TURN servers for RTCPeerConnection, with TURN credentials
+// for the caller. It needs the join token of the call about to be joined, as
+// "Authorization: Bearer <token>" with ?roomId=, so only participants can relay through TURN.
+// Route: GET /api/ice-servers?roomId=
+func GetICEServers(c *fiber.Ctx) error {
+	roomId := c.Query("roomId")
+	token, _ := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	claims, err := auth.VerifyJoinToken(joinSecret, token, roomId, time.Now())
+	if err != nil {
+		requestLogger(c).Warn("Rejected ICE server request", logging.KeyRoomID, roomId, "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Valid join token required"})
+	}
+
+	allowed, retryAfter := redis.AllowRequest(c.UserContext(), "ice-servers", claims.Subject,
+		iceConfig.RateLimitPerMinute, iceConfig.RateLimitBurst)
+	if !allowed {
+		requestLogger(c).Info("Rate limited ICE server request", logging.KeyUserID, claims.Subject, "retry_after", retryAfter)
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many requests, try again later"})
+	}
+
+	ttl := time.Duration(iceConfig.CredentialTTLSeconds) * time.Second
+	expiresAt := time.Now().Add(ttl)
+	return c.JSON(fiber.Map{
+		"iceServers": webrtc.GetICEServers(iceConfig.STUNURLs, iceConfig.TURNURLs, iceConfig.TURNSecret, claims.Subject, expiresAt),
+		"ttl":        iceConfig.CredentialTTLSeconds,
+		"expiresAt":  expiresAt.Unix(),
+	})
+}
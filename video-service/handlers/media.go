@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"video-service/models"
+	"video-service/redis"
+	"video-service/sfu"
+)
+
+var (
+	// mediaServer forwards media of SFU rooms, nil keeps every room a mesh
+	mediaServer *sfu.SFU
+	// meshMaxParticipants is the size an "auto" room may reach before it moves to the SFU
+	meshMaxParticipants = 4
+)
+
+// ConfigureSFU enables SFU rooms, called once from main before serving
+func ConfigureSFU(s *sfu.SFU, meshMax int) {
+	mediaServer = s
+	meshMaxParticipants = meshMax
+}
+
+// roomModeForType maps CreateRoomRequest.Type to the media topology the room starts with
+func roomModeForType(roomType string) string {
+	switch roomType {
+	case "group":
+		return models.RoomModeSFU
+	case "peer":
+		return models.RoomModeMesh
+	default:
+		return models.RoomModeAuto
+	}
+}
+
+// errSFUElsewhere means another instance forwards the room's media, or would have to
+// because the room has participants connected to it
+var errSFUElsewhere = errors.New("room's SFU runs on another instance")
+
+// mediaMode decides whether a peer that joined builds a mesh or connects to the SFU. An
+// "auto" room that outgrew the mesh moves everybody to the SFU, as long as they are all
+// connected to this instance, a room spanning instances stays a mesh. A peer of an SFU room
+// owned by another instance gets errSFUElsewhere, this SFU could neither send it the others'
+// media nor forward its own.
+func mediaMode(ctx context.Context, peer *Peer, mode string) (string, error) {
+	if mediaServer == nil {
+		return models.RoomModeMesh, nil
+	}
+
+	outgrown := mode == models.RoomModeAuto && len(redis.GetRoomParticipants(ctx, peer.RoomId)) > meshMaxParticipants
+	owner, switched, err := redis.ClaimSFU(ctx, peer.RoomId, instanceId, outgrown, localUserIds(peer.RoomId))
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case switched:
+		peer.log.Info("Room outgrew the mesh, switching to the SFU", "mesh_max_participants", meshMaxParticipants)
+		moveLocalPeersToSFU(peer.RoomId, peer.UserId)
+	case outgrown && owner == "":
+		peer.log.Info("Room outgrew the mesh but spans instances, staying in the mesh", "mesh_max_participants", meshMaxParticipants)
+	}
+
+	switch owner {
+	case "":
+		return models.RoomModeMesh, nil
+	case instanceId:
+		return models.RoomModeSFU, nil
+	default:
+		return "", errSFUElsewhere
+	}
+}
+
+// startMedia tells a peer that joined the mode mediaMode picked and connects it to the SFU
+func startMedia(peer *Peer, mode string) {
+	if err := peer.WriteJSON(roomModeMessage(peer.RoomId, mode)); err != nil {
+		peer.log.Warn("Error sending room mode", "error", err)
+	}
+	if mode == models.RoomModeSFU {
+		peer.enterSFU()
+	}
+}
+
+// moveRoomToSFU switches a room to this instance's SFU and moves its local peers there.
+// It returns errSFUElsewhere when participants are connected to other instances.
+func moveRoomToSFU(ctx context.Context, roomId string) error {
+	owner, switched, err := redis.ClaimSFU(ctx, roomId, instanceId, true, localUserIds(roomId))
+	if err != nil {
+		return err
+	}
+	if owner != instanceId {
+		return errSFUElsewhere
+	}
+	if switched {
+		moveLocalPeersToSFU(roomId, "")
+	}
+	return nil
+}
+
+// moveLocalPeersToSFU tells the local peers of a room that was a mesh so far to connect to
+// the SFU, but excludeUserId, which is connected by its caller
+func moveLocalPeersToSFU(roomId, excludeUserId string) {
+	for _, other := range roomPeers(roomId, excludeUserId) {
+		if err := other.WriteJSON(roomModeMessage(roomId, models.RoomModeSFU)); err != nil {
+			other.log.Warn("Error sending room mode", "error", err)
+		}
+		other.enterSFU()
+	}
+}
+
+// roomModeMessage announces "mesh" or "sfu". In a mesh clients keep using request-offer and
+// relay offers to each other, with the SFU they answer the offers of the peer "sfu".
+func roomModeMessage(roomId, mode string) models.SignalMessage {
+	metadata, _ := json.Marshal(map[string]string{"mode": mode})
+	return models.SignalMessage{
+		Type:     "room-mode",
+		UserId:   models.SFUPeerId,
+		RoomId:   roomId,
+		Metadata: metadata,
+	}
+}
+
+// enterSFU connects the peer's media to the SFU, a peer that is already connected stays as is
+func (p *Peer) enterSFU() {
+	p.mediaMu.Lock()
+	defer p.mediaMu.Unlock()
+
+	if mediaServer == nil || p.mediaDone || p.media.Load() != nil {
+		return
+	}
+	participant, err := mediaServer.Join(p.RoomId, p.UserId, func(msg models.SignalMessage) {
+		if err := p.WriteJSON(msg); err != nil {
+			p.log.Warn("Error sending SFU signal", "type", msg.Type, "error", err)
+		}
+	}, p.log)
+	if err != nil {
+		p.log.Error("Failed to connect to the SFU", "error", err)
+		return
+	}
+	p.media.Store(participant)
+}
+
+// leaveSFU closes the peer's SFU connection, if it has one, and keeps it from connecting again
+func (p *Peer) leaveSFU() {
+	p.mediaMu.Lock()
+	defer p.mediaMu.Unlock()
+
+	p.mediaDone = true
+	if participant := p.media.Swap(nil); participant != nil {
+		participant.Close()
+	}
+}
+
+// localUserIds returns the users of a room connected to this instance
+func localUserIds(roomId string) []string {
+	peers := roomPeers(roomId, "")
+	userIds := make([]string, len(peers))
+	for i, peer := range peers {
+		userIds[i] = peer.UserId
+	}
+	return userIds
+}
+
+// roomPeers returns a snapshot of the local peers in a room, without excludeUserId
+func roomPeers(roomId, excludeUserId string) []*Peer {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
+	peers := make([]*Peer, 0, len(rooms[roomId]))
+	for id, peer := range rooms[roomId] {
+		if id != excludeUserId {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
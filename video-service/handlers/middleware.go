@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"video-service/auth"
+	"video-service/logging"
+	"video-service/origins"
+	"video-service/redis"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequestLogger assigns every request a correlation ID and logs it once it completes.
+// The chat server forwards its own X-Request-ID so a call can be followed across both services.
+func RequestLogger() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		requestID := c.Get(logging.RequestIDHeader)
+		if requestID == "" {
+			requestID = logging.NewID()
+		}
+		c.Set(logging.RequestIDHeader, requestID)
+
+		logger := slog.Default().With(slog.String(logging.KeyRequestID, requestID))
+		c.Locals(logging.LocalsLogger, logger)
+		c.SetUserContext(logging.WithLogger(c.UserContext(), logger))
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		level := slog.LevelInfo
+		if err != nil || status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.Log(c.UserContext(), level, "http request",
+			slog.String("method", c.Method()),
+			slog.String("path", c.Path()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.IP()),
+		)
+		return err
+	}
+}
+
+// requestLogger returns the logger installed by RequestLogger, or the default logger
+func requestLogger(c *fiber.Ctx) *slog.Logger {
+	return logging.FromContext(c.UserContext())
+}
+
+// CORS echoes allowed origins back, browsers refuse "*" together with credentials.
+// Requests from any other origin are rejected, websocket upgrades included.
+func CORS(allowed *origins.Allowlist) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		origin := c.Get(fiber.HeaderOrigin)
+		c.Vary(fiber.HeaderOrigin)
+
+		if !allowed.Allows(origin, c.Hostname()) {
+			requestLogger(c).Warn("Rejected request from disallowed origin",
+				"origin", origin, "method", c.Method(), "path", c.Path())
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+
+		if origin != "" {
+			c.Set(fiber.HeaderAccessControlAllowOrigin, origin)
+			c.Set(fiber.HeaderAccessControlAllowCredentials, "true")
+			c.Set(fiber.HeaderAccessControlAllowMethods, "GET,POST,PUT,DELETE,OPTIONS")
+			c.Set(fiber.HeaderAccessControlAllowHeaders, "Origin, Content-Type, Accept, Authorization")
+			c.Set(fiber.HeaderAccessControlMaxAge, "86400")
+		}
+
+		if c.Method() == fiber.MethodOptions {
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+		return c.Next()
+	}
+}
+
+// localsJoinClaims is where RequireJoinToken and RequireRoomRole leave the verified claims
+const localsJoinClaims = "joinClaims"
+
+// RequireJoinToken only lets a websocket upgrade through with a join token for its room in
+// ?token=, browsers can't set headers on websocket requests. Unless implicit rooms are
+// allowed, the room must also have been created already.
+func RequireJoinToken(secret []byte, allowImplicitRooms bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId := c.Params("roomId")
+
+		claims, err := auth.VerifyJoinToken(secret, c.Query("token"), roomId, time.Now())
+		if err != nil {
+			requestLogger(c).Warn("Rejected signaling join", logging.KeyRoomID, roomId, "error", err)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Valid join token required"})
+		}
+
+		meta := redis.GetRoomMetadata(c.UserContext(), roomId)
+		if !allowImplicitRooms && len(meta) == 0 {
+			requestLogger(c).Info("Rejected join of unknown room", logging.KeyRoomID, roomId, logging.KeyUserID, claims.Subject)
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Room not found"})
+		}
+
+		if redis.IsBannedFromRoom(c.UserContext(), roomId, claims.Subject) {
+			requestLogger(c).Info("Rejected join of removed participant", logging.KeyRoomID, roomId, logging.KeyUserID, claims.Subject)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You were removed from this call"})
+		}
+		if meta["locked"] != "" && roomRole(meta, claims) == auth.RoleParticipant {
+			requestLogger(c).Info("Rejected join of locked room", logging.KeyRoomID, roomId, logging.KeyUserID, claims.Subject)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Room is locked"})
+		}
+
+		c.Locals(localsJoinClaims, claims)
+		return c.Next()
+	}
+}
+
+// RequireServiceSignature lets through requests the chat server signed with the shared secret,
+// the same way this service signs its callbacks to the chat server
+func RequireServiceSignature(secret []byte) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !auth.VerifyServiceRequest(secret, c.Body(), c.Get(auth.CallbackSignatureHeader)) {
+			requestLogger(c).Warn("Rejected unsigned service request", "path", c.Path(), "client_ip", c.IP())
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Valid signature required"})
+		}
+		return c.Next()
+	}
+}
+
+// RequireRoomRole lets REST calls on a room through for holders of a join token for it,
+// sent as "Authorization: Bearer <token>", whose role in the room (see roomRole) is one of
+// roles. The claims end up in Locals like for RequireJoinToken.
+func RequireRoomRole(secret []byte, roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId := c.Params("roomId")
+
+		token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		claims, err := auth.VerifyJoinToken(secret, token, roomId, time.Now())
+		if !ok || err != nil {
+			requestLogger(c).Warn("Rejected room request", logging.KeyRoomID, roomId, "path", c.Path(), "error", err)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Valid join token required"})
+		}
+
+		role := roomRole(redis.GetRoomMetadata(c.UserContext(), roomId), claims)
+		if !slices.Contains(roles, role) {
+			requestLogger(c).Info("Rejected room request for role", logging.KeyRoomID, roomId, logging.KeyUserID, claims.Subject, "role", role, "path", c.Path())
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Not allowed in this role"})
+		}
+
+		c.Locals(localsJoinClaims, claims)
+		return c.Next()
+	}
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"video-service/auth"
+	"video-service/models"
+	"video-service/redis"
+)
+
+// roomRole is the role claims give in a room. The host is kept in the room's metadata, the
+// creator until it is transferred, so a token minted as host before doesn't outrank the new one.
+func roomRole(meta map[string]string, claims auth.JoinClaims) string {
+	switch {
+	case claims.Subject == roomHost(meta):
+		return auth.RoleHost
+	case claims.Role == auth.RoleModerator:
+		return auth.RoleModerator
+	default:
+		return auth.RoleParticipant
+	}
+}
+
+// roomHost returns the host in a room's metadata
+func roomHost(meta map[string]string) string {
+	if host := meta["host"]; host != "" {
+		return host
+	}
+	return meta["creator"] // rooms created before hosts were stored
+}
+
+// isModerator reports whether a role may use the moderator controls
+func isModerator(role string) bool {
+	return role == auth.RoleHost || role == auth.RoleModerator
+}
+
+// moderationMessage is a signaling event announcing a moderator action, by is the moderator
+func moderationMessage(msgType, roomId, by string, fields map[string]interface{}) models.SignalMessage {
+	if fields == nil {
+		fields = make(map[string]interface{}, 1)
+	}
+	fields["by"] = by
+	metadata, _ := json.Marshal(fields)
+	return models.SignalMessage{
+		Type:     msgType,
+		UserId:   models.SFUPeerId,
+		RoomId:   roomId,
+		Metadata: metadata,
+	}
+}
+
+// denyModeration tells the sender why its moderator action was refused
+func denyModeration(sender *Peer, action, reason string) {
+	sender.log.Warn("Refused moderator action", "action", action, "role", sender.Role(), "reason", reason)
+	if err := sender.WriteJSON(moderationMessage("moderation-denied", sender.RoomId, sender.UserId, map[string]interface{}{
+		"action": action,
+		"reason": reason,
+	})); err != nil {
+		sender.log.Warn("Error sending moderation denial", "error", err)
+	}
+}
+
+// handleModeration runs the moderator controls: mute-participant, remove-participant,
+// lock-room, end-call and transfer-host. Every action is announced to the whole room.
+func handleModeration(ctx context.Context, sender *Peer, msg models.SignalMessage) {
+	roomId := sender.RoomId
+	role := sender.Role()
+
+	if msg.Type == "transfer-host" && role != auth.RoleHost {
+		denyModeration(sender, msg.Type, "only the host can hand over the call")
+		return
+	}
+	if !isModerator(role) {
+		denyModeration(sender, msg.Type, "only the host and moderators can do this")
+		return
+	}
+
+	// The target may be connected to another instance, Redis knows who is in the room
+	target := msg.TargetId
+	switch msg.Type {
+	case "mute-participant", "remove-participant", "transfer-host":
+		if target == "" || target == sender.UserId || !redis.IsInRoom(ctx, roomId, target) {
+			denyModeration(sender, msg.Type, "no such participant")
+			return
+		}
+		if msg.Type == "remove-participant" && target == roomHost(redis.GetRoomMetadata(ctx, roomId)) {
+			denyModeration(sender, msg.Type, "the host can't be removed")
+			return
+		}
+	}
+
+	logger := sender.log.With("action", msg.Type)
+	switch msg.Type {
+	case "mute-participant":
+		var request struct {
+			Kind string `json:"kind"` // audio (default) or video
+		}
+		_ = json.Unmarshal(msg.Metadata, &request)
+		muted := true
+		update := models.MediaStateUpdate{AudioMuted: &muted}
+		if request.Kind == "video" {
+			update = models.MediaStateUpdate{VideoMuted: &muted}
+		} else {
+			request.Kind = "audio"
+		}
+
+		// The target's client stops sending, everybody else sees it muted right away
+		sendToUser(roomId, target, moderationMessage("force-mute", roomId, sender.UserId, map[string]interface{}{
+			"kind": request.Kind,
+		}))
+		if state, err := redis.UpdateMediaState(ctx, roomId, target, update); err == nil {
+			metadata, _ := json.Marshal(state)
+			broadcastToRoom(roomId, target, models.SignalMessage{
+				Type:     "media-state",
+				UserId:   target,
+				RoomId:   roomId,
+				Metadata: metadata,
+			})
+		}
+		logger.Info("Participant muted", "target_id", target, "kind", request.Kind)
+
+	case "remove-participant":
+		redis.BanFromRoom(ctx, roomId, target)
+		removed := moderationMessage("participant-removed", roomId, sender.UserId, map[string]interface{}{
+			"userId": target,
+		})
+		// The target is told before its connection closes, its read loop then cleans up like any other leave
+		if peer := roomPeer(roomId, target); peer != nil {
+			hangUpPeer(peer, &removed)
+		} else {
+			publishSignal(roomId, relayedSignal{Kind: relayHangUp, To: target, Msg: &removed})
+		}
+		broadcastToRoom(roomId, target, removed)
+		logger.Info("Participant removed", "target_id", target)
+
+	case "lock-room":
+		var request struct {
+			Locked *bool `json:"locked"`
+		}
+		_ = json.Unmarshal(msg.Metadata, &request)
+		locked := request.Locked == nil || *request.Locked
+		redis.SetRoomLocked(ctx, roomId, locked)
+		broadcastToRoom(roomId, "", moderationMessage("room-locked", roomId, sender.UserId, map[string]interface{}{
+			"locked": locked,
+		}))
+		logger.Info("Room lock changed", "locked", locked)
+
+	case "end-call":
+		closed := endRoom(ctx, roomId, sender.UserId)
+		logger.Info("Call ended by moderator", "closed_connections", closed)
+
+	case "transfer-host":
+		redis.SetRoomHost(ctx, roomId, target)
+		setUserRole(roomId, target, auth.RoleHost)
+		redis.SetParticipantRole(ctx, roomId, target, auth.RoleHost)
+
+		// The previous host keeps moderating only if its token made it a moderator
+		previous := auth.RoleParticipant
+		if sender.tokenRole == auth.RoleModerator {
+			previous = auth.RoleModerator
+		}
+		sender.setRole(previous)
+		redis.SetParticipantRole(ctx, roomId, sender.UserId, previous)
+
+		broadcastToRoom(roomId, "", moderationMessage("host-changed", roomId, sender.UserId, map[string]interface{}{
+			"userId":         target,
+			"previousHostId": sender.UserId,
+		}))
+		logger.Info("Host transferred", "target_id", target)
+	}
+}
+
+// roomPeer returns the local peer of userId in a room, nil if it isn't connected here
+func roomPeer(roomId, userId string) *Peer {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+	return rooms[roomId][userId]
+}
+
+// setUserRole changes the role of a peer connected to any instance
+func setUserRole(roomId, userId, role string) {
+	if peer := roomPeer(roomId, userId); peer != nil {
+		peer.setRole(role)
+		return
+	}
+	publishSignal(roomId, relayedSignal{Kind: relayRole, To: userId, Role: role})
+}
+
+// hangUpPeer disconnects a local peer, after sending it msg unless it's nil
+func hangUpPeer(peer *Peer, msg *models.SignalMessage) {
+	if msg != nil {
+		if err := peer.WriteJSON(*msg); err != nil {
+			peer.log.Warn("Error sending signal", "type", msg.Type, "error", err)
+		}
+	}
+	peer.hangUp()
+}
+
+// endRoom ends a call on every instance: connections get call-ended and are hung up, and
+// the room is removed from Redis. by is who ended it, it returns how many connections
+// were closed on this instance.
+func endRoom(ctx context.Context, roomId, by string) int {
+	ended := moderationMessage("call-ended", roomId, by, nil)
+	closed := hangUpRoom(roomId, ended)
+	publishSignal(roomId, relayedSignal{Kind: relayEnd, By: by, Msg: &ended})
+
+	redis.DeleteRoom(ctx, roomId)
+	return closed
+}
+
+// hangUpRoom sends ended to the local connections of a room, waiting ones included, and
+// hangs them up. It returns how many there were.
+func hangUpRoom(roomId string, ended models.SignalMessage) int {
+	var peersToClose []*Peer
+
+	roomsMutex.Lock()
+	if peers, exists := rooms[roomId]; exists {
+		// Collect peers to close later
+		for _, peer := range peers {
+			peersToClose = append(peersToClose, peer)
+		}
+		// Remove from map IMMEDIATELY so removeUserFromRoom won't find it
+		delete(rooms, roomId)
+	}
+	// Whoever is still waiting won't get in any more
+	for _, peer := range waiting[roomId] {
+		peersToClose = append(peersToClose, peer)
+	}
+	delete(waiting, roomId)
+	roomsMutex.Unlock() // Unlock BEFORE closing connections
+
+	// Now close connections (safe from deadlock)
+	for _, peer := range peersToClose {
+		hangUpPeer(peer, &ended)
+	}
+	return len(peersToClose)
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"video-service/auth"
+	"video-service/logging"
+	"video-service/models"
+	"video-service/recording"
+	"video-service/redis"
+	"video-service/sfu"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// chatRecordingsPath is where the chat server registers recordings of group calls
+const chatRecordingsPath = "/api/video/recordings"
+
+var (
+	// recordingStorage is where recordings are written, nil turns recording off
+	recordingStorage recording.Storage
+	chatServiceURL   string
+	callbackSecret   []byte
+	chatClient       = &http.Client{Timeout: 10 * time.Second}
+
+	// recordings are the running recordings of this instance by room
+	recordings      = make(map[string]*recording.Session)
+	recordingsMutex sync.Mutex
+)
+
+// ConfigureRecording enables recording, called once from main before serving.
+// Recordings of group calls are registered with the chat server at chatURL, signed with secret.
+func ConfigureRecording(storage recording.Storage, chatURL string, secret []byte) {
+	recordingStorage = storage
+	chatServiceURL = chatURL
+	callbackSecret = secret
+}
+
+// RecordingRegistration is what the chat server is told about a finished recording
+type RecordingRegistration struct {
+	RecordingId string           `json:"recordingId"`
+	RoomId      string           `json:"roomId"`
+	GroupId     string           `json:"groupId"`
+	StartedBy   string           `json:"startedBy"`
+	StartedAt   time.Time        `json:"startedAt"`
+	StoppedAt   time.Time        `json:"stoppedAt"`
+	Files       []recording.File `json:"files"`
+}
+
+// StartRecording records every track of a room until StopRecording or the call ends.
+// Mesh rooms move to the SFU first, media never passes the server otherwise.
+// Route: POST /api/rooms/:roomId/recording/start
+func StartRecording(c *fiber.Ctx) error {
+	roomId := c.Params("roomId")
+	claims, _ := c.Locals(localsJoinClaims).(auth.JoinClaims)
+	logger := requestLogger(c).With(logging.KeyRoomID, roomId, logging.KeyUserID, claims.Subject)
+
+	if recordingStorage == nil || mediaServer == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Recording is disabled"})
+	}
+
+	ctx := c.UserContext()
+	meta := redis.GetRoomMetadata(ctx, roomId)
+	if len(meta) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Room not found"})
+	}
+
+	if meta["mode"] != models.RoomModeSFU {
+		logger.Info("Moving room to the SFU for recording", "mode", meta["mode"])
+	}
+	if err := moveRoomToSFU(ctx, roomId); err != nil {
+		if errors.Is(err, errSFUElsewhere) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Participants are connected to another instance"})
+		}
+		logger.Error("Failed to move room to the SFU", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start recording"})
+	}
+
+	groupId := meta["groupId"]
+	session := recording.NewSession(roomId, claims.Subject, recordingStorage, logger, func(s *recording.Session) {
+		recordingStopped(s, groupId)
+	})
+
+	recordingsMutex.Lock()
+	defer recordingsMutex.Unlock()
+
+	if err := mediaServer.StartRecording(roomId, session); err != nil {
+		switch {
+		case errors.Is(err, sfu.ErrAlreadyRecording):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Room is already being recorded"})
+		case errors.Is(err, sfu.ErrRoomNotFound):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Nobody is connected to the room"})
+		default:
+			logger.Error("Failed to start recording", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start recording"})
+		}
+	}
+	recordings[roomId] = session
+
+	redis.SetRoomRecording(ctx, roomId, session.Id)
+	broadcastToRoom(roomId, "", recordingMessage("recording-started", session))
+	logger.Info("Recording started", "recording_id", session.Id)
+
+	return c.JSON(fiber.Map{
+		"recordingId": session.Id,
+		"roomId":      roomId,
+		"startedBy":   session.StartedBy,
+		"startedAt":   session.StartedAt,
+	})
+}
+
+// StopRecording ends the recording of a room and returns its files
+// Route: POST /api/rooms/:roomId/recording/stop
+func StopRecording(c *fiber.Ctx) error {
+	roomId := c.Params("roomId")
+
+	recordingsMutex.Lock()
+	session := recordings[roomId]
+	recordingsMutex.Unlock()
+
+	if session == nil || mediaServer == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Room is not being recorded"})
+	}
+	// Returns once the files are complete, recordingStopped has run by then
+	if err := mediaServer.StopRecording(roomId); err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Room is not being recorded"})
+	}
+
+	return c.JSON(fiber.Map{
+		"recordingId": session.Id,
+		"roomId":      roomId,
+		"startedAt":   session.StartedAt,
+		"stoppedAt":   session.StoppedAt(),
+		"files":       session.Files(),
+	})
+}
+
+// recordingStopped runs once a recording ended, by StopRecording or because everybody left
+func recordingStopped(s *recording.Session, groupId string) {
+	recordingsMutex.Lock()
+	if recordings[s.RoomId] == s {
+		delete(recordings, s.RoomId)
+	}
+	recordingsMutex.Unlock()
+
+	ctx := context.Background()
+	redis.SetRoomRecording(ctx, s.RoomId, "")
+	broadcastToRoom(s.RoomId, "", recordingMessage("recording-stopped", s))
+
+	if groupId != "" && chatServiceURL != "" {
+		go registerRecording(RecordingRegistration{
+			RecordingId: s.Id,
+			RoomId:      s.RoomId,
+			GroupId:     groupId,
+			StartedBy:   s.StartedBy,
+			StartedAt:   s.StartedAt,
+			StoppedAt:   s.StoppedAt(),
+			Files:       s.Files(),
+		})
+	}
+}
+
+// recordingMessage tells participants a recording started or stopped, clients must show it
+// for as long as they are recorded
+func recordingMessage(msgType string, s *recording.Session) models.SignalMessage {
+	metadata, _ := json.Marshal(map[string]string{"recordingId": s.Id, "startedBy": s.StartedBy})
+	return models.SignalMessage{
+		Type:     msgType,
+		UserId:   models.SFUPeerId,
+		RoomId:   s.RoomId,
+		Metadata: metadata,
+	}
+}
+
+// registerRecording adds a finished recording to its chat group, so members find it afterwards
+func registerRecording(registration RecordingRegistration) {
+	logger := slog.Default().With(logging.KeyRoomID, registration.RoomId, "recording_id", registration.RecordingId, "group_id", registration.GroupId)
+
+	body, err := json.Marshal(registration)
+	if err != nil {
+		logger.Error("Failed to encode recording registration", "error", err)
+		return
+	}
+	if err := postToChat(chatRecordingsPath, body); err != nil {
+		logger.Error("Failed to register recording with the chat server", "error", err)
+		return
+	}
+	logger.Info("Registered recording with the chat server", "files", len(registration.Files))
+}
+
+// postToChat sends a signed JSON request to the chat server
+func postToChat(path string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), chatClient.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, chatServiceURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(auth.CallbackSignatureHeader, auth.SignCallback(callbackSecret, body))
+
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("chat server answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"video-service/logging"
+	"video-service/metrics"
+	"video-service/models"
+	"video-service/redis"
+)
+
+// The peers of a room can be connected to different instances. Each instance subscribes
+// to the Redis channel of every room it has peers in, and whatever isn't delivered to
+// a local peer is published there for the others.
+
+// Kinds of relayed signals
+const (
+	relayUser       = "user"       // Msg for the peer To
+	relayRoom       = "room"       // Msg for every peer but Exclude
+	relayModerators = "moderators" // Msg for the host and moderators
+	relayHangUp     = "hang-up"    // Msg for the peer To, which is then hung up
+	relayEnd        = "end"        // the call ended, Msg for everybody before hanging up
+	relayRole       = "role"       // the peer To has Role now
+	relayAdmit      = "admit"      // By admitted the waiting peer To, everybody waiting if To is empty
+	relayDeny       = "deny"       // By denied the waiting peer To
+	relayWaiting    = "waiting"    // send admission requests for the waiting peers to To
+)
+
+var (
+	// instanceId tells this instance's signals apart from the others'
+	instanceId = logging.NewID()
+
+	// roomSignals is nil until StartRelay, signals then stay on this instance
+	roomSignals *redis.RoomSubscriber
+)
+
+// relayedSignal is what instances publish on a room's channel
+type relayedSignal struct {
+	Origin  string                `json:"origin"`
+	Kind    string                `json:"kind"`
+	To      string                `json:"to,omitempty"`
+	Exclude string                `json:"exclude,omitempty"`
+	By      string                `json:"by,omitempty"`
+	Role    string                `json:"role,omitempty"`
+	Msg     *models.SignalMessage `json:"msg,omitempty"`
+}
+
+// StartRelay subscribes this instance to the rooms its peers join and handles what the
+// other instances relay
+func StartRelay(ctx context.Context) {
+	roomSignals = redis.NewRoomSubscriber(ctx)
+	go roomSignals.Run(handleRelayed)
+}
+
+// joinRelay subscribes to a room for a peer that connected, it reports whether leaveRelay
+// has to be called once the peer is gone
+func joinRelay(ctx context.Context, roomId string, logger *slog.Logger) bool {
+	if roomSignals == nil {
+		return false
+	}
+	if err := roomSignals.Join(ctx, roomId); err != nil {
+		logger.Warn("Could not subscribe to room signals, peers on other instances won't be reached", "error", err)
+		return false
+	}
+	return true
+}
+
+func leaveRelay(ctx context.Context, roomId string) {
+	roomSignals.Leave(ctx, roomId)
+}
+
+// publishSignal hands a signal to the other instances in the room. It returns how many
+// received it, this instance counts as one when it has peers in the room.
+func publishSignal(roomId string, signal relayedSignal) int64 {
+	if roomSignals == nil {
+		return 0
+	}
+	signal.Origin = instanceId
+	payload, err := json.Marshal(signal)
+	if err != nil {
+		slog.Error("Error encoding relayed signal", logging.KeyRoomID, roomId, "kind", signal.Kind, "error", err)
+		return 0
+	}
+	receivers, err := redis.PublishSignal(context.Background(), roomId, payload)
+	if err != nil {
+		slog.Warn("Error relaying signal", logging.KeyRoomID, roomId, "kind", signal.Kind, "error", err)
+		return 0
+	}
+	metrics.RelayedSignals.WithLabelValues(signal.Kind, "sent").Inc()
+	return receivers
+}
+
+// handleRelayed acts on a signal another instance published for a room with peers here
+func handleRelayed(roomId string, payload []byte) {
+	var signal relayedSignal
+	if err := json.Unmarshal(payload, &signal); err != nil {
+		slog.Warn("Ignoring invalid relayed signal", logging.KeyRoomID, roomId, "error", err)
+		return
+	}
+	if signal.Origin == instanceId {
+		return
+	}
+
+	ctx := context.Background()
+	switch signal.Kind {
+	case relayUser:
+		if signal.Msg != nil {
+			deliverToUser(roomId, signal.To, *signal.Msg)
+		}
+	case relayRoom:
+		if signal.Msg != nil {
+			deliverToRoom(roomId, signal.Exclude, *signal.Msg)
+		}
+	case relayModerators:
+		if signal.Msg != nil {
+			deliverToModerators(roomId, *signal.Msg)
+		}
+	case relayHangUp:
+		if peer := roomPeer(roomId, signal.To); peer != nil {
+			hangUpPeer(peer, signal.Msg)
+		}
+	case relayEnd:
+		if signal.Msg != nil {
+			hangUpRoom(roomId, *signal.Msg)
+		}
+	case relayRole:
+		if peer := roomPeer(roomId, signal.To); peer != nil {
+			peer.setRole(signal.Role)
+		}
+	case relayAdmit:
+		admitWaiting(ctx, roomId, signal.To, signal.By)
+	case relayDeny:
+		if peer := takeWaiting(ctx, roomId, signal.To, false); peer != nil {
+			denyPeer(peer, signal.By)
+		}
+	case relayWaiting:
+		// The moderator asking is connected to the instance that published this
+		for _, peer := range waitingPeers(roomId) {
+			sendToUser(roomId, signal.To, admissionRequest(peer))
+		}
+	default:
+		slog.Warn("Ignoring relayed signal of unknown kind", logging.KeyRoomID, roomId, "kind", signal.Kind)
+		return
+	}
+	metrics.RelayedSignals.WithLabelValues(signal.Kind, "received").Inc()
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"time"
+	"video-service/auth"
+	"video-service/logging"
 	"video-service/models"
 	"video-service/redis"
 
@@ -18,7 +20,7 @@ func GetRoomParticipants(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Room ID required"})
 	}
 
-	participants := redis.GetRoomParticipants(roomId)
+	participants := redis.GetRoomParticipants(c.UserContext(), roomId)
 
 	return c.JSON(fiber.Map{
 		"roomId":       roomId,
@@ -27,7 +29,8 @@ func GetRoomParticipants(c *fiber.Ctx) error {
 	})
 }
 
-// CreateRoom creates a new video call room
+// CreateRoom creates a new video call room for the chat server, RequireServiceSignature checked
+// the request. A room that already exists keeps its host and settings.
 // Route: POST /api/rooms/create
 func CreateRoom(c *fiber.Ctx) error {
 	var req models.CreateRoomRequest
@@ -35,6 +38,11 @@ func CreateRoom(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
+	if age := time.Since(time.Unix(req.RequestedAt, 0)); age > auth.ServiceRequestMaxAge || age < -auth.ServiceRequestMaxAge {
+		requestLogger(c).Warn("Rejected stale room creation", logging.KeyRoomID, req.RoomId, "age", age)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Request expired"})
+	}
+
 	if req.CreatorId == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Creator ID required"})
 	}
@@ -43,18 +51,30 @@ func CreateRoom(c *fiber.Ctx) error {
 	if roomId == "" {
 		roomId = generateRoomId()
 	}
-
-	// Initialize room in Redis
-	redis.InitializeRoom(roomId, req.CreatorId)
+	// Initialize room in Redis, unless it exists already
+	mode := roomModeForType(req.Type)
+	if !redis.InitializeRoom(c.UserContext(), roomId, req.CreatorId, req.GroupId, mode) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   "Room already exists",
+			"roomId":  roomId,
+			"created": false,
+		})
+	}
+	if req.WaitingRoom {
+		redis.SetWaitingRoom(c.UserContext(), roomId, true)
+	}
+	requestLogger(c).Info("Room created", logging.KeyRoomID, roomId, logging.KeyUserID, req.CreatorId, "group_id", req.GroupId, "mode", mode, "waiting_room", req.WaitingRoom)
 
 	return c.JSON(fiber.Map{
-		"roomId":    roomId,
-		"creatorId": req.CreatorId,
-		"created":   true,
+		"roomId":      roomId,
+		"creatorId":   req.CreatorId,
+		"mode":        mode,
+		"waitingRoom": req.WaitingRoom,
+		"created":     true,
 	})
 }
 
-// DeleteRoom removes a video call room
+// DeleteRoom ends a video call for everybody, for its host and moderators
 // Route: DELETE /api/rooms/:roomId
 func DeleteRoom(c *fiber.Ctx) error {
 	roomId := c.Params("roomId")
@@ -62,27 +82,10 @@ func DeleteRoom(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Room ID required"})
 	}
 
-	// 1. Close local websocket connections for this room
-	var peersToClose []*Peer
-
-	roomsMutex.Lock()
-	if peers, exists := rooms[roomId]; exists {
-		// Collect peers to close later
-		for _, peer := range peers {
-			peersToClose = append(peersToClose, peer)
-		}
-		// Remove from map IMMEDIATELY so removeUserFromRoom won't find it
-		delete(rooms, roomId)
-	}
-	roomsMutex.Unlock() // Unlock BEFORE closing connections
-
-	// Now close connections (safe from deadlock)
-	for _, peer := range peersToClose {
-		peer.Conn.Close()
-	}
-
-	// 2. Delete from Redis
-	redis.DeleteRoom(roomId)
+	// Ends it like a moderator over signaling, RequireRoomRole put the claims in Locals
+	claims, _ := c.Locals(localsJoinClaims).(auth.JoinClaims)
+	closed := endRoom(c.UserContext(), roomId, claims.Subject)
+	requestLogger(c).Info("Room deleted", logging.KeyRoomID, roomId, "closed_connections", closed)
 
 	return c.JSON(fiber.Map{
 		"roomId":  roomId,
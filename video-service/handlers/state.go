@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"video-service/models"
+	"video-service/redis"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// handleMediaState stores a participant's new media state and shows it to everybody else
+func handleMediaState(ctx context.Context, sender *Peer, msg models.SignalMessage) {
+	var update models.MediaStateUpdate
+	if err := json.Unmarshal(msg.Metadata, &update); err != nil {
+		sender.log.Debug("Ignoring invalid media state", "error", err)
+		return
+	}
+	if update.AudioMuted == nil && update.VideoMuted == nil && update.IsScreening == nil {
+		return
+	}
+
+	state, err := redis.UpdateMediaState(ctx, sender.RoomId, sender.UserId, update)
+	if err != nil {
+		return
+	}
+	metadata, _ := json.Marshal(state)
+	broadcastToRoom(sender.RoomId, sender.UserId, models.SignalMessage{
+		Type:     "media-state",
+		UserId:   sender.UserId,
+		RoomId:   sender.RoomId,
+		Metadata: metadata,
+	})
+}
+
+// sendRoomState tells a joining peer who is in the call and what they send,
+// media-state messages keep it current afterwards
+func sendRoomState(ctx context.Context, peer *Peer) {
+	info, ok := redis.GetRoomInfo(ctx, peer.RoomId)
+	if !ok {
+		return
+	}
+	metadata, _ := json.Marshal(info)
+	if err := peer.WriteJSON(models.SignalMessage{
+		Type:     "room-state",
+		UserId:   models.SFUPeerId,
+		RoomId:   peer.RoomId,
+		Metadata: metadata,
+	}); err != nil {
+		peer.log.Warn("Error sending room state", "error", err)
+	}
+}
+
+// GetRoomInfo returns a room with its participants' names and media state
+// Route: GET /api/rooms/:roomId
+func GetRoomInfo(c *fiber.Ctx) error {
+	info, ok := redis.GetRoomInfo(c.UserContext(), c.Params("roomId"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Room not found"})
+	}
+	return c.JSON(info)
+}
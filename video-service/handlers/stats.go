@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+	"video-service/metrics"
+	"video-service/models"
+	"video-service/redis"
+	"video-service/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// minStatsInterval drops reports of clients that send stats more often, a few seconds apart is plenty
+const minStatsInterval = time.Second
+
+// handleStats folds a client's stats report into its smoothed stats in Redis
+func handleStats(ctx context.Context, sender *Peer, msg models.SignalMessage) {
+	var report models.CallStats
+	if err := json.Unmarshal(msg.Metadata, &report); err != nil || !webrtc.ValidateCallStats(report) {
+		sender.log.Debug("Ignoring invalid stats report", "error", err)
+		return
+	}
+
+	now := time.Now()
+	if sender.stats.Samples > 0 && now.Sub(time.UnixMilli(sender.stats.UpdatedAt)) < minStatsInterval {
+		return
+	}
+
+	sender.stats.UserId = sender.UserId
+	sender.stats = webrtc.SmoothStats(sender.stats, report, now.UnixMilli())
+	redis.SaveParticipantStats(ctx, sender.RoomId, sender.stats)
+
+	metrics.CallRTT.Observe(report.RTT / 1000)
+	metrics.CallPacketLoss.Observe(report.PacketLoss)
+	metrics.CallJitter.Observe(report.Jitter / 1000)
+	metrics.CallBitrate.Observe(report.Bitrate * 1000)
+	metrics.CallQualityScore.Observe(sender.stats.Score)
+}
+
+// GetRoomStats returns the call quality of every participant and of the room as a whole
+// Route: GET /api/rooms/:roomId/stats
+func GetRoomStats(c *fiber.Ctx) error {
+	roomId := c.Params("roomId")
+	if roomId == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Room ID required"})
+	}
+
+	participants := redis.GetRoomStats(c.UserContext(), roomId)
+	return c.JSON(webrtc.AggregateRoomStats(roomId, participants))
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"video-service/models"
+	"video-service/redis"
+)
+
+// enterWaitingRoom holds a peer until a host or moderator admits it, they get an admission-request
+func enterWaitingRoom(ctx context.Context, peer *Peer) {
+	roomsMutex.Lock()
+	if waiting[peer.RoomId] == nil {
+		waiting[peer.RoomId] = make(map[string]*Peer)
+	}
+	waiting[peer.RoomId][peer.UserId] = peer
+	roomsMutex.Unlock()
+	redis.AddWaiting(ctx, peer.RoomId, peer.UserId)
+
+	if err := peer.WriteJSON(models.SignalMessage{
+		Type:   "admission-pending",
+		UserId: models.SFUPeerId,
+		RoomId: peer.RoomId,
+	}); err != nil {
+		peer.log.Warn("Error sending admission state", "error", err)
+	}
+	sendToModerators(peer.RoomId, admissionRequest(peer))
+}
+
+// leaveWaitingRoom removes a peer that disconnected while waiting, it reports whether
+// the peer was still waiting
+func leaveWaitingRoom(ctx context.Context, peer *Peer) bool {
+	if takeWaiting(ctx, peer.RoomId, peer.UserId, false) != peer {
+		return false
+	}
+	sendToModerators(peer.RoomId, admissionResolved(peer.RoomId, peer.UserId, "left", peer.UserId))
+	return true
+}
+
+// takeWaiting removes a peer from a room's waiting room, into the room itself if admit is
+// set, in one step so it can't disconnect in between. It returns nil if nobody waits as userId.
+func takeWaiting(ctx context.Context, roomId, userId string, admit bool) *Peer {
+	roomsMutex.Lock()
+	peer := waiting[roomId][userId]
+	if peer == nil {
+		roomsMutex.Unlock()
+		return nil
+	}
+	delete(waiting[roomId], userId)
+	if len(waiting[roomId]) == 0 {
+		delete(waiting, roomId)
+	}
+	if admit {
+		addUserToRoomLocked(peer)
+	}
+	roomsMutex.Unlock()
+
+	if admit {
+		redis.RemoveWaiting(ctx, roomId, userId)
+	} else {
+		redis.LeaveWaiting(ctx, roomId, userId)
+	}
+	return peer
+}
+
+// waitingPeers returns a snapshot of the peers waiting to join a room
+func waitingPeers(roomId string) []*Peer {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
+	peers := make([]*Peer, 0, len(waiting[roomId]))
+	for _, peer := range waiting[roomId] {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// handleWaitingRoom runs the waiting room controls of hosts and moderators: admit-participant
+// and deny-participant for a waiting targetId, and waiting-room to turn it on or off
+func handleWaitingRoom(ctx context.Context, sender *Peer, msg models.SignalMessage) {
+	roomId := sender.RoomId
+	if !isModerator(sender.Role()) {
+		denyModeration(sender, msg.Type, "only the host and moderators can do this")
+		return
+	}
+
+	// The peer may wait on another instance, which then admits or denies it
+	logger := sender.log.With("action", msg.Type)
+	switch msg.Type {
+	case "admit-participant", "deny-participant":
+		admit := msg.Type == "admit-participant"
+		if peer := takeWaiting(ctx, roomId, msg.TargetId, admit); peer != nil {
+			if admit {
+				admitPeer(ctx, peer, sender.UserId)
+			} else {
+				denyPeer(peer, sender.UserId)
+			}
+		} else if msg.TargetId != "" && redis.IsWaiting(ctx, roomId, msg.TargetId) {
+			kind := relayDeny
+			if admit {
+				kind = relayAdmit
+			}
+			publishSignal(roomId, relayedSignal{Kind: kind, To: msg.TargetId, By: sender.UserId})
+		} else {
+			denyModeration(sender, msg.Type, "nobody with this ID is waiting")
+			return
+		}
+		logger.Info("Admission decided", "target_id", msg.TargetId, "admitted", admit)
+
+	case "waiting-room":
+		var request struct {
+			Enabled *bool `json:"enabled"`
+		}
+		_ = json.Unmarshal(msg.Metadata, &request)
+		enabled := request.Enabled == nil || *request.Enabled
+		redis.SetWaitingRoom(ctx, roomId, enabled)
+		broadcastToRoom(roomId, "", moderationMessage("waiting-room-changed", roomId, sender.UserId, map[string]interface{}{
+			"enabled": enabled,
+		}))
+
+		// Without a waiting room nobody has to wait any longer
+		if !enabled {
+			admitWaiting(ctx, roomId, "", sender.UserId)
+			publishSignal(roomId, relayedSignal{Kind: relayAdmit, By: sender.UserId})
+		}
+		logger.Info("Waiting room changed", "enabled", enabled)
+	}
+}
+
+// admitWaiting admits the local peer waiting as userId, every local waiting peer if userId
+// is empty. by is who admitted them.
+func admitWaiting(ctx context.Context, roomId, userId, by string) {
+	if userId != "" {
+		if peer := takeWaiting(ctx, roomId, userId, true); peer != nil {
+			admitPeer(ctx, peer, by)
+		}
+		return
+	}
+	for _, waitingPeer := range waitingPeers(roomId) {
+		if peer := takeWaiting(ctx, roomId, waitingPeer.UserId, true); peer != nil {
+			admitPeer(ctx, peer, by)
+		}
+	}
+}
+
+// denyPeer turns away a peer takeWaiting removed from the waiting room, by is who denied it
+func denyPeer(peer *Peer, by string) {
+	denied := moderationMessage("admission-denied", peer.RoomId, by, nil)
+	hangUpPeer(peer, &denied)
+	sendToModerators(peer.RoomId, admissionResolved(peer.RoomId, peer.UserId, "denied", by))
+}
+
+// admitPeer lets a peer takeWaiting moved into the room join it, by is who admitted it
+func admitPeer(ctx context.Context, peer *Peer, by string) {
+	if err := peer.WriteJSON(moderationMessage("admission-granted", peer.RoomId, by, nil)); err != nil {
+		peer.log.Warn("Error sending admission", "error", err)
+	}
+	sendToModerators(peer.RoomId, admissionResolved(peer.RoomId, peer.UserId, "admitted", by))
+	peer.log.Info("User joining room", "role", peer.Role(), "admitted_by", by)
+	joinRoom(ctx, peer, redis.GetRoomMetadata(ctx, peer.RoomId))
+}
+
+// sendAdmissionRequests shows a host or moderator that joined who is already waiting,
+// the other instances send theirs
+func sendAdmissionRequests(peer *Peer) {
+	for _, waitingPeer := range waitingPeers(peer.RoomId) {
+		if err := peer.WriteJSON(admissionRequest(waitingPeer)); err != nil {
+			peer.log.Warn("Error sending admission request", "error", err)
+			return
+		}
+	}
+	publishSignal(peer.RoomId, relayedSignal{Kind: relayWaiting, To: peer.UserId})
+}
+
+// sendToModerators sends msg to the room's host and moderators, on every instance
+func sendToModerators(roomId string, msg models.SignalMessage) {
+	deliverToModerators(roomId, msg)
+	publishSignal(roomId, relayedSignal{Kind: relayModerators, Msg: &msg})
+}
+
+// deliverToModerators sends msg to the room's local host and moderators
+func deliverToModerators(roomId string, msg models.SignalMessage) {
+	for _, peer := range roomPeers(roomId, "") {
+		if !isModerator(peer.Role()) {
+			continue
+		}
+		if err := peer.WriteJSON(msg); err != nil {
+			peer.log.Warn("Error sending signal", "type", msg.Type, "error", err)
+		}
+	}
+}
+
+// admissionRequest asks the hosts and moderators to admit or deny a waiting peer
+func admissionRequest(peer *Peer) models.SignalMessage {
+	metadata, _ := json.Marshal(map[string]string{"userId": peer.UserId, "name": peer.name})
+	return models.SignalMessage{
+		Type:     "admission-request",
+		UserId:   peer.UserId,
+		RoomId:   peer.RoomId,
+		Metadata: metadata,
+	}
+}
+
+// admissionResolved tells the hosts and moderators that a request is settled,
+// status is admitted, denied or left
+func admissionResolved(roomId, userId, status, by string) models.SignalMessage {
+	return moderationMessage("admission-resolved", roomId, by, map[string]interface{}{
+		"userId": userId,
+		"status": status,
+	})
+}
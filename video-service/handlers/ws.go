@@ -1,18 +1,59 @@
 package handlers
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
+	"video-service/auth"
+	"video-service/logging"
+	"video-service/metrics"
 	"video-service/models"
 	"video-service/redis"
+	"video-service/sfu"
+	"video-service/tracing"
 
 	"github.com/gofiber/websocket/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Peer wraps the websocket connection to ensure thread-safe writes
 type Peer struct {
-	Conn *websocket.Conn
-	mu   sync.Mutex
+	Conn   *websocket.Conn
+	RoomId string
+	UserId string
+	mu     sync.Mutex
+	log    *slog.Logger // carries room_id, user_id and conn_id
+
+	mediaMu   sync.Mutex                      // serializes entering and leaving the SFU
+	media     atomic.Pointer[sfu.Participant] // set while the room uses the SFU
+	mediaDone bool                            // set by leaveSFU once the peer is gone, guarded by mediaMu
+
+	stats models.ParticipantStats // smoothed call quality, only touched by the read loop
+
+	roleMu    sync.Mutex
+	role      string // host, moderator or participant, see roomRole
+	tokenRole string // role of the join token, what a host falls back to when handing over
+
+	name     string      // display name from the join token
+	admitted atomic.Bool // false while the peer is in the waiting room
+}
+
+// Role returns the peer's current role in its room
+func (p *Peer) Role() string {
+	p.roleMu.Lock()
+	defer p.roleMu.Unlock()
+	return p.role
+}
+
+func (p *Peer) setRole(role string) {
+	p.roleMu.Lock()
+	p.role = role
+	p.roleMu.Unlock()
 }
 
 // WriteJSON safely writes JSON to the websocket connection
@@ -22,49 +63,104 @@ func (p *Peer) WriteJSON(v interface{}) error {
 	return p.Conn.WriteJSON(v)
 }
 
+// hangUp ends the peer's connection from another goroutine. Closing a connection fasthttp
+// hijacked does nothing, so the client gets a close frame and the read loop a deadline, the
+// handler returning closes the connection.
+func (p *Peer) hangUp() {
+	p.mu.Lock()
+	err := p.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	p.mu.Unlock()
+	if err != nil {
+		p.log.Debug("Error sending close frame", "error", err)
+	}
+	if err := p.Conn.SetReadDeadline(time.Now()); err != nil {
+		p.log.Warn("Error hanging up", "error", err)
+	}
+}
+
 var (
 	// In-memory connection pool (room -> user -> Peer)
 	// These are package-private but accessible to room.go
 	rooms      = make(map[string]map[string]*Peer)
 	roomsMutex = &sync.RWMutex{}
+
+	// Peers held in a room's waiting room (room -> user -> Peer), also guarded by roomsMutex.
+	// They get no signals of the room until a host or moderator admits them.
+	waiting = make(map[string]map[string]*Peer)
 )
 
-// HandleWebRTCSignaling manages WebSocket connections for WebRTC signaling
+// HandleWebRTCSignaling manages WebSocket connections for WebRTC signaling.
+// RequireJoinToken has verified the join token, the user comes from it and the role from roomRole.
 func HandleWebRTCSignaling(c *websocket.Conn) {
 	roomId := c.Params("roomId")
-	userId := c.Query("userId")
+	claims, _ := c.Locals(localsJoinClaims).(auth.JoinClaims)
+	userId := claims.Subject
 
-	if roomId == "" || userId == "" {
-		log.Println("Missing roomId or userId")
+	logger, ok := c.Locals(logging.LocalsLogger).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+	logger = logger.With(
+		slog.String(logging.KeyRoomID, roomId),
+		slog.String(logging.KeyUserID, userId),
+		slog.String(logging.KeyConnID, logging.NewID()),
+	)
+
+	if roomId == "" || userId == "" || claims.Room != roomId {
+		logger.Warn("Signaling connection without a verified join token")
 		c.Close()
 		return
 	}
 
-	meta := redis.GetRoomMetadata(roomId)
+	joinCtx, joinSpan := startSignalSpan(context.Background(), "join", roomId, userId)
+
+	// Signals of peers connected to other instances arrive through the room's channel
+	if joinRelay(joinCtx, roomId, logger) {
+		defer leaveRelay(context.Background(), roomId)
+	}
+
+	meta := redis.GetRoomMetadata(joinCtx, roomId)
 
-	// If map is empty, the room is "new" (implicit creation)
+	// An empty map means the room is new, RequireJoinToken only lets this happen
+	// when implicit room creation is allowed
 	if len(meta) == 0 {
-		log.Printf("Room %s does not exist. Initializing implicitly for user %s", roomId, userId)
-		// Auto-initialize the room with the connecting user as 'creator'
-		redis.InitializeRoom(roomId, userId)
+		// Auto-initialize the room with the connecting user as 'creator', unless a
+		// concurrent join got there first and its user is the host
+		if redis.InitializeRoom(joinCtx, roomId, userId, "", models.RoomModeAuto) {
+			logger.Info("Room does not exist, initialized implicitly")
+		}
+		meta = redis.GetRoomMetadata(joinCtx, roomId)
 	}
 
-	log.Printf("User %s joining room %s", userId, roomId)
+	role := roomRole(meta, claims)
+	peer := &Peer{Conn: c, RoomId: roomId, UserId: userId, role: role, tokenRole: claims.Role, name: claims.Name, log: logger}
 
-	// Add user to room
-	_ = addUserToRoom(roomId, userId, c)
-	defer removeUserFromRoom(roomId, userId)
+	metrics.ConnectedSockets.Inc()
+	defer metrics.ConnectedSockets.Dec()
 
-	// Add to Redis tracking
-	redis.AddUserToRoom(roomId, userId)
-	defer redis.RemoveUserFromRoom(roomId, userId)
+	defer func() {
+		leaveCtx, leaveSpan := startSignalSpan(context.Background(), "leave", roomId, userId)
+		defer leaveSpan.End()
 
-	// Notify others that a new user joined
-	broadcastToRoom(roomId, userId, models.SignalMessage{
-		Type:   "user-joined",
-		UserId: userId,
-		RoomId: roomId,
-	})
+		// Denied peers never were in the room
+		if leaveWaitingRoom(leaveCtx, peer) || !peer.admitted.Load() {
+			return
+		}
+		redis.RemoveUserFromRoom(leaveCtx, roomId, userId)
+		removeUserFromRoom(roomId, userId)
+	}()
+	defer peer.leaveSFU()
+
+	// Hosts and moderators skip the waiting room
+	if meta["waitingRoom"] != "" && role == auth.RoleParticipant {
+		logger.Info("User waiting for admission")
+		enterWaitingRoom(joinCtx, peer)
+	} else {
+		logger.Info("User joining room", "role", role)
+		addUserToRoom(peer)
+		joinRoom(joinCtx, peer, meta)
+	}
+	joinSpan.End()
 
 	// Main message loop
 	for {
@@ -72,7 +168,7 @@ func HandleWebRTCSignaling(c *websocket.Conn) {
 		// ReadJSON is safe to call concurrently with WriteJSON (but not other Reads)
 		err := c.ReadJSON(&msg)
 		if err != nil {
-			log.Printf("Error reading message from user %s: %v", userId, err)
+			logger.Info("Signaling connection closed", "error", err)
 			break
 		}
 
@@ -80,29 +176,158 @@ func HandleWebRTCSignaling(c *websocket.Conn) {
 		msg.UserId = userId
 		msg.RoomId = roomId
 
+		// Until it's admitted the peer can't signal anybody
+		if !peer.admitted.Load() {
+			logger.Debug("Ignoring message from the waiting room", "type", msg.Type)
+			continue
+		}
+		metrics.MessagesTotal.WithLabelValues(signalTypeLabel(msg.Type)).Inc()
+
 		// Handle different message types
-		handleSignalMessage(roomId, userId, msg)
+		msgCtx, span := startSignalSpan(context.Background(), signalTypeLabel(msg.Type), roomId, userId)
+		handleSignalMessage(msgCtx, peer, msg)
+		span.End()
 	}
 
-	// Notify others that user left
+	// Notify others that user left, nobody saw it join from the waiting room
+	if peer.admitted.Load() {
+		broadcastToRoom(roomId, userId, models.SignalMessage{
+			Type:   "user-left",
+			UserId: userId,
+			RoomId: roomId,
+		})
+	}
+
+	logger.Info("User left room")
+}
+
+// joinRoom completes the join of a peer addUserToRoom added: it is announced to the
+// others, starts its media and gets the room's state, unless rejectJoin turns it away.
+// meta is the room's metadata.
+func joinRoom(ctx context.Context, peer *Peer, meta map[string]string) {
+	roomId, userId := peer.RoomId, peer.UserId
+
+	// Add to Redis tracking
+	redis.AddUserToRoom(ctx, roomId, userId)
+
+	// Rooms created before the SFU have no mode and behave like "auto"
+	mode := meta["mode"]
+	if mode == "" {
+		mode = models.RoomModeAuto
+	}
+	mode, err := mediaMode(ctx, peer, mode)
+	if errors.Is(err, errSFUElsewhere) {
+		rejectJoin(ctx, peer)
+		return
+	}
+	if err != nil {
+		peer.log.Error("Failed to pick the room's media mode, using the mesh", "error", err)
+		mode = models.RoomModeMesh
+	}
+
+	participant := models.RoomParticipant{
+		UserId:   userId,
+		Username: peer.name,
+		Role:     peer.Role(),
+		JoinedAt: time.Now().Unix(),
+	}
+	redis.SetParticipant(ctx, roomId, participant)
+
+	// Notify others that a new user joined, with its name and media state
+	joined, _ := json.Marshal(participant)
 	broadcastToRoom(roomId, userId, models.SignalMessage{
-		Type:   "user-left",
-		UserId: userId,
-		RoomId: roomId,
+		Type:     "user-joined",
+		UserId:   userId,
+		RoomId:   roomId,
+		Metadata: joined,
 	})
 
-	log.Printf("User %s left room %s", userId, roomId)
+	startMedia(peer, mode)
+	sendRoomState(ctx, peer)
+
+	// Joining a recorded call must be as visible as the recording starting
+	if recordingId := meta["recordingId"]; recordingId != "" {
+		metadata, _ := json.Marshal(map[string]string{"recordingId": recordingId})
+		if err := peer.WriteJSON(models.SignalMessage{
+			Type:     "recording-started",
+			UserId:   models.SFUPeerId,
+			RoomId:   roomId,
+			Metadata: metadata,
+		}); err != nil {
+			peer.log.Warn("Error sending recording state", "error", err)
+		}
+	}
+
+	// Whoever can admit sees who is already waiting
+	if isModerator(peer.Role()) {
+		sendAdmissionRequests(peer)
+	}
+}
+
+// rejectJoin turns away a peer of an SFU room whose media runs on another instance before
+// anybody saw it join. The client is told with join-rejected and hung up, connecting again
+// through a load balancer that routes by room ID gets it to the right instance.
+func rejectJoin(ctx context.Context, peer *Peer) {
+	peer.log.Warn("Room's SFU runs on another instance, rejecting the join")
+	peer.admitted.Store(false)
+	removeUserFromRoom(peer.RoomId, peer.UserId)
+	redis.RemoveUserFromRoom(ctx, peer.RoomId, peer.UserId)
+
+	metadata, _ := json.Marshal(map[string]string{"reason": "sfu-on-other-instance"})
+	hangUpPeer(peer, &models.SignalMessage{
+		Type:     "join-rejected",
+		UserId:   models.SFUPeerId,
+		RoomId:   peer.RoomId,
+		Metadata: metadata,
+	})
+}
+
+// startSignalSpan opens the span covering one signaling step of a participant
+func startSignalSpan(ctx context.Context, step, roomId, userId string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "signal "+step,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("video.room_id", roomId),
+			attribute.String("video.user_id", userId),
+		),
+	)
+}
+
+// signalTypeLabel keeps client supplied message types from exploding metric cardinality
+func signalTypeLabel(msgType string) string {
+	switch msgType {
+	case "offer", "answer", "ice-candidate", "request-offer", "video-hints", "stats", "media-state",
+		"mute-participant", "remove-participant", "lock-room", "end-call", "transfer-host",
+		"admit-participant", "deny-participant", "waiting-room":
+		return msgType
+	default:
+		return "other"
+	}
 }
 
 // handleSignalMessage processes different WebRTC signaling messages
-func handleSignalMessage(roomId, senderId string, msg models.SignalMessage) {
+func handleSignalMessage(ctx context.Context, sender *Peer, msg models.SignalMessage) {
+	roomId, senderId := sender.RoomId, sender.UserId
+
 	switch msg.Type {
 	case "offer", "answer", "ice-candidate":
+		// Signals for the SFU go to the server side of the sender's connection
+		if msg.TargetId == models.SFUPeerId {
+			if media := sender.media.Load(); media != nil {
+				media.HandleSignal(msg)
+			}
+			return
+		}
 		// Forward these signals directly to the specific target peer
 		if msg.TargetId != "" {
 			sendToUser(roomId, msg.TargetId, msg)
 		}
 	case "request-offer":
+		// With the SFU the server offers, a request makes it offer again
+		if media := sender.media.Load(); media != nil {
+			media.HandleSignal(msg)
+			return
+		}
 		// New peer requesting offers from existing peers (Mesh network initiation)
 		// We broadcast to everyone ELSE in the room saying "I am new, please call me"
 		broadcastToRoom(roomId, senderId, models.SignalMessage{
@@ -110,26 +335,48 @@ func handleSignalMessage(roomId, senderId string, msg models.SignalMessage) {
 			UserId:   senderId,   // The new user
 			TargetId: msg.UserId, // Explicitly target the requester if needed by client logic
 		})
+	case "video-hints":
+		// The sizes the sender shows each publisher at, the SFU sends matching simulcast layers
+		if media := sender.media.Load(); media != nil {
+			media.HandleSignal(msg)
+		}
+	case "stats":
+		// Call quality as measured by the sender's browser
+		handleStats(ctx, sender, msg)
+	case "media-state":
+		// The sender muted, unmuted or started or stopped sharing its screen
+		handleMediaState(ctx, sender, msg)
+	case "mute-participant", "remove-participant", "lock-room", "end-call", "transfer-host":
+		// Moderator controls, refused unless the sender hosts or moderates the room
+		handleModeration(ctx, sender, msg)
+	case "admit-participant", "deny-participant", "waiting-room":
+		// Waiting room controls, for the host and moderators too
+		handleWaitingRoom(ctx, sender, msg)
 	default:
-		log.Printf("Unknown message type: %s", msg.Type)
+		sender.log.Warn("Unknown message type", "type", msg.Type)
 	}
 }
 
 // Room management functions
 
-func addUserToRoom(roomId, userId string, conn *websocket.Conn) *Peer {
+func addUserToRoom(peer *Peer) {
 	roomsMutex.Lock()
 	defer roomsMutex.Unlock()
+	addUserToRoomLocked(peer)
+}
 
-	if rooms[roomId] == nil {
-		rooms[roomId] = make(map[string]*Peer)
+// addUserToRoomLocked is addUserToRoom for callers holding roomsMutex
+func addUserToRoomLocked(peer *Peer) {
+	if rooms[peer.RoomId] == nil {
+		rooms[peer.RoomId] = make(map[string]*Peer)
 	}
 
-	peer := &Peer{Conn: conn}
-	rooms[roomId][userId] = peer
-	return peer
+	rooms[peer.RoomId][peer.UserId] = peer
+	peer.admitted.Store(true)
 }
 
+// removeUserFromRoom forgets a local peer. Peers on other instances may still be in the
+// room, redis.RemoveUserFromRoom deletes it once its last user left and nobody waits.
 func removeUserFromRoom(roomId, userId string) {
 	roomsMutex.Lock()
 	defer roomsMutex.Unlock()
@@ -139,28 +386,49 @@ func removeUserFromRoom(roomId, userId string) {
 		// Clean up empty rooms
 		if len(rooms[roomId]) == 0 {
 			delete(rooms, roomId)
-			// Also clear from Redis if local instance was the last holder
-			// (In production with multiple pods, Redis cleanup logic handles this via expiry)
-			redis.DeleteRoom(roomId)
 		}
 	}
 }
 
+// sendToUser delivers msg to a peer of the room, through the other instances
+// when it isn't connected to this one
 func sendToUser(roomId, userId string, msg models.SignalMessage) {
+	if deliverToUser(roomId, userId, msg) {
+		return
+	}
+	// This instance is subscribed to the room too, somebody else has to be
+	if publishSignal(roomId, relayedSignal{Kind: relayUser, To: userId, Msg: &msg}) <= 1 {
+		metrics.DroppedMessages.WithLabelValues(msg.Type, "peer_not_found").Inc()
+	}
+}
+
+// deliverToUser writes msg to a local peer, it reports whether the peer is connected here
+func deliverToUser(roomId, userId string, msg models.SignalMessage) bool {
 	roomsMutex.RLock()
 	peer, exists := rooms[roomId][userId]
 	roomsMutex.RUnlock()
 
-	if exists {
-		// WriteJSON uses the Peer's internal mutex, so it is safe
-		err := peer.WriteJSON(msg)
-		if err != nil {
-			log.Printf("Error sending to user %s: %v", userId, err)
-		}
+	if !exists {
+		return false
 	}
+
+	// WriteJSON uses the Peer's internal mutex, so it is safe
+	err := peer.WriteJSON(msg)
+	if err != nil {
+		peer.log.Warn("Error sending signal", "type", msg.Type, "error", err)
+		metrics.DroppedMessages.WithLabelValues(msg.Type, "write_failed").Inc()
+	}
+	return true
 }
 
+// broadcastToRoom sends msg to every peer of the room but excludeUserId, on every instance
 func broadcastToRoom(roomId, excludeUserId string, msg models.SignalMessage) {
+	deliverToRoom(roomId, excludeUserId, msg)
+	publishSignal(roomId, relayedSignal{Kind: relayRoom, Exclude: excludeUserId, Msg: &msg})
+}
+
+// deliverToRoom sends msg to the local peers of the room but excludeUserId
+func deliverToRoom(roomId, excludeUserId string, msg models.SignalMessage) {
 	roomsMutex.RLock()
 	peersMap := rooms[roomId]
 
@@ -178,7 +446,8 @@ func broadcastToRoom(roomId, excludeUserId string, msg models.SignalMessage) {
 	for _, peer := range snapshot {
 		go func(p *Peer) {
 			if err := p.WriteJSON(msg); err != nil {
-				log.Printf("Error broadcasting to peer: %v", err)
+				p.log.Warn("Error broadcasting signal", "type", msg.Type, "error", err)
+				metrics.DroppedMessages.WithLabelValues(msg.Type, "write_failed").Inc()
 			}
 		}(peer)
 	}
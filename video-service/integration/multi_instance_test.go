@@ -0,0 +1,457 @@
+//go:build integration
+
+// Package integration runs the video service the way it's deployed: several instances
+// sharing one Redis. It needs a Redis at REDIS_URL (localhost:6379 by default, make db-up):
+//
+//	go test -tags integration ./integration/
+package integration
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"video-service/auth"
+	"video-service/models"
+
+	"github.com/fasthttp/websocket"
+)
+
+const joinSecret = "integration-test-video-join-secret"
+
+// instance is a video service process
+type instance struct {
+	addr string
+}
+
+// startInstances builds the service and starts n instances on the same Redis
+func startInstances(t *testing.T, n int) []instance {
+	t.Helper()
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		redisURL = "localhost:6379"
+	}
+	if conn, err := net.DialTimeout("tcp", redisURL, time.Second); err != nil {
+		t.Fatalf("no Redis at %s (set REDIS_URL or run make db-up): %v", redisURL, err)
+	} else {
+		conn.Close()
+	}
+
+	binary := filepath.Join(t.TempDir(), "video-service")
+	build := exec.Command("go", "build", "-o", binary, "video-service")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building the video service: %v\n%s", err, out)
+	}
+
+	instances := make([]instance, n)
+	for i := range instances {
+		port := freePort(t)
+		cmd := exec.Command(binary)
+		cmd.Env = append(os.Environ(),
+			"PORT="+fmt.Sprint(port),
+			"REDIS_URL="+redisURL,
+			"VIDEO_JOIN_SECRET="+joinSecret,
+			"RECORDING_STORAGE=none",
+			"LOG_LEVEL=warn",
+		)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("starting instance %d: %v", i, err)
+		}
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+		instances[i] = instance{addr: fmt.Sprintf("127.0.0.1:%d", port)}
+		waitHealthy(t, instances[i])
+	}
+	return instances
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func waitHealthy(t *testing.T, in instance) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := http.Get("http://" + in.addr + "/health"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("instance at %s never became healthy", in.addr)
+}
+
+// joinToken mints what the chat server would for userId
+func joinToken(roomId, userId, role string) string {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(auth.JoinClaims{
+		Subject:  userId,
+		Name:     userId,
+		Room:     roomId,
+		Role:     role,
+		Audience: "video-service",
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(time.Minute).Unix(),
+	})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(joinSecret))
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// client is a participant's signaling connection
+type client struct {
+	t        *testing.T
+	userId   string
+	conn     *websocket.Conn
+	messages chan models.SignalMessage
+}
+
+func connect(t *testing.T, in instance, roomId, userId, role string) *client {
+	t.Helper()
+	url := "ws://" + in.addr + "/ws/" + roomId + "?token=" + joinToken(roomId, userId, role)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("%s joining %s: %v", userId, in.addr, err)
+	}
+	c := &client{t: t, userId: userId, conn: conn, messages: make(chan models.SignalMessage, 64)}
+	go func() {
+		defer close(c.messages)
+		for {
+			var msg models.SignalMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+func (c *client) send(msg models.SignalMessage) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("%s sending %s: %v", c.userId, msg.Type, err)
+	}
+}
+
+// expect skips messages until one of msgType arrives
+func (c *client) expect(msgType string) models.SignalMessage {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("%s disconnected waiting for %s", c.userId, msgType)
+			}
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-timeout:
+			c.t.Fatalf("%s got no %s", c.userId, msgType)
+		}
+	}
+}
+
+// expectClosed waits until the service hangs up
+func (c *client) expectClosed() {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.t.Fatalf("%s is still connected", c.userId)
+		}
+	}
+}
+
+// expectAll skips messages until one of each of msgTypes arrived, in whatever order
+func (c *client) expectAll(msgTypes ...string) map[string]models.SignalMessage {
+	c.t.Helper()
+	got := make(map[string]models.SignalMessage, len(msgTypes))
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(msgTypes) {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("%s disconnected waiting for %v", c.userId, msgTypes)
+			}
+			for _, msgType := range msgTypes {
+				if _, seen := got[msgType]; !seen && msg.Type == msgType {
+					got[msgType] = msg
+				}
+			}
+		case <-timeout:
+			c.t.Fatalf("%s got only %d of %v", c.userId, len(got), msgTypes)
+		}
+	}
+	return got
+}
+
+func roomStatus(t *testing.T, in instance, roomId, userId string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://"+in.addr+"/api/rooms/"+roomId, nil)
+	req.Header.Set("Authorization", "Bearer "+joinToken(roomId, userId, auth.RoleParticipant))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitRoomGone waits for the instance handling the room's last leave to delete it, which
+// can finish after the connections closed
+func waitRoomGone(t *testing.T, in instance, roomId, userId string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := roomStatus(t, in, roomId, userId)
+		if status == http.StatusNotFound {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("room still exists: %d", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// createRoom creates a room the way the chat server does, creatorId hosts it. roomType is
+// "group", "peer" or empty for an "auto" room.
+func createRoom(t *testing.T, in instance, creatorId, roomType string) string {
+	t.Helper()
+	id := make([]byte, 6)
+	rand.Read(id)
+	roomId := "integration_" + hex.EncodeToString(id)
+	body, _ := json.Marshal(models.CreateRoomRequest{RoomId: roomId, CreatorId: creatorId, Type: roomType, RequestedAt: time.Now().Unix()})
+	create, _ := http.NewRequest(http.MethodPost, "http://"+in.addr+"/api/rooms/create", bytes.NewReader(body))
+	create.Header.Set("Content-Type", "application/json")
+	create.Header.Set(auth.CallbackSignatureHeader, auth.SignServiceRequest([]byte(joinSecret), body))
+	resp, err := http.DefaultClient.Do(create)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("creating the room: %v %v", err, resp)
+	}
+	resp.Body.Close()
+	return roomId
+}
+
+// expectMode waits for the room-mode message and checks the mode it announces
+func (c *client) expectMode(mode string) {
+	c.t.Helper()
+	var announced struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal(c.expect("room-mode").Metadata, &announced); err != nil || announced.Mode != mode {
+		c.t.Fatalf("%s was told to use %q (%v), want %q", c.userId, announced.Mode, err, mode)
+	}
+}
+
+func TestSignalingAcrossInstances(t *testing.T) {
+	instances := startInstances(t, 2)
+	a, b := instances[0], instances[1]
+
+	roomId := createRoom(t, a, "alice", "")
+
+	// alice hosts on A, bob joins on B
+	alice := connect(t, a, roomId, "alice", auth.RoleParticipant)
+	alice.expect("room-state")
+	bob := connect(t, b, roomId, "bob", auth.RoleParticipant)
+	bob.expect("room-state")
+	if joined := alice.expect("user-joined"); joined.UserId != "bob" {
+		t.Fatalf("alice saw %s join instead of bob", joined.UserId)
+	}
+
+	t.Run("offers and answers", func(t *testing.T) {
+		bob.send(models.SignalMessage{Type: "offer", TargetId: "alice", SDP: &models.SessionDesc{Type: "offer", SDP: "v=0"}})
+		if offer := alice.expect("offer"); offer.UserId != "bob" || offer.SDP == nil {
+			t.Fatalf("alice got %+v", offer)
+		}
+		alice.send(models.SignalMessage{Type: "answer", TargetId: "bob", SDP: &models.SessionDesc{Type: "answer", SDP: "v=0"}})
+		if answer := bob.expect("answer"); answer.UserId != "alice" {
+			t.Fatalf("bob got %+v", answer)
+		}
+	})
+
+	t.Run("broadcasts", func(t *testing.T) {
+		bob.send(models.SignalMessage{Type: "media-state", Metadata: json.RawMessage(`{"audioMuted": true}`)})
+		state := alice.expect("media-state")
+		if state.UserId != "bob" || !strings.Contains(string(state.Metadata), `"audioMuted":true`) {
+			t.Fatalf("alice got %+v", state)
+		}
+	})
+
+	t.Run("waiting room", func(t *testing.T) {
+		alice.send(models.SignalMessage{Type: "waiting-room", Metadata: json.RawMessage(`{"enabled": true}`)})
+		bob.expect("waiting-room-changed")
+
+		carol := connect(t, b, roomId, "carol", auth.RoleParticipant)
+		carol.expect("admission-pending")
+		if request := alice.expect("admission-request"); request.UserId != "carol" {
+			t.Fatalf("alice was asked to admit %s", request.UserId)
+		}
+		alice.send(models.SignalMessage{Type: "admit-participant", TargetId: "carol"})
+		carol.expect("admission-granted")
+		carol.expect("room-state")
+		if joined := alice.expect("user-joined"); joined.UserId != "carol" {
+			t.Fatalf("alice saw %s join instead of carol", joined.UserId)
+		}
+
+		// Kicks reach the instance the participant is connected to
+		alice.send(models.SignalMessage{Type: "remove-participant", TargetId: "carol"})
+		carol.expect("participant-removed")
+		carol.expectClosed()
+		// The removal and carol leaving are broadcast separately, in any order
+		if left := bob.expectAll("participant-removed", "user-left")["user-left"]; left.UserId != "carol" {
+			t.Fatalf("bob saw %s leave instead of carol", left.UserId)
+		}
+	})
+
+	t.Run("room outlives an instance's last peer", func(t *testing.T) {
+		mia := connect(t, b, roomId, "mia", auth.RoleModerator)
+		mia.expect("room-state")
+
+		// A has no peers left in the room, B still has bob and mia
+		alice.conn.Close()
+		if left := bob.expect("user-left"); left.UserId != "alice" {
+			t.Fatalf("bob saw %s leave instead of alice", left.UserId)
+		}
+		if status := roomStatus(t, a, roomId, "bob"); status != http.StatusOK {
+			t.Fatalf("room is gone after alice left: %d", status)
+		}
+
+		// Ending the call from A hangs up everybody on B
+		dan := connect(t, a, roomId, "dan", auth.RoleModerator)
+		dan.expect("room-state")
+		mia.expect("user-joined")
+		dan.send(models.SignalMessage{Type: "end-call"})
+		bob.expect("call-ended")
+		bob.expectClosed()
+		mia.expectClosed()
+		waitRoomGone(t, b, roomId, "bob")
+	})
+
+	t.Run("waiting peers keep an empty room", func(t *testing.T) {
+		roomId := createRoom(t, a, "erin", "")
+		erin := connect(t, a, roomId, "erin", auth.RoleParticipant)
+		erin.expect("room-state")
+		erin.send(models.SignalMessage{Type: "waiting-room", Metadata: json.RawMessage(`{"enabled": true}`)})
+		erin.expect("waiting-room-changed")
+
+		frank := connect(t, b, roomId, "frank", auth.RoleParticipant)
+		frank.expect("admission-pending")
+		erin.expect("admission-request")
+
+		// The host leaving while frank waits doesn't take the room with it
+		erin.conn.Close()
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if status := roomStatus(t, b, roomId, "frank"); status != http.StatusOK {
+				t.Fatalf("room is gone while frank waits: %d", status)
+			}
+		}
+
+		// Coming back, the host still hosts and can let frank in
+		erin = connect(t, a, roomId, "erin", auth.RoleParticipant)
+		erin.expect("room-state")
+		if request := erin.expect("admission-request"); request.UserId != "frank" {
+			t.Fatalf("erin was asked to admit %s", request.UserId)
+		}
+		erin.send(models.SignalMessage{Type: "admit-participant", TargetId: "frank"})
+		frank.expect("admission-granted")
+		frank.expect("room-state")
+	})
+}
+
+func TestSFURoomsStayOnOneInstance(t *testing.T) {
+	instances := startInstances(t, 2)
+	a, b := instances[0], instances[1]
+
+	t.Run("joins on another instance are rejected", func(t *testing.T) {
+		roomId := createRoom(t, a, "alice", "group")
+		alice := connect(t, a, roomId, "alice", auth.RoleParticipant)
+		alice.expectMode(models.RoomModeSFU)
+
+		// B's SFU has none of alice's media
+		bob := connect(t, b, roomId, "bob", auth.RoleParticipant)
+		rejected := bob.expect("join-rejected")
+		if !strings.Contains(string(rejected.Metadata), "sfu-on-other-instance") {
+			t.Fatalf("bob was rejected with %s", rejected.Metadata)
+		}
+		bob.expectClosed()
+
+		bob = connect(t, a, roomId, "bob", auth.RoleParticipant)
+		bob.expectMode(models.RoomModeSFU)
+		if joined := alice.expect("user-joined"); joined.UserId != "bob" {
+			t.Fatalf("alice saw %s join instead of bob", joined.UserId)
+		}
+
+		// Once everybody left the next join may take the room to another instance
+		alice.conn.Close()
+		bob.conn.Close()
+		alice.expectClosed()
+		bob.expectClosed()
+		waitRoomGone(t, b, roomId, "carol")
+	})
+
+	t.Run("auto rooms spanning instances stay a mesh", func(t *testing.T) {
+		roomId := createRoom(t, a, "u1", "")
+		for i, in := range []instance{a, a, b, b} {
+			peer := connect(t, in, roomId, fmt.Sprintf("u%d", i+1), auth.RoleParticipant)
+			peer.expectMode(models.RoomModeMesh)
+		}
+		// Past SFU_MESH_MAX_PARTICIPANTS, but A's SFU couldn't reach the peers on B
+		fifth := connect(t, a, roomId, "u5", auth.RoleParticipant)
+		fifth.expectMode(models.RoomModeMesh)
+	})
+
+	t.Run("auto rooms on one instance move to the SFU", func(t *testing.T) {
+		roomId := createRoom(t, b, "v1", "")
+		peers := make([]*client, 4)
+		for i := range peers {
+			peers[i] = connect(t, b, roomId, fmt.Sprintf("v%d", i+1), auth.RoleParticipant)
+			peers[i].expectMode(models.RoomModeMesh)
+		}
+		fifth := connect(t, b, roomId, "v5", auth.RoleParticipant)
+		fifth.expectMode(models.RoomModeSFU)
+		for _, peer := range peers {
+			peer.expectMode(models.RoomModeSFU)
+		}
+
+		// A latecomer on the other instance can't join the SFU on B
+		late := connect(t, a, roomId, "v6", auth.RoleParticipant)
+		late.expect("join-rejected")
+		late.expectClosed()
+	})
+}
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// RequestIDHeader carries the correlation ID between clients, the chat server and the video service
+const RequestIDHeader = "X-Request-ID"
+
+// LocalsLogger is the fiber Locals key holding the request logger, websocket handlers read it from there
+const LocalsLogger = "logger"
+
+// Attribute keys shared by every log line so they can be queried consistently
+const (
+	KeyRequestID = "request_id"
+	KeyUserID    = "user_id"
+	KeyConnID    = "conn_id"
+	KeyRoomID    = "room_id"
+)
+
+type loggerKey struct{}
+
+// Setup installs the process wide slog logger.
+// level is one of debug, info, warn or error; format is json or text.
+func Setup(level, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: ParseLevel(level)}
+
+	var handler slog.Handler
+	if strings.EqualFold(format, "text") {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// ParseLevel maps a LOG_LEVEL value to a slog level, defaulting to info
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// NewID returns a random identifier for requests and socket connections
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithLogger stores a request scoped logger in the context
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the request scoped logger, or the default logger if there is none
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
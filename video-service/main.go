@@ -1,21 +1,77 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"os"
+	"strings"
 
+	"video-service/auth"
+	"video-service/config"
 	"video-service/handlers"
+	"video-service/logging"
+	"video-service/origins"
+	"video-service/recording"
 	"video-service/redis"
+	"video-service/sfu"
+	"video-service/tracing"
 
+	"github.com/gofiber/contrib/otelfiber/v2"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/websocket/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logging.Setup(cfg.Log.Level, cfg.Log.Format)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "video-service", cfg.Tracing.Exporter)
+	if err != nil {
+		slog.Error("Invalid tracing configuration", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	allowedOrigins, err := origins.Parse(cfg.CORS.AllowedOrigins)
+	if err != nil {
+		slog.Error("Invalid allowed origins", "error", err)
+		os.Exit(1)
+	}
+
 	// Initialize Redis for room tracking
-	redis.InitRedis()
+	redis.InitRedis(cfg.Redis)
+
+	// Peers of a room may be connected to other instances, signals reach them through Redis
+	handlers.StartRelay(context.Background())
+
+	mediaServer, err := sfu.New(sfu.Config{
+		ICEServers: cfg.SFU.ICEServers,
+		UDPPortMin: uint16(cfg.SFU.UDPPortMin),
+		UDPPortMax: uint16(cfg.SFU.UDPPortMax),
+		PublicIPs:  cfg.SFU.PublicIPs,
+	})
+	if err != nil {
+		slog.Error("Invalid SFU configuration", "error", err)
+		os.Exit(1)
+	}
+	handlers.ConfigureSFU(mediaServer, cfg.SFU.MeshMaxParticipants)
+
+	recordingStorage, err := recording.NewStorage(cfg.Recording)
+	if err != nil {
+		slog.Error("Invalid recording configuration", "error", err)
+		os.Exit(1)
+	}
+	joinSecret := []byte(cfg.Auth.JoinSecret)
+	handlers.ConfigureICE(cfg.ICE, joinSecret)
+	handlers.ConfigureRecording(recordingStorage, cfg.Chat.ServiceURL, joinSecret)
 
 	app := fiber.New(fiber.Config{
 		ServerHeader: "GopherChat Video Service",
@@ -23,21 +79,18 @@ func main() {
 	})
 
 	// Middleware
-	app.Use(logger.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "http://localhost:3000, http://localhost:5173",
-		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
-		AllowCredentials: true,
-	}))
-
-	// Health check
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"status":  "healthy",
-			"service": "video-calling",
-		})
-	})
+	// Websocket upgrades are long lived, signaling messages get their own spans instead
+	app.Use(otelfiber.Middleware(otelfiber.WithNext(func(c *fiber.Ctx) bool {
+		return strings.HasPrefix(c.Path(), "/ws")
+	})))
+	app.Use(handlers.RequestLogger())
+	app.Use(handlers.CORS(allowedOrigins))
+
+	// Health checks and Prometheus scrape endpoint
+	app.Get("/health", handlers.HealthCheck)
+	app.Get("/healthz", handlers.HealthCheck)
+	app.Get("/readyz", handlers.ReadinessCheck)
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
 
 	// WebSocket upgrade middleware
 	app.Use("/ws", func(c *fiber.Ctx) error {
@@ -49,23 +102,32 @@ func main() {
 	})
 
 	// WebSocket routes for signaling
-	// Route: ws://localhost:4000/ws/:roomId?userId=xxx
-	app.Get("/ws/:roomId", websocket.New(handlers.HandleWebRTCSignaling))
+	// Route: ws://localhost:4000/ws/:roomId?token=xxx, the token comes from the chat server
+	app.Get("/ws/:roomId",
+		handlers.RequireJoinToken(joinSecret, cfg.Auth.AllowImplicitRooms),
+		websocket.New(handlers.HandleWebRTCSignaling))
 
 	// REST API routes
 	api := app.Group("/api")
 
-	// Room management
-	api.Get("/rooms/:roomId/participants", handlers.GetRoomParticipants)
-	api.Post("/rooms/create", handlers.CreateRoom)
-	api.Delete("/rooms/:roomId", handlers.DeleteRoom)
+	// STUN and TURN servers with short lived TURN credentials
+	api.Get("/ice-servers", handlers.GetICEServers)
 
-	// Get server port
-	port := os.Getenv("VIDEO_SERVICE_PORT")
-	if port == "" {
-		port = "4000"
-	}
+	// Room management, anybody with a join token for the room can look at it
+	roomAccess := handlers.RequireRoomRole(joinSecret, auth.RoleHost, auth.RoleModerator, auth.RoleParticipant)
+	api.Get("/rooms/:roomId", roomAccess, handlers.GetRoomInfo)
+	api.Get("/rooms/:roomId/participants", roomAccess, handlers.GetRoomParticipants)
+	api.Get("/rooms/:roomId/stats", roomAccess, handlers.GetRoomStats)
+	api.Post("/rooms/create", handlers.RequireServiceSignature(joinSecret), handlers.CreateRoom)
+	api.Delete("/rooms/:roomId", handlers.RequireRoomRole(joinSecret, auth.RoleHost, auth.RoleModerator), handlers.DeleteRoom)
 
-	log.Printf("Video Service starting on port %s", port)
-	log.Fatal(app.Listen(":" + port))
+	// Recording, for the host and moderators of a call with their join token
+	recordingAccess := handlers.RequireRoomRole(joinSecret, auth.RoleHost, auth.RoleModerator)
+	api.Post("/rooms/:roomId/recording/start", recordingAccess, handlers.StartRecording)
+	api.Post("/rooms/:roomId/recording/stop", recordingAccess, handlers.StopRecording)
+
+	slog.Info("Video Service starting", "port", cfg.Server.Port)
+	if err := app.Listen(fmt.Sprintf(":%d", cfg.Server.Port)); err != nil {
+		slog.Error("Video Service stopped", "error", err)
+	}
 }
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// Namespace matches the chat server so dashboards can query both services the same way
+const Namespace = "gopherchat"
+
+var (
+	ConnectedSockets = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "connected_sockets",
+		Help:      "Number of WebSocket connections currently open on this instance.",
+	})
+
+	// MessagesTotal counts inbound signaling messages, rate() gives messages per second by type
+	MessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "messages_total",
+		Help:      "Socket messages received, by message type.",
+	}, []string{"type"})
+
+	DroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "dropped_messages_total",
+		Help:      "Outbound messages that were never delivered, by message type and reason.",
+	}, []string{"type", "reason"})
+
+	// RelayedSignals counts what instances exchange about rooms they share through Redis
+	RelayedSignals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "relayed_signals_total",
+		Help:      "Signals relayed between instances through Redis, by relay kind and direction (sent or received).",
+	}, []string{"kind", "direction"})
+
+	SFUPeerConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "sfu_peer_connections",
+		Help:      "Participants connected to the SFU on this instance.",
+	})
+
+	SFUForwardedTracks = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "sfu_forwarded_tracks",
+		Help:      "Published tracks the SFU on this instance is forwarding to subscribers.",
+	})
+
+	// Call quality as reported by clients in "stats" messages, one observation per report
+	CallRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "call_rtt_seconds",
+		Help:      "Round trip time reported by call participants.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+	})
+
+	CallPacketLoss = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "call_packet_loss_ratio",
+		Help:      "Fraction of packets lost reported by call participants.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5},
+	})
+
+	CallJitter = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "call_jitter_seconds",
+		Help:      "Jitter reported by call participants.",
+		Buckets:   prometheus.ExponentialBuckets(0.002, 2, 10),
+	})
+
+	CallBitrate = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "call_receive_bitrate_bits_per_second",
+		Help:      "Bitrate call participants receive.",
+		Buckets:   prometheus.ExponentialBuckets(32_000, 2, 10),
+	})
+
+	CallQualityScore = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "call_quality_score",
+		Help:      "Estimated mean opinion score of calls, 1 (bad) to 4.5 (excellent), after smoothing.",
+		Buckets:   []float64{1.5, 2, 2.5, 3, 3.5, 3.8, 4, 4.2, 4.4},
+	})
+
+	RedisCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Latency of Redis commands (including PUBLISH), by command.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"command"})
+)
+
+// redisHook times every command that goes through a go-redis client
+type redisHook struct{}
+
+// RedisHook returns a go-redis hook that feeds RedisCommandDuration
+func RedisHook() redis.Hook {
+	return redisHook{}
+}
+
+func (redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		RedisCommandDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		RedisCommandDuration.WithLabelValues("pipeline").Observe(time.Since(start).Seconds())
+		return err
+	}
+}
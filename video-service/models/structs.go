@@ -4,7 +4,7 @@ import "encoding/json"
 
 // SignalMessage represents WebRTC signaling messages
 type SignalMessage struct {
-	Type     string          `json:"type"`     // "offer", "answer", "ice-candidate", "user-joined", "user-left"
+	Type     string          `json:"type"`     // "offer", "answer", "ice-candidate", "user-joined", "user-left", "room-mode"
 	UserId   string          `json:"userId"`   // Sender's user ID
 	TargetId string          `json:"targetId"` // Recipient's user ID (for peer-to-peer)
 	RoomId   string          `json:"roomId"`   // Room ID
@@ -13,6 +13,18 @@ type SignalMessage struct {
 	Metadata json.RawMessage `json:"metadata,omitempty"` // Additional data
 }
 
+// Media topologies of a room. In a mesh every participant connects to every other one,
+// through the SFU every participant has a single connection with the server.
+const (
+	RoomModeMesh = "mesh"
+	RoomModeSFU  = "sfu"
+	RoomModeAuto = "auto" // mesh until the room outgrows it, then SFU for the rest of the call
+)
+
+// SFUPeerId is the peer ID the SFU uses in signaling: offers, answers and ICE candidates
+// sent to it go to the server instead of another participant
+const SFUPeerId = "sfu"
+
 // SessionDesc represents SDP (Session Description Protocol)
 type SessionDesc struct {
 	Type string `json:"type"` // "offer" or "answer"
@@ -31,25 +43,42 @@ type CreateRoomRequest struct {
 	RoomId    string `json:"roomId"`    // Optional: custom room ID
 	CreatorId string `json:"creatorId"` // User creating the room
 	GroupId   string `json:"groupId"`   // Optional: associated group
-	Type      string `json:"type"`      // "peer" or "group"
+	Type      string `json:"type"`      // "peer" (mesh), "group" (SFU), empty decides by room size
+
+	// WaitingRoom holds participants until the host or a moderator admits them
+	WaitingRoom bool `json:"waitingRoom"`
+
+	// RequestedAt is when the chat server signed the request, in unix seconds
+	RequestedAt int64 `json:"requestedAt"`
 }
 
 // RoomParticipant represents a user in a video call
 type RoomParticipant struct {
 	UserId      string `json:"userId"`
 	Username    string `json:"username"`
+	Role        string `json:"role,omitempty"` // from the join token: host, moderator or participant
 	JoinedAt    int64  `json:"joinedAt"`
 	AudioMuted  bool   `json:"audioMuted"`
 	VideoMuted  bool   `json:"videoMuted"`
 	IsScreening bool   `json:"isScreening"` // Screen sharing
 }
 
+// MediaStateUpdate is the metadata of a "media-state" message, fields left out keep their value
+type MediaStateUpdate struct {
+	AudioMuted  *bool `json:"audioMuted,omitempty"`
+	VideoMuted  *bool `json:"videoMuted,omitempty"`
+	IsScreening *bool `json:"isScreening,omitempty"`
+}
+
 // RoomInfo contains metadata about a video call room
 type RoomInfo struct {
 	RoomId       string            `json:"roomId"`
 	CreatorId    string            `json:"creatorId"`
 	GroupId      string            `json:"groupId,omitempty"`
 	Type         string            `json:"type"` // "peer" or "group"
+	Mode         string            `json:"mode"` // one of the RoomMode values
+	RecordingId  string            `json:"recordingId,omitempty"`
+	WaitingRoom  bool              `json:"waitingRoom"`
 	CreatedAt    int64             `json:"createdAt"`
 	Participants []RoomParticipant `json:"participants"`
 	IsActive     bool              `json:"isActive"`
@@ -71,3 +100,30 @@ type CallNotification struct {
 	Type       string `json:"type"` // "peer" or "group"
 	GroupName  string `json:"groupName,omitempty"`
 }
+
+// CallStats summarizes RTCPeerConnection.getStats(), clients send it every few seconds as the
+// metadata of a "stats" message
+type CallStats struct {
+	RTT        float64 `json:"rtt"`        // round trip time in milliseconds
+	PacketLoss float64 `json:"packetLoss"` // fraction of packets lost since the last report, 0 to 1
+	Jitter     float64 `json:"jitter"`     // milliseconds
+	Bitrate    float64 `json:"bitrate"`    // received kbit/s
+}
+
+// ParticipantStats is the smoothed call quality of one participant
+type ParticipantStats struct {
+	UserId string `json:"userId"`
+	CallStats
+	Score     float64 `json:"score"`   // estimated MOS, 1 (bad) to 4.5 (excellent)
+	Samples   int64   `json:"samples"` // reports received
+	UpdatedAt int64   `json:"updatedAt"`
+}
+
+// RoomStats aggregates the quality of every participant that reported stats
+type RoomStats struct {
+	RoomId string `json:"roomId"`
+	CallStats
+	Score        float64            `json:"score"`    // average of the participants
+	MinScore     float64            `json:"minScore"` // the participant with the worst call
+	Participants []ParticipantStats `json:"participants"`
+}
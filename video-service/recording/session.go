@@ -0,0 +1,283 @@
+package recording
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"video-service/sfu"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// trackQueue is how many packets of a track may wait for the disk before they are dropped,
+// a few seconds of video
+const trackQueue = 1024
+
+// File is one recorded track
+type File struct {
+	Name     string `json:"name"` // path in the storage
+	UserId   string `json:"userId"`
+	TrackId  string `json:"trackId"`
+	Kind     string `json:"kind"` // audio or video
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"` // bytes
+}
+
+// Session is one recording of a room. It is the room's sfu.Recorder, every track published
+// while it runs gets a file.
+type Session struct {
+	Id        string
+	RoomId    string
+	StartedBy string
+	StartedAt time.Time
+
+	storage Storage
+	log     *slog.Logger
+	onClose func(*Session)
+
+	mu        sync.Mutex
+	tracks    []*trackRecorder
+	stoppedAt time.Time
+	closed    bool
+}
+
+// NewSession prepares a recording of roomId, onClose runs once it ended and its files are complete
+func NewSession(roomId, startedBy string, storage Storage, logger *slog.Logger, onClose func(*Session)) *Session {
+	id := newRecordingId()
+	return &Session{
+		Id:        id,
+		RoomId:    roomId,
+		StartedBy: startedBy,
+		StartedAt: time.Now(),
+		storage:   storage,
+		log:       logger.With("recording_id", id),
+		onClose:   onClose,
+	}
+}
+
+// AddTrack implements sfu.Recorder
+func (s *Session) AddTrack(info sfu.TrackInfo) sfu.TrackWriter {
+	ext, ok := fileExtensions[strings.ToLower(info.Codec.MimeType)]
+	if !ok {
+		s.log.Warn("Not recording track, its codec has no file format", "track_id", info.ID, "mime_type", info.Codec.MimeType)
+		return nil
+	}
+
+	file := File{
+		Name:     path.Join(safeName(s.RoomId), s.Id, safeName(info.ID)+ext),
+		UserId:   info.Publisher,
+		TrackId:  info.ID,
+		Kind:     info.Kind.String(),
+		MimeType: info.Codec.MimeType,
+	}
+	out, err := s.storage.Create(context.Background(), file.Name)
+	if err != nil {
+		s.log.Error("Failed to create recording file", "file", file.Name, "error", err)
+		return nil
+	}
+	counted := &countingWriter{out: out}
+
+	var writer media.Writer
+	switch ext {
+	case ".ogg":
+		channels := info.Codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		writer, err = oggwriter.NewWith(counted, info.Codec.ClockRate, channels)
+	case ".webm":
+		writer = newWebMWriter(counted, strings.EqualFold(info.Codec.MimeType, webrtc.MimeTypeVP9))
+	case ".h264":
+		writer = h264writer.NewWith(counted)
+	}
+	if err != nil {
+		s.log.Error("Failed to start recording file", "file", file.Name, "error", err)
+		_ = counted.Close()
+		return nil
+	}
+
+	track := newTrackRecorder(file, counted, writer, s.log)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = track.Close()
+		return nil
+	}
+	s.tracks = append(s.tracks, track)
+	s.mu.Unlock()
+
+	s.log.Info("Recording track", "file", file.Name)
+	return track
+}
+
+// Close implements sfu.Recorder, it finishes every file and then runs onClose
+func (s *Session) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.stoppedAt = time.Now()
+	tracks := slices.Clone(s.tracks)
+	s.mu.Unlock()
+
+	for _, track := range tracks {
+		if err := track.Close(); err != nil {
+			s.log.Warn("Failed to finish recording file", "file", track.file.Name, "error", err)
+		}
+	}
+	s.log.Info("Recording stopped", "files", len(tracks))
+	if s.onClose != nil {
+		s.onClose(s)
+	}
+}
+
+// StoppedAt is zero while the recording runs
+func (s *Session) StoppedAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stoppedAt
+}
+
+// Files lists the files written so far, empty ones included
+func (s *Session) Files() []File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make([]File, 0, len(s.tracks))
+	for _, track := range s.tracks {
+		file := track.file
+		file.Size = track.out.written.Load()
+		files = append(files, file)
+	}
+	return files
+}
+
+// fileExtensions maps the codecs the SFU negotiates to the container they are recorded in
+var fileExtensions = map[string]string{
+	strings.ToLower(webrtc.MimeTypeOpus): ".ogg",
+	strings.ToLower(webrtc.MimeTypeVP8):  ".webm",
+	strings.ToLower(webrtc.MimeTypeVP9):  ".webm",
+	strings.ToLower(webrtc.MimeTypeH264): ".h264",
+}
+
+// trackRecorder queues the packets of one track and writes them from its own goroutine,
+// so a slow disk never holds up forwarding
+type trackRecorder struct {
+	file   File
+	out    *countingWriter
+	writer media.Writer
+	log    *slog.Logger
+
+	mu      sync.Mutex
+	packets chan *rtp.Packet
+	closed  bool
+	dropped int
+	done    chan struct{}
+	err     error
+}
+
+func newTrackRecorder(file File, out *countingWriter, writer media.Writer, logger *slog.Logger) *trackRecorder {
+	t := &trackRecorder{
+		file:    file,
+		out:     out,
+		writer:  writer,
+		log:     logger,
+		packets: make(chan *rtp.Packet, trackQueue),
+		done:    make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// WriteRTP implements sfu.TrackWriter
+func (t *trackRecorder) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, io.ErrClosedPipe
+	}
+	packet := &rtp.Packet{Header: *header, Payload: slices.Clone(payload)}
+	select {
+	case t.packets <- packet:
+	default:
+		t.dropped++
+	}
+	return len(payload), nil
+}
+
+func (t *trackRecorder) run() {
+	defer close(t.done)
+
+	var writeErr error
+	for packet := range t.packets {
+		if writeErr != nil {
+			continue // drain, the file is broken anyway
+		}
+		writeErr = t.writer.WriteRTP(packet)
+	}
+	t.err = errors.Join(writeErr, t.writer.Close())
+}
+
+// Close implements sfu.TrackWriter, it returns once the file is complete
+func (t *trackRecorder) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.packets)
+		if t.dropped > 0 {
+			t.log.Warn("Recording fell behind and dropped packets", "file", t.file.Name, "dropped", t.dropped)
+		}
+	}
+	t.mu.Unlock()
+
+	<-t.done
+	return t.err
+}
+
+type countingWriter struct {
+	out     io.WriteCloser
+	written atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	w.written.Add(int64(n))
+	return n, err
+}
+
+func (w *countingWriter) Close() error {
+	return w.out.Close()
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// safeName keeps client chosen IDs (track IDs come from their SDP) from forming paths
+func safeName(name string) string {
+	return unsafeNameChars.ReplaceAllString(name, "_")
+}
+
+func newRecordingId() string {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "rec_" + time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return "rec_" + hex.EncodeToString(bytes)
+}
@@ -0,0 +1,51 @@
+// Package recording writes the tracks of recorded SFU calls to storage, one file per track:
+// Opus audio as Ogg, VP8 and VP9 video as WebM and H264 as an Annex B elementary stream.
+package recording
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"video-service/config"
+)
+
+// Storage is where recordings end up. Names are slash separated paths like
+// <room ID>/<recording ID>/<track>.webm.
+type Storage interface {
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+}
+
+// NewStorage returns the backend selected by cfg.Storage, nil when recording is turned off
+func NewStorage(cfg config.RecordingConfig) (Storage, error) {
+	switch strings.ToLower(cfg.Storage) {
+	case "local":
+		if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+			return nil, fmt.Errorf("creating recording directory: %w", err)
+		}
+		return LocalStorage{Dir: cfg.Dir}, nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown recording storage %q", cfg.Storage)
+	}
+}
+
+// LocalStorage keeps recordings on the service's disk, mount a volume at Dir in containers
+type LocalStorage struct {
+	Dir string
+}
+
+func (s LocalStorage) Create(_ context.Context, name string) (io.WriteCloser, error) {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	if !strings.HasPrefix(path, filepath.Clean(s.Dir)+string(filepath.Separator)) {
+		return nil, fmt.Errorf("recording name %q leaves the recording directory", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+}
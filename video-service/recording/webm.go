@@ -0,0 +1,231 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/codecs/vp9"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// Matroska element IDs, https://www.matroska.org/technical/elements.html
+var (
+	idEBML               = []byte{0x1A, 0x45, 0xDF, 0xA3}
+	idEBMLVersion        = []byte{0x42, 0x86}
+	idEBMLReadVersion    = []byte{0x42, 0xF7}
+	idEBMLMaxIDLength    = []byte{0x42, 0xF2}
+	idEBMLMaxSizeLength  = []byte{0x42, 0xF3}
+	idDocType            = []byte{0x42, 0x82}
+	idDocTypeVersion     = []byte{0x42, 0x87}
+	idDocTypeReadVersion = []byte{0x42, 0x85}
+	idSegment            = []byte{0x18, 0x53, 0x80, 0x67}
+	idInfo               = []byte{0x15, 0x49, 0xA9, 0x66}
+	idTimecodeScale      = []byte{0x2A, 0xD7, 0xB1}
+	idMuxingApp          = []byte{0x4D, 0x80}
+	idWritingApp         = []byte{0x57, 0x41}
+	idTracks             = []byte{0x16, 0x54, 0xAE, 0x6B}
+	idTrackEntry         = []byte{0xAE}
+	idTrackNumber        = []byte{0xD7}
+	idTrackUID           = []byte{0x73, 0xC5}
+	idTrackType          = []byte{0x83}
+	idCodecID            = []byte{0x86}
+	idVideo              = []byte{0xE0}
+	idPixelWidth         = []byte{0xB0}
+	idPixelHeight        = []byte{0xBA}
+	idCluster            = []byte{0x1F, 0x43, 0xB6, 0x75}
+	idTimecode           = []byte{0xE7}
+	idSimpleBlock        = []byte{0xA3}
+)
+
+const (
+	// unknownSize lets the segment grow while recording, players read it to the end of the file
+	unknownSize = 0x01FFFFFFFFFFFFFF
+	// clusterDuration starts a new cluster at the first keyframe after this many milliseconds
+	clusterDuration = 5000
+	// maxSampleLate is how many packets the sample builder waits for a missing one
+	maxSampleLate = 256
+)
+
+// webmWriter muxes one VP8 or VP9 track into a WebM file. It has no cues, players can
+// play it from the start, remux it (ffmpeg -c copy) for seeking.
+type webmWriter struct {
+	out      io.WriteCloser
+	codecID  string // V_VP8 or V_VP9
+	builder  *samplebuilder.SampleBuilder
+	keyFrame func(frame []byte) (ok bool, width, height int)
+
+	started     bool
+	firstTS     uint32
+	lastTS      uint32
+	elapsed     int64 // in 90kHz ticks since the first frame
+	cluster     bytes.Buffer
+	clusterTime int64 // milliseconds
+	err         error
+}
+
+func newWebMWriter(out io.WriteCloser, vp9Video bool) *webmWriter {
+	w := &webmWriter{out: out, codecID: "V_VP8", keyFrame: vp8KeyFrame}
+	var depacketizer rtp.Depacketizer = &codecs.VP8Packet{}
+	if vp9Video {
+		w.codecID, w.keyFrame, depacketizer = "V_VP9", vp9KeyFrame, &codecs.VP9Packet{}
+	}
+	w.builder = samplebuilder.New(maxSampleLate, depacketizer, 90000)
+	return w
+}
+
+// WriteRTP adds a packet, frames are written once complete. Everything before the first
+// keyframe is dropped, there is nothing a player could decode it with.
+func (w *webmWriter) WriteRTP(packet *rtp.Packet) error {
+	w.builder.Push(packet)
+	for sample := w.builder.Pop(); sample != nil; sample = w.builder.Pop() {
+		w.writeFrame(sample.Data, sample.PacketTimestamp)
+	}
+	return w.err
+}
+
+func (w *webmWriter) writeFrame(frame []byte, timestamp uint32) {
+	if w.err != nil || len(frame) == 0 {
+		return
+	}
+	keyFrame, width, height := w.keyFrame(frame)
+
+	if !w.started {
+		if !keyFrame {
+			return
+		}
+		w.started, w.firstTS, w.lastTS = true, timestamp, timestamp
+		w.err = w.writeHeader(width, height)
+	}
+
+	// RTP timestamps wrap around, the signed difference keeps counting
+	w.elapsed += int64(int32(timestamp - w.lastTS))
+	w.lastTS = timestamp
+	ms := w.elapsed / 90
+
+	relative := ms - w.clusterTime
+	if w.cluster.Len() == 0 || (keyFrame && relative >= clusterDuration) || relative > 32767 || relative < -32768 {
+		w.flushCluster()
+		w.clusterTime, relative = ms, 0
+		w.cluster.Write(element(idTimecode, uintData(uint64(max(ms, 0)))))
+	}
+
+	var flags byte
+	if keyFrame {
+		flags = 0x80
+	}
+	block := make([]byte, 0, 4+len(frame))
+	block = append(block, 0x81) // track number 1
+	block = binary.BigEndian.AppendUint16(block, uint16(int16(relative)))
+	block = append(block, flags)
+	block = append(block, frame...)
+	w.cluster.Write(element(idSimpleBlock, block))
+}
+
+func (w *webmWriter) writeHeader(width, height int) error {
+	header := element(idEBML, concat(
+		element(idEBMLVersion, uintData(1)),
+		element(idEBMLReadVersion, uintData(1)),
+		element(idEBMLMaxIDLength, uintData(4)),
+		element(idEBMLMaxSizeLength, uintData(8)),
+		element(idDocType, []byte("webm")),
+		element(idDocTypeVersion, uintData(4)),
+		element(idDocTypeReadVersion, uintData(2)),
+	))
+	header = append(header, idSegment...)
+	header = binary.BigEndian.AppendUint64(header, unknownSize)
+	header = append(header, element(idInfo, concat(
+		element(idTimecodeScale, uintData(1_000_000)), // timecodes in milliseconds
+		element(idMuxingApp, []byte("GopherChat")),
+		element(idWritingApp, []byte("GopherChat video-service")),
+	))...)
+	header = append(header, element(idTracks, element(idTrackEntry, concat(
+		element(idTrackNumber, uintData(1)),
+		element(idTrackUID, uintData(1)),
+		element(idTrackType, uintData(1)), // video
+		element(idCodecID, []byte(w.codecID)),
+		element(idVideo, concat(
+			element(idPixelWidth, uintData(uint64(width))),
+			element(idPixelHeight, uintData(uint64(height))),
+		)),
+	)))...)
+
+	_, err := w.out.Write(header)
+	return err
+}
+
+func (w *webmWriter) flushCluster() {
+	if w.cluster.Len() == 0 || w.err != nil {
+		return
+	}
+	_, w.err = w.out.Write(element(idCluster, w.cluster.Bytes()))
+	w.cluster.Reset()
+}
+
+// Close writes what is left and closes the file
+func (w *webmWriter) Close() error {
+	w.builder.Flush()
+	for sample := w.builder.Pop(); sample != nil; sample = w.builder.Pop() {
+		w.writeFrame(sample.Data, sample.PacketTimestamp)
+	}
+	w.flushCluster()
+	return errors.Join(w.err, w.out.Close())
+}
+
+// vp8KeyFrame reads the frame tag and, for keyframes, the size (RFC 6386 9.1)
+func vp8KeyFrame(frame []byte) (bool, int, int) {
+	if len(frame) < 10 || frame[0]&0x01 != 0 {
+		return false, 0, 0
+	}
+	width := int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3FFF)
+	height := int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3FFF)
+	return true, width, height
+}
+
+// vp9KeyFrame parses the uncompressed header of a VP9 frame
+func vp9KeyFrame(frame []byte) (bool, int, int) {
+	var header vp9.Header
+	if err := header.Unmarshal(frame); err != nil || header.ShowExistingFrame || header.NonKeyFrame {
+		return false, 0, 0
+	}
+	return true, int(header.Width()), int(header.Height())
+}
+
+// element encodes an EBML element with a known size
+func element(id, data []byte) []byte {
+	encoded := make([]byte, 0, len(id)+8+len(data))
+	encoded = append(encoded, id...)
+	encoded = append(encoded, vintSize(uint64(len(data)))...)
+	return append(encoded, data...)
+}
+
+// vintSize encodes a size in the fewest bytes, all ones is reserved for unknown sizes
+func vintSize(size uint64) []byte {
+	length := 1
+	for size >= 1<<(7*length)-1 {
+		length++
+	}
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = byte(size)
+		size >>= 8
+	}
+	encoded[0] |= 0x80 >> (length - 1)
+	return encoded
+}
+
+// uintData encodes an unsigned integer in the fewest bytes
+func uintData(value uint64) []byte {
+	encoded := binary.BigEndian.AppendUint64(nil, value)
+	for len(encoded) > 1 && encoded[0] == 0 {
+		encoded = encoded[1:]
+	}
+	return encoded
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
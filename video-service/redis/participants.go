@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"video-service/logging"
+	"video-service/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// participantKey holds who a participant is and what it currently sends
+func participantKey(roomId, userId string) string {
+	return "video:room:" + roomId + ":participant:" + userId
+}
+
+// SetParticipant stores a participant that joined, replacing the state of an earlier connection
+func SetParticipant(ctx context.Context, roomId string, participant models.RoomParticipant) {
+	key := participantKey(roomId, participant.UserId)
+	pipe := Client.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, map[string]interface{}{
+		"userId":      participant.UserId,
+		"username":    participant.Username,
+		"role":        participant.Role,
+		"joinedAt":    participant.JoinedAt,
+		"audioMuted":  participant.AudioMuted,
+		"videoMuted":  participant.VideoMuted,
+		"isScreening": participant.IsScreening,
+	})
+	pipe.Expire(ctx, key, 4*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Error storing participant", logging.KeyRoomID, roomId, logging.KeyUserID, participant.UserId, "error", err)
+	}
+}
+
+// UpdateMediaState applies a media-state change and returns the participant's resulting state
+func UpdateMediaState(ctx context.Context, roomId, userId string, update models.MediaStateUpdate) (models.RoomParticipant, error) {
+	fields := make(map[string]interface{}, 3)
+	if update.AudioMuted != nil {
+		fields["audioMuted"] = *update.AudioMuted
+	}
+	if update.VideoMuted != nil {
+		fields["videoMuted"] = *update.VideoMuted
+	}
+	if update.IsScreening != nil {
+		fields["isScreening"] = *update.IsScreening
+	}
+
+	key := participantKey(roomId, userId)
+	pipe := Client.TxPipeline()
+	if len(fields) > 0 {
+		pipe.HSet(ctx, key, fields)
+		pipe.Expire(ctx, key, 4*time.Hour)
+	}
+	state := pipe.HGetAll(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Error updating media state", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+		return models.RoomParticipant{}, err
+	}
+	return parseParticipant(userId, state.Val()), nil
+}
+
+// SetParticipantRole records a participant's new role, e.g. after the host role was transferred
+func SetParticipantRole(ctx context.Context, roomId, userId, role string) {
+	key := participantKey(roomId, userId)
+	if err := Client.HSet(ctx, key, "role", role).Err(); err != nil {
+		slog.Error("Error setting participant role", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+	}
+}
+
+// GetParticipantStates returns every participant of a room with its media state. Participants
+// of services that predate the per participant hashes only have their user ID.
+func GetParticipantStates(ctx context.Context, roomId string) []models.RoomParticipant {
+	userIds := GetRoomParticipants(ctx, roomId)
+	if len(userIds) == 0 {
+		return []models.RoomParticipant{}
+	}
+
+	pipe := Client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(userIds))
+	for i, userId := range userIds {
+		cmds[i] = pipe.HGetAll(ctx, participantKey(roomId, userId))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Error getting participant states", logging.KeyRoomID, roomId, "error", err)
+	}
+
+	participants := make([]models.RoomParticipant, 0, len(userIds))
+	for i, cmd := range cmds {
+		participants = append(participants, parseParticipant(userIds[i], cmd.Val()))
+	}
+	return participants
+}
+
+// GetRoomInfo returns the room with all its participants, false if it doesn't exist
+func GetRoomInfo(ctx context.Context, roomId string) (models.RoomInfo, bool) {
+	meta := GetRoomMetadata(ctx, roomId)
+	if len(meta) == 0 {
+		return models.RoomInfo{}, false
+	}
+
+	createdAt, _ := strconv.ParseInt(meta["createdAt"], 10, 64)
+	roomType := "peer"
+	if meta["mode"] == models.RoomModeSFU {
+		roomType = "group"
+	}
+	participants := GetParticipantStates(ctx, roomId)
+	return models.RoomInfo{
+		RoomId:       roomId,
+		CreatorId:    meta["creator"],
+		GroupId:      meta["groupId"],
+		Type:         roomType,
+		Mode:         meta["mode"],
+		RecordingId:  meta["recordingId"],
+		WaitingRoom:  meta["waitingRoom"] != "",
+		CreatedAt:    createdAt,
+		Participants: participants,
+		IsActive:     len(participants) > 0,
+	}, true
+}
+
+func parseParticipant(userId string, fields map[string]string) models.RoomParticipant {
+	flag := func(name string) bool {
+		value, _ := strconv.ParseBool(fields[name])
+		return value
+	}
+	joinedAt, _ := strconv.ParseInt(fields["joinedAt"], 10, 64)
+	return models.RoomParticipant{
+		UserId:      userId,
+		Username:    fields["username"],
+		Role:        fields["role"],
+		JoinedAt:    joinedAt,
+		AudioMuted:  flag("audioMuted"),
+		VideoMuted:  flag("videoMuted"),
+		IsScreening: flag("isScreening"),
+	}
+}
@@ -0,0 +1,50 @@
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The same token bucket as the chat server's: it refills lazily on every call, TIME comes from
+// Redis so instances agree, and the key expires once the bucket would be full again anyway
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local allowed, retry = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, retry}
+`)
+
+// AllowRequest takes a token from the bucket scope/key, refilled with perMinute tokens a minute
+// up to burst. It returns when to retry if none is left. Redis errors fail open.
+func AllowRequest(ctx context.Context, scope, key string, perMinute, burst int) (bool, time.Duration) {
+	if perMinute <= 0 || burst <= 0 {
+		return true, 0
+	}
+
+	res, err := tokenBucket.Run(ctx, Client, []string{"video:ratelimit:" + scope + ":" + key}, float64(perMinute)/60, burst).Int64Slice()
+	if err != nil || len(res) != 2 {
+		slog.Warn("Rate limiter unavailable, allowing request", "scope", scope, "error", err)
+		return true, 0
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond
+}
@@ -2,112 +2,368 @@ package redis
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
 
+	"video-service/config"
+	"video-service/logging"
+	"video-service/metrics"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 )
 
-var (
-	Client *redis.Client
-	ctx    = context.Background()
-)
+var Client *redis.Client
 
 // InitRedis initializes the Redis connection
-func InitRedis() {
-	redisAddr := os.Getenv("REDIS_URL")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
-	}
-
+func InitRedis(cfg config.RedisConfig) {
 	Client = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "",
-		DB:       1, // Use DB 1 for video service to avoid conflicts with chat service
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
+	Client.AddHook(metrics.RedisHook())
+
+	if err := redisotel.InstrumentTracing(Client); err != nil {
+		slog.Warn("Could not instrument Redis tracing", "error", err)
+	}
 
-	_, err := Client.Ping(ctx).Result()
+	_, err := Client.Ping(context.Background()).Result()
 	if err != nil {
-		log.Fatalf("Could not connect to Redis: %v", err)
+		slog.Error("Could not connect to Redis", "error", err)
+		os.Exit(1)
 	}
 
-	log.Println("Video Service connected to Redis")
+	slog.Info("Video Service connected to Redis")
+}
+
+// Ping checks that Redis is reachable, used by the health and readiness probes
+func Ping(ctx context.Context) error {
+	if Client == nil {
+		return errors.New("redis client not initialized")
+	}
+	return Client.Ping(ctx).Err()
 }
 
 // AddUserToRoom adds a user to a video call room and refreshes TTL
-func AddUserToRoom(roomId, userId string) {
+func AddUserToRoom(ctx context.Context, roomId, userId string) {
 	key := "video:room:" + roomId + ":users"
 	if err := Client.SAdd(ctx, key, userId).Err(); err != nil {
-		log.Printf("Error adding user %s to room %s: %v", userId, roomId, err)
+		slog.Error("Error adding user to room", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
 	}
 	// Refresh expiration (4 hours)
 	Client.Expire(ctx, key, 4*time.Hour)
 }
 
-// RemoveUserFromRoom removes a user from a video call room
-func RemoveUserFromRoom(roomId, userId string) {
-	key := "video:room:" + roomId + ":users"
-	if err := Client.SRem(ctx, key, userId).Err(); err != nil {
-		log.Printf("Error removing user %s from room %s: %v", userId, roomId, err)
+// leaveRoom takes a user out of the room's users (ARGV[2] = 1) or waiting room (ARGV[2] = 2)
+// and deletes the keys from KEYS[5] on with it. The room's SFU claim goes with its last user,
+// the room itself once nobody is in it or waiting to be admitted, in one script so a user
+// joining or leaving on another instance in between can't lose the room or leave it behind.
+var leaveRoom = redis.NewScript(`
+redis.call('SREM', KEYS[tonumber(ARGV[2])], ARGV[1])
+for i = 5, #KEYS do
+	redis.call('DEL', KEYS[i])
+end
+if redis.call('SCARD', KEYS[1]) > 0 then
+	return 0
+end
+-- Without users the SFU can move to whichever instance the next one joins
+redis.call('HDEL', KEYS[3], 'sfuInstance')
+if redis.call('SCARD', KEYS[2]) > 0 then
+	return 0
+end
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[3], KEYS[4])
+return 1
+`)
+
+const (
+	leaveUsers   = 1
+	leaveWaiting = 2
+)
+
+// runLeaveRoom runs leaveRoom for a user of a room
+func runLeaveRoom(ctx context.Context, roomId, userId string, from int, keys ...string) error {
+	keys = append([]string{
+		"video:room:" + roomId + ":users",
+		waitingKey(roomId),
+		"video:room:" + roomId + ":meta",
+		bannedKey(roomId),
+	}, keys...)
+	deleted, err := leaveRoom.Run(ctx, Client, keys, userId, from).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 1 {
+		slog.Info("Room deleted from Redis", logging.KeyRoomID, roomId)
+	}
+	return nil
+}
+
+// RemoveUserFromRoom removes a user from a video call room with its participant state, the
+// room goes with its last user whichever instance it was connected to, unless somebody still
+// waits to be admitted
+func RemoveUserFromRoom(ctx context.Context, roomId, userId string) {
+	err := runLeaveRoom(ctx, roomId, userId, leaveUsers, participantKey(roomId, userId), statsKey(roomId, userId))
+	if err != nil {
+		slog.Error("Error removing user from room", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
 	}
+}
 
-	// Check if room is empty
-	count, _ := Client.SCard(ctx, key).Result()
-	if count == 0 {
-		DeleteRoom(roomId)
+// IsInRoom reports whether a user is in a room on any instance
+func IsInRoom(ctx context.Context, roomId, userId string) bool {
+	key := "video:room:" + roomId + ":users"
+	member, err := Client.SIsMember(ctx, key, userId).Result()
+	if err != nil {
+		slog.Error("Error checking room membership", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
 	}
+	return member
 }
 
 // GetRoomParticipants returns all users currently in a room
-func GetRoomParticipants(roomId string) []string {
+func GetRoomParticipants(ctx context.Context, roomId string) []string {
 	key := "video:room:" + roomId + ":users"
 	members, err := Client.SMembers(ctx, key).Result()
 	if err != nil {
-		log.Printf("Error getting participants for room %s: %v", roomId, err)
+		slog.Error("Error getting room participants", logging.KeyRoomID, roomId, "error", err)
 		return []string{}
 	}
 	return members
 }
 
-// InitializeRoom creates a new room with metadata
-func InitializeRoom(roomId, creatorId string) {
+// initializeRoom writes the metadata of a room only if it has none, so the host, creator and
+// settings of a running call can't be replaced by creating it again
+var initializeRoom = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+return 1
+`)
+
+// InitializeRoom creates a new room with metadata, mode is one of the models.RoomMode values.
+// groupId links calls of a chat group to it, empty for other rooms. It reports false if the
+// room already existed, which then stays as it was.
+func InitializeRoom(ctx context.Context, roomId, creatorId, groupId, mode string) bool {
 	metaKey := "video:room:" + roomId + ":meta"
-	err := Client.HSet(ctx, metaKey, map[string]interface{}{
-		"creator":   creatorId,
-		"createdAt": time.Now().Unix(),
-		"type":      "video",
-	}).Err()
+	args := []interface{}{
+		int64((4 * time.Hour).Seconds()),
+		"creator", creatorId,
+		"host", creatorId,
+		"createdAt", time.Now().Unix(),
+		"type", "video",
+		"mode", mode,
+	}
+	if groupId != "" {
+		args = append(args, "groupId", groupId)
+	}
 
+	created, err := initializeRoom.Run(ctx, Client, []string{metaKey}, args...).Int()
 	if err != nil {
-		log.Printf("Error initializing room %s: %v", roomId, err)
+		slog.Error("Error initializing room", logging.KeyRoomID, roomId, "error", err)
+		return false
 	}
-	// Set expiration
-	Client.Expire(ctx, metaKey, 4*time.Hour)
+	return created == 1
 }
 
 // DeleteRoom removes all room data (users and metadata)
-func DeleteRoom(roomId string) {
+func DeleteRoom(ctx context.Context, roomId string) {
 	usersKey := "video:room:" + roomId + ":users"
 	metaKey := "video:room:" + roomId + ":meta"
-	Client.Del(ctx, usersKey, metaKey)
-	log.Printf("Room %s deleted from Redis", roomId)
+	keys := []string{usersKey, metaKey, bannedKey(roomId), waitingKey(roomId)}
+	for _, userId := range GetRoomParticipants(ctx, roomId) {
+		keys = append(keys, statsKey(roomId, userId), participantKey(roomId, userId))
+	}
+	Client.Del(ctx, keys...)
+	slog.Info("Room deleted from Redis", logging.KeyRoomID, roomId)
 }
 
 // GetRoomMetadata retrieves room metadata
-func GetRoomMetadata(roomId string) map[string]string {
+func GetRoomMetadata(ctx context.Context, roomId string) map[string]string {
 	metaKey := "video:room:" + roomId + ":meta"
 	meta, err := Client.HGetAll(ctx, metaKey).Result()
 	if err != nil {
-		log.Printf("Error getting metadata for room %s: %v", roomId, err)
+		slog.Error("Error getting room metadata", logging.KeyRoomID, roomId, "error", err)
 		return nil
 	}
 	return meta
 }
 
+// claimSFU settles which instance forwards the media of an SFU room, the SFU of one instance
+// can't reach the peers of another. KEYS are the room's meta and users, ARGV[1] the instance
+// asking, ARGV[2] is 1 to switch a mesh room and ARGV[3] on are the users connected to the
+// instance asking. A mesh room only switches if all its users are among them. It returns the
+// instance owning the SFU, empty while the room is a mesh, and 1 if this call switched it.
+var claimSFU = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return {'', 0}
+end
+if redis.call('HGET', KEYS[1], 'mode') == 'sfu' then
+	local owner = redis.call('HGET', KEYS[1], 'sfuInstance')
+	if owner then
+		return {owner, 0}
+	end
+	redis.call('HSET', KEYS[1], 'sfuInstance', ARGV[1])
+	return {ARGV[1], 0}
+end
+if ARGV[2] ~= '1' then
+	return {'', 0}
+end
+local local_users = {}
+for i = 3, #ARGV do
+	local_users[ARGV[i]] = true
+end
+for _, userId in ipairs(redis.call('SMEMBERS', KEYS[2])) do
+	if not local_users[userId] then
+		return {'', 0}
+	end
+end
+redis.call('HSET', KEYS[1], 'mode', 'sfu', 'sfuInstance', ARGV[1])
+return {ARGV[1], 1}
+`)
+
+// ClaimSFU returns the instance whose SFU carries the room's media, claiming it for instance
+// if nobody did yet. With switchMesh a mesh room moves to instance's SFU, unless users other
+// than localUsers are in it. owner is empty while the room stays a mesh, switched reports
+// whether this call moved it to the SFU.
+func ClaimSFU(ctx context.Context, roomId, instance string, switchMesh bool, localUsers []string) (owner string, switched bool, err error) {
+	keys := []string{"video:room:" + roomId + ":meta", "video:room:" + roomId + ":users"}
+	args := make([]interface{}, 0, len(localUsers)+2)
+	args = append(args, instance, 0)
+	if switchMesh {
+		args[1] = 1
+	}
+	for _, userId := range localUsers {
+		args = append(args, userId)
+	}
+
+	result, err := claimSFU.Run(ctx, Client, keys, args...).Slice()
+	if err != nil {
+		return "", false, err
+	}
+	owner, _ = result[0].(string)
+	flag, _ := result[1].(int64)
+	return owner, flag == 1, nil
+}
+
+// SetRoomRecording marks the room as being recorded, an empty recordingId clears the mark.
+// Joining clients learn about a running recording from it.
+func SetRoomRecording(ctx context.Context, roomId, recordingId string) {
+	metaKey := "video:room:" + roomId + ":meta"
+	var err error
+	if recordingId == "" {
+		err = Client.HDel(ctx, metaKey, "recordingId").Err()
+	} else {
+		err = Client.HSet(ctx, metaKey, "recordingId", recordingId).Err()
+	}
+	if err != nil {
+		slog.Error("Error setting room recording", logging.KeyRoomID, roomId, "recording_id", recordingId, "error", err)
+	}
+}
+
+// SetRoomHost transfers the host role of a room, see handlers.roomRole
+func SetRoomHost(ctx context.Context, roomId, userId string) {
+	metaKey := "video:room:" + roomId + ":meta"
+	if err := Client.HSet(ctx, metaKey, "host", userId).Err(); err != nil {
+		slog.Error("Error setting room host", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+	}
+}
+
+// SetRoomLocked locks a room against new participants, hosts and moderators still get in
+func SetRoomLocked(ctx context.Context, roomId string, locked bool) {
+	metaKey := "video:room:" + roomId + ":meta"
+	var err error
+	if locked {
+		err = Client.HSet(ctx, metaKey, "locked", "1").Err()
+	} else {
+		err = Client.HDel(ctx, metaKey, "locked").Err()
+	}
+	if err != nil {
+		slog.Error("Error setting room lock", logging.KeyRoomID, roomId, "locked", locked, "error", err)
+	}
+}
+
+// SetWaitingRoom turns a room's waiting room on or off, participants joining while
+// it's on wait for the host or a moderator to admit them
+func SetWaitingRoom(ctx context.Context, roomId string, enabled bool) {
+	metaKey := "video:room:" + roomId + ":meta"
+	var err error
+	if enabled {
+		err = Client.HSet(ctx, metaKey, "waitingRoom", "1").Err()
+	} else {
+		err = Client.HDel(ctx, metaKey, "waitingRoom").Err()
+	}
+	if err != nil {
+		slog.Error("Error setting waiting room", logging.KeyRoomID, roomId, "enabled", enabled, "error", err)
+	}
+}
+
+// waitingKey holds the users in a room's waiting room, whichever instance they wait on
+func waitingKey(roomId string) string {
+	return "video:room:" + roomId + ":waiting"
+}
+
+// AddWaiting records a user waiting to be admitted to a room
+func AddWaiting(ctx context.Context, roomId, userId string) {
+	key := waitingKey(roomId)
+	if err := Client.SAdd(ctx, key, userId).Err(); err != nil {
+		slog.Error("Error adding user to waiting room", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+	}
+	Client.Expire(ctx, key, 4*time.Hour)
+}
+
+// RemoveWaiting forgets a user that was admitted, it joins the room right after
+func RemoveWaiting(ctx context.Context, roomId, userId string) {
+	if err := Client.SRem(ctx, waitingKey(roomId), userId).Err(); err != nil {
+		slog.Error("Error removing user from waiting room", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+	}
+}
+
+// LeaveWaiting forgets a user that was denied or stopped waiting, the room goes with it if
+// nobody else is in it or waiting
+func LeaveWaiting(ctx context.Context, roomId, userId string) {
+	if err := runLeaveRoom(ctx, roomId, userId, leaveWaiting); err != nil {
+		slog.Error("Error removing user from waiting room", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+	}
+}
+
+// IsWaiting reports whether a user waits to be admitted to a room on any instance
+func IsWaiting(ctx context.Context, roomId, userId string) bool {
+	waiting, err := Client.SIsMember(ctx, waitingKey(roomId), userId).Result()
+	if err != nil {
+		slog.Error("Error checking waiting room", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+	}
+	return waiting
+}
+
+// bannedKey holds the users removed from a room, they can't rejoin with a fresh token
+func bannedKey(roomId string) string {
+	return "video:room:" + roomId + ":banned"
+}
+
+// BanFromRoom keeps a removed participant out of the room for the rest of the call
+func BanFromRoom(ctx context.Context, roomId, userId string) {
+	key := bannedKey(roomId)
+	if err := Client.SAdd(ctx, key, userId).Err(); err != nil {
+		slog.Error("Error banning user from room", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+	}
+	Client.Expire(ctx, key, 4*time.Hour)
+}
+
+// IsBannedFromRoom reports whether userId was removed from the room
+func IsBannedFromRoom(ctx context.Context, roomId, userId string) bool {
+	banned, err := Client.SIsMember(ctx, bannedKey(roomId), userId).Result()
+	if err != nil {
+		slog.Error("Error checking room ban", logging.KeyRoomID, roomId, logging.KeyUserID, userId, "error", err)
+	}
+	return banned
+}
+
 // GetAllActiveRooms returns list of all active room IDs using SCAN (Safe for production)
-func GetAllActiveRooms() []string {
+func GetAllActiveRooms(ctx context.Context) []string {
 	var rooms []string
 	// Pattern to match: video:room:{roomId}:users
 	iter := Client.Scan(ctx, 0, "video:room:*:users", 0).Iterator()
@@ -123,7 +379,7 @@ func GetAllActiveRooms() []string {
 	}
 
 	if err := iter.Err(); err != nil {
-		log.Printf("Error scanning active rooms: %v", err)
+		slog.Error("Error scanning active rooms", "error", err)
 	}
 	return rooms
 }
@@ -0,0 +1,83 @@
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"video-service/logging"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	signalChannelPrefix = "video:room:"
+	signalChannelSuffix = ":signals"
+)
+
+// signalChannel is the channel the instances with peers in a room relay its signals on
+func signalChannel(roomId string) string {
+	return signalChannelPrefix + roomId + signalChannelSuffix
+}
+
+// PublishSignal sends payload to every instance subscribed to a room, this one included,
+// and returns how many received it
+func PublishSignal(ctx context.Context, roomId string, payload []byte) (int64, error) {
+	return Client.Publish(ctx, signalChannel(roomId), payload).Result()
+}
+
+// RoomSubscriber receives the signals of the rooms this instance has peers in over one
+// connection. Rooms are counted, a room stays subscribed until its last local peer leaves.
+type RoomSubscriber struct {
+	pubsub *redis.PubSub
+	mu     sync.Mutex
+	rooms  map[string]int
+}
+
+// NewRoomSubscriber opens the subscription, Run delivers what it receives
+func NewRoomSubscriber(ctx context.Context) *RoomSubscriber {
+	return &RoomSubscriber{
+		pubsub: Client.Subscribe(ctx),
+		rooms:  make(map[string]int),
+	}
+}
+
+// Join subscribes to a room's signals for one more local peer
+func (s *RoomSubscriber) Join(ctx context.Context, roomId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rooms[roomId] == 0 {
+		if err := s.pubsub.Subscribe(ctx, signalChannel(roomId)); err != nil {
+			return err
+		}
+	}
+	s.rooms[roomId]++
+	return nil
+}
+
+// Leave drops a local peer's interest in a room, the last one unsubscribes
+func (s *RoomSubscriber) Leave(ctx context.Context, roomId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rooms[roomId] == 0 {
+		return
+	}
+	s.rooms[roomId]--
+	if s.rooms[roomId] > 0 {
+		return
+	}
+	delete(s.rooms, roomId)
+	if err := s.pubsub.Unsubscribe(ctx, signalChannel(roomId)); err != nil {
+		slog.Warn("Error unsubscribing from room signals", logging.KeyRoomID, roomId, "error", err)
+	}
+}
+
+// Run calls handle with every signal received until the subscription is closed
+func (s *RoomSubscriber) Run(handle func(roomId string, payload []byte)) {
+	for msg := range s.pubsub.Channel() {
+		roomId := strings.TrimSuffix(strings.TrimPrefix(msg.Channel, signalChannelPrefix), signalChannelSuffix)
+		handle(roomId, []byte(msg.Payload))
+	}
+}
@@ -0,0 +1,83 @@
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"video-service/logging"
+	"video-service/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// statsKey holds the smoothed call stats of one participant
+func statsKey(roomId, userId string) string {
+	return "video:room:" + roomId + ":stats:" + userId
+}
+
+// SaveParticipantStats stores the latest smoothed stats of a participant, they expire with the room
+func SaveParticipantStats(ctx context.Context, roomId string, stats models.ParticipantStats) {
+	key := statsKey(roomId, stats.UserId)
+	pipe := Client.TxPipeline()
+	pipe.HSet(ctx, key, map[string]interface{}{
+		"rtt":        stats.RTT,
+		"packetLoss": stats.PacketLoss,
+		"jitter":     stats.Jitter,
+		"bitrate":    stats.Bitrate,
+		"score":      stats.Score,
+		"samples":    stats.Samples,
+		"updatedAt":  stats.UpdatedAt,
+	})
+	pipe.Expire(ctx, key, 4*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Error saving call stats", logging.KeyRoomID, roomId, logging.KeyUserID, stats.UserId, "error", err)
+	}
+}
+
+// GetRoomStats returns the stats of every participant of a room that reported any
+func GetRoomStats(ctx context.Context, roomId string) []models.ParticipantStats {
+	participants := GetRoomParticipants(ctx, roomId)
+
+	if len(participants) == 0 {
+		return nil
+	}
+
+	pipe := Client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(participants))
+	for i, userId := range participants {
+		cmds[i] = pipe.HGetAll(ctx, statsKey(roomId, userId))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Error getting call stats", logging.KeyRoomID, roomId, "error", err)
+		return nil
+	}
+
+	stats := make([]models.ParticipantStats, 0, len(participants))
+	for i, cmd := range cmds {
+		if fields := cmd.Val(); len(fields) > 0 {
+			stats = append(stats, parseParticipantStats(participants[i], fields))
+		}
+	}
+	return stats
+}
+
+func parseParticipantStats(userId string, fields map[string]string) models.ParticipantStats {
+	number := func(name string) float64 {
+		value, _ := strconv.ParseFloat(fields[name], 64)
+		return value
+	}
+	return models.ParticipantStats{
+		UserId: userId,
+		CallStats: models.CallStats{
+			RTT:        number("rtt"),
+			PacketLoss: number("packetLoss"),
+			Jitter:     number("jitter"),
+			Bitrate:    number("bitrate"),
+		},
+		Score:     number("score"),
+		Samples:   int64(number("samples")),
+		UpdatedAt: int64(number("updatedAt")),
+	}
+}
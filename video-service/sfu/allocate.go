@@ -0,0 +1,119 @@
+package sfu
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// videoHint is the size a client shows a publisher's video at, in CSS pixels. 0x0 hides it,
+// e.g. a tile that scrolled out of view, and the SFU stops sending it.
+type videoHint struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// setHints replaces the participant's hints with the "video-hints" metadata, an object of
+// hints by publisher user ID. Publishers without a hint get their best layer.
+func (p *Participant) setHints(metadata json.RawMessage) {
+	hints := make(map[string]videoHint)
+	if err := json.Unmarshal(metadata, &hints); err != nil {
+		p.log.Warn("Ignoring malformed video hints", "error", err)
+		return
+	}
+
+	p.hintsMu.Lock()
+	p.hints = hints
+	p.hintsMu.Unlock()
+
+	speaker, _ := p.room.speakers.active()
+	p.allocate(speaker)
+}
+
+// maxLayer returns the index of the best layer worth sending for the hint of publisherId,
+// -1 when the video is hidden
+func (p *Participant) maxLayer(publisherId string, layers int) int {
+	p.hintsMu.Lock()
+	hint, ok := p.hints[publisherId]
+	p.hintsMu.Unlock()
+
+	var best int
+	switch {
+	case !ok:
+		best = layers - 1
+	case hint.Width <= 0 || hint.Height <= 0:
+		return -1
+	case max(hint.Width, hint.Height) <= 320:
+		best = 0
+	case max(hint.Width, hint.Height) <= 640:
+		best = 1
+	default:
+		best = 2
+	}
+	return min(best, layers-1)
+}
+
+// bandwidth is what congestion control estimates the participant can receive
+func (p *Participant) bandwidth() int {
+	if p.estimator == nil {
+		return initialBitrate
+	}
+	return p.estimator.GetTargetBitrate()
+}
+
+// allocate picks the layer of every video the participant receives. Audio always goes
+// through. Every visible video gets its lowest layer first, then the remaining bandwidth
+// upgrades them in order, the active speaker first.
+func (p *Participant) allocate(speaker string) {
+	p.mu.Lock()
+	downs := make([]*downTrack, 0, len(p.subscriptions))
+	for _, sub := range p.subscriptions {
+		downs = append(downs, sub.down)
+	}
+	p.mu.Unlock()
+
+	budget := p.bandwidth()
+	videos := downs[:0]
+	for _, down := range downs {
+		if down.track.kind == webrtc.RTPCodecTypeAudio {
+			budget -= down.track.bitrate("")
+			continue
+		}
+		videos = append(videos, down)
+	}
+	sort.SliceStable(videos, func(i, j int) bool {
+		return videos[i].track.publisher.UserId == speaker && videos[j].track.publisher.UserId != speaker
+	})
+
+	ladders := make([][]layerRate, len(videos))
+	picks := make([]int, len(videos))
+	limits := make([]int, len(videos))
+	for i, down := range videos {
+		ladders[i] = down.track.ladder()
+		limits[i] = p.maxLayer(down.track.publisher.UserId, len(ladders[i]))
+		picks[i] = -1
+		if limits[i] >= 0 {
+			picks[i] = 0
+			budget -= ladders[i][0].bitrate
+		}
+	}
+	for i := range videos {
+		for picks[i] >= 0 && picks[i] < limits[i] {
+			cost := ladders[i][picks[i]+1].bitrate - ladders[i][picks[i]].bitrate
+			if cost > budget {
+				break
+			}
+			budget -= cost
+			picks[i]++
+		}
+	}
+
+	for i, down := range videos {
+		if picks[i] < 0 {
+			down.pause()
+		} else {
+			down.switchTo(ladders[i][picks[i]].rid)
+		}
+	}
+}
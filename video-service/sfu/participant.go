@@ -0,0 +1,305 @@
+package sfu
+
+import (
+	"log/slog"
+	"sync"
+
+	"video-service/metrics"
+	"video-service/models"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Participant is the server end of one user's PeerConnection
+type Participant struct {
+	UserId string
+
+	room      *Room
+	pc        *webrtc.PeerConnection
+	estimator cc.BandwidthEstimator // of the media sent to the participant, may be nil
+	send      func(models.SignalMessage)
+	log       *slog.Logger
+
+	mu            sync.Mutex                // serializes negotiation
+	subscriptions map[string]*subscription  // by forwarded track ID
+	candidates    []webrtc.ICECandidateInit // arrived before the remote description
+	renegotiate   bool                      // tracks changed while an offer was outstanding
+	closed        bool
+
+	hintsMu sync.Mutex
+	hints   map[string]videoHint // by publisher user ID
+}
+
+// subscription is a forwarded track sent to the participant
+type subscription struct {
+	sender *webrtc.RTPSender
+	down   *downTrack
+}
+
+func newParticipant(room *Room, pc *webrtc.PeerConnection, estimator cc.BandwidthEstimator, userId string, send func(models.SignalMessage), logger *slog.Logger) *Participant {
+	p := &Participant{
+		UserId:        userId,
+		room:          room,
+		pc:            pc,
+		estimator:     estimator,
+		send:          send,
+		log:           logger,
+		subscriptions: make(map[string]*subscription),
+		hints:         make(map[string]videoHint),
+	}
+
+	// Receive a camera and a microphone from the start, more tracks (screen sharing)
+	// arrive with an offer from the client
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			logger.Error("Failed to add SFU transceiver", "kind", kind.String(), "error", err)
+		}
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return // gathering finished
+		}
+		init := candidate.ToJSON()
+		ice := &models.ICECandidate{Candidate: init.Candidate}
+		if init.SDPMid != nil {
+			ice.SDPMid = *init.SDPMid
+		}
+		if init.SDPMLineIndex != nil {
+			ice.SDPMLineIndex = int(*init.SDPMLineIndex)
+		}
+		p.signal(models.SignalMessage{Type: "ice-candidate", ICE: ice})
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		p.log.Info("SFU connection state changed", "state", state.String())
+	})
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		room.publish(p, remote, receiver)
+	})
+
+	return p
+}
+
+// signal sends msg to the participant as coming from the SFU
+func (p *Participant) signal(msg models.SignalMessage) {
+	msg.UserId = models.SFUPeerId
+	msg.TargetId = p.UserId
+	msg.RoomId = p.room.id
+	p.send(msg)
+}
+
+// HandleSignal processes a signaling message the participant addressed to the SFU
+func (p *Participant) HandleSignal(msg models.SignalMessage) {
+	switch msg.Type {
+	case "answer":
+		p.handleAnswer(msg.SDP)
+	case "offer":
+		p.handleOffer(msg.SDP)
+	case "ice-candidate":
+		p.addCandidate(msg.ICE)
+	case "request-offer":
+		// Lets a client that lost track of the negotiation start over
+		p.Negotiate()
+	case "video-hints":
+		p.setHints(msg.Metadata)
+	}
+}
+
+// Negotiate brings the tracks sent to the participant up to date with the room and offers
+// the result. While an earlier offer is outstanding it waits for the answer.
+func (p *Participant) Negotiate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.negotiate()
+}
+
+func (p *Participant) negotiate() {
+	if p.closed {
+		return
+	}
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		p.renegotiate = true
+		return
+	}
+	p.renegotiate = false
+	p.syncTracks()
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		p.log.Error("Failed to create SFU offer", "error", err)
+		return
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		p.log.Error("Failed to set SFU offer", "error", err)
+		return
+	}
+	p.signal(models.SignalMessage{
+		Type: "offer",
+		SDP:  &models.SessionDesc{Type: "offer", SDP: offer.SDP},
+	})
+}
+
+// syncTracks adds the room's new tracks to the connection and removes the ended ones
+func (p *Participant) syncTracks() {
+	tracks := p.room.tracksFor(p.UserId)
+
+	for id, sub := range p.subscriptions {
+		if track, ok := tracks[id]; ok && track == sub.down.track {
+			continue
+		}
+		sub.down.track.removeDown(p)
+		if err := p.pc.RemoveTrack(sub.sender); err != nil {
+			p.log.Warn("Failed to remove forwarded track", "track_id", id, "error", err)
+		}
+		delete(p.subscriptions, id)
+	}
+
+	for id, track := range tracks {
+		if _, ok := p.subscriptions[id]; ok {
+			continue
+		}
+		down := newDownTrack(track, p)
+		sender, err := p.pc.AddTrack(down)
+		if err != nil {
+			p.log.Warn("Failed to add forwarded track", "track_id", id, "error", err)
+			continue
+		}
+		track.addDown(down)
+		p.subscriptions[id] = &subscription{sender: sender, down: down}
+		go p.readRTCP(sender, down)
+	}
+}
+
+// readRTCP passes keyframe requests of the subscriber on to the publisher. Reading also keeps
+// the NACK, report and congestion control interceptors of the sender running.
+func (p *Participant) readRTCP(sender *webrtc.RTPSender, down *downTrack) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if rid, paused := down.layer(); !paused {
+					down.track.requestKeyFrame(rid)
+				}
+			}
+		}
+	}
+}
+
+func (p *Participant) handleAnswer(sdp *models.SessionDesc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if sdp == nil || sdp.Type != "answer" || p.closed {
+		return
+	}
+	if p.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		p.log.Warn("Ignoring SFU answer without an outstanding offer")
+		return
+	}
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp.SDP}); err != nil {
+		p.log.Warn("Failed to apply SFU answer", "error", err)
+		return
+	}
+	p.flushCandidates()
+
+	if p.renegotiate {
+		p.negotiate()
+	}
+}
+
+// handleOffer answers a client that adds or removes tracks itself. When both sides offer at
+// once the server's offer wins, the client rolls back and answers it.
+func (p *Participant) handleOffer(sdp *models.SessionDesc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if sdp == nil || sdp.Type != "offer" || p.closed {
+		return
+	}
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		p.log.Info("Ignoring client offer during SFU negotiation")
+		return
+	}
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp.SDP}); err != nil {
+		p.log.Warn("Failed to apply client offer", "error", err)
+		return
+	}
+	p.flushCandidates()
+
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		p.log.Error("Failed to create SFU answer", "error", err)
+		return
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		p.log.Error("Failed to set SFU answer", "error", err)
+		return
+	}
+	p.signal(models.SignalMessage{
+		Type: "answer",
+		SDP:  &models.SessionDesc{Type: "answer", SDP: answer.SDP},
+	})
+
+	if p.renegotiate {
+		p.negotiate()
+	}
+}
+
+func (p *Participant) addCandidate(ice *models.ICECandidate) {
+	if ice == nil || ice.Candidate == "" {
+		return
+	}
+	mid, index := ice.SDPMid, uint16(ice.SDPMLineIndex)
+	candidate := webrtc.ICECandidateInit{Candidate: ice.Candidate, SDPMid: &mid, SDPMLineIndex: &index}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	if p.pc.RemoteDescription() == nil {
+		p.candidates = append(p.candidates, candidate)
+		return
+	}
+	if err := p.pc.AddICECandidate(candidate); err != nil {
+		p.log.Warn("Failed to add ICE candidate", "error", err)
+	}
+}
+
+// flushCandidates adds the candidates that arrived before the remote description
+func (p *Participant) flushCandidates() {
+	for _, candidate := range p.candidates {
+		if err := p.pc.AddICECandidate(candidate); err != nil {
+			p.log.Warn("Failed to add ICE candidate", "error", err)
+		}
+	}
+	p.candidates = nil
+}
+
+// Close ends the connection, the other participants stop receiving its tracks
+func (p *Participant) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	if err := p.pc.Close(); err != nil {
+		p.log.Warn("Failed to close SFU connection", "error", err)
+	}
+	p.room.leave(p)
+	metrics.SFUPeerConnections.Dec()
+}
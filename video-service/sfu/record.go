@@ -0,0 +1,130 @@
+package sfu
+
+import (
+	"errors"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	// ErrRoomNotFound is returned for rooms nobody is connected to on this instance
+	ErrRoomNotFound = errors.New("no SFU room")
+	// ErrAlreadyRecording is returned when a room is already being recorded
+	ErrAlreadyRecording = errors.New("room is already being recorded")
+	// ErrNotRecording is returned when stopping a room that isn't recorded
+	ErrNotRecording = errors.New("room is not being recorded")
+)
+
+// TrackInfo describes a published track to a Recorder
+type TrackInfo struct {
+	ID        string // as forwarded, <user ID>-<track ID>
+	Publisher string // user ID
+	Kind      webrtc.RTPCodecType
+	Codec     webrtc.RTPCodecParameters
+}
+
+// TrackWriter stores the packets of one track. Simulcast tracks are recorded in their best
+// layer, sequence numbers and timestamps stay continuous across layer switches.
+type TrackWriter interface {
+	WriteRTP(header *rtp.Header, payload []byte) (int, error)
+	Close() error
+}
+
+// Recorder receives every track of a room while the room is recorded
+type Recorder interface {
+	// AddTrack is called for tracks already published and every track published later,
+	// nil skips the track. The writer is closed when the track or the recording ends.
+	AddTrack(track TrackInfo) TrackWriter
+	// Close is called once the recording ended, by StopRecording or because everybody left.
+	// Every TrackWriter is closed by then.
+	Close()
+}
+
+// StartRecording hands every track of the room to rec until StopRecording or the room ends
+func (s *SFU) StartRecording(roomId string, rec Recorder) error {
+	// Holding s.mu keeps removeRoom from ending the room before it sees the recorder
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room := s.rooms[roomId]
+	if room == nil {
+		return ErrRoomNotFound
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.recorder != nil {
+		return ErrAlreadyRecording
+	}
+	room.recorder = rec
+	for _, track := range room.tracks {
+		room.record(track)
+	}
+	return nil
+}
+
+// StopRecording ends the room's recording, Recorder.Close has returned once it does
+func (s *SFU) StopRecording(roomId string) error {
+	room := s.room(roomId)
+	if room == nil {
+		return ErrRoomNotFound
+	}
+	if !room.stopRecording() {
+		return ErrNotRecording
+	}
+	return nil
+}
+
+// Recording reports whether the room is being recorded
+func (s *SFU) Recording(roomId string) bool {
+	room := s.room(roomId)
+	if room == nil {
+		return false
+	}
+
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	return room.recorder != nil
+}
+
+func (s *SFU) room(roomId string) *Room {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rooms[roomId]
+}
+
+// record starts recording a track, r.mu must be held
+func (r *Room) record(track *forwardedTrack) {
+	w := r.recorder.AddTrack(TrackInfo{
+		ID:        track.id,
+		Publisher: track.publisher.UserId,
+		Kind:      track.kind,
+		Codec:     track.codec,
+	})
+	if w != nil {
+		track.startRecording(w)
+	}
+}
+
+// stopRecording closes the recording of every track and the recorder, false if there was none
+func (r *Room) stopRecording() bool {
+	r.mu.Lock()
+	rec := r.recorder
+	r.recorder = nil
+	tracks := make([]*forwardedTrack, 0, len(r.tracks))
+	for _, track := range r.tracks {
+		tracks = append(tracks, track)
+	}
+	r.mu.Unlock()
+
+	if rec == nil {
+		return false
+	}
+	for _, track := range tracks {
+		track.stopRecording()
+	}
+	rec.Close()
+	return true
+}
@@ -0,0 +1,238 @@
+package sfu
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"video-service/metrics"
+	"video-service/models"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// roomTick is how often a room measures its layers, looks for the active speaker and
+// reallocates the subscribers' bandwidth
+const roomTick = 500 * time.Millisecond
+
+// Room forwards every published track to all other participants of one call
+type Room struct {
+	id  string
+	sfu *SFU
+
+	mu           sync.RWMutex
+	participants map[string]*Participant
+	tracks       map[string]*forwardedTrack
+
+	recorder Recorder // nil unless the room is recorded, guarded by mu
+
+	speakers *speakerDetector
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newRoom(s *SFU, id string) *Room {
+	r := &Room{
+		id:           id,
+		sfu:          s,
+		participants: make(map[string]*Participant),
+		tracks:       make(map[string]*forwardedTrack),
+		speakers:     newSpeakerDetector(),
+		done:         make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// stop ends the room's loop once its last participant left
+func (r *Room) stop() {
+	r.stopOnce.Do(func() { close(r.done) })
+}
+
+func (r *Room) run() {
+	ticker := time.NewTicker(roomTick)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			for _, track := range r.trackList() {
+				track.measure(now.Sub(last))
+				track.followBestLayer()
+			}
+			last = now
+
+			speaker, changed := r.speakers.update(now)
+			if changed {
+				r.announceSpeaker(speaker)
+			}
+			for _, participant := range r.participantList() {
+				participant.allocate(speaker)
+			}
+		}
+	}
+}
+
+// add registers a participant for pc and returns the one it replaces, if any
+func (r *Room) add(pc *webrtc.PeerConnection, estimator cc.BandwidthEstimator, userId string, send func(models.SignalMessage), logger *slog.Logger) (*Participant, *Participant) {
+	participant := newParticipant(r, pc, estimator, userId, send, logger)
+
+	r.mu.Lock()
+	replaced := r.participants[userId]
+	r.participants[userId] = participant
+	r.mu.Unlock()
+
+	metrics.SFUPeerConnections.Inc()
+	return participant, replaced
+}
+
+// leave removes the participant, its published tracks end once its connection is closed
+func (r *Room) leave(participant *Participant) {
+	r.mu.Lock()
+	if r.participants[participant.UserId] == participant {
+		delete(r.participants, participant.UserId)
+		r.speakers.forget(participant.UserId)
+	}
+	empty := len(r.participants) == 0
+	r.mu.Unlock()
+
+	for _, track := range r.trackList() {
+		track.removeDown(participant)
+	}
+	if empty {
+		r.sfu.removeRoom(r)
+	}
+}
+
+// tracksFor returns the tracks userId should receive, everything but its own
+func (r *Room) tracksFor(userId string) map[string]*forwardedTrack {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tracks := make(map[string]*forwardedTrack, len(r.tracks))
+	for id, track := range r.tracks {
+		if track.publisher.UserId != userId {
+			tracks[id] = track
+		}
+	}
+	return tracks
+}
+
+func (r *Room) trackList() []*forwardedTrack {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tracks := make([]*forwardedTrack, 0, len(r.tracks))
+	for _, track := range r.tracks {
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+func (r *Room) participantList() []*Participant {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	participants := make([]*Participant, 0, len(r.participants))
+	for _, participant := range r.participants {
+		participants = append(participants, participant)
+	}
+	return participants
+}
+
+// renegotiateExcept offers the current tracks to everybody but userId
+func (r *Room) renegotiateExcept(userId string) {
+	// Negotiate reads the track list, so it must run without holding r.mu
+	for _, participant := range r.participantList() {
+		if participant.UserId != userId {
+			participant.Negotiate()
+		}
+	}
+}
+
+// announceSpeaker tells everybody who is talking, clients highlight them or put them on the stage
+func (r *Room) announceSpeaker(userId string) {
+	metadata, _ := json.Marshal(map[string]string{"userId": userId})
+	for _, participant := range r.participantList() {
+		participant.signal(models.SignalMessage{Type: "active-speaker", Metadata: metadata})
+	}
+}
+
+// publish forwards one layer of a remote track to every other participant until the publisher
+// stops sending it. It runs in pion's OnTrack goroutine, which pion starts once per simulcast layer.
+func (r *Room) publish(publisher *Participant, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	trackID := remote.ID()
+	if trackID == "" {
+		trackID = strconv.FormatUint(uint64(remote.SSRC()), 10)
+	}
+	// The stream ID of forwarded tracks is the publisher, so clients can tell whose camera a track belongs to
+	id := publisher.UserId + "-" + trackID
+
+	r.mu.Lock()
+	track, ok := r.tracks[id]
+	if !ok {
+		track = newForwardedTrack(id, publisher, remote)
+		r.tracks[id] = track
+		if r.recorder != nil {
+			r.record(track)
+		}
+	}
+	l := track.addLayer(remote)
+	r.mu.Unlock()
+
+	if ok {
+		publisher.log.Info("Receiving simulcast layer", "track_id", id, "rid", l.rid)
+	} else {
+		metrics.SFUForwardedTracks.Inc()
+		publisher.log.Info("Forwarding track", "track_id", id, "kind", remote.Kind().String(), "rid", l.rid)
+		r.renegotiateExcept(publisher.UserId)
+	}
+
+	defer func() {
+		r.mu.Lock()
+		ended := track.removeLayer(l)
+		if ended && r.tracks[id] == track {
+			delete(r.tracks, id)
+		}
+		r.mu.Unlock()
+		if !ended {
+			return
+		}
+		track.stopRecording()
+		metrics.SFUForwardedTracks.Dec()
+		publisher.log.Info("Stopped forwarding track", "track_id", id)
+		r.renegotiateExcept(publisher.UserId)
+	}()
+
+	audioLevel := audioLevelExtension(receiver)
+	track.forward(l, func(packet *rtp.Packet) {
+		if audioLevel == 0 {
+			return
+		}
+		var level rtp.AudioLevelExtension
+		if payload := packet.GetExtension(audioLevel); payload != nil && level.Unmarshal(payload) == nil {
+			r.speakers.observe(publisher.UserId, level.Level, time.Now())
+		}
+	})
+}
+
+// audioLevelExtension returns the negotiated header extension ID of RFC 6464 audio levels, 0 without
+func audioLevelExtension(receiver *webrtc.RTPReceiver) uint8 {
+	if receiver == nil {
+		return 0
+	}
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.AudioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,179 @@
+// Package sfu forwards media for group calls. Every participant has one PeerConnection with
+// the server, publishes its tracks on it once and receives everybody else's tracks on it.
+// The server is the offerer: whenever the tracks of a room change it renegotiates with each
+// subscriber over the signaling socket, where it appears as the peer models.SFUPeerId.
+// Video published in simulcast layers reaches each subscriber in the layer its bandwidth
+// and the size it shows the video at allow.
+package sfu
+
+import (
+	"log/slog"
+	"sync"
+
+	"video-service/models"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Config tunes the server side of the PeerConnections
+type Config struct {
+	ICEServers []string // STUN/TURN URLs the server gathers candidates with
+	UDPPortMin uint16   // 0 lets the OS pick, set a range to open in the firewall
+	UDPPortMax uint16
+	// PublicIPs replace the host candidate addresses, for servers behind 1:1 NAT like
+	// containers with published ports or cloud VMs
+	PublicIPs []string
+}
+
+// SFU owns the rooms that forward media on this instance
+type SFU struct {
+	settings webrtc.SettingEngine
+	config   webrtc.Configuration
+
+	mu    sync.Mutex
+	rooms map[string]*Room
+}
+
+const (
+	// initialBitrate is what a subscriber is assumed to receive until congestion control knows better
+	initialBitrate = 1_000_000
+	maxBitrate     = 8_000_000
+)
+
+// New prepares the network settings shared by every PeerConnection
+func New(cfg Config) (*SFU, error) {
+	settings := webrtc.SettingEngine{}
+	if cfg.UDPPortMin != 0 || cfg.UDPPortMax != 0 {
+		if err := settings.SetEphemeralUDPPortRange(cfg.UDPPortMin, cfg.UDPPortMax); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.PublicIPs) > 0 {
+		if err := settings.SetICEAddressRewriteRules(webrtc.ICEAddressRewriteRule{
+			External:        cfg.PublicIPs,
+			AsCandidateType: webrtc.ICECandidateTypeHost,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	var iceServers []webrtc.ICEServer
+	if len(cfg.ICEServers) > 0 {
+		iceServers = []webrtc.ICEServer{{URLs: cfg.ICEServers}}
+	}
+
+	s := &SFU{
+		settings: settings,
+		config:   webrtc.Configuration{ICEServers: iceServers},
+		rooms:    make(map[string]*Room),
+	}
+	// Fail at startup rather than on the first join
+	pc, _, err := s.newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+	_ = pc.Close()
+	return s, nil
+}
+
+// newPeerConnection sets up the codecs and interceptors (NACK, RTCP reports, TWCC) of one
+// connection. The bandwidth estimator belongs to the interceptor chain, so each connection
+// gets an API of its own.
+func (s *SFU) newPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, err
+	}
+	// Publishers tag their audio with its level, which finds the active speaker
+	if err := media.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio,
+	); err != nil {
+		return nil, nil, err
+	}
+
+	var estimator cc.BandwidthEstimator
+	congestion, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBitrate),
+			gcc.SendSideBWEMaxBitrate(maxBitrate),
+			// Forwarded media is already paced by its publisher
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	congestion.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+		estimator = e
+	})
+
+	// The estimator comes first, it needs the sequence numbers the TWCC sender writes
+	interceptors := &interceptor.Registry{}
+	interceptors.Add(congestion)
+	// Subscribers report the arrival of forwarded packets, the estimator learns their bandwidth from it
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(media, interceptors); err != nil {
+		return nil, nil, err
+	}
+	if err := webrtc.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		return nil, nil, err
+	}
+
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(media),
+		webrtc.WithInterceptorRegistry(interceptors),
+		webrtc.WithSettingEngine(s.settings),
+	)
+	pc, err := api.NewPeerConnection(s.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc, estimator, nil
+}
+
+// Join connects userId to the room's SFU and sends it the first offer through send.
+// A participant that joins again replaces its previous connection.
+func (s *SFU) Join(roomId, userId string, send func(models.SignalMessage), logger *slog.Logger) (*Participant, error) {
+	pc, estimator, err := s.newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	room, ok := s.rooms[roomId]
+	if !ok {
+		room = newRoom(s, roomId)
+		s.rooms[roomId] = room
+	}
+	participant, replaced := room.add(pc, estimator, userId, send, logger)
+	s.mu.Unlock()
+
+	if replaced != nil {
+		replaced.Close()
+	}
+	participant.Negotiate()
+	return participant, nil
+}
+
+// removeRoom forgets room once its last participant left, unless somebody joined meanwhile.
+// A recording ends with the room.
+func (s *SFU) removeRoom(room *Room) {
+	s.mu.Lock()
+	room.mu.RLock()
+	empty := len(room.participants) == 0
+	room.mu.RUnlock()
+
+	removed := empty && s.rooms[room.id] == room
+	if removed {
+		delete(s.rooms, room.id)
+		room.stop()
+	}
+	s.mu.Unlock()
+
+	if removed {
+		room.stopRecording()
+	}
+}
@@ -0,0 +1,95 @@
+package sfu
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// speakerSmoothing is the weight of one audio packet (20ms) in the average, about a second of speech counts
+	speakerSmoothing = 0.05
+	// speakerThreshold is the smoothed loudness someone needs to count as speaking, roughly -70 dBov
+	speakerThreshold = 57
+	// speakerMargin is how much louder than the current speaker somebody has to be to take over
+	speakerMargin = 6
+	// speakerSilence fades out publishers that stopped sending audio, e.g. muted microphones
+	speakerSilence = 400 * time.Millisecond
+)
+
+// speakerDetector finds the active speaker from the audio levels (RFC 6464) publishers
+// put on their packets
+type speakerDetector struct {
+	mu       sync.Mutex
+	speakers map[string]*speaker
+	current  string
+}
+
+type speaker struct {
+	loudness float64 // 0 is silence, 127 the loudest
+	heard    time.Time
+}
+
+func newSpeakerDetector() *speakerDetector {
+	return &speakerDetector{speakers: make(map[string]*speaker)}
+}
+
+// observe adds one packet's level, in -dBov like on the wire
+func (d *speakerDetector) observe(userId string, level uint8, now time.Time) {
+	loudness := 127 - float64(min(level, 127))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.speakers[userId]
+	if !ok {
+		s = &speaker{}
+		d.speakers[userId] = s
+	}
+	s.loudness += (loudness - s.loudness) * speakerSmoothing
+	s.heard = now
+}
+
+// update returns the active speaker and whether that changed since the last call. Silence keeps
+// the last speaker, somebody else has to speak up to take over.
+func (d *speakerDetector) update(now time.Time) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	best, bestLoudness := "", 0.0
+	for userId, s := range d.speakers {
+		if now.Sub(s.heard) > speakerSilence {
+			s.loudness /= 2
+		}
+		if s.loudness > bestLoudness {
+			best, bestLoudness = userId, s.loudness
+		}
+	}
+
+	if best == "" || best == d.current || bestLoudness < speakerThreshold {
+		return d.current, false
+	}
+	if current, ok := d.speakers[d.current]; ok && current.loudness >= speakerThreshold && bestLoudness < current.loudness+speakerMargin {
+		return d.current, false
+	}
+	d.current = best
+	return best, true
+}
+
+// forget drops a participant that left
+func (d *speakerDetector) forget(userId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.speakers, userId)
+	if d.current == userId {
+		d.current = ""
+	}
+}
+
+// active returns the current speaker, "" before anybody spoke
+func (d *speakerDetector) active() (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.current, d.current != ""
+}
@@ -0,0 +1,499 @@
+package sfu
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyFrameInterval throttles keyframe requests per layer, every subscriber of a new
+// layer asks for one and a keyframe costs the publisher a lot of bandwidth
+const keyFrameInterval = 300 * time.Millisecond
+
+// forwardedTrack is one published track. With simulcast the publisher sends it in several
+// layers (RTP stream IDs), each subscriber receives one of them through its downTrack.
+type forwardedTrack struct {
+	id        string
+	publisher *Participant
+	kind      webrtc.RTPCodecType
+	codec     webrtc.RTPCodecParameters
+
+	mu     sync.RWMutex
+	layers map[string]*layer // by RID, "" without simulcast
+	downs  map[*Participant]*downTrack
+
+	// subscribers is a copy of downs the read loops use without locking
+	subscribers atomic.Pointer[[]*downTrack]
+	// recording gets the best layer while the room is recorded
+	recording atomic.Pointer[downTrack]
+}
+
+// layer is one encoding of a published track
+type layer struct {
+	rid     string
+	remote  *webrtc.TrackRemote
+	bitrate int // measured, bits per second
+
+	bytes   atomic.Int64 // received since the last measurement
+	lastPLI atomic.Int64 // unix nanoseconds
+}
+
+func newForwardedTrack(id string, publisher *Participant, remote *webrtc.TrackRemote) *forwardedTrack {
+	track := &forwardedTrack{
+		id:        id,
+		publisher: publisher,
+		kind:      remote.Kind(),
+		codec:     remote.Codec(),
+		layers:    make(map[string]*layer),
+		downs:     make(map[*Participant]*downTrack),
+	}
+	track.subscribers.Store(&[]*downTrack{})
+	return track
+}
+
+func (t *forwardedTrack) addLayer(remote *webrtc.TrackRemote) *layer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l := &layer{rid: remote.RID(), remote: remote}
+	t.layers[l.rid] = l
+	return l
+}
+
+// removeLayer reports whether it was the last layer, the track has ended then
+func (t *forwardedTrack) removeLayer(l *layer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.layers[l.rid] == l {
+		delete(t.layers, l.rid)
+	}
+	return len(t.layers) == 0
+}
+
+// ladder returns the layers from the cheapest to the best. Layers are ranked by their
+// measured bitrate, until every layer has been measured by the usual RID names.
+func (t *forwardedTrack) ladder() []layerRate {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ladder := make([]layerRate, 0, len(t.layers))
+	measured := true
+	for rid, l := range t.layers {
+		ladder = append(ladder, layerRate{rid: rid, bitrate: l.bitrate})
+		measured = measured && l.bitrate > 0
+	}
+	sort.Slice(ladder, func(i, j int) bool {
+		if measured {
+			return ladder[i].bitrate < ladder[j].bitrate
+		}
+		return ridRank(ladder[i].rid, t.layers) < ridRank(ladder[j].rid, t.layers)
+	})
+	return ladder
+}
+
+type layerRate struct {
+	rid     string
+	bitrate int
+}
+
+// ridRank orders the common simulcast naming schemes: q/h/f, l/m/h and 0/1/2
+func ridRank[V any](rid string, layers map[string]V) int {
+	switch strings.ToLower(rid) {
+	case "q", "l", "low", "0":
+		return 0
+	case "m", "mid", "1":
+		return 1
+	case "h":
+		if _, ok := layers["f"]; ok {
+			return 1 // half resolution next to full
+		}
+		return 2
+	default:
+		return 2
+	}
+}
+
+// measure turns the bytes received since the last call into smoothed bitrates
+func (t *forwardedTrack) measure(elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, l := range t.layers {
+		rate := int(float64(l.bytes.Swap(0)*8) / elapsed.Seconds())
+		if l.bitrate == 0 {
+			l.bitrate = rate
+		} else {
+			l.bitrate = (l.bitrate + rate) / 2
+		}
+	}
+}
+
+// bitrate of one layer, 0 while unknown
+func (t *forwardedTrack) bitrate(rid string) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if l, ok := t.layers[rid]; ok {
+		return l.bitrate
+	}
+	return 0
+}
+
+func (t *forwardedTrack) addDown(down *downTrack) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.downs[down.subscriber] = down
+	t.publishSubscribers()
+}
+
+func (t *forwardedTrack) removeDown(subscriber *Participant) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.downs, subscriber)
+	t.publishSubscribers()
+}
+
+// publishSubscribers refreshes the lock free copy of downs, t.mu must be held
+func (t *forwardedTrack) publishSubscribers() {
+	subscribers := make([]*downTrack, 0, len(t.downs))
+	for _, down := range t.downs {
+		subscribers = append(subscribers, down)
+	}
+	t.subscribers.Store(&subscribers)
+}
+
+// forward reads one layer until the publisher stops sending it
+func (t *forwardedTrack) forward(l *layer, onAudio func(*rtp.Packet)) {
+	for {
+		packet, _, err := l.remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		l.bytes.Add(int64(packet.MarshalSize()))
+
+		keyFrame := true
+		if t.kind == webrtc.RTPCodecTypeAudio {
+			onAudio(packet)
+		} else {
+			keyFrame = isKeyFrame(t.codec.MimeType, packet.Payload)
+		}
+
+		for _, down := range *t.subscribers.Load() {
+			down.writeRTP(l.rid, packet, keyFrame)
+		}
+		if down := t.recording.Load(); down != nil {
+			down.writeRTP(l.rid, packet, keyFrame)
+		}
+	}
+}
+
+// startRecording sends the track's best layer to w until stopRecording
+func (t *forwardedTrack) startRecording(w TrackWriter) {
+	down := &downTrack{
+		track:       t,
+		log:         t.publisher.log,
+		payloadType: t.codec.PayloadType,
+		writer:      w,
+	}
+	if ladder := t.ladder(); len(ladder) > 0 {
+		down.target = ladder[len(ladder)-1].rid
+	}
+	if previous := t.recording.Swap(down); previous != nil {
+		previous.closeWriter()
+	}
+	t.requestKeyFrame(down.target)
+}
+
+// followBestLayer moves the recording to the best layer, they can come and go with the
+// publisher's bandwidth
+func (t *forwardedTrack) followBestLayer() {
+	down := t.recording.Load()
+	if down == nil {
+		return
+	}
+	if ladder := t.ladder(); len(ladder) > 0 {
+		down.switchTo(ladder[len(ladder)-1].rid)
+	}
+}
+
+func (t *forwardedTrack) stopRecording() {
+	if down := t.recording.Swap(nil); down != nil {
+		down.closeWriter()
+	}
+}
+
+// requestKeyFrame asks the publisher for a keyframe on one layer, a subscriber can't
+// decode video or switch layers without one
+func (t *forwardedTrack) requestKeyFrame(rid string) {
+	if t.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	t.mu.RLock()
+	l, ok := t.layers[rid]
+	t.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := l.lastPLI.Load()
+	if now-last < int64(keyFrameInterval) || !l.lastPLI.CompareAndSwap(last, now) {
+		return
+	}
+	if err := t.publisher.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(l.remote.SSRC())},
+	}); err != nil {
+		t.publisher.log.Debug("Failed to request keyframe", "track_id", t.id, "rid", rid, "error", err)
+	}
+}
+
+// rtpWriter is where a downTrack sends its packets, the subscriber's connection or a recording
+type rtpWriter interface {
+	WriteRTP(header *rtp.Header, payload []byte) (int, error)
+}
+
+// downTrack sends one forwarded track to one subscriber, or to the recording. It picks a
+// single layer and rewrites sequence numbers and timestamps, so layer switches look like
+// one stream.
+type downTrack struct {
+	track      *forwardedTrack
+	subscriber *Participant // nil for recordings
+	log        *slog.Logger
+
+	mu          sync.Mutex
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writer      rtpWriter // nil until bound
+
+	current    string // RID being forwarded
+	target     string // RID to switch to at its next keyframe
+	forwarding bool   // current is set and its keyframe was sent
+	paused     bool   // the subscriber doesn't show this video
+
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastSent  time.Time
+}
+
+func newDownTrack(track *forwardedTrack, subscriber *Participant) *downTrack {
+	down := &downTrack{track: track, subscriber: subscriber, log: subscriber.log}
+	// Start cheap, the next allocation upgrades the layer if the bandwidth allows
+	if ladder := track.ladder(); len(ladder) > 0 {
+		down.target = ladder[0].rid
+	}
+	return down
+}
+
+// Bind implements webrtc.TrackLocal, it is called once the subscriber accepted the track
+func (d *downTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := matchCodec(d.track.codec, ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	d.mu.Lock()
+	d.ssrc, d.payloadType, d.writer = ctx.SSRC(), codec.PayloadType, ctx.WriteStream()
+	target := d.target
+	d.mu.Unlock()
+
+	d.track.requestKeyFrame(target)
+	return codec, nil
+}
+
+// Unbind implements webrtc.TrackLocal
+func (d *downTrack) Unbind(webrtc.TrackLocalContext) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.writer = nil
+	d.forwarding = false
+	return nil
+}
+
+func (d *downTrack) ID() string                { return d.track.id }
+func (d *downTrack) RID() string               { return "" }
+func (d *downTrack) StreamID() string          { return d.track.publisher.UserId }
+func (d *downTrack) Kind() webrtc.RTPCodecType { return d.track.kind }
+
+// switchTo makes rid the layer to forward, the switch happens at its next keyframe
+func (d *downTrack) switchTo(rid string) {
+	d.mu.Lock()
+	changed := d.paused || d.target != rid
+	d.paused, d.target = false, rid
+	needsKeyFrame := changed && (!d.forwarding || d.current != rid)
+	d.mu.Unlock()
+
+	if needsKeyFrame {
+		d.track.requestKeyFrame(rid)
+	}
+}
+
+// pause stops forwarding until the next switchTo
+func (d *downTrack) pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.paused, d.forwarding = true, false
+}
+
+// layer returns the RID forwarded now, or the one it waits for
+func (d *downTrack) layer() (rid string, paused bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.forwarding {
+		return d.current, d.paused
+	}
+	return d.target, d.paused
+}
+
+func (d *downTrack) writeRTP(rid string, packet *rtp.Packet, keyFrame bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.writer == nil || d.paused {
+		return
+	}
+	if !d.forwarding || rid != d.current {
+		if rid != d.target || !keyFrame {
+			return
+		}
+		d.switchLayer(rid, packet)
+	}
+
+	header := packet.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	header.SequenceNumber += d.seqOffset
+	header.Timestamp += d.tsOffset
+	// The publisher's extension IDs mean nothing on this connection, the interceptors add ours
+	header.Extension, header.Extensions, header.ExtensionProfile = false, nil, 0
+
+	if _, err := d.writer.WriteRTP(&header, packet.Payload); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		d.log.Debug("Failed to forward packet", "track_id", d.track.id, "error", err)
+		return
+	}
+	d.lastSeq, d.lastTS, d.lastSent = header.SequenceNumber, header.Timestamp, time.Now()
+}
+
+// closeWriter ends a recording's output, forwarding stops with it
+func (d *downTrack) closeWriter() {
+	d.mu.Lock()
+	w := d.writer
+	d.writer = nil
+	d.mu.Unlock()
+
+	if closer, ok := w.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			d.log.Warn("Failed to finish recorded track", "track_id", d.track.id, "error", err)
+		}
+	}
+}
+
+// switchLayer continues the outgoing sequence numbers and timestamps where the previous
+// layer stopped, d.mu must be held
+func (d *downTrack) switchLayer(rid string, packet *rtp.Packet) {
+	if !d.lastSent.IsZero() {
+		elapsed := uint32(time.Since(d.lastSent).Seconds() * float64(d.track.codec.ClockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		d.seqOffset = d.lastSeq + 1 - packet.SequenceNumber
+		d.tsOffset = d.lastTS + elapsed - packet.Timestamp
+	}
+	d.current, d.forwarding = rid, true
+}
+
+// matchCodec finds the subscriber's payload type for the publisher's codec,
+// preferring the same format parameters (e.g. the H264 profile)
+func matchCodec(codec webrtc.RTPCodecParameters, offered []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	var fallback *webrtc.RTPCodecParameters
+	for i, candidate := range offered {
+		if !strings.EqualFold(candidate.MimeType, codec.MimeType) {
+			continue
+		}
+		if candidate.SDPFmtpLine == codec.SDPFmtpLine {
+			return candidate, true
+		}
+		if fallback == nil {
+			fallback = &offered[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// isKeyFrame reports whether an RTP payload starts a keyframe. Codecs it can't parse count
+// as keyframes, switching on them may show artifacts until the next real one.
+func isKeyFrame(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		var vp8 codecs.VP8Packet
+		if _, err := vp8.Unmarshal(payload); err != nil || len(vp8.Payload) == 0 {
+			return false
+		}
+		return vp8.S == 1 && vp8.PID == 0 && vp8.Payload[0]&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var vp9 codecs.VP9Packet
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		return !vp9.P && vp9.B
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264KeyFrame(payload)
+	default:
+		return true
+	}
+}
+
+// isH264KeyFrame looks for an IDR slice or SPS in single NAL, STAP-A and FU-A payloads
+func isH264KeyFrame(payload []byte) bool {
+	const (
+		naluIDR  = 5
+		naluSPS  = 7
+		naluSTAP = 24
+		naluFU   = 28
+	)
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch nalu := payload[0] & 0x1F; nalu {
+	case naluIDR, naluSPS:
+		return true
+	case naluSTAP:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1F; t == naluIDR || t == naluSPS {
+				return true
+			}
+			i += 2 + size
+		}
+	case naluFU:
+		if len(payload) < 2 {
+			return false
+		}
+		start := payload[1]&0x80 != 0
+		t := payload[1] & 0x1F
+		return start && (t == naluIDR || t == naluSPS)
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package webrtc
+
+import (
+	"math"
+
+	"video-service/models"
+)
+
+// statsSmoothing weighs a new report against the previous ones, a single bad
+// report shouldn't flip the score
+const statsSmoothing = 0.3
+
+// QualityScore estimates the mean opinion score of a call from its network stats, with the
+// simplified E-model (ITU-T G.107) most WebRTC monitoring uses. 4.5 is excellent, below 3.1
+// most people notice, 1 is unusable.
+func QualityScore(stats models.CallStats) float64 {
+	// One way delay plus what the jitter buffer adds, plus codec delay
+	latency := stats.RTT/2 + stats.Jitter*2 + 10
+
+	r := 93.2
+	if latency < 160 {
+		r -= latency / 40
+	} else {
+		r -= (latency - 120) / 10
+	}
+	r -= stats.PacketLoss * 100 * 2.5
+
+	r = min(max(r, 0), 100)
+	mos := 1 + 0.035*r + 0.000007*r*(r-60)*(100-r)
+	return math.Round(min(max(mos, 1), 4.5)*100) / 100
+}
+
+// ValidateCallStats rejects reports no browser produces, they would skew the room's averages
+func ValidateCallStats(stats models.CallStats) bool {
+	for _, value := range []float64{stats.RTT, stats.PacketLoss, stats.Jitter, stats.Bitrate} {
+		if math.IsNaN(value) || math.IsInf(value, 0) || value < 0 {
+			return false
+		}
+	}
+	return stats.PacketLoss <= 1 && stats.RTT < 60_000 && stats.Jitter < 60_000
+}
+
+// SmoothStats folds a new report into a participant's stats and scores the result
+func SmoothStats(previous models.ParticipantStats, report models.CallStats, now int64) models.ParticipantStats {
+	next := previous
+	if previous.Samples == 0 {
+		next.CallStats = report
+	} else {
+		next.RTT = smooth(previous.RTT, report.RTT)
+		next.PacketLoss = smooth(previous.PacketLoss, report.PacketLoss)
+		next.Jitter = smooth(previous.Jitter, report.Jitter)
+		next.Bitrate = smooth(previous.Bitrate, report.Bitrate)
+	}
+	next.Score = QualityScore(next.CallStats)
+	next.Samples++
+	next.UpdatedAt = now
+	return next
+}
+
+func smooth(previous, value float64) float64 {
+	return previous + statsSmoothing*(value-previous)
+}
+
+// AggregateRoomStats averages the participants' stats, the bitrate is the room's total
+func AggregateRoomStats(roomId string, participants []models.ParticipantStats) models.RoomStats {
+	room := models.RoomStats{RoomId: roomId, Participants: participants}
+	if len(participants) == 0 {
+		room.Participants = []models.ParticipantStats{}
+		return room
+	}
+
+	room.MinScore = math.Inf(1)
+	for _, p := range participants {
+		room.RTT += p.RTT
+		room.PacketLoss += p.PacketLoss
+		room.Jitter += p.Jitter
+		room.Bitrate += p.Bitrate
+		room.Score += p.Score
+		room.MinScore = min(room.MinScore, p.Score)
+	}
+	n := float64(len(participants))
+	room.RTT /= n
+	room.PacketLoss /= n
+	room.Jitter /= n
+	room.Score = math.Round(room.Score/n*100) / 100
+	return room
+}
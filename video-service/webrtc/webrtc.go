@@ -1,36 +1,55 @@
 package webrtc
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
-	"log"
+	"log/slog"
+	"strconv"
+	"time"
 
 	"video-service/models"
 )
 
 // Configuration constants for WebRTC
 const (
-	// STUN servers for NAT traversal
+	// STUN server for NAT traversal, config.ICEConfig has the ones served to clients
 	DefaultSTUNServer = "stun:stun.l.google.com:19302"
 
 	// ICE gathering timeout
 	ICEGatheringTimeout = 5000 // milliseconds
 )
 
-// GetICEServers returns the list of ICE servers for WebRTC connections
-// These are sent to clients to help with NAT traversal
-func GetICEServers() []map[string]interface{} {
-	return []map[string]interface{}{
-		{
-			"urls": []string{DefaultSTUNServer},
-		},
-		// TODO: Add TURN servers for better connectivity
-		// TURN servers require authentication
-		// {
-		// 	"urls":       []string{"turn:your-turn-server.com:3478"},
-		// 	"username":   "your-username",
-		// 	"credential": "your-password",
-		// },
+// ICEServer is one entry of RTCConfiguration.iceServers
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// GetICEServers returns the ICE servers sent to clients to help with NAT traversal.
+// TURN servers get credentials for userId that stop working at expiresAt.
+func GetICEServers(stunURLs, turnURLs []string, turnSecret, userId string, expiresAt time.Time) []ICEServer {
+	servers := make([]ICEServer, 0, 2)
+	if len(stunURLs) > 0 {
+		servers = append(servers, ICEServer{URLs: stunURLs})
+	}
+	if len(turnURLs) > 0 {
+		username, credential := TURNCredentials(turnSecret, userId, expiresAt)
+		servers = append(servers, ICEServer{URLs: turnURLs, Username: username, Credential: credential})
 	}
+	return servers
+}
+
+// TURNCredentials mints credentials in the TURN REST API format coturn accepts with
+// use-auth-secret: the username is "<expiry unix time>:<user>", the password the base64
+// HMAC-SHA1 of the username keyed with the shared secret
+func TURNCredentials(secret, userId string, expiresAt time.Time) (string, string) {
+	username := strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userId
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
 
 // ValidateSDP checks if an SDP message is valid
@@ -40,12 +59,12 @@ func ValidateSDP(sdp *models.SessionDesc) bool {
 	}
 
 	if sdp.Type != "offer" && sdp.Type != "answer" {
-		log.Printf("Invalid SDP type: %s", sdp.Type)
+		slog.Debug("Invalid SDP type", "type", sdp.Type)
 		return false
 	}
 
 	if sdp.SDP == "" {
-		log.Println("Empty SDP string")
+		slog.Debug("Empty SDP string")
 		return false
 	}
 
@@ -64,7 +83,7 @@ func ValidateICECandidate(ice *models.ICECandidate) bool {
 	}
 
 	if ice.Candidate == "" {
-		log.Println("Empty ICE candidate")
+		slog.Debug("Empty ICE candidate")
 		return false
 	}
 
@@ -179,21 +198,6 @@ func GetMobileMediaConstraints() MediaConstraints {
 	}
 }
 
-// TODO: Implement SFU (Selective Forwarding Unit) for group calls
-// This would require:
-// - Media stream processing
-// - Bandwidth optimization
-// - Quality adaptation
-// - Recording capabilities
-
-// TODO: Implement recording functionality
-// - Start/stop recording
-// - Store recordings
+// TODO: Recording follow-ups
 // - Generate thumbnails
 // - Handle storage limits
-
-// TODO: Implement call quality metrics
-// - Packet loss tracking
-// - Latency measurements
-// - Bandwidth usage
-// - Connection quality scoring